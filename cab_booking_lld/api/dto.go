@@ -0,0 +1,883 @@
+package api
+
+import (
+	"fmt"
+	"time"
+
+	"cab_booking.com/src"
+)
+
+type location struct {
+	Lat *float64 `json:"lat"`
+	Lon *float64 `json:"lon"`
+}
+
+// coordinates rejects a missing location or missing coordinates before they
+// reach the service, which only checks that they are in range.
+func (l *location) coordinates(field string) (float64, float64, error) {
+	if l == nil || l.Lat == nil || l.Lon == nil {
+		return 0, 0, fmt.Errorf("%w: %s.lat and %s.lon are required", errBadRequest, field, field)
+	}
+	if err := src.ValidateCoordinates(*l.Lat, *l.Lon); err != nil {
+		return 0, 0, fmt.Errorf("%s: %w", field, err)
+	}
+	return *l.Lat, *l.Lon, nil
+}
+
+type registerRequest struct {
+	Name string `json:"name"`
+}
+
+type registerCabRequest struct {
+	Name     string `json:"name"`
+	Category string `json:"category"`
+}
+
+type fareQuoteRequest struct {
+	Pickup *location `json:"pickup"`
+	Drop   *location `json:"drop"`
+}
+
+type priorityTierRequest struct {
+	PriorityTier *int `json:"priorityTier"`
+}
+
+type bookRideRequest struct {
+	UserId   string     `json:"userId"`
+	Pickup   *location  `json:"pickup"`
+	Drop     *location  `json:"drop"`
+	PickupAt *time.Time `json:"pickupAt"`
+	RideType string     `json:"rideType"`
+	Seats    *int       `json:"seats"`
+	Category string     `json:"category"`
+	// PaymentMethodId pays with the rider's default method when empty.
+	PaymentMethodId string `json:"paymentMethodId"`
+	PromoCode       string `json:"promoCode"`
+	// Stops are visited in order on the way to the drop.
+	Stops []location `json:"stops"`
+	// WaitForCab holds the reply until a cab is assigned instead of returning
+	// the ride while dispatch is still searching.
+	WaitForCab bool `json:"waitForCab"`
+}
+
+// bookingOptions books a solo ride in any category unless rideType and
+// category say otherwise. Seats only apply to pool rides and default to one.
+func (brr *bookRideRequest) bookingOptions() ([]src.BookingOption, error) {
+	options := make([]src.BookingOption, 0, 4)
+	if brr.PaymentMethodId != "" {
+		options = append(options, src.WithPaymentMethod(brr.PaymentMethodId))
+	}
+	if brr.PromoCode != "" {
+		options = append(options, src.WithPromoCode(brr.PromoCode))
+	}
+	if brr.Category != "" {
+		category, err := src.ParseVehicleCategory(brr.Category)
+		if err != nil {
+			return nil, err
+		}
+		options = append(options, src.WithVehicleCategory(category))
+	}
+	if len(brr.Stops) > 0 {
+		stops := make([]src.GeoPoint, 0, len(brr.Stops))
+		for i := range brr.Stops {
+			lat, lon, err := brr.Stops[i].coordinates(fmt.Sprintf("stops[%d]", i))
+			if err != nil {
+				return nil, err
+			}
+			stops = append(stops, src.GeoPoint{Lat: lat, Lon: lon})
+		}
+		options = append(options, src.WithStops(stops...))
+	}
+	rideType := src.SoloRide
+	if brr.RideType != "" {
+		var err error
+		if rideType, err = src.ParseRideType(brr.RideType); err != nil {
+			return nil, err
+		}
+	}
+	if rideType != src.PoolRide {
+		if brr.Seats != nil {
+			return nil, fmt.Errorf("%w: seats only apply to pool rides", errBadRequest)
+		}
+		return options, nil
+	}
+	seats := 1
+	if brr.Seats != nil {
+		seats = *brr.Seats
+	}
+	return append(options, src.WithPool(seats)), nil
+}
+
+// addStopRequest adds the stop at the end unless index says where.
+type addStopRequest struct {
+	Index    *int      `json:"index"`
+	Location *location `json:"location"`
+}
+
+type rescheduleRequest struct {
+	PickupAt *time.Time `json:"pickupAt"`
+}
+
+type rideStatusRequest struct {
+	Status string `json:"status"`
+}
+
+// cancelRideRequest cancels for no particular reason unless one is given.
+type cancelRideRequest struct {
+	CancelledBy string `json:"cancelledBy"`
+	Reason      string `json:"reason"`
+}
+
+type offerReplyRequest struct {
+	CabId string `json:"cabId"`
+}
+
+// rateRideRequest carries userId when the rider rates the driver and cabId
+// when the driver rates the rider.
+type rateRideRequest struct {
+	UserId string   `json:"userId"`
+	CabId  string   `json:"cabId"`
+	Stars  *int     `json:"stars"`
+	Tags   []string `json:"tags"`
+}
+
+// addPaymentMethodRequest only needs cardNumber for cards.
+type addPaymentMethodRequest struct {
+	Type       string `json:"type"`
+	CardNumber string `json:"cardNumber"`
+	Default    bool   `json:"default"`
+}
+
+type paymentMethodRequest struct {
+	PaymentMethodId string `json:"paymentMethodId"`
+}
+
+type walletTopUpRequest struct {
+	PaymentMethodId string `json:"paymentMethodId"`
+	Amount          *int   `json:"amount"`
+}
+
+type incentiveRequest struct {
+	Amount *int   `json:"amount"`
+	Note   string `json:"note"`
+}
+
+// refundRequest refunds whatever is left of the payment when amount is left out.
+type refundRequest struct {
+	Amount int    `json:"amount"`
+	Reason string `json:"reason"`
+}
+
+// createPromotionRequest leaves a limit, a validity bound or the zone list out
+// to not restrict the promotion on it.
+type createPromotionRequest struct {
+	Code          string     `json:"code"`
+	Kind          string     `json:"kind"`
+	Value         int        `json:"value"`
+	MaxDiscount   int        `json:"maxDiscount"`
+	FirstRideOnly bool       `json:"firstRideOnly"`
+	PerUserLimit  int        `json:"perUserLimit"`
+	TotalLimit    int        `json:"totalLimit"`
+	ValidFrom     *time.Time `json:"validFrom"`
+	ValidUntil    *time.Time `json:"validUntil"`
+	ZoneIds       []string   `json:"zoneIds"`
+}
+
+func (cpr *createPromotionRequest) promotion() (src.Promotion, error) {
+	if cpr.Code == "" || cpr.Kind == "" {
+		return src.Promotion{}, fmt.Errorf("%w: code and kind are required", errBadRequest)
+	}
+	kind, err := src.ParsePromotionKind(cpr.Kind)
+	if err != nil {
+		return src.Promotion{}, err
+	}
+	promotion := src.Promotion{
+		Code:          cpr.Code,
+		Kind:          kind,
+		Value:         cpr.Value,
+		MaxDiscount:   cpr.MaxDiscount,
+		FirstRideOnly: cpr.FirstRideOnly,
+		PerUserLimit:  cpr.PerUserLimit,
+		TotalLimit:    cpr.TotalLimit,
+		ZoneIds:       cpr.ZoneIds,
+	}
+	if cpr.ValidFrom != nil {
+		promotion.ValidFrom = *cpr.ValidFrom
+	}
+	if cpr.ValidUntil != nil {
+		promotion.ValidUntil = *cpr.ValidUntil
+	}
+	return promotion, nil
+}
+
+type point struct {
+	Lat float64 `json:"lat"`
+	Lon float64 `json:"lon"`
+}
+
+type userResponse struct {
+	Id           string  `json:"id"`
+	Name         string  `json:"name"`
+	PriorityTier int     `json:"priorityTier"`
+	Rating       float64 `json:"rating"`
+	RatingCount  int     `json:"ratingCount"`
+}
+
+func newUserResponse(user *src.User) userResponse {
+	return userResponse{Id: user.GetId(), Name: user.GetName(), PriorityTier: user.GetPriorityTier(), Rating: user.GetRating(), RatingCount: user.GetRatingCount()}
+}
+
+type cabResponse struct {
+	Id                 string     `json:"id"`
+	Name               string     `json:"name"`
+	Category           string     `json:"category"`
+	Seats              int        `json:"seats"`
+	Status             string     `json:"status"`
+	TotalRides         int        `json:"totalRides"`
+	Location           point      `json:"location"`
+	Rating             float64    `json:"rating"`
+	RatingCount        int        `json:"ratingCount"`
+	FlaggedForReview   bool       `json:"flaggedForReview"`
+	Cancellations      int        `json:"cancellations"`
+	CancellationRate   float64    `json:"cancellationRate"`
+	DeprioritisedUntil *time.Time `json:"deprioritisedUntil,omitempty"`
+}
+
+func newCabResponse(cab *src.Cab) cabResponse {
+	lat, lon := cab.GetCurrLocation()
+	var deprioritisedUntil *time.Time
+	if until := cab.GetDeprioritisedUntil(); !until.IsZero() {
+		deprioritisedUntil = &until
+	}
+	return cabResponse{
+		Id:                 cab.GetId(),
+		Name:               cab.GetName(),
+		Category:           cab.GetCategory().String(),
+		Seats:              cab.GetCategory().GetSeats(),
+		Status:             cab.GetCabStatus().String(),
+		TotalRides:         cab.GetTotalRides(),
+		Location:           point{Lat: lat, Lon: lon},
+		Rating:             cab.GetRating(),
+		RatingCount:        cab.GetRatingCount(),
+		FlaggedForReview:   cab.IsFlaggedForReview(),
+		Cancellations:      cab.GetCancellations(),
+		CancellationRate:   cab.GetCancellationRate(),
+		DeprioritisedUntil: deprioritisedUntil,
+	}
+}
+
+type fareResponse struct {
+	BaseFare              int     `json:"baseFare"`
+	DistanceFare          int     `json:"distanceFare"`
+	TimeFare              int     `json:"timeFare"`
+	WaitingCharge         int     `json:"waitingCharge"`
+	SurgeCharge           int     `json:"surgeCharge"`
+	ZoneSurcharge         int     `json:"zoneSurcharge"`
+	PoolDiscount          int     `json:"poolDiscount"`
+	MinimumFareAdjustment int     `json:"minimumFareAdjustment"`
+	Taxes                 int     `json:"taxes"`
+	PromoDiscount         int     `json:"promoDiscount"`
+	Total                 int     `json:"total"`
+	SurgeMultiplier       float64 `json:"surgeMultiplier"`
+	PoolShare             float64 `json:"poolShare,omitempty"`
+	PromoCode             string  `json:"promoCode,omitempty"`
+	PickupZoneId          string  `json:"pickupZoneId,omitempty"`
+	DropZoneId            string  `json:"dropZoneId,omitempty"`
+	StopCharge            int     `json:"stopCharge"`
+	StopWaitingCharge     int     `json:"stopWaitingCharge"`
+	DistanceKm            float64 `json:"distanceKm"`
+	DurationSeconds       float64 `json:"durationSeconds"`
+	WaitingSeconds        float64 `json:"waitingSeconds"`
+	Stops                 int     `json:"stops"`
+	StopWaitingSeconds    float64 `json:"stopWaitingSeconds"`
+	IsFinal               bool    `json:"isFinal"`
+}
+
+func newFareResponse(fare *src.FareBreakdown) *fareResponse {
+	if fare == nil {
+		return nil
+	}
+	return &fareResponse{
+		BaseFare:              fare.BaseFare,
+		DistanceFare:          fare.DistanceFare,
+		TimeFare:              fare.TimeFare,
+		WaitingCharge:         fare.WaitingCharge,
+		StopCharge:            fare.StopCharge,
+		StopWaitingCharge:     fare.StopWaitingCharge,
+		SurgeCharge:           fare.SurgeCharge,
+		ZoneSurcharge:         fare.ZoneSurcharge,
+		PoolDiscount:          fare.PoolDiscount,
+		MinimumFareAdjustment: fare.MinimumFareAdjustment,
+		Taxes:                 fare.Taxes,
+		PromoDiscount:         fare.PromoDiscount,
+		Total:                 fare.Total,
+		SurgeMultiplier:       fare.SurgeMultiplier,
+		PoolShare:             fare.PoolShare,
+		PromoCode:             fare.PromoCode,
+		PickupZoneId:          fare.PickupZoneId,
+		DropZoneId:            fare.DropZoneId,
+		DistanceKm:            fare.DistanceKm,
+		DurationSeconds:       fare.Duration.Seconds(),
+		WaitingSeconds:        fare.WaitingTime.Seconds(),
+		Stops:                 fare.Stops,
+		StopWaitingSeconds:    fare.StopWaitingTime.Seconds(),
+		IsFinal:               fare.IsFinal,
+	}
+}
+
+type fareQuoteResponse struct {
+	Category string        `json:"category"`
+	Seats    int           `json:"seats"`
+	Fare     *fareResponse `json:"fare"`
+}
+
+func newFareQuoteResponses(quotes []src.FareQuote) []fareQuoteResponse {
+	responses := make([]fareQuoteResponse, 0, len(quotes))
+	for _, quote := range quotes {
+		responses = append(responses, fareQuoteResponse{Category: quote.Category.String(), Seats: quote.Seats, Fare: newFareResponse(quote.Fare)})
+	}
+	return responses
+}
+
+type rideResponse struct {
+	Id              string                `json:"id"`
+	UserId          string                `json:"userId"`
+	CabId           string                `json:"cabId,omitempty"`
+	Status          string                `json:"status"`
+	RideType        string                `json:"rideType"`
+	Seats           int                   `json:"seats"`
+	VehicleCategory string                `json:"vehicleCategory"`
+	Pickup          point                 `json:"pickup"`
+	Drop            point                 `json:"drop"`
+	Stops           []rideStopResponse    `json:"stops"`
+	TotalAmount     int                   `json:"totalAmount"`
+	SurgeMultiplier float64               `json:"surgeMultiplier"`
+	SurgeZoneId     string                `json:"surgeZoneId,omitempty"`
+	PriorityTier    int                   `json:"priorityTier"`
+	CreatedAt       time.Time             `json:"createdAt"`
+	PickupAt        *time.Time            `json:"pickupAt,omitempty"`
+	FareEstimate    *fareResponse         `json:"fareEstimate,omitempty"`
+	FinalFare       *fareResponse         `json:"finalFare,omitempty"`
+	Cancellation    *cancellationResponse `json:"cancellation,omitempty"`
+	PaymentMethodId string                `json:"paymentMethodId,omitempty"`
+	PromoCode       string                `json:"promoCode,omitempty"`
+}
+
+func newRideResponse(ride *src.Ride) rideResponse {
+	startLat, startLon := ride.GetStartPoint()
+	endLat, endLon := ride.GetEndPoint()
+	var pickupAt *time.Time
+	if ride.IsScheduled() {
+		scheduledPickupAt := ride.GetScheduledPickupAt()
+		pickupAt = &scheduledPickupAt
+	}
+	return rideResponse{
+		Id:              ride.GetId(),
+		UserId:          ride.GetUserId(),
+		CabId:           ride.GetCabId(),
+		Status:          ride.GetStatus().String(),
+		RideType:        ride.GetRideType().String(),
+		Seats:           ride.GetSeats(),
+		VehicleCategory: ride.GetVehicleCategory().String(),
+		Pickup:          point{Lat: startLat, Lon: startLon},
+		Drop:            point{Lat: endLat, Lon: endLon},
+		Stops:           newRideStopResponses(ride.GetStops()),
+		TotalAmount:     ride.GetTotalAmount(),
+		SurgeMultiplier: ride.GetSurgeMultiplier(),
+		SurgeZoneId:     ride.GetSurgeZoneId(),
+		PriorityTier:    ride.GetPriorityTier(),
+		CreatedAt:       ride.GetCreatedAt(),
+		PickupAt:        pickupAt,
+		FareEstimate:    newFareResponse(ride.GetFareEstimate()),
+		FinalFare:       newFareResponse(ride.GetFinalFare()),
+		Cancellation:    newCancellationResponse(ride.GetCancellation()),
+		PaymentMethodId: ride.GetPaymentMethodId(),
+		PromoCode:       ride.GetPromoCode(),
+	}
+}
+
+type rideStopResponse struct {
+	Location       point      `json:"location"`
+	Status         string     `json:"status"`
+	ArrivedAt      *time.Time `json:"arrivedAt,omitempty"`
+	DepartedAt     *time.Time `json:"departedAt,omitempty"`
+	WaitingSeconds float64    `json:"waitingSeconds"`
+}
+
+func newRideStopResponses(stops []src.RideStop) []rideStopResponse {
+	responses := make([]rideStopResponse, 0, len(stops))
+	for _, stop := range stops {
+		response := rideStopResponse{
+			Location:       point{Lat: stop.Location.Lat, Lon: stop.Location.Lon},
+			Status:         stop.Status.String(),
+			WaitingSeconds: stop.GetWaitingTime().Seconds(),
+		}
+		if !stop.ArrivedAt.IsZero() {
+			response.ArrivedAt = &stop.ArrivedAt
+		}
+		if !stop.DepartedAt.IsZero() {
+			response.DepartedAt = &stop.DepartedAt
+		}
+		responses = append(responses, response)
+	}
+	return responses
+}
+
+type cancellationResponse struct {
+	CancelledBy           string    `json:"cancelledBy"`
+	Reason                string    `json:"reason"`
+	AtFault               string    `json:"atFault"`
+	SinceConfirmedSeconds float64   `json:"sinceConfirmedSeconds"`
+	DriverDistanceKm      float64   `json:"driverDistanceKm"`
+	Fee                   int       `json:"fee"`
+	FeeWaived             bool      `json:"feeWaived"`
+	At                    time.Time `json:"at"`
+}
+
+func newCancellationResponse(cancellation *src.Cancellation) *cancellationResponse {
+	if cancellation == nil {
+		return nil
+	}
+	return &cancellationResponse{
+		CancelledBy:           cancellation.CancelledBy.String(),
+		Reason:                cancellation.Reason.String(),
+		AtFault:               cancellation.AtFault.String(),
+		SinceConfirmedSeconds: cancellation.SinceConfirmed.Seconds(),
+		DriverDistanceKm:      cancellation.DriverDistanceKm,
+		Fee:                   cancellation.Fee,
+		FeeWaived:             cancellation.FeeWaived,
+		At:                    cancellation.At,
+	}
+}
+
+type transitionResponse struct {
+	From string    `json:"from"`
+	To   string    `json:"to"`
+	At   time.Time `json:"at"`
+}
+
+func newTimelineResponse(timeline []src.RideTransition) []transitionResponse {
+	transitions := make([]transitionResponse, 0, len(timeline))
+	for _, transition := range timeline {
+		transitions = append(transitions, transitionResponse{From: transition.From.String(), To: transition.To.String(), At: transition.At})
+	}
+	return transitions
+}
+
+type poolStopResponse struct {
+	RideId  string `json:"rideId"`
+	Kind    string `json:"kind"`
+	Point   point  `json:"point"`
+	Visited bool   `json:"visited"`
+}
+
+type poolTripResponse struct {
+	Id       string             `json:"id"`
+	CabId    string             `json:"cabId"`
+	Capacity int                `json:"capacity"`
+	RideIds  []string           `json:"rideIds"`
+	Stops    []poolStopResponse `json:"stops"`
+}
+
+func newPoolTripResponse(trip *src.PoolTrip) poolTripResponse {
+	stops := make([]poolStopResponse, 0, len(trip.GetStops()))
+	for i, stop := range trip.GetStops() {
+		stops = append(stops, poolStopResponse{
+			RideId:  stop.RideId,
+			Kind:    stop.Kind.String(),
+			Point:   point{Lat: stop.Lat, Lon: stop.Lon},
+			Visited: i < trip.GetVisitedStops(),
+		})
+	}
+	return poolTripResponse{
+		Id:       trip.GetId(),
+		CabId:    trip.GetCabId(),
+		Capacity: trip.GetCapacity(),
+		RideIds:  trip.GetRideIds(),
+		Stops:    stops,
+	}
+}
+
+type ratingResponse struct {
+	RideId      string    `json:"rideId"`
+	RatedBy     string    `json:"ratedBy"`
+	RaterId     string    `json:"raterId"`
+	SubjectId   string    `json:"subjectId"`
+	Stars       int       `json:"stars"`
+	Tags        []string  `json:"tags"`
+	SubmittedAt time.Time `json:"submittedAt"`
+}
+
+func newRatingResponse(rating src.Rating) ratingResponse {
+	return ratingResponse{
+		RideId:      rating.GetRideId(),
+		RatedBy:     rating.GetAuthor().String(),
+		RaterId:     rating.GetRaterId(),
+		SubjectId:   rating.GetSubjectId(),
+		Stars:       rating.GetStars(),
+		Tags:        rating.GetTags(),
+		SubmittedAt: rating.GetSubmittedAt(),
+	}
+}
+
+type paymentMethodResponse struct {
+	Id        string    `json:"id"`
+	Type      string    `json:"type"`
+	Label     string    `json:"label"`
+	Default   bool      `json:"default"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+func newPaymentMethodResponse(method src.PaymentMethod) paymentMethodResponse {
+	return paymentMethodResponse{
+		Id:        method.GetId(),
+		Type:      method.GetMethodType().String(),
+		Label:     method.GetLabel(),
+		Default:   method.IsDefault(),
+		CreatedAt: method.GetCreatedAt(),
+	}
+}
+
+type balanceResponse struct {
+	UserId          string `json:"userId"`
+	WalletBalance   int    `json:"walletBalance"`
+	OutstandingDues int    `json:"outstandingDues"`
+}
+
+func newBalanceResponse(balance src.RiderBalance) balanceResponse {
+	return balanceResponse{UserId: balance.UserId, WalletBalance: balance.WalletBalance, OutstandingDues: balance.OutstandingDues}
+}
+
+type paymentResponse struct {
+	Id              string    `json:"id"`
+	RideId          string    `json:"rideId"`
+	UserId          string    `json:"userId"`
+	PaymentMethodId string    `json:"paymentMethodId,omitempty"`
+	Method          string    `json:"method"`
+	Amount          int       `json:"amount"`
+	Refunded        int       `json:"refunded"`
+	AmountDue       int       `json:"amountDue"`
+	Status          string    `json:"status"`
+	Reference       string    `json:"reference,omitempty"`
+	FailureReason   string    `json:"failureReason,omitempty"`
+	CreatedAt       time.Time `json:"createdAt"`
+	UpdatedAt       time.Time `json:"updatedAt"`
+}
+
+func newPaymentResponse(payment *src.Payment) paymentResponse {
+	return paymentResponse{
+		Id:              payment.GetId(),
+		RideId:          payment.GetRideId(),
+		UserId:          payment.GetUserId(),
+		PaymentMethodId: payment.GetMethodId(),
+		Method:          payment.GetMethodType().String(),
+		Amount:          payment.GetAmount(),
+		Refunded:        payment.GetRefunded(),
+		AmountDue:       payment.GetAmountDue(),
+		Status:          payment.GetStatus().String(),
+		Reference:       payment.GetReference(),
+		FailureReason:   payment.GetFailureReason(),
+		CreatedAt:       payment.GetCreatedAt(),
+		UpdatedAt:       payment.GetUpdatedAt(),
+	}
+}
+
+type promotionResponse struct {
+	Code          string     `json:"code"`
+	Kind          string     `json:"kind"`
+	Value         int        `json:"value"`
+	MaxDiscount   int        `json:"maxDiscount,omitempty"`
+	FirstRideOnly bool       `json:"firstRideOnly"`
+	PerUserLimit  int        `json:"perUserLimit,omitempty"`
+	TotalLimit    int        `json:"totalLimit,omitempty"`
+	ValidFrom     *time.Time `json:"validFrom,omitempty"`
+	ValidUntil    *time.Time `json:"validUntil,omitempty"`
+	ZoneIds       []string   `json:"zoneIds,omitempty"`
+	ReferrerId    string     `json:"referrerId,omitempty"`
+	CreatedAt     time.Time  `json:"createdAt"`
+}
+
+func newPromotionResponse(promotion *src.Promotion) promotionResponse {
+	response := promotionResponse{
+		Code:          promotion.Code,
+		Kind:          promotion.Kind.String(),
+		Value:         promotion.Value,
+		MaxDiscount:   promotion.MaxDiscount,
+		FirstRideOnly: promotion.FirstRideOnly,
+		PerUserLimit:  promotion.PerUserLimit,
+		TotalLimit:    promotion.TotalLimit,
+		ZoneIds:       promotion.ZoneIds,
+		ReferrerId:    promotion.ReferrerId,
+		CreatedAt:     promotion.CreatedAt,
+	}
+	if !promotion.ValidFrom.IsZero() {
+		response.ValidFrom = &promotion.ValidFrom
+	}
+	if !promotion.ValidUntil.IsZero() {
+		response.ValidUntil = &promotion.ValidUntil
+	}
+	return response
+}
+
+type promoRedemptionResponse struct {
+	Id         string    `json:"id"`
+	Code       string    `json:"code"`
+	RideId     string    `json:"rideId,omitempty"`
+	Status     string    `json:"status"`
+	Discount   int       `json:"discount"`
+	ReservedAt time.Time `json:"reservedAt"`
+	UpdatedAt  time.Time `json:"updatedAt"`
+}
+
+func newPromoRedemptionResponses(redemptions []src.PromoRedemption) []promoRedemptionResponse {
+	responses := make([]promoRedemptionResponse, 0, len(redemptions))
+	for _, redemption := range redemptions {
+		responses = append(responses, promoRedemptionResponse{
+			Id:         redemption.Id,
+			Code:       redemption.Code,
+			RideId:     redemption.RideId,
+			Status:     redemption.Status.String(),
+			Discount:   redemption.Discount,
+			ReservedAt: redemption.ReservedAt,
+			UpdatedAt:  redemption.UpdatedAt,
+		})
+	}
+	return responses
+}
+
+type ledgerEntryResponse struct {
+	Id          string    `json:"id"`
+	RideId      string    `json:"rideId,omitempty"`
+	PaymentId   string    `json:"paymentId,omitempty"`
+	Kind        string    `json:"kind"`
+	Method      string    `json:"method"`
+	Amount      int       `json:"amount"`
+	WalletDelta int       `json:"walletDelta"`
+	DuesDelta   int       `json:"duesDelta"`
+	Reference   string    `json:"reference,omitempty"`
+	Note        string    `json:"note,omitempty"`
+	At          time.Time `json:"at"`
+}
+
+func newLedgerResponse(entries []src.LedgerEntry) []ledgerEntryResponse {
+	response := make([]ledgerEntryResponse, 0, len(entries))
+	for _, entry := range entries {
+		response = append(response, ledgerEntryResponse{
+			Id:          entry.Id,
+			RideId:      entry.RideId,
+			PaymentId:   entry.PaymentId,
+			Kind:        entry.Kind.String(),
+			Method:      entry.Method.String(),
+			Amount:      entry.Amount,
+			WalletDelta: entry.WalletDelta,
+			DuesDelta:   entry.DuesDelta,
+			Reference:   entry.Reference,
+			Note:        entry.Note,
+			At:          entry.At,
+		})
+	}
+	return response
+}
+
+type earningEntryResponse struct {
+	Id         string    `json:"id"`
+	RideId     string    `json:"rideId,omitempty"`
+	Kind       string    `json:"kind"`
+	Fare       int       `json:"fare,omitempty"`
+	Commission int       `json:"commission,omitempty"`
+	Amount     int       `json:"amount"`
+	BatchId    string    `json:"batchId,omitempty"`
+	Note       string    `json:"note,omitempty"`
+	At         time.Time `json:"at"`
+}
+
+func newEarningEntryResponse(entry src.EarningEntry) earningEntryResponse {
+	return earningEntryResponse{
+		Id:         entry.Id,
+		RideId:     entry.RideId,
+		Kind:       entry.Kind.String(),
+		Fare:       entry.Fare,
+		Commission: entry.Commission,
+		Amount:     entry.Amount,
+		BatchId:    entry.BatchId,
+		Note:       entry.Note,
+		At:         entry.At,
+	}
+}
+
+type earningsBalanceResponse struct {
+	CabId   string `json:"cabId"`
+	Balance int    `json:"balance"`
+}
+
+type statementResponse struct {
+	CabId         string                 `json:"cabId"`
+	Period        string                 `json:"period"`
+	From          time.Time              `json:"from"`
+	To            time.Time              `json:"to"`
+	Rides         int                    `json:"rides"`
+	Fares         int                    `json:"fares"`
+	Commission    int                    `json:"commission"`
+	RideEarnings  int                    `json:"rideEarnings"`
+	Incentives    int                    `json:"incentives"`
+	NetEarnings   int                    `json:"netEarnings"`
+	PaidOut       int                    `json:"paidOut"`
+	OnlineSeconds int64                  `json:"onlineSeconds"`
+	BreakSeconds  int64                  `json:"breakSeconds"`
+	Entries       []earningEntryResponse `json:"entries"`
+}
+
+func newStatementResponse(statement *src.EarningsStatement) statementResponse {
+	entries := make([]earningEntryResponse, 0, len(statement.Entries))
+	for _, entry := range statement.Entries {
+		entries = append(entries, newEarningEntryResponse(entry))
+	}
+	return statementResponse{
+		CabId:         statement.CabId,
+		Period:        statement.Period.String(),
+		From:          statement.From,
+		To:            statement.To,
+		Rides:         statement.Rides,
+		Fares:         statement.Fares,
+		Commission:    statement.Commission,
+		RideEarnings:  statement.RideEarnings,
+		Incentives:    statement.Incentives,
+		NetEarnings:   statement.NetEarnings,
+		PaidOut:       statement.PaidOut,
+		OnlineSeconds: int64(statement.OnlineTime / time.Second),
+		BreakSeconds:  int64(statement.BreakTime / time.Second),
+		Entries:       entries,
+	}
+}
+
+type payoutResponse struct {
+	CabId   string `json:"cabId"`
+	CabName string `json:"cabName"`
+	Amount  int    `json:"amount"`
+}
+
+type payoutBatchResponse struct {
+	Id        string           `json:"id"`
+	CreatedAt time.Time        `json:"createdAt"`
+	Payouts   []payoutResponse `json:"payouts"`
+	Total     int              `json:"total"`
+}
+
+func newPayoutBatchResponse(batch *src.PayoutBatch) payoutBatchResponse {
+	payouts := make([]payoutResponse, 0, len(batch.Payouts))
+	for _, payout := range batch.Payouts {
+		payouts = append(payouts, payoutResponse{CabId: payout.CabId, CabName: payout.CabName, Amount: payout.Amount})
+	}
+	return payoutBatchResponse{Id: batch.Id, CreatedAt: batch.CreatedAt, Payouts: payouts, Total: batch.Total}
+}
+
+type offerResponse struct {
+	RideId      string    `json:"rideId"`
+	CabId       string    `json:"cabId"`
+	Attempt     int       `json:"attempt"`
+	MaxAttempts int       `json:"maxAttempts"`
+	Status      string    `json:"status"`
+	OfferedAt   time.Time `json:"offeredAt"`
+	ExpiresAt   time.Time `json:"expiresAt"`
+}
+
+func newOfferResponse(offer *src.RideOffer) offerResponse {
+	return offerResponse{
+		RideId:      offer.GetRideId(),
+		CabId:       offer.GetCabId(),
+		Attempt:     offer.GetAttempt(),
+		MaxAttempts: offer.GetMaxAttempts(),
+		Status:      offer.GetStatus().String(),
+		OfferedAt:   offer.GetOfferedAt(),
+		ExpiresAt:   offer.GetExpiresAt(),
+	}
+}
+
+type pendingRideResponse struct {
+	RideId        string    `json:"rideId"`
+	Tier          int       `json:"tier"`
+	Position      int       `json:"position"`
+	Retries       int       `json:"retries"`
+	EnqueuedAt    time.Time `json:"enqueuedAt"`
+	Deadline      time.Time `json:"deadline"`
+	NextAttemptAt time.Time `json:"nextAttemptAt"`
+}
+
+func newPendingRideResponse(pendingRide *src.PendingRide) pendingRideResponse {
+	return pendingRideResponse{
+		RideId:        pendingRide.GetRideId(),
+		Tier:          pendingRide.GetTier(),
+		Position:      pendingRide.GetPosition(),
+		Retries:       pendingRide.GetRetries(),
+		EnqueuedAt:    pendingRide.GetEnqueuedAt(),
+		Deadline:      pendingRide.GetDeadline(),
+		NextAttemptAt: pendingRide.GetNextAttemptAt(),
+	}
+}
+
+type queuedCabResponse struct {
+	CabId    string    `json:"cabId"`
+	Position int       `json:"position"`
+	JoinedAt time.Time `json:"joinedAt"`
+}
+
+func newQueuedCabResponses(queue []src.QueuedCab) []queuedCabResponse {
+	responses := make([]queuedCabResponse, 0, len(queue))
+	for _, queuedCab := range queue {
+		responses = append(responses, queuedCabResponse{CabId: queuedCab.CabId, Position: queuedCab.Position, JoinedAt: queuedCab.JoinedAt})
+	}
+	return responses
+}
+
+type pendingQueueStatsResponse struct {
+	Depth                     int         `json:"depth"`
+	DepthByTier               map[int]int `json:"depthByTier"`
+	OldestWaitSeconds         float64     `json:"oldestWaitSeconds"`
+	AverageWaitSeconds        float64     `json:"averageWaitSeconds"`
+	Matched                   int         `json:"matched"`
+	Expired                   int         `json:"expired"`
+	AverageMatchedWaitSeconds float64     `json:"averageMatchedWaitSeconds"`
+}
+
+func newPendingQueueStatsResponse(stats src.PendingQueueStats) pendingQueueStatsResponse {
+	return pendingQueueStatsResponse{
+		Depth:                     stats.Depth,
+		DepthByTier:               stats.DepthByTier,
+		OldestWaitSeconds:         stats.OldestWait.Seconds(),
+		AverageWaitSeconds:        stats.AverageWait.Seconds(),
+		Matched:                   stats.Matched,
+		Expired:                   stats.Expired,
+		AverageMatchedWaitSeconds: stats.AverageMatchedWait.Seconds(),
+	}
+}
+
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+type rideTotalsResponse struct {
+	Rides      int     `json:"rides"`
+	Completed  int     `json:"completed"`
+	Canceled   int     `json:"canceled"`
+	Spend      int     `json:"spend"`
+	DistanceKm float64 `json:"distanceKm"`
+}
+
+type ridePageResponse struct {
+	Rides      []rideResponse     `json:"rides"`
+	NextCursor string             `json:"nextCursor,omitempty"`
+	Totals     rideTotalsResponse `json:"totals"`
+}
+
+func newRidePageResponse(page *src.RidePage) ridePageResponse {
+	rides := make([]rideResponse, 0, len(page.Rides))
+	for i := range page.Rides {
+		rides = append(rides, newRideResponse(&page.Rides[i]))
+	}
+	totals := page.Totals
+	return ridePageResponse{
+		Rides:      rides,
+		NextCursor: page.NextCursor,
+		Totals:     rideTotalsResponse{Rides: totals.Rides, Completed: totals.Completed, Canceled: totals.Canceled, Spend: totals.Spend, DistanceKm: totals.DistanceKm},
+	}
+}
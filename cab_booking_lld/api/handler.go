@@ -0,0 +1,933 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"cab_booking.com/src"
+)
+
+const maxRequestBodyBytes = 1 << 20
+
+var errBadRequest = errors.New("bad request")
+
+type CabServiceHandler struct {
+	cabService        src.CabServiceV2
+	heartbeatInterval time.Duration
+	mux               *http.ServeMux
+}
+
+// NewCabServiceHandler exposes every CabService operation as a JSON endpoint.
+// Calls run with the request's context, so a client that hangs up stops the
+// work done for it. Ride tracking streams send a heartbeat every heartbeatInterval.
+func NewCabServiceHandler(cabService src.CabServiceV2, heartbeatInterval time.Duration) http.Handler {
+	csh := &CabServiceHandler{
+		cabService:        cabService,
+		heartbeatInterval: heartbeatInterval,
+		mux:               http.NewServeMux(),
+	}
+	csh.mux.HandleFunc("POST /users", csh.registerUser)
+	csh.mux.HandleFunc("GET /users/{userId}", csh.getUser)
+	csh.mux.HandleFunc("PUT /users/{userId}/priority-tier", csh.setUserPriorityTier)
+	csh.mux.HandleFunc("GET /users/{userId}/rides", csh.listUserRides)
+	csh.mux.HandleFunc("POST /users/{userId}/payment-methods", csh.addPaymentMethod)
+	csh.mux.HandleFunc("GET /users/{userId}/payment-methods", csh.listPaymentMethods)
+	csh.mux.HandleFunc("PUT /users/{userId}/payment-methods/default", csh.setDefaultPaymentMethod)
+	csh.mux.HandleFunc("GET /users/{userId}/balance", csh.getBalance)
+	csh.mux.HandleFunc("POST /users/{userId}/wallet/top-up", csh.topUpWallet)
+	csh.mux.HandleFunc("POST /users/{userId}/dues/pay", csh.payDues)
+	csh.mux.HandleFunc("GET /users/{userId}/ledger", csh.getLedger)
+	csh.mux.HandleFunc("GET /users/{userId}/referral-code", csh.getReferralCode)
+	csh.mux.HandleFunc("GET /users/{userId}/promo-redemptions", csh.listPromoRedemptions)
+	csh.mux.HandleFunc("POST /promotions", csh.createPromotion)
+	csh.mux.HandleFunc("GET /promotions/{code}", csh.getPromotion)
+	csh.mux.HandleFunc("POST /cabs", csh.registerCab)
+	csh.mux.HandleFunc("GET /cabs/{cabId}", csh.getCab)
+	csh.mux.HandleFunc("GET /cabs/{cabId}/rides", csh.listCabRides)
+	csh.mux.HandleFunc("PUT /cabs/{cabId}/location", csh.updateCabLocation)
+	csh.mux.HandleFunc("POST /cabs/{cabId}/online", csh.goOnline)
+	csh.mux.HandleFunc("POST /cabs/{cabId}/break", csh.takeBreak)
+	csh.mux.HandleFunc("POST /cabs/{cabId}/offline", csh.goOffline)
+	csh.mux.HandleFunc("POST /cabs/{cabId}/incentives", csh.addDriverIncentive)
+	csh.mux.HandleFunc("GET /cabs/{cabId}/earnings/balance", csh.getEarningsBalance)
+	csh.mux.HandleFunc("GET /cabs/{cabId}/statements/{period}", csh.getEarningsStatement)
+	csh.mux.HandleFunc("POST /payout-batches", csh.createPayoutBatch)
+	csh.mux.HandleFunc("GET /payout-batches/{batchId}", csh.getPayoutBatch)
+	csh.mux.HandleFunc("GET /payout-batches/{batchId}/export", csh.exportPayoutBatch)
+	csh.mux.HandleFunc("POST /fare-quotes", csh.quoteFares)
+	csh.mux.HandleFunc("POST /rides", csh.bookRide)
+	csh.mux.HandleFunc("GET /rides/{rideId}", csh.getRide)
+	csh.mux.HandleFunc("PUT /rides/{rideId}/status", csh.updateRideStatus)
+	csh.mux.HandleFunc("POST /rides/{rideId}/cancel", csh.cancelRide)
+	csh.mux.HandleFunc("PUT /rides/{rideId}/pickup-time", csh.rescheduleRide)
+	csh.mux.HandleFunc("POST /rides/{rideId}/stops", csh.addStop)
+	csh.mux.HandleFunc("DELETE /rides/{rideId}/stops/{index}", csh.removeStop)
+	csh.mux.HandleFunc("POST /rides/{rideId}/stops/{index}/arrive", csh.arriveAtStop)
+	csh.mux.HandleFunc("POST /rides/{rideId}/stops/{index}/depart", csh.departStop)
+	csh.mux.HandleFunc("GET /rides/{rideId}/track", csh.trackRide)
+	csh.mux.HandleFunc("GET /rides/{rideId}/timeline", csh.getRideTimeline)
+	csh.mux.HandleFunc("GET /rides/{rideId}/pool", csh.getPoolTrip)
+	csh.mux.HandleFunc("POST /rides/{rideId}/rating/driver", csh.rateDriver)
+	csh.mux.HandleFunc("POST /rides/{rideId}/rating/rider", csh.rateRider)
+	csh.mux.HandleFunc("GET /rides/{rideId}/ratings", csh.getRideRatings)
+	csh.mux.HandleFunc("GET /rides/{rideId}/payment", csh.getRidePayment)
+	csh.mux.HandleFunc("POST /rides/{rideId}/refund", csh.refundRide)
+	csh.mux.HandleFunc("GET /rides/{rideId}/offer", csh.getRideOffer)
+	csh.mux.HandleFunc("POST /rides/{rideId}/offer/accept", csh.acceptRide)
+	csh.mux.HandleFunc("POST /rides/{rideId}/offer/reject", csh.rejectRide)
+	csh.mux.HandleFunc("GET /rides/{rideId}/pending", csh.getPendingRide)
+	csh.mux.HandleFunc("GET /pending-rides/stats", csh.getPendingQueueStats)
+	csh.mux.HandleFunc("GET /zones/{zoneId}/queue", csh.getZoneQueue)
+	return csh
+}
+
+func (csh *CabServiceHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	csh.mux.ServeHTTP(w, r)
+}
+
+func (csh *CabServiceHandler) registerUser(w http.ResponseWriter, r *http.Request) {
+	var request registerRequest
+	if err := decodeRequest(w, r, &request); err != nil {
+		writeError(w, err)
+		return
+	}
+	if strings.TrimSpace(request.Name) == "" {
+		writeError(w, fmt.Errorf("%w: name is required", errBadRequest))
+		return
+	}
+	user, err := csh.cabService.RegisterUser(r.Context(), request.Name)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, newUserResponse(user))
+}
+
+func (csh *CabServiceHandler) getUser(w http.ResponseWriter, r *http.Request) {
+	user, err := csh.cabService.GetUser(r.Context(), r.PathValue("userId"))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, newUserResponse(user))
+}
+
+func (csh *CabServiceHandler) setUserPriorityTier(w http.ResponseWriter, r *http.Request) {
+	var request priorityTierRequest
+	if err := decodeRequest(w, r, &request); err != nil {
+		writeError(w, err)
+		return
+	}
+	if request.PriorityTier == nil {
+		writeError(w, fmt.Errorf("%w: priorityTier is required", errBadRequest))
+		return
+	}
+	userId := r.PathValue("userId")
+	if err := csh.cabService.SetUserPriorityTier(r.Context(), userId, *request.PriorityTier); err != nil {
+		writeError(w, err)
+		return
+	}
+	csh.getUser(w, r)
+}
+
+func (csh *CabServiceHandler) listUserRides(w http.ResponseWriter, r *http.Request) {
+	csh.listRides(w, r, src.RideQuery{UserId: r.PathValue("userId")})
+}
+
+func (csh *CabServiceHandler) listCabRides(w http.ResponseWriter, r *http.Request) {
+	csh.listRides(w, r, src.RideQuery{CabId: r.PathValue("cabId")})
+}
+
+// listRides narrows the query with the status, from, to, order, limit and
+// cursor query parameters. Statuses are comma separated and the range bounds
+// are RFC 3339 times.
+func (csh *CabServiceHandler) listRides(w http.ResponseWriter, r *http.Request, query src.RideQuery) {
+	params := r.URL.Query()
+	if statuses := params.Get("status"); statuses != "" {
+		for _, name := range strings.Split(statuses, ",") {
+			status, err := src.ParseRideStatus(name)
+			if err != nil {
+				writeError(w, err)
+				return
+			}
+			query.Statuses = append(query.Statuses, status)
+		}
+	}
+	var err error
+	for _, bound := range []struct {
+		name string
+		at   *time.Time
+	}{{"from", &query.CreatedFrom}, {"to", &query.CreatedTo}} {
+		if value := params.Get(bound.name); value != "" {
+			if *bound.at, err = time.Parse(time.RFC3339, value); err != nil {
+				writeError(w, fmt.Errorf("%w: %s must be an RFC 3339 time", errBadRequest, bound.name))
+				return
+			}
+		}
+	}
+	if order := params.Get("order"); order != "" {
+		if query.Order, err = src.ParseRideSortOrder(order); err != nil {
+			writeError(w, err)
+			return
+		}
+	}
+	if limit := params.Get("limit"); limit != "" {
+		if query.Limit, err = strconv.Atoi(limit); err != nil || query.Limit < 1 {
+			writeError(w, fmt.Errorf("%w: limit must be a positive number", errBadRequest))
+			return
+		}
+	}
+	query.Cursor = params.Get("cursor")
+	page, err := csh.cabService.QueryRides(r.Context(), query)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, newRidePageResponse(page))
+}
+
+func (csh *CabServiceHandler) addPaymentMethod(w http.ResponseWriter, r *http.Request) {
+	var request addPaymentMethodRequest
+	if err := decodeRequest(w, r, &request); err != nil {
+		writeError(w, err)
+		return
+	}
+	if request.Type == "" {
+		writeError(w, fmt.Errorf("%w: type is required", errBadRequest))
+		return
+	}
+	methodType, err := src.ParsePaymentMethodType(request.Type)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if (methodType == src.CardPayment) != (request.CardNumber != "") {
+		writeError(w, fmt.Errorf("%w: cardNumber is required for cards and only for cards", errBadRequest))
+		return
+	}
+	method, err := csh.cabService.AddPaymentMethod(r.Context(), r.PathValue("userId"), methodType, request.CardNumber, request.Default)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, newPaymentMethodResponse(*method))
+}
+
+func (csh *CabServiceHandler) listPaymentMethods(w http.ResponseWriter, r *http.Request) {
+	methods, err := csh.cabService.GetPaymentMethods(r.Context(), r.PathValue("userId"))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	response := make([]paymentMethodResponse, 0, len(methods))
+	for _, method := range methods {
+		response = append(response, newPaymentMethodResponse(method))
+	}
+	writeJSON(w, http.StatusOK, response)
+}
+
+func (csh *CabServiceHandler) setDefaultPaymentMethod(w http.ResponseWriter, r *http.Request) {
+	var request paymentMethodRequest
+	if err := decodeRequest(w, r, &request); err != nil {
+		writeError(w, err)
+		return
+	}
+	if request.PaymentMethodId == "" {
+		writeError(w, fmt.Errorf("%w: paymentMethodId is required", errBadRequest))
+		return
+	}
+	if err := csh.cabService.SetDefaultPaymentMethod(r.Context(), r.PathValue("userId"), request.PaymentMethodId); err != nil {
+		writeError(w, err)
+		return
+	}
+	csh.listPaymentMethods(w, r)
+}
+
+func (csh *CabServiceHandler) getBalance(w http.ResponseWriter, r *http.Request) {
+	balance, err := csh.cabService.GetBalance(r.Context(), r.PathValue("userId"))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, newBalanceResponse(balance))
+}
+
+func (csh *CabServiceHandler) topUpWallet(w http.ResponseWriter, r *http.Request) {
+	var request walletTopUpRequest
+	if err := decodeRequest(w, r, &request); err != nil {
+		writeError(w, err)
+		return
+	}
+	if request.PaymentMethodId == "" || request.Amount == nil {
+		writeError(w, fmt.Errorf("%w: paymentMethodId and amount are required", errBadRequest))
+		return
+	}
+	balance, err := csh.cabService.TopUpWallet(r.Context(), r.PathValue("userId"), request.PaymentMethodId, *request.Amount)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, newBalanceResponse(balance))
+}
+
+func (csh *CabServiceHandler) payDues(w http.ResponseWriter, r *http.Request) {
+	var request paymentMethodRequest
+	if err := decodeRequest(w, r, &request); err != nil {
+		writeError(w, err)
+		return
+	}
+	if request.PaymentMethodId == "" {
+		writeError(w, fmt.Errorf("%w: paymentMethodId is required", errBadRequest))
+		return
+	}
+	balance, err := csh.cabService.PayDues(r.Context(), r.PathValue("userId"), request.PaymentMethodId)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, newBalanceResponse(balance))
+}
+
+func (csh *CabServiceHandler) getLedger(w http.ResponseWriter, r *http.Request) {
+	entries, err := csh.cabService.GetLedger(r.Context(), r.PathValue("userId"))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, newLedgerResponse(entries))
+}
+
+func (csh *CabServiceHandler) getReferralCode(w http.ResponseWriter, r *http.Request) {
+	promotion, err := csh.cabService.GetReferralCode(r.Context(), r.PathValue("userId"))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, newPromotionResponse(promotion))
+}
+
+func (csh *CabServiceHandler) listPromoRedemptions(w http.ResponseWriter, r *http.Request) {
+	redemptions, err := csh.cabService.GetPromoRedemptions(r.Context(), r.PathValue("userId"))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, newPromoRedemptionResponses(redemptions))
+}
+
+func (csh *CabServiceHandler) createPromotion(w http.ResponseWriter, r *http.Request) {
+	var request createPromotionRequest
+	if err := decodeRequest(w, r, &request); err != nil {
+		writeError(w, err)
+		return
+	}
+	promotion, err := request.promotion()
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	created, err := csh.cabService.CreatePromotion(r.Context(), promotion)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, newPromotionResponse(created))
+}
+
+func (csh *CabServiceHandler) getPromotion(w http.ResponseWriter, r *http.Request) {
+	promotion, err := csh.cabService.GetPromotion(r.Context(), r.PathValue("code"))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, newPromotionResponse(promotion))
+}
+
+func (csh *CabServiceHandler) registerCab(w http.ResponseWriter, r *http.Request) {
+	var request registerCabRequest
+	if err := decodeRequest(w, r, &request); err != nil {
+		writeError(w, err)
+		return
+	}
+	if strings.TrimSpace(request.Name) == "" {
+		writeError(w, fmt.Errorf("%w: name is required", errBadRequest))
+		return
+	}
+	if request.Category == "" {
+		writeError(w, fmt.Errorf("%w: category is required", errBadRequest))
+		return
+	}
+	category, err := src.ParseVehicleCategory(request.Category)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if category == src.AnyCategory {
+		writeError(w, fmt.Errorf("%w: a cab needs a vehicle category", errBadRequest))
+		return
+	}
+	cab, err := csh.cabService.RegisterCab(r.Context(), request.Name, category)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, newCabResponse(cab))
+}
+
+func (csh *CabServiceHandler) getCab(w http.ResponseWriter, r *http.Request) {
+	cab, err := csh.cabService.GetCab(r.Context(), r.PathValue("cabId"))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, newCabResponse(cab))
+}
+
+func (csh *CabServiceHandler) updateCabLocation(w http.ResponseWriter, r *http.Request) {
+	var request location
+	if err := decodeRequest(w, r, &request); err != nil {
+		writeError(w, err)
+		return
+	}
+	lat, lon, err := request.coordinates("location")
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if err := csh.cabService.UpdateCabLocation(r.Context(), r.PathValue("cabId"), lat, lon); err != nil {
+		writeError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (csh *CabServiceHandler) goOnline(w http.ResponseWriter, r *http.Request) {
+	csh.changeShift(w, r, csh.cabService.GoOnline)
+}
+
+func (csh *CabServiceHandler) takeBreak(w http.ResponseWriter, r *http.Request) {
+	csh.changeShift(w, r, csh.cabService.TakeBreak)
+}
+
+func (csh *CabServiceHandler) goOffline(w http.ResponseWriter, r *http.Request) {
+	csh.changeShift(w, r, csh.cabService.GoOffline)
+}
+
+func (csh *CabServiceHandler) changeShift(w http.ResponseWriter, r *http.Request, change func(ctx context.Context, cabId string) (*src.Cab, error)) {
+	cab, err := change(r.Context(), r.PathValue("cabId"))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, newCabResponse(cab))
+}
+
+func (csh *CabServiceHandler) addDriverIncentive(w http.ResponseWriter, r *http.Request) {
+	var request incentiveRequest
+	if err := decodeRequest(w, r, &request); err != nil {
+		writeError(w, err)
+		return
+	}
+	if request.Amount == nil {
+		writeError(w, fmt.Errorf("%w: amount is required", errBadRequest))
+		return
+	}
+	entry, err := csh.cabService.AddDriverIncentive(r.Context(), r.PathValue("cabId"), *request.Amount, request.Note)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, newEarningEntryResponse(*entry))
+}
+
+func (csh *CabServiceHandler) getEarningsBalance(w http.ResponseWriter, r *http.Request) {
+	cabId := r.PathValue("cabId")
+	balance, err := csh.cabService.GetEarningsBalance(r.Context(), cabId)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, earningsBalanceResponse{CabId: cabId, Balance: balance})
+}
+
+// getEarningsStatement covers the day or week of the date query parameter, or
+// the current one when it is left out.
+func (csh *CabServiceHandler) getEarningsStatement(w http.ResponseWriter, r *http.Request) {
+	period, err := src.ParseStatementPeriod(r.PathValue("period"))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	at := time.Now()
+	if date := r.URL.Query().Get("date"); date != "" {
+		if at, err = time.ParseInLocation(time.DateOnly, date, time.Local); err != nil {
+			writeError(w, fmt.Errorf("%w: date must look like %s", errBadRequest, time.DateOnly))
+			return
+		}
+	}
+	statement, err := csh.cabService.GetEarningsStatement(r.Context(), r.PathValue("cabId"), period, at)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, newStatementResponse(statement))
+}
+
+func (csh *CabServiceHandler) createPayoutBatch(w http.ResponseWriter, r *http.Request) {
+	batch, err := csh.cabService.CreatePayoutBatch(r.Context())
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, newPayoutBatchResponse(batch))
+}
+
+func (csh *CabServiceHandler) getPayoutBatch(w http.ResponseWriter, r *http.Request) {
+	batch, err := csh.cabService.GetPayoutBatch(r.Context(), r.PathValue("batchId"))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, newPayoutBatchResponse(batch))
+}
+
+func (csh *CabServiceHandler) exportPayoutBatch(w http.ResponseWriter, r *http.Request) {
+	batch, err := csh.cabService.GetPayoutBatch(r.Context(), r.PathValue("batchId"))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "text/csv")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", "payout-"+batch.Id+".csv"))
+	if err := batch.WriteCSV(w); err != nil {
+		log.Printf("api: writing payout batch %s: %v", batch.Id, err)
+	}
+}
+
+func (csh *CabServiceHandler) bookRide(w http.ResponseWriter, r *http.Request) {
+	var request bookRideRequest
+	if err := decodeRequest(w, r, &request); err != nil {
+		writeError(w, err)
+		return
+	}
+	if request.UserId == "" {
+		writeError(w, fmt.Errorf("%w: userId is required", errBadRequest))
+		return
+	}
+	startLat, startLon, err := request.Pickup.coordinates("pickup")
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	endLat, endLon, err := request.Drop.coordinates("drop")
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	options, err := request.bookingOptions()
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	var ride *src.Ride
+	switch {
+	case request.PickupAt != nil:
+		ride, err = csh.cabService.ScheduleRide(r.Context(), request.UserId, startLat, startLon, endLat, endLon, *request.PickupAt, options...)
+	case request.WaitForCab:
+		// Dispatch can take longer than the server write timeout allows, and a
+		// rider who hangs up while waiting cancels the ride.
+		http.NewResponseController(w).SetWriteDeadline(time.Time{})
+		ride, err = csh.cabService.BookRide(r.Context(), request.UserId, startLat, startLon, endLat, endLon, options...)
+	default:
+		ride, err = csh.cabService.RequestRide(r.Context(), request.UserId, startLat, startLon, endLat, endLon, options...)
+	}
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	w.Header().Set("Location", "/rides/"+ride.GetId())
+	writeJSON(w, http.StatusCreated, newRideResponse(ride))
+}
+
+func (csh *CabServiceHandler) quoteFares(w http.ResponseWriter, r *http.Request) {
+	var request fareQuoteRequest
+	if err := decodeRequest(w, r, &request); err != nil {
+		writeError(w, err)
+		return
+	}
+	startLat, startLon, err := request.Pickup.coordinates("pickup")
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	endLat, endLon, err := request.Drop.coordinates("drop")
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	quotes, err := csh.cabService.QuoteFares(r.Context(), startLat, startLon, endLat, endLon)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, newFareQuoteResponses(quotes))
+}
+
+func (csh *CabServiceHandler) getRide(w http.ResponseWriter, r *http.Request) {
+	ride, err := csh.cabService.GetRide(r.Context(), r.PathValue("rideId"))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, newRideResponse(ride))
+}
+
+func (csh *CabServiceHandler) updateRideStatus(w http.ResponseWriter, r *http.Request) {
+	var request rideStatusRequest
+	if err := decodeRequest(w, r, &request); err != nil {
+		writeError(w, err)
+		return
+	}
+	status, err := src.ParseRideStatus(request.Status)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	ride, err := csh.cabService.UpdateRideStatus(r.Context(), r.PathValue("rideId"), status)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, newRideResponse(ride))
+}
+
+func (csh *CabServiceHandler) cancelRide(w http.ResponseWriter, r *http.Request) {
+	var request cancelRideRequest
+	if err := decodeRequest(w, r, &request); err != nil {
+		writeError(w, err)
+		return
+	}
+	if request.CancelledBy == "" {
+		writeError(w, fmt.Errorf("%w: cancelledBy is required", errBadRequest))
+		return
+	}
+	cancelledBy, err := src.ParseCancellationActor(request.CancelledBy)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	reason := src.OtherReason
+	if request.Reason != "" {
+		if reason, err = src.ParseCancellationReason(request.Reason); err != nil {
+			writeError(w, err)
+			return
+		}
+	}
+	ride, err := csh.cabService.CancelRide(r.Context(), r.PathValue("rideId"), cancelledBy, reason)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, newRideResponse(ride))
+}
+
+func (csh *CabServiceHandler) rescheduleRide(w http.ResponseWriter, r *http.Request) {
+	var request rescheduleRequest
+	if err := decodeRequest(w, r, &request); err != nil {
+		writeError(w, err)
+		return
+	}
+	if request.PickupAt == nil {
+		writeError(w, fmt.Errorf("%w: pickupAt is required", errBadRequest))
+		return
+	}
+	ride, err := csh.cabService.RescheduleRide(r.Context(), r.PathValue("rideId"), *request.PickupAt)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, newRideResponse(ride))
+}
+
+func (csh *CabServiceHandler) addStop(w http.ResponseWriter, r *http.Request) {
+	var request addStopRequest
+	if err := decodeRequest(w, r, &request); err != nil {
+		writeError(w, err)
+		return
+	}
+	lat, lon, err := request.Location.coordinates("location")
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	rideId := r.PathValue("rideId")
+	index := 0
+	if request.Index != nil {
+		index = *request.Index
+	} else {
+		ride, err := csh.cabService.GetRide(r.Context(), rideId)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		index = len(ride.GetStops())
+	}
+	ride, err := csh.cabService.AddStop(r.Context(), rideId, index, lat, lon)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, newRideResponse(ride))
+}
+
+func (csh *CabServiceHandler) removeStop(w http.ResponseWriter, r *http.Request) {
+	csh.changeStop(w, r, csh.cabService.RemoveStop)
+}
+
+func (csh *CabServiceHandler) arriveAtStop(w http.ResponseWriter, r *http.Request) {
+	csh.changeStop(w, r, csh.cabService.ArriveAtStop)
+}
+
+func (csh *CabServiceHandler) departStop(w http.ResponseWriter, r *http.Request) {
+	csh.changeStop(w, r, csh.cabService.DepartStop)
+}
+
+func (csh *CabServiceHandler) changeStop(w http.ResponseWriter, r *http.Request, change func(ctx context.Context, rideId string, index int) (*src.Ride, error)) {
+	index, err := strconv.Atoi(r.PathValue("index"))
+	if err != nil {
+		writeError(w, fmt.Errorf("%w: stop index must be a number", errBadRequest))
+		return
+	}
+	ride, err := change(r.Context(), r.PathValue("rideId"), index)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, newRideResponse(ride))
+}
+
+func (csh *CabServiceHandler) getRideTimeline(w http.ResponseWriter, r *http.Request) {
+	timeline, err := csh.cabService.GetRideTimeline(r.Context(), r.PathValue("rideId"))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, newTimelineResponse(timeline))
+}
+
+func (csh *CabServiceHandler) getPoolTrip(w http.ResponseWriter, r *http.Request) {
+	trip, err := csh.cabService.GetPoolTrip(r.Context(), r.PathValue("rideId"))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, newPoolTripResponse(trip))
+}
+
+func (csh *CabServiceHandler) rateDriver(w http.ResponseWriter, r *http.Request) {
+	var request rateRideRequest
+	if err := decodeRequest(w, r, &request); err != nil {
+		writeError(w, err)
+		return
+	}
+	if request.UserId == "" {
+		writeError(w, fmt.Errorf("%w: userId is required", errBadRequest))
+		return
+	}
+	csh.rate(w, r, request, request.UserId, csh.cabService.RateDriver)
+}
+
+func (csh *CabServiceHandler) rateRider(w http.ResponseWriter, r *http.Request) {
+	var request rateRideRequest
+	if err := decodeRequest(w, r, &request); err != nil {
+		writeError(w, err)
+		return
+	}
+	if request.CabId == "" {
+		writeError(w, fmt.Errorf("%w: cabId is required", errBadRequest))
+		return
+	}
+	csh.rate(w, r, request, request.CabId, csh.cabService.RateRider)
+}
+
+func (csh *CabServiceHandler) rate(w http.ResponseWriter, r *http.Request, request rateRideRequest, raterId string, rate func(ctx context.Context, rideId, raterId string, stars int, tags []string) (*src.Rating, error)) {
+	if request.Stars == nil {
+		writeError(w, fmt.Errorf("%w: stars is required", errBadRequest))
+		return
+	}
+	rating, err := rate(r.Context(), r.PathValue("rideId"), raterId, *request.Stars, request.Tags)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, newRatingResponse(*rating))
+}
+
+func (csh *CabServiceHandler) getRideRatings(w http.ResponseWriter, r *http.Request) {
+	ratings, err := csh.cabService.GetRideRatings(r.Context(), r.PathValue("rideId"))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	responses := make([]ratingResponse, 0, len(ratings))
+	for _, rating := range ratings {
+		responses = append(responses, newRatingResponse(rating))
+	}
+	writeJSON(w, http.StatusOK, responses)
+}
+
+func (csh *CabServiceHandler) getRidePayment(w http.ResponseWriter, r *http.Request) {
+	payment, err := csh.cabService.GetRidePayment(r.Context(), r.PathValue("rideId"))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, newPaymentResponse(payment))
+}
+
+func (csh *CabServiceHandler) refundRide(w http.ResponseWriter, r *http.Request) {
+	var request refundRequest
+	if err := decodeRequest(w, r, &request); err != nil {
+		writeError(w, err)
+		return
+	}
+	payment, err := csh.cabService.RefundRide(r.Context(), r.PathValue("rideId"), request.Amount, request.Reason)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, newPaymentResponse(payment))
+}
+
+func (csh *CabServiceHandler) getRideOffer(w http.ResponseWriter, r *http.Request) {
+	offer, err := csh.cabService.GetRideOffer(r.Context(), r.PathValue("rideId"))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, newOfferResponse(offer))
+}
+
+func (csh *CabServiceHandler) acceptRide(w http.ResponseWriter, r *http.Request) {
+	csh.replyToOffer(w, r, csh.cabService.AcceptRide)
+}
+
+func (csh *CabServiceHandler) rejectRide(w http.ResponseWriter, r *http.Request) {
+	csh.replyToOffer(w, r, csh.cabService.RejectRide)
+}
+
+func (csh *CabServiceHandler) replyToOffer(w http.ResponseWriter, r *http.Request, reply func(ctx context.Context, rideId, cabId string) error) {
+	var request offerReplyRequest
+	if err := decodeRequest(w, r, &request); err != nil {
+		writeError(w, err)
+		return
+	}
+	if request.CabId == "" {
+		writeError(w, fmt.Errorf("%w: cabId is required", errBadRequest))
+		return
+	}
+	if err := reply(r.Context(), r.PathValue("rideId"), request.CabId); err != nil {
+		writeError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func (csh *CabServiceHandler) getPendingRide(w http.ResponseWriter, r *http.Request) {
+	pendingRide, err := csh.cabService.GetPendingRide(r.Context(), r.PathValue("rideId"))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, newPendingRideResponse(pendingRide))
+}
+
+func (csh *CabServiceHandler) getPendingQueueStats(w http.ResponseWriter, r *http.Request) {
+	stats, err := csh.cabService.GetPendingQueueStats(r.Context())
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, newPendingQueueStatsResponse(stats))
+}
+
+func (csh *CabServiceHandler) getZoneQueue(w http.ResponseWriter, r *http.Request) {
+	queue, err := csh.cabService.GetZoneQueue(r.Context(), r.PathValue("zoneId"))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, newQueuedCabResponses(queue))
+}
+
+func decodeRequest(w http.ResponseWriter, r *http.Request, request any) error {
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxRequestBodyBytes))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(request); err != nil {
+		return fmt.Errorf("%w: %v", errBadRequest, err)
+	}
+	return nil
+}
+
+// statusCodeFor maps service errors to the HTTP status the client should see.
+func statusCodeFor(err error) int {
+	switch {
+	case errors.Is(err, errBadRequest), errors.Is(err, src.ErrInvalidCoordinates), errors.Is(err, src.ErrUnknownRideStatus),
+		errors.Is(err, src.ErrInvalidPickupTime), errors.Is(err, src.ErrUnknownRideType), errors.Is(err, src.ErrInvalidSeats),
+		errors.Is(err, src.ErrUnknownVehicleCategory), errors.Is(err, src.ErrInvalidRating), errors.Is(err, src.ErrInvalidName),
+		errors.Is(err, src.ErrUnknownCancellationActor), errors.Is(err, src.ErrUnknownCancellationReason), errors.Is(err, src.ErrReasonNotAllowed),
+		errors.Is(err, src.ErrUnknownPaymentMethodType), errors.Is(err, src.ErrPaymentMethodNotAllowed), errors.Is(err, src.ErrInvalidCard),
+		errors.Is(err, src.ErrInvalidAmount), errors.Is(err, src.ErrMissingRefundReason),
+		errors.Is(err, src.ErrUnknownPromotionKind), errors.Is(err, src.ErrInvalidPromotion), errors.Is(err, src.ErrPromoNotActive),
+		errors.Is(err, src.ErrPromoNotApplicable), errors.Is(err, src.ErrUnknownStatementPeriod),
+		errors.Is(err, src.ErrOutsideServiceArea), errors.Is(err, src.ErrInvalidRideQuery), errors.Is(err, src.ErrInvalidCursor),
+		errors.Is(err, src.ErrInvalidStop):
+		return http.StatusBadRequest
+	case errors.Is(err, src.ErrOutstandingDues), errors.Is(err, src.ErrCardDeclined), errors.Is(err, src.ErrInsufficientWalletBalance):
+		return http.StatusPaymentRequired
+	case errors.Is(err, src.ErrNotRideParticipant):
+		return http.StatusForbidden
+	case errors.Is(err, src.ErrUserNotFound), errors.Is(err, src.ErrRideNotFound), errors.Is(err, src.ErrCabNotFound),
+		errors.Is(err, src.ErrNoOfferForRide), errors.Is(err, src.ErrRideNotPending), errors.Is(err, src.ErrNotInPool),
+		errors.Is(err, src.ErrPaymentMethodNotFound), errors.Is(err, src.ErrPaymentNotFound), errors.Is(err, src.ErrPromoNotFound),
+		errors.Is(err, src.ErrRedemptionNotFound), errors.Is(err, src.ErrPayoutBatchNotFound),
+		errors.Is(err, src.ErrZoneNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, src.ErrInvalidTransition), errors.Is(err, src.ErrCabNotAvailable), errors.Is(err, src.ErrCabNotAssigned),
+		errors.Is(err, src.ErrNoPendingOffer), errors.Is(err, src.ErrOfferNotForCab), errors.Is(err, src.ErrRideNotScheduled),
+		errors.Is(err, src.ErrRideNotCompleted), errors.Is(err, src.ErrRatingWindowClosed), errors.Is(err, src.ErrAlreadyRated),
+		errors.Is(err, src.ErrRefundNotAllowed), errors.Is(err, src.ErrAlreadyCharged), errors.Is(err, src.ErrPromoCodeTaken),
+		errors.Is(err, src.ErrPromoLimitReached), errors.Is(err, src.ErrCabOnRide), errors.Is(err, src.ErrInvalidShiftChange),
+		errors.Is(err, src.ErrNothingToPayOut), errors.Is(err, src.ErrStopsLocked), errors.Is(err, src.ErrStopOutOfOrder),
+		errors.Is(err, src.ErrRideCanceled):
+		return http.StatusConflict
+	case errors.Is(err, src.ErrNoCabAvailable):
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusInternalServerError
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	statusCode := statusCodeFor(err)
+	message := err.Error()
+	if statusCode == http.StatusInternalServerError {
+		log.Printf("api: %v", err)
+		message = http.StatusText(statusCode)
+	}
+	writeJSON(w, statusCode, errorResponse{Error: message})
+}
+
+func writeJSON(w http.ResponseWriter, statusCode int, body any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		log.Printf("api: writing response: %v", err)
+	}
+}
@@ -0,0 +1,664 @@
+package api
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"cab_booking.com/src"
+)
+
+// testRateCard prices every category alike, with a charge for each stop and
+// for the wait at it.
+var testRateCard = src.FareRateCard{BaseFare: 50, PerKm: 12, PerMinute: 2, WaitingPerMinute: 2, FreeWaitingTime: 3 * time.Minute,
+	PerStop: 25, FreeStopWaitingTime: 3 * time.Minute, AverageSpeedKmph: 25}
+
+// testZones keeps bookings inside Bengaluru and queues cabs at the airport.
+const testZones = `{
+	"serviceAreas": [
+		{"id": "bengaluru", "vertices": [{"lat": 12.80, "lon": 77.40}, {"lat": 12.80, "lon": 77.85}, {"lat": 13.30, "lon": 77.85}, {"lat": 13.30, "lon": 77.40}]}
+	],
+	"specialZones": [
+		{"id": "airport", "vertices": [{"lat": 13.18, "lon": 77.69}, {"lat": 13.18, "lon": 77.72}, {"lat": 13.21, "lon": 77.72}, {"lat": 13.21, "lon": 77.69}],
+			"pickupSurcharge": 120, "dropSurcharge": 80, "queued": true}
+	]
+}`
+
+var (
+	koramangala = point{Lat: 12.9352, Lon: 77.6245}
+	mgRoad      = point{Lat: 12.9716, Lon: 77.5946}
+)
+
+// newTestServer serves an in-memory cab service that pays cash unless the
+// rider stores a card, charges no cancellation fees and rewards referrals.
+func newTestServer(t *testing.T, clock src.Clock, heartbeatInterval time.Duration) (src.CabService, *httptest.Server) {
+	t.Helper()
+	zonePolicy, err := src.ReadZonePolicy(strings.NewReader(testZones))
+	if err != nil {
+		t.Fatalf("reading zones: %v", err)
+	}
+	idGenerationStrategy := src.NewIdGenerationUsingUUID()
+	distanceCalculator := src.NewHaversineDistanceCalculator()
+	userRepo := src.NewUserRepository(idGenerationStrategy)
+	cabRepo := src.NewCabRepository(idGenerationStrategy, src.NewGridGeoIndex(0.01, distanceCalculator))
+	rideRepo := src.NewRideRepository(idGenerationStrategy, src.NewGridGeoIndex(0.01, distanceCalculator), clock)
+	promotionRepo := src.NewPromotionRepository()
+	eventBus := src.NewInMemoryEventBus(256)
+	zoneManager := src.NewQueueingZoneManager(cabRepo, eventBus, clock, zonePolicy)
+	poolManager := src.NewInMemoryPoolManager(cabRepo, idGenerationStrategy, distanceCalculator, src.PoolPolicy{Capacity: 3})
+	pricingStrategy := src.NewPromotionPricingStrategy(src.NewZoneSurchargePricingStrategy(src.NewMeteredPricingStrategy(testRateCard, distanceCalculator), zoneManager), promotionRepo)
+	cabFindingStrategy := src.NewZoneQueueCabFindingStrategy(src.NewNearestAvailableCarFindingStrategy(cabRepo, distanceCalculator, 0), zoneManager)
+	rideDispatcher := src.NewOfferDispatcher(cabRepo, rideRepo, cabFindingStrategy, src.NewInMemoryPendingRideQueue(time.Minute, 100*time.Millisecond, 400*time.Millisecond),
+		poolManager, eventBus, clock, time.Second, 3)
+	ratingManager := src.NewPostRideRatingManager(src.NewRatingRepository(), userRepo, cabRepo, rideRepo, eventBus, clock, src.RatingPolicy{
+		SubmissionWindow: 24 * time.Hour,
+		RollingWindow:    50,
+		MaxTags:          5,
+	})
+	cancellationManager := src.NewPolicyCancellationManager(cabRepo, distanceCalculator, eventBus, clock, src.CancellationPolicy{
+		FreeWindow:                time.Hour,
+		FreeDistanceKm:            100,
+		MaxDriverCancellationRate: 1,
+	})
+	paymentProcessor := src.NewLedgerPaymentProcessor(src.NewPaymentRepository(), src.NewLedgerRepository(), userRepo, src.NewFakePaymentGateway(), idGenerationStrategy, eventBus, clock)
+	promotionManager := src.NewReservingPromotionManager(promotionRepo, userRepo, rideRepo, paymentProcessor, src.NewGridZoneResolver(0.05), idGenerationStrategy, eventBus, clock,
+		src.PromotionPolicy{ReferralDiscount: 40, ReferralReward: 60})
+	driverManager := src.NewLedgerDriverManager(src.NewEarningsRepository(), cabRepo, rideRepo, idGenerationStrategy, eventBus, clock, src.EarningsPolicy{CommissionPercent: 25})
+	cabService := src.NewInMemoryCabService(userRepo, cabRepo, rideRepo, idGenerationStrategy, pricingStrategy, rideDispatcher, poolManager,
+		ratingManager, cancellationManager, paymentProcessor, promotionManager, driverManager, zoneManager, eventBus, clock)
+	server := httptest.NewServer(NewCabServiceHandler(src.NewCabServiceV2(cabService), heartbeatInterval))
+	t.Cleanup(func() {
+		server.Close()
+		cabService.Close()
+	})
+	return cabService, server
+}
+
+// call sends body as JSON, decodes the reply into response when it is not nil
+// and returns the status code.
+func call(t *testing.T, method, url string, body any, response any) int {
+	t.Helper()
+	var payload bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&payload).Encode(body); err != nil {
+			t.Fatalf("encoding %s %s: %v", method, url, err)
+		}
+	}
+	request, err := http.NewRequest(method, url, &payload)
+	if err != nil {
+		t.Fatalf("%s %s: %v", method, url, err)
+	}
+	request.Header.Set("Content-Type", "application/json")
+	reply, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatalf("%s %s: %v", method, url, err)
+	}
+	defer reply.Body.Close()
+	if response != nil {
+		if err := json.NewDecoder(reply.Body).Decode(response); err != nil {
+			t.Fatalf("decoding %s %s: %v", method, url, err)
+		}
+	}
+	return reply.StatusCode
+}
+
+func expectStatus(t *testing.T, what string, got, want int) {
+	t.Helper()
+	if got != want {
+		t.Fatalf("%s: got status %d, want %d", what, got, want)
+	}
+}
+
+// eventually polls until done reports true or a couple of seconds pass.
+func eventually(t *testing.T, what string, done func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(2 * time.Second); !done(); {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func registerUser(t *testing.T, cabService src.CabService, name string) *src.User {
+	t.Helper()
+	user, err := cabService.RegisterUser(name)
+	if err != nil {
+		t.Fatalf("registering %s: %v", name, err)
+	}
+	return user
+}
+
+func registerCab(t *testing.T, cabService src.CabService, name string, category src.VehicleCategory) *src.Cab {
+	t.Helper()
+	cab, err := cabService.RegisterCab(name, category)
+	if err != nil {
+		t.Fatalf("registering cab %s: %v", name, err)
+	}
+	return cab
+}
+
+// confirmRide plays the driver accepting the first offer for the ride and
+// waits for the cab to be assigned.
+func confirmRide(t *testing.T, cabService src.CabService, rideId string) string {
+	t.Helper()
+	var offer *src.RideOffer
+	eventually(t, "an offer for ride "+rideId, func() bool {
+		var err error
+		offer, err = cabService.GetRideOffer(rideId)
+		return err == nil && offer.GetStatus() == src.OfferPending
+	})
+	if err := cabService.AcceptRide(rideId, offer.GetCabId()); err != nil {
+		t.Fatalf("accepting ride %s: %v", rideId, err)
+	}
+	eventually(t, "ride "+rideId+" to be confirmed", func() bool {
+		status, err := cabService.GetRideStatus(rideId)
+		return err == nil && status == src.Confirmed
+	})
+	return offer.GetCabId()
+}
+
+// completeRide books a ride from Koramangala to MG Road and drives it to the
+// end.
+func completeRide(t *testing.T, cabService src.CabService, userId string, options ...src.BookingOption) *src.Ride {
+	t.Helper()
+	ride, err := cabService.BookRide(userId, koramangala.Lat, koramangala.Lon, mgRoad.Lat, mgRoad.Lon, options...)
+	if err != nil {
+		t.Fatalf("booking a ride: %v", err)
+	}
+	cabId := confirmRide(t, cabService, ride.GetId())
+	if _, err := cabService.UpdateRideStatus(ride.GetId(), src.PickedUp); err != nil {
+		t.Fatalf("picking up ride %s: %v", ride.GetId(), err)
+	}
+	if ride, err = cabService.UpdateRideStatus(ride.GetId(), src.Completed); err != nil {
+		t.Fatalf("completing ride %s: %v", ride.GetId(), err)
+	}
+	cabService.UpdateCabLocation(cabId, koramangala.Lat, koramangala.Lon)
+	return ride
+}
+
+func TestRejectedRequests(t *testing.T) {
+	cabService, server := newTestServer(t, src.NewSystemClock(), time.Second)
+	rider := registerUser(t, cabService, "Priya")
+	cab := registerCab(t, cabService, "Innova", src.SUV)
+	cabService.UpdateCabLocation(cab.GetId(), koramangala.Lat, koramangala.Lon)
+	userURL, cabURL := server.URL+"/users/"+rider.GetId(), server.URL+"/cabs/"+cab.GetId()
+
+	tests := []struct {
+		name   string
+		method string
+		url    string
+		body   any
+		want   int
+	}{
+		{"an out of range location", "PUT", cabURL + "/location", point{95, 77.62}, http.StatusBadRequest},
+		{"a booking without a drop", "POST", server.URL + "/rides", map[string]any{"userId": rider.GetId(), "pickup": koramangala}, http.StatusBadRequest},
+		{"a booking for an unknown rider", "POST", server.URL + "/rides", map[string]any{"userId": "nobody", "pickup": koramangala, "drop": mgRoad}, http.StatusNotFound},
+		{"a booking outside the service area", "POST", server.URL + "/rides", map[string]any{"userId": rider.GetId(), "pickup": point{12.2958, 76.6394}, "drop": mgRoad}, http.StatusBadRequest},
+		{"an unknown ride", "GET", server.URL + "/rides/nothing", nil, http.StatusNotFound},
+		{"an invalid card", "POST", userURL + "/payment-methods", map[string]any{"type": "Card", "cardNumber": "1234 5678 9012 3456"}, http.StatusBadRequest},
+		{"an unknown promotion kind", "POST", server.URL + "/promotions", map[string]any{"code": "BOGUS", "kind": "Cashback", "value": 10}, http.StatusBadRequest},
+		{"an unknown promotion", "GET", server.URL + "/promotions/NOSUCHCODE", nil, http.StatusNotFound},
+		{"an unknown cab going online", "POST", server.URL + "/cabs/missing/online", nil, http.StatusNotFound},
+		{"an unknown statement period", "GET", cabURL + "/statements/Monthly", nil, http.StatusBadRequest},
+		{"a malformed statement date", "GET", cabURL + "/statements/Daily?date=04-03-2026", nil, http.StatusBadRequest},
+		{"an incentive without an amount", "POST", cabURL + "/incentives", map[string]any{"note": "Festival"}, http.StatusBadRequest},
+		{"a payout batch with nothing owed", "POST", server.URL + "/payout-batches", nil, http.StatusConflict},
+		{"an unknown payout batch", "GET", server.URL + "/payout-batches/missing", nil, http.StatusNotFound},
+		{"the queue of a zone that does not exist", "GET", server.URL + "/zones/nowhere/queue", nil, http.StatusNotFound},
+		{"an unknown ride status filter", "GET", userURL + "/rides?status=Lost", nil, http.StatusBadRequest},
+		{"a bad cursor", "GET", userURL + "/rides?cursor=nope", nil, http.StatusBadRequest},
+		{"a page too large", "GET", userURL + "/rides?limit=1000", nil, http.StatusBadRequest},
+		{"the rides of an unknown cab", "GET", server.URL + "/cabs/nobody/rides", nil, http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			expectStatus(t, tt.name, call(t, tt.method, tt.url, tt.body, nil), tt.want)
+		})
+	}
+}
+
+func TestBookingToCompletion(t *testing.T) {
+	_, server := newTestServer(t, src.NewSystemClock(), time.Second)
+
+	var rider userResponse
+	var cab cabResponse
+	expectStatus(t, "registering a rider", call(t, "POST", server.URL+"/users", map[string]string{"name": "Priya"}, &rider), http.StatusCreated)
+	expectStatus(t, "registering a cab", call(t, "POST", server.URL+"/cabs", map[string]string{"name": "Innova", "category": "SUV"}, &cab), http.StatusCreated)
+	expectStatus(t, "pushing the cab location", call(t, "PUT", server.URL+"/cabs/"+cab.Id+"/location", point{12.9300, 77.6200}, nil), http.StatusNoContent)
+
+	var ride rideResponse
+	bookRide := map[string]any{"userId": rider.Id, "pickup": koramangala, "drop": mgRoad}
+	expectStatus(t, "booking a ride", call(t, "POST", server.URL+"/rides", bookRide, &ride), http.StatusCreated)
+
+	// The driver app polls for the offer and accepts it, the rider app polls until the cab is assigned
+	var offer offerResponse
+	eventually(t, "the ride to be offered", func() bool {
+		call(t, "GET", server.URL+"/rides/"+ride.Id+"/offer", nil, &offer)
+		return offer.Status == "Pending"
+	})
+	expectStatus(t, "accepting the offer", call(t, "POST", server.URL+"/rides/"+ride.Id+"/offer/accept", map[string]string{"cabId": offer.CabId}, nil), http.StatusAccepted)
+	eventually(t, "the ride to be confirmed", func() bool {
+		call(t, "GET", server.URL+"/rides/"+ride.Id, nil, &ride)
+		return ride.Status == "Confirmed"
+	})
+	if ride.CabId != offer.CabId {
+		t.Fatalf("got cab %s on the ride, want %s", ride.CabId, offer.CabId)
+	}
+
+	statusURL := server.URL + "/rides/" + ride.Id + "/status"
+	expectStatus(t, "completing before pickup", call(t, "PUT", statusURL, map[string]string{"status": "Completed"}, nil), http.StatusConflict)
+	expectStatus(t, "an unknown status", call(t, "PUT", statusURL, map[string]string{"status": "Teleported"}, nil), http.StatusBadRequest)
+	expectStatus(t, "picking up the rider", call(t, "PUT", statusURL, map[string]string{"status": "PickedUp"}, nil), http.StatusOK)
+	var completed rideResponse
+	expectStatus(t, "completing the ride", call(t, "PUT", statusURL, map[string]string{"status": "Completed"}, &completed), http.StatusOK)
+	if completed.Status != "Completed" || completed.FinalFare == nil || !completed.FinalFare.IsFinal {
+		t.Fatalf("got %+v, want the completed ride with its final fare", completed)
+	}
+
+	var timeline []transitionResponse
+	var rides ridePageResponse
+	expectStatus(t, "fetching the timeline", call(t, "GET", server.URL+"/rides/"+ride.Id+"/timeline", nil, &timeline), http.StatusOK)
+	expectStatus(t, "listing the rider's rides", call(t, "GET", server.URL+"/users/"+rider.Id+"/rides", nil, &rides), http.StatusOK)
+	if len(timeline) != 3 || len(rides.Rides) != 1 || rides.Rides[0].Status != "Completed" {
+		t.Fatalf("got %v and %v, want 3 transitions and 1 completed ride", timeline, rides.Rides)
+	}
+
+	// Both sides rate the ride once
+	ratingURL := server.URL + "/rides/" + ride.Id + "/rating/"
+	rateDriver := map[string]any{"userId": rider.Id, "stars": 5, "tags": []string{"Smooth driving"}}
+	expectStatus(t, "rating the driver", call(t, "POST", ratingURL+"driver", rateDriver, nil), http.StatusCreated)
+	expectStatus(t, "rating the driver twice", call(t, "POST", ratingURL+"driver", rateDriver, nil), http.StatusConflict)
+	expectStatus(t, "rating someone else's driver", call(t, "POST", ratingURL+"rider", map[string]any{"cabId": "stranger", "stars": 4}, nil), http.StatusForbidden)
+	expectStatus(t, "rating without stars", call(t, "POST", ratingURL+"rider", map[string]any{"cabId": offer.CabId}, nil), http.StatusBadRequest)
+	expectStatus(t, "rating the rider", call(t, "POST", ratingURL+"rider", map[string]any{"cabId": offer.CabId, "stars": 4}, nil), http.StatusCreated)
+	var ratings []ratingResponse
+	var driver cabResponse
+	expectStatus(t, "fetching the ride's ratings", call(t, "GET", server.URL+"/rides/"+ride.Id+"/ratings", nil, &ratings), http.StatusOK)
+	expectStatus(t, "fetching the driver", call(t, "GET", server.URL+"/cabs/"+offer.CabId, nil, &driver), http.StatusOK)
+	if len(ratings) != 2 || driver.RatingCount == 0 {
+		t.Fatalf("got %v and %+v, want both ratings and a rated driver", ratings, driver)
+	}
+
+	// Without a stored method the driver collects cash, and a dispute refunds part of it to the wallet
+	var payment paymentResponse
+	refundURL := server.URL + "/rides/" + ride.Id + "/refund"
+	expectStatus(t, "fetching the ride's payment", call(t, "GET", server.URL+"/rides/"+ride.Id+"/payment", nil, &payment), http.StatusOK)
+	if payment.Method != "Cash" || payment.Status != "Succeeded" || payment.Amount != completed.FinalFare.Total {
+		t.Fatalf("got %+v, want the final fare paid in cash", payment)
+	}
+	expectStatus(t, "refunding without a reason", call(t, "POST", refundURL, map[string]any{"amount": 10}, nil), http.StatusBadRequest)
+	expectStatus(t, "refunding more than was paid", call(t, "POST", refundURL, map[string]any{"amount": payment.Amount + 1, "reason": "Overcharged"}, nil), http.StatusConflict)
+	expectStatus(t, "refunding part of the fare", call(t, "POST", refundURL, map[string]any{"amount": 10, "reason": "Driver took a longer route"}, &payment), http.StatusOK)
+	if payment.Status != "PartiallyRefunded" {
+		t.Fatalf("got %+v, want the payment partly refunded", payment)
+	}
+	var card paymentMethodResponse
+	expectStatus(t, "adding a card", call(t, "POST", server.URL+"/users/"+rider.Id+"/payment-methods", map[string]any{"type": "Card", "cardNumber": "4242 4242 4242 4242"}, &card), http.StatusCreated)
+	if !card.Default || card.Label != "Card ending 4242" {
+		t.Fatalf("got %+v, want the first card to become the default", card)
+	}
+	var balance balanceResponse
+	var ledger []ledgerEntryResponse
+	expectStatus(t, "topping up the wallet", call(t, "POST", server.URL+"/users/"+rider.Id+"/wallet/top-up", map[string]any{"paymentMethodId": card.Id, "amount": 100}, &balance), http.StatusOK)
+	expectStatus(t, "fetching the ledger", call(t, "GET", server.URL+"/users/"+rider.Id+"/ledger", nil, &ledger), http.StatusOK)
+	if balance.WalletBalance != 110 || balance.OutstandingDues != 0 || len(ledger) != 3 || ledger[1].Kind != "RideRefund" {
+		t.Fatalf("got %+v and %v, want the refund and the top-up in the wallet", balance, ledger)
+	}
+
+	// A rider who changes their mind before a cab is found cancels for free
+	var cancelled rideResponse
+	expectStatus(t, "booking a ride to cancel", call(t, "POST", server.URL+"/rides", bookRide, &ride), http.StatusCreated)
+	cancelURL := server.URL + "/rides/" + ride.Id + "/cancel"
+	expectStatus(t, "cancelling for a reason only drivers give", call(t, "POST", cancelURL, map[string]string{"cancelledBy": "Rider", "reason": "RiderNoShow"}, nil), http.StatusBadRequest)
+	expectStatus(t, "cancelling the ride", call(t, "POST", cancelURL, map[string]string{"cancelledBy": "Rider", "reason": "ChangeOfPlans"}, &cancelled), http.StatusOK)
+	if cancelled.Status != "Canceled" || cancelled.Cancellation == nil || cancelled.Cancellation.Reason != "ChangeOfPlans" || cancelled.Cancellation.Fee != 0 {
+		t.Fatalf("got %+v, want a free cancellation with its reason", cancelled)
+	}
+}
+
+func TestBookingThatWaitsForCab(t *testing.T) {
+	cabService, server := newTestServer(t, src.NewSystemClock(), time.Second)
+	rider := registerUser(t, cabService, "Kavya")
+	cab := registerCab(t, cabService, "Dzire", src.Sedan)
+	cabService.UpdateCabLocation(cab.GetId(), koramangala.Lat, koramangala.Lon)
+	// book posts in the background, since the reply only comes once dispatch is over
+	book := func(ctx context.Context) <-chan *http.Response {
+		body, _ := json.Marshal(map[string]any{"userId": rider.GetId(), "pickup": koramangala, "drop": mgRoad, "waitForCab": true})
+		request, _ := http.NewRequestWithContext(ctx, "POST", server.URL+"/rides", bytes.NewReader(body))
+		replies := make(chan *http.Response, 1)
+		go func() {
+			reply, _ := http.DefaultClient.Do(request)
+			replies <- reply
+		}()
+		return replies
+	}
+	var latest src.Ride
+	newRideOffered := func(previousId string) func() bool {
+		return func() bool {
+			page, err := cabService.QueryRides(src.RideQuery{UserId: rider.GetId(), Order: src.NewestFirst, Limit: 1})
+			if err != nil || len(page.Rides) == 0 || page.Rides[0].GetId() == previousId {
+				return false
+			}
+			latest = page.Rides[0]
+			offer, err := cabService.GetRideOffer(latest.GetId())
+			return err == nil && offer.GetStatus() == src.OfferPending
+		}
+	}
+
+	// The reply comes once the driver accepts
+	replies := book(context.Background())
+	eventually(t, "the ride to be offered", newRideOffered(""))
+	confirmed := latest
+	cabService.AcceptRide(confirmed.GetId(), cab.GetId())
+	reply := <-replies
+	if reply == nil {
+		t.Fatalf("got no reply to the booking")
+	}
+	defer reply.Body.Close()
+	var ride rideResponse
+	if err := json.NewDecoder(reply.Body).Decode(&ride); err != nil || reply.StatusCode != http.StatusCreated || ride.Status != "Confirmed" || ride.CabId != cab.GetId() {
+		t.Fatalf("got %d and %+v, %v, want the ride confirmed with the cab", reply.StatusCode, ride, err)
+	}
+	cabService.CancelRide(confirmed.GetId(), src.CancelledByRider, src.ChangeOfPlans)
+
+	// A rider who hangs up while waiting cancels the ride and withdraws its offer
+	ctx, hangUp := context.WithCancel(context.Background())
+	replies = book(ctx)
+	eventually(t, "the second ride to be offered", newRideOffered(confirmed.GetId()))
+	hangUp()
+	<-replies
+	eventually(t, "the abandoned ride to be cancelled", func() bool {
+		status, err := cabService.GetRideStatus(latest.GetId())
+		return err == nil && status == src.Canceled
+	})
+	if offer, err := cabService.GetRideOffer(latest.GetId()); err != nil || offer.GetStatus() != src.OfferWithdrawn {
+		t.Fatalf("got %v, %v, want the offer withdrawn", offer, err)
+	}
+}
+
+// readEventStream collects the event names of a Server-Sent Events stream until
+// the server ends it.
+func readEventStream(ctx context.Context, url string, events chan<- string) {
+	defer close(events)
+	request, _ := http.NewRequestWithContext(ctx, "GET", url, nil)
+	reply, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return
+	}
+	defer reply.Body.Close()
+	scanner := bufio.NewScanner(reply.Body)
+	for scanner.Scan() {
+		if name, found := strings.CutPrefix(scanner.Text(), "event: "); found {
+			events <- name
+		}
+	}
+}
+
+func TestRideTracking(t *testing.T) {
+	cabService, server := newTestServer(t, src.NewSystemClock(), 30*time.Millisecond)
+	cab := registerCab(t, cabService, "Swift", src.Hatchback)
+	cabService.UpdateCabLocation(cab.GetId(), 12.9300, 77.6200)
+	bookRide := func(name string) *src.Ride {
+		ride, err := cabService.BookRide(registerUser(t, cabService, name).GetId(), koramangala.Lat, koramangala.Lon, mgRoad.Lat, mgRoad.Lon)
+		if err != nil {
+			t.Fatalf("booking a ride: %v", err)
+		}
+		return ride
+	}
+
+	// A rider opens a stream and walks away, the server must let it go
+	abandonedRide := bookRide("Meera")
+	abandonCtx, abandon := context.WithCancel(context.Background())
+	abandonedEvents := make(chan string, 16)
+	go readEventStream(abandonCtx, server.URL+"/rides/"+abandonedRide.GetId()+"/track", abandonedEvents)
+	if first := <-abandonedEvents; first != "ride" {
+		t.Fatalf("got %s first, want the stream to start with the ride", first)
+	}
+	abandon()
+	cabService.UpdateRideStatus(abandonedRide.GetId(), src.Canceled)
+
+	ride := bookRide("Arjun")
+	events := make(chan string, 64)
+	go readEventStream(context.Background(), server.URL+"/rides/"+ride.GetId()+"/track", events)
+	if first := <-events; first != "ride" {
+		t.Fatalf("got %s first, want the stream to start with the ride", first)
+	}
+	cabId := confirmRide(t, cabService, ride.GetId())
+	cabService.UpdateCabLocation(cabId, 12.9340, 77.6230)
+	time.Sleep(80 * time.Millisecond)
+	cabService.UpdateCabLocation(cabId, 12.9350, 77.6240)
+	cabService.UpdateRideStatus(ride.GetId(), src.PickedUp)
+	cabService.UpdateRideStatus(ride.GetId(), src.Completed)
+
+	var received []string
+	heartbeats := 0
+	timeout := time.After(2 * time.Second)
+	for streaming := true; streaming; {
+		select {
+		case name, open := <-events:
+			if !open {
+				streaming = false
+			} else if name == "heartbeat" {
+				heartbeats++
+			} else {
+				received = append(received, name)
+			}
+		case <-timeout:
+			t.Fatalf("got %v, want the tracking stream to end with the ride", received)
+		}
+	}
+	want := []string{"CabAssigned", "CabLocationUpdated", "CabLocationUpdated", "RidePickedUp", "RideCompleted", "end"}
+	if strings.Join(received, ",") != strings.Join(want, ",") || heartbeats == 0 {
+		t.Fatalf("got %v and %d heartbeats, want %v with heartbeats in between", received, heartbeats, want)
+	}
+}
+
+func TestPromotions(t *testing.T) {
+	cabService, server := newTestServer(t, src.NewSystemClock(), time.Second)
+	cab := registerCab(t, cabService, "Ertiga", src.SUV)
+	cabService.UpdateCabLocation(cab.GetId(), koramangala.Lat, koramangala.Lon)
+
+	var created promotionResponse
+	validUntil := time.Now().Add(24 * time.Hour).Truncate(time.Second)
+	expectStatus(t, "creating a promotion", call(t, "POST", server.URL+"/promotions", map[string]any{"code": "festive", "kind": "Percentage", "value": 15, "maxDiscount": 50, "validUntil": validUntil}, &created), http.StatusCreated)
+	if created.Code != "FESTIVE" || created.Kind != "Percentage" || created.ValidUntil == nil || !created.ValidUntil.Equal(validUntil) {
+		t.Fatalf("got %+v, want the promotion back as created", created)
+	}
+	expectStatus(t, "a code in use", call(t, "POST", server.URL+"/promotions", map[string]any{"code": "FESTIVE", "kind": "Flat", "value": 10}, nil), http.StatusConflict)
+	expectStatus(t, "looking up a promotion", call(t, "GET", server.URL+"/promotions/festive", nil, nil), http.StatusOK)
+
+	// A code with a single use left is turned away once it is taken
+	expectStatus(t, "creating a one off promotion", call(t, "POST", server.URL+"/promotions", map[string]any{"code": "FLASH", "kind": "Flat", "value": 20, "totalLimit": 1}, nil), http.StatusCreated)
+	completeRide(t, cabService, registerUser(t, cabService, "Zoya").GetId(), src.WithPromoCode("FLASH"))
+	bookWithFlash := map[string]any{"userId": registerUser(t, cabService, "Kabir").GetId(), "pickup": koramangala, "drop": mgRoad, "promoCode": "FLASH"}
+	expectStatus(t, "an exhausted code", call(t, "POST", server.URL+"/rides", bookWithFlash, nil), http.StatusConflict)
+
+	// A referred rider's first ride is discounted and shows up in their redemptions
+	referrer := registerUser(t, cabService, "Ira")
+	var referral promotionResponse
+	expectStatus(t, "a referral code", call(t, "GET", server.URL+"/users/"+referrer.GetId()+"/referral-code", nil, &referral), http.StatusOK)
+	if referral.Code == "" || referral.ReferrerId != referrer.GetId() {
+		t.Fatalf("got %+v, want a referral code for %s", referral, referrer.GetId())
+	}
+	friend := registerUser(t, cabService, "Naina")
+	ride := completeRide(t, cabService, friend.GetId(), src.WithPromoCode(strings.ToLower(referral.Code)))
+	var redemptions []promoRedemptionResponse
+	eventually(t, "the referral code to be redeemed", func() bool {
+		expectStatus(t, "a rider's promo redemptions", call(t, "GET", server.URL+"/users/"+friend.GetId()+"/promo-redemptions", nil, &redemptions), http.StatusOK)
+		return len(redemptions) == 1 && redemptions[0].Status == "Redeemed"
+	})
+	if redemptions[0].Code != referral.Code || redemptions[0].RideId != ride.GetId() || redemptions[0].Discount != 40 {
+		t.Fatalf("got %+v, want the referral code redeemed for 40", redemptions)
+	}
+}
+
+func TestDriverShiftsAndPayouts(t *testing.T) {
+	// A Wednesday, so the week started two days before
+	wednesday := time.Date(2026, time.March, 4, 8, 0, 0, 0, time.Local)
+	clock := src.NewManualClock(wednesday)
+	cabService, server := newTestServer(t, clock, time.Second)
+	cab := registerCab(t, cabService, "Ertiga", src.SUV)
+	steady := registerCab(t, cabService, "Dzire", src.Sedan)
+	cabURL := server.URL + "/cabs/" + cab.GetId()
+
+	var shift cabResponse
+	for _, step := range []struct {
+		action, status string
+		then           time.Duration
+	}{{"online", "ReadyToTakeRide", 3 * time.Hour}, {"break", "OnBreak", 15 * time.Minute}, {"offline", "InActive", 0}} {
+		if code := call(t, "POST", cabURL+"/"+step.action, nil, &shift); code != http.StatusOK || shift.Status != step.status {
+			t.Fatalf("going %s: got %d and %s, want the cab %s", step.action, code, shift.Status, step.status)
+		}
+		clock.Advance(step.then)
+	}
+	expectStatus(t, "a break while offline", call(t, "POST", cabURL+"/break", nil, nil), http.StatusConflict)
+	var statement statementResponse
+	expectStatus(t, "a weekly statement", call(t, "GET", cabURL+"/statements/Weekly?date="+wednesday.Format(time.DateOnly), nil, &statement), http.StatusOK)
+	if statement.Period != "Weekly" || statement.OnlineSeconds != int64((3*time.Hour).Seconds()) || statement.BreakSeconds != int64((15*time.Minute).Seconds()) {
+		t.Fatalf("got %+v, want three hours online and a quarter hour break", statement)
+	}
+	// A driver who never changes shift has been online since registering
+	expectStatus(t, "a daily statement", call(t, "GET", server.URL+"/cabs/"+steady.GetId()+"/statements/Daily?date="+wednesday.Format(time.DateOnly), nil, &statement), http.StatusOK)
+	if statement.OnlineSeconds != int64((3*time.Hour + 15*time.Minute).Seconds()) {
+		t.Fatalf("got %+v, want online since registering", statement)
+	}
+
+	expectStatus(t, "an incentive", call(t, "POST", cabURL+"/incentives", map[string]any{"amount": 75, "note": "Festival"}, nil), http.StatusCreated)
+	var payoutBatch payoutBatchResponse
+	expectStatus(t, "a payout batch", call(t, "POST", server.URL+"/payout-batches", nil, &payoutBatch), http.StatusCreated)
+	if payoutBatch.Total != 75 {
+		t.Fatalf("got %+v, want the incentive paid out", payoutBatch)
+	}
+	expectStatus(t, "looking up a payout batch", call(t, "GET", server.URL+"/payout-batches/"+payoutBatch.Id, nil, nil), http.StatusOK)
+	reply, err := http.Get(server.URL + "/payout-batches/" + payoutBatch.Id + "/export")
+	if err != nil {
+		t.Fatalf("exporting the payout batch: %v", err)
+	}
+	defer reply.Body.Close()
+	rows, err := csv.NewReader(reply.Body).ReadAll()
+	if err != nil || reply.Header.Get("Content-Type") != "text/csv" || len(rows) != 2 || rows[1][0] != payoutBatch.Id || rows[1][3] != "Ertiga" || rows[1][4] != "75" {
+		t.Fatalf("got %s and %v, %v, want the batch as CSV", reply.Header.Get("Content-Type"), rows, err)
+	}
+}
+
+func TestAirportQueue(t *testing.T) {
+	cabService, server := newTestServer(t, src.NewSystemClock(), time.Second)
+	first := registerCab(t, cabService, "First", src.Sedan)
+	cabService.UpdateCabLocation(first.GetId(), 13.205, 77.715)
+	var queue []queuedCabResponse
+	eventually(t, "the first cab to join the airport queue", func() bool {
+		call(t, "GET", server.URL+"/zones/airport/queue", nil, &queue)
+		return len(queue) == 1
+	})
+	second := registerCab(t, cabService, "Second", src.Sedan)
+	cabService.UpdateCabLocation(second.GetId(), 13.1990, 77.7070)
+	eventually(t, "the second cab to join the airport queue", func() bool {
+		expectStatus(t, "the airport queue", call(t, "GET", server.URL+"/zones/airport/queue", nil, &queue), http.StatusOK)
+		return len(queue) == 2
+	})
+	if queue[0].CabId != first.GetId() || queue[1].CabId != second.GetId() || queue[1].Position != 2 {
+		t.Fatalf("got %+v, want the cabs in the order they arrived", queue)
+	}
+}
+
+func TestRideHistory(t *testing.T) {
+	cabService, server := newTestServer(t, src.NewSystemClock(), time.Second)
+	rider := registerUser(t, cabService, "Meera")
+	cab := registerCab(t, cabService, "Swift", src.Sedan)
+	cabService.UpdateCabLocation(cab.GetId(), koramangala.Lat, koramangala.Lon)
+	var completed []*src.Ride
+	for i := 0; i < 5; i++ {
+		completed = append(completed, completeRide(t, cabService, rider.GetId()))
+	}
+	cancelled, err := cabService.BookRide(rider.GetId(), koramangala.Lat, koramangala.Lon, mgRoad.Lat, mgRoad.Lon)
+	if err != nil {
+		t.Fatalf("booking a ride: %v", err)
+	}
+	cabService.CancelRide(cancelled.GetId(), src.CancelledByRider, src.ChangeOfPlans)
+
+	// The driver pages through the rides they drove
+	var cabRides, nextPage, riderRides ridePageResponse
+	cabRidesURL := server.URL + "/cabs/" + cab.GetId() + "/rides?status=Completed&limit=3"
+	expectStatus(t, "the cab's rides", call(t, "GET", cabRidesURL, nil, &cabRides), http.StatusOK)
+	if len(cabRides.Rides) != 3 || cabRides.Rides[0].Id != completed[0].GetId() || cabRides.NextCursor == "" || cabRides.Totals.Completed != 5 {
+		t.Fatalf("got %+v, want the first 3 of 5 completed rides", cabRides)
+	}
+	expectStatus(t, "the next page", call(t, "GET", cabRidesURL+"&cursor="+cabRides.NextCursor, nil, &nextPage), http.StatusOK)
+	if len(nextPage.Rides) != 2 || nextPage.Rides[1].Id != completed[4].GetId() || nextPage.NextCursor != "" {
+		t.Fatalf("got %+v, want the last 2 completed rides", nextPage)
+	}
+
+	// The rider narrows the history to a time range
+	userRidesURL := server.URL + "/users/" + rider.GetId() + "/rides"
+	from := url.QueryEscape(completed[4].GetCreatedAt().Format(time.RFC3339Nano))
+	expectStatus(t, "the rider's rides since the last completed one", call(t, "GET", userRidesURL+"?order=newest&from="+from, nil, &riderRides), http.StatusOK)
+	if len(riderRides.Rides) != 2 || riderRides.Rides[0].Id != cancelled.GetId() || riderRides.Totals.Canceled != 1 {
+		t.Fatalf("got %+v, want the cancelled and the last completed ride", riderRides)
+	}
+	expectStatus(t, "an empty range", call(t, "GET", userRidesURL+"?from="+from+"&to="+from, nil, nil), http.StatusBadRequest)
+}
+
+func TestRideStops(t *testing.T) {
+	cabService, server := newTestServer(t, src.NewSystemClock(), time.Second)
+	rider := registerUser(t, cabService, "Nikhil")
+	cab := registerCab(t, cabService, "Ertiga", src.Sedan)
+	cabService.UpdateCabLocation(cab.GetId(), koramangala.Lat, koramangala.Lon)
+	friend, pharmacy, office := point{12.9450, 77.6100}, point{12.9550, 77.6050}, point{12.9600, 77.6000}
+	distanceCalculator := src.NewHaversineDistanceCalculator()
+	pathKm := func(points ...point) float64 {
+		distanceKm := 0.0
+		for i := 1; i < len(points); i++ {
+			distanceKm += distanceCalculator.Distance(points[i-1].Lat, points[i-1].Lon, points[i].Lat, points[i].Lon)
+		}
+		return distanceKm
+	}
+
+	// The rider books with a stop, adds two more and takes one back out
+	var ride rideResponse
+	bookRide := map[string]any{"userId": rider.GetId(), "pickup": koramangala, "drop": mgRoad, "stops": []point{pharmacy}}
+	expectStatus(t, "booking a ride with a stop", call(t, "POST", server.URL+"/rides", bookRide, &ride), http.StatusCreated)
+	if len(ride.Stops) != 1 || ride.Stops[0].Status != "Pending" || ride.FareEstimate.Stops != 1 || ride.FareEstimate.StopCharge != testRateCard.PerStop {
+		t.Fatalf("got %+v, want the booking quoted with one pending stop", ride)
+	}
+	stopsURL := server.URL + "/rides/" + ride.Id + "/stops"
+	expectStatus(t, "adding a stop at the end", call(t, "POST", stopsURL, map[string]any{"location": office}, &ride), http.StatusOK)
+	expectStatus(t, "adding a stop first", call(t, "POST", stopsURL, map[string]any{"index": 0, "location": friend}, &ride), http.StatusOK)
+	if len(ride.Stops) != 3 || ride.Stops[0].Location.Lat != friend.Lat || ride.Stops[2].Location.Lat != office.Lat || ride.FareEstimate.StopCharge != 3*testRateCard.PerStop {
+		t.Fatalf("got %+v, want three stops in order quoted at three stop charges", ride)
+	}
+	if math.Abs(ride.FareEstimate.DistanceKm-pathKm(koramangala, friend, pharmacy, office, mgRoad)) > 1e-9 {
+		t.Fatalf("got an estimate of %.3f km, want it to run through every stop", ride.FareEstimate.DistanceKm)
+	}
+	expectStatus(t, "a fourth stop", call(t, "POST", stopsURL, map[string]any{"location": friend}, nil), http.StatusBadRequest)
+	expectStatus(t, "a stop without a location", call(t, "POST", stopsURL, map[string]any{"index": 0}, nil), http.StatusBadRequest)
+	expectStatus(t, "removing the last stop", call(t, "DELETE", stopsURL+"/2", nil, &ride), http.StatusOK)
+	expectStatus(t, "removing a stop that is not there", call(t, "DELETE", stopsURL+"/5", nil, nil), http.StatusBadRequest)
+	expectStatus(t, "reaching a stop before pickup", call(t, "POST", stopsURL+"/0/arrive", nil, nil), http.StatusConflict)
+	if len(ride.Stops) != 2 || ride.FareEstimate.Stops != 2 {
+		t.Fatalf("got %+v, want the friend and the pharmacy left", ride)
+	}
+
+	// Once the rider is on board the stops are visited in order
+	confirmRide(t, cabService, ride.Id)
+	if _, err := cabService.UpdateRideStatus(ride.Id, src.PickedUp); err != nil {
+		t.Fatalf("picking up the rider: %v", err)
+	}
+	expectStatus(t, "adding a stop on board", call(t, "POST", stopsURL, map[string]any{"location": office}, nil), http.StatusConflict)
+	expectStatus(t, "reaching the second stop first", call(t, "POST", stopsURL+"/1/arrive", nil, nil), http.StatusConflict)
+	expectStatus(t, "leaving a stop not reached", call(t, "POST", stopsURL+"/0/depart", nil, nil), http.StatusConflict)
+	expectStatus(t, "reaching the first stop", call(t, "POST", stopsURL+"/0/arrive", nil, &ride), http.StatusOK)
+	expectStatus(t, "leaving the first stop", call(t, "POST", stopsURL+"/0/depart", nil, &ride), http.StatusOK)
+	if ride.Stops[0].Status != "Departed" || ride.Stops[0].ArrivedAt == nil || ride.Stops[1].Status != "Pending" {
+		t.Fatalf("got %+v, want the first stop left and the second still ahead", ride.Stops)
+	}
+}
@@ -0,0 +1,67 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// trackRide streams one ride as Server-Sent Events. The stream starts with the
+// ride itself, then carries the assigned cab's location and every status change
+// until the ride is over, with heartbeats in between so idle connections stay
+// open and dead ones are noticed.
+func (csh *CabServiceHandler) trackRide(w http.ResponseWriter, r *http.Request) {
+	tracker, err := csh.cabService.TrackRide(r.Context(), r.PathValue("rideId"))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	defer tracker.Stop()
+
+	controller := http.NewResponseController(w)
+	// The server write timeout is meant for ordinary requests, not for a stream
+	// that lasts as long as the ride.
+	controller.SetWriteDeadline(time.Time{})
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+
+	send := func(eventName string, id int, body any) error {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintf(w, "event: %s\nid: %d\ndata: %s\n\n", eventName, id, data); err != nil {
+			return err
+		}
+		return controller.Flush()
+	}
+
+	sequence := 0
+	if send("ride", sequence, newRideResponse(tracker.GetRide())) != nil {
+		return
+	}
+	heartbeat := time.NewTicker(csh.heartbeatInterval)
+	defer heartbeat.Stop()
+	for {
+		sequence++
+		select {
+		case <-r.Context().Done():
+			return
+		case event, open := <-tracker.Updates():
+			if !open {
+				send("end", sequence, map[string]string{"rideId": tracker.GetRide().GetId()})
+				return
+			}
+			if send(event.Type.String(), sequence, event) != nil {
+				return
+			}
+		case at := <-heartbeat.C:
+			if send("heartbeat", sequence, map[string]time.Time{"at": at}) != nil {
+				return
+			}
+		}
+	}
+}
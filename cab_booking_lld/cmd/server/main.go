@@ -0,0 +1,238 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"cab_booking.com/api"
+	"cab_booking.com/src"
+)
+
+func main() {
+	addr := flag.String("addr", ":8080", "address to listen on")
+	databasePath := flag.String("db", "", "SQLite database file, users, cabs, rides, payments, promotions and driver earnings are kept in memory when empty")
+	offerTimeout := flag.Duration("offer-timeout", 15*time.Second, "how long a driver has to answer a ride offer")
+	maxOfferAttempts := flag.Int("max-offer-attempts", 3, "drivers offered a ride before it waits in the pending queue")
+	maxPendingWait := flag.Duration("max-pending-wait", 5*time.Minute, "how long a ride waits for a cab before giving up")
+	webhookURL := flag.String("notification-webhook", "", "URL that receives rider and driver notifications")
+	scheduleLeadTime := flag.Duration("schedule-lead-time", 20*time.Minute, "how long before a scheduled pickup dispatch starts")
+	heartbeatInterval := flag.Duration("tracking-heartbeat", 15*time.Second, "how often ride tracking streams send a heartbeat")
+	poolCapacity := flag.Int("pool-capacity", 3, "rider seats a pooled cab offers")
+	poolMaxDetour := flag.Float64("pool-max-detour", 0.4, "how much longer than direct a pool rider's trip may get, as a fraction")
+	ratingWindow := flag.Duration("rating-window", 72*time.Hour, "how long after the drop either side can rate a ride")
+	ratingReviewThreshold := flag.Float64("rating-review-threshold", 3.5, "rolling average below which a driver is flagged for review")
+	ratingKmPerStar := flag.Float64("rating-km-per-star", 0.5, "extra pickup distance a driver's star above average is worth in dispatch")
+	cancellationFreeWindow := flag.Duration("cancellation-free-window", 2*time.Minute, "how long after a cab is confirmed a rider can cancel for free")
+	cancellationBaseFee := flag.Int("cancellation-base-fee", 50, "fee a rider pays for cancelling after the free window")
+	referralDiscount := flag.Int("referral-discount", 50, "amount a referral code takes off a new rider's first ride")
+	referralReward := flag.Int("referral-reward", 50, "wallet credit a referrer gets once the rider they referred completes a first ride")
+	commissionPercent := flag.Float64("commission-percent", 20, "share of each fare the platform keeps as commission")
+	dailyRideTarget := flag.Int("daily-ride-target", 10, "rides a driver completes in a day to earn the daily bonus")
+	dailyTargetBonus := flag.Int("daily-target-bonus", 200, "incentive a driver earns on reaching the daily ride target, zero turns it off")
+	roadGraphPath := flag.String("road-graph", "", "road graph file to route pickups and trips on, straight lines are used when empty")
+	routeCacheSize := flag.Int("route-cache-size", 10000, "node to node paths the router keeps cached")
+	maxSnapDistance := flag.Float64("max-snap-distance", 1, "how far in km a point can be from the nearest road and still be routed")
+	maxPickupEta := flag.Duration("max-pickup-eta", 20*time.Minute, "longest drive to a pickup a cab is dispatched for when routing by road")
+	zonesPath := flag.String("zones", "", "zones file with the service areas rides can be booked in and special zones such as airports, rides can be booked anywhere when empty")
+	ratingMinutesPerStar := flag.Float64("rating-minutes-per-star", 1, "pickup time a driver's star above average is worth in dispatch when routing by road")
+	shutdownTimeout := flag.Duration("shutdown-timeout", 10*time.Second, "how long in flight requests get to finish on shutdown")
+	flag.Parse()
+
+	idGenerationStrategy := src.NewIdGenerationUsingUUID()
+	distanceCalculator := src.NewHaversineDistanceCalculator()
+	clock := src.NewSystemClock()
+	repos, err := openRepositories(*databasePath, idGenerationStrategy, distanceCalculator, clock)
+	if err != nil {
+		log.Fatalf("opening repositories: %v", err)
+	}
+	userRepo, cabRepo, rideRepo := repos.userRepo, repos.cabRepo, repos.rideRepo
+	rateCards := map[src.VehicleCategory]src.FareRateCard{
+		src.Hatchback: {BaseFare: 40, PerKm: 10, PerMinute: 1, WaitingPerMinute: 1, FreeWaitingTime: 3 * time.Minute, PerStop: 20, FreeStopWaitingTime: 3 * time.Minute, MinimumFare: 80, TaxPercent: 5, AverageSpeedKmph: 25},
+		src.Sedan:     {BaseFare: 50, PerKm: 12, PerMinute: 2, WaitingPerMinute: 2, FreeWaitingTime: 3 * time.Minute, PerStop: 25, FreeStopWaitingTime: 3 * time.Minute, MinimumFare: 100, TaxPercent: 5, AverageSpeedKmph: 25},
+		src.SUV:       {BaseFare: 80, PerKm: 18, PerMinute: 3, WaitingPerMinute: 3, FreeWaitingTime: 3 * time.Minute, PerStop: 40, FreeStopWaitingTime: 3 * time.Minute, MinimumFare: 150, TaxPercent: 5, AverageSpeedKmph: 25},
+		src.Auto:      {BaseFare: 30, PerKm: 9, PerMinute: 1, WaitingPerMinute: 1, FreeWaitingTime: 3 * time.Minute, PerStop: 15, FreeStopWaitingTime: 3 * time.Minute, MinimumFare: 50, TaxPercent: 5, AverageSpeedKmph: 20},
+		src.Bike:      {BaseFare: 20, PerKm: 6, PerMinute: 1, WaitingPerMinute: 1, FreeWaitingTime: 3 * time.Minute, PerStop: 10, FreeStopWaitingTime: 3 * time.Minute, MinimumFare: 30, TaxPercent: 5, AverageSpeedKmph: 30},
+	}
+	var router src.Router
+	if *roadGraphPath != "" {
+		roadGraph, err := src.LoadRoadGraph(*roadGraphPath, distanceCalculator)
+		if err != nil {
+			log.Fatalf("loading road graph: %v", err)
+		}
+		router = src.NewAStarRouter(roadGraph, distanceCalculator, src.RoutingPolicy{
+			MaxSnapDistanceKm: *maxSnapDistance,
+			AccessSpeedKmph:   15,
+			CacheSize:         *routeCacheSize,
+		})
+		log.Printf("routing on %d road nodes from %s", roadGraph.GetNodeCount(), *roadGraphPath)
+	}
+	categoryPricingStrategies := make(map[src.VehicleCategory]src.PricingStrategy, len(rateCards))
+	for category, rateCard := range rateCards {
+		categoryPricingStrategies[category] = src.NewRoutedMeteredPricingStrategy(rateCard, router, distanceCalculator)
+	}
+	poolManager := src.NewInMemoryPoolManager(cabRepo, idGenerationStrategy, distanceCalculator, src.PoolPolicy{
+		Capacity:            *poolCapacity,
+		MaxDetourFactor:     *poolMaxDetour,
+		MaxPickupDistanceKm: 5,
+		MaxFareShare:        0.8,
+		MinFareShare:        0.5,
+	})
+	zonePolicy := src.ZonePolicy{}
+	if *zonesPath != "" {
+		if zonePolicy, err = src.LoadZonePolicy(*zonesPath); err != nil {
+			log.Fatalf("loading zones: %v", err)
+		}
+		log.Printf("%d service areas and %d special zones from %s", len(zonePolicy.ServiceAreas), len(zonePolicy.SpecialZones), *zonesPath)
+	}
+	eventBus := src.NewInMemoryEventBus(1024)
+	zoneManager := src.NewQueueingZoneManager(cabRepo, eventBus, clock, zonePolicy)
+	zoneResolver := src.NewGridZoneResolver(0.05)
+	pricingStrategy := src.NewPromotionPricingStrategy(src.NewZoneSurchargePricingStrategy(src.NewPoolPricingStrategy(src.NewSurgePricingStrategy(src.NewCategoryPricingStrategy(categoryPricingStrategies, src.Sedan), zoneResolver, rideRepo, cabRepo, 2.5, 5*time.Minute, clock), poolManager), zoneManager), repos.promotionRepo)
+	baseCabFindingStrategy := src.NewRatingAwareCabFindingStrategy(cabRepo, distanceCalculator, 10, 5, *ratingKmPerStar)
+	if router != nil {
+		baseCabFindingStrategy = src.NewRouteAwareCabFindingStrategy(cabRepo, router, 5, *maxPickupEta, *ratingMinutesPerStar)
+	}
+	cabFindingStrategy := src.NewPoolAwareCabFindingStrategy(src.NewCancellationAwareCabFindingStrategy(src.NewZoneQueueCabFindingStrategy(baseCabFindingStrategy, zoneManager), clock), poolManager)
+	pendingRideQueue := src.NewInMemoryPendingRideQueue(*maxPendingWait, 2*time.Second, 30*time.Second)
+	rideDispatcher := src.NewOfferDispatcher(cabRepo, rideRepo, cabFindingStrategy, pendingRideQueue, poolManager, eventBus, clock, *offerTimeout, *maxOfferAttempts)
+	rideScheduler := src.NewLeadTimeRideScheduler(clock, rideRepo, rideDispatcher, eventBus, *scheduleLeadTime, 15*time.Second)
+	// The dispatcher starts out knowing no rides, so the ones still searching
+	// for a cab when the server last stopped are handed back to it.
+	for _, ride := range rideRepo.FindOpenRides() {
+		go rideDispatcher.Dispatch(&ride)
+	}
+	ratingManager := src.NewPostRideRatingManager(repos.ratingRepo, userRepo, cabRepo, rideRepo, eventBus, clock, src.RatingPolicy{
+		SubmissionWindow:    *ratingWindow,
+		RollingWindow:       50,
+		ReviewThreshold:     *ratingReviewThreshold,
+		MinRatingsForReview: 10,
+		MaxTags:             5,
+	})
+	cancellationManager := src.NewPolicyCancellationManager(cabRepo, distanceCalculator, eventBus, clock, src.CancellationPolicy{
+		FreeWindow:                  *cancellationFreeWindow,
+		FreeDistanceKm:              0.5,
+		BaseFee:                     *cancellationBaseFee,
+		FeePerMinute:                5,
+		FeePerKm:                    10,
+		MaxFee:                      4 * *cancellationBaseFee,
+		MaxDriverCancellationRate:   0.2,
+		MinRidesForCancellationRate: 20,
+		DeprioritiseFor:             time.Hour,
+	})
+	// Cards are charged through the fake gateway until a real processor is plugged in.
+	paymentProcessor := src.NewLedgerPaymentProcessor(repos.paymentRepo, repos.ledgerRepo, userRepo, src.NewFakePaymentGateway(), idGenerationStrategy, eventBus, clock)
+	promotionManager := src.NewReservingPromotionManager(repos.promotionRepo, userRepo, rideRepo, paymentProcessor, zoneResolver, idGenerationStrategy, eventBus, clock, src.PromotionPolicy{
+		ReferralDiscount: *referralDiscount,
+		ReferralReward:   *referralReward,
+	})
+	driverManager := src.NewLedgerDriverManager(repos.earningsRepo, cabRepo, rideRepo, idGenerationStrategy, eventBus, clock, src.EarningsPolicy{
+		CommissionPercent: *commissionPercent,
+		DailyRideTarget:   *dailyRideTarget,
+		DailyTargetBonus:  *dailyTargetBonus,
+	})
+	cabService := src.NewInMemoryCabService(userRepo, cabRepo, rideRepo, idGenerationStrategy, pricingStrategy, rideDispatcher, poolManager, ratingManager, cancellationManager, paymentProcessor, promotionManager, driverManager, zoneManager, eventBus, clock)
+
+	notificationChannels := []src.NotificationChannel{src.NewConsoleNotificationChannel(os.Stdout)}
+	if *webhookURL != "" {
+		notificationChannels = append(notificationChannels, src.NewWebhookNotificationChannel(*webhookURL, 5*time.Second))
+	}
+	eventBus.Subscribe(src.NewNotificationDispatcher(notificationChannels...))
+	eventBus.Subscribe(src.NewAuditLogWriter(os.Stderr))
+
+	server := &http.Server{
+		Addr:              *addr,
+		Handler:           api.NewCabServiceHandler(src.NewCabServiceV2(cabService), *heartbeatInterval),
+		ReadHeaderTimeout: 5 * time.Second,
+		ReadTimeout:       10 * time.Second,
+		WriteTimeout:      10 * time.Second,
+		IdleTimeout:       time.Minute,
+	}
+	// Tracking streams only end with their ride, so shutdown cancels the base
+	// context to close them instead of waiting out the shutdown timeout.
+	requestCtx, cancelRequests := context.WithCancel(context.Background())
+	server.BaseContext = func(net.Listener) context.Context { return requestCtx }
+	server.RegisterOnShutdown(cancelRequests)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	serverErr := make(chan error, 1)
+	go func() {
+		log.Printf("cab booking API listening on %s", *addr)
+		serverErr <- server.ListenAndServe()
+	}()
+
+	select {
+	case err := <-serverErr:
+		if !errors.Is(err, http.ErrServerClosed) {
+			log.Fatalf("server stopped: %v", err)
+		}
+	case <-ctx.Done():
+		log.Printf("shutting down")
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+		defer cancel()
+		if err := server.Shutdown(shutdownCtx); err != nil {
+			log.Fatalf("graceful shutdown failed: %v", err)
+		}
+	}
+	rideScheduler.Close()
+	cabService.Close()
+}
+
+type repositories struct {
+	userRepo      src.IUserRepository
+	cabRepo       src.ICabRepository
+	rideRepo      src.IRideRegistory
+	ratingRepo    src.IRatingRepository
+	paymentRepo   src.IPaymentRepository
+	ledgerRepo    src.ILedgerRepository
+	promotionRepo src.IPromotionRepository
+	earningsRepo  src.IEarningsRepository
+}
+
+func openRepositories(databasePath string, idGenerationStrategy src.IdGenerationStrategy, distanceCalculator src.DistanceCalculator, clock src.Clock) (repositories, error) {
+	cabLocationIndex := src.NewGridGeoIndex(0.01, distanceCalculator)
+	openRideIndex := src.NewGridGeoIndex(0.01, distanceCalculator)
+	if databasePath == "" {
+		return repositories{
+			userRepo:      src.NewUserRepository(idGenerationStrategy),
+			cabRepo:       src.NewCabRepository(idGenerationStrategy, cabLocationIndex),
+			rideRepo:      src.NewRideRepository(idGenerationStrategy, openRideIndex, clock),
+			ratingRepo:    src.NewRatingRepository(),
+			paymentRepo:   src.NewPaymentRepository(),
+			ledgerRepo:    src.NewLedgerRepository(),
+			promotionRepo: src.NewPromotionRepository(),
+			earningsRepo:  src.NewEarningsRepository(),
+		}, nil
+	}
+	db, err := src.OpenSQLiteDatabase(databasePath)
+	if err != nil {
+		return repositories{}, err
+	}
+	cabRepo, err := src.NewSQLiteCabRepository(db, idGenerationStrategy, cabLocationIndex)
+	if err != nil {
+		return repositories{}, err
+	}
+	rideRepo, err := src.NewSQLiteRideRepository(db, idGenerationStrategy, openRideIndex, clock)
+	if err != nil {
+		return repositories{}, err
+	}
+	return repositories{
+		userRepo:      src.NewSQLiteUserRepository(db, idGenerationStrategy),
+		cabRepo:       cabRepo,
+		rideRepo:      rideRepo,
+		ratingRepo:    src.NewSQLiteRatingRepository(db),
+		paymentRepo:   src.NewSQLitePaymentRepository(db),
+		ledgerRepo:    src.NewSQLiteLedgerRepository(db),
+		promotionRepo: src.NewSQLitePromotionRepository(db),
+		earningsRepo:  src.NewSQLiteEarningsRepository(db),
+	}, nil
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"cab_booking.com/src"
+)
+
+func main() {
+	cabFindingStrategies := flag.String("cab-finding", "nearest,rating", "comma separated cab finding strategies to compare: nearest, rating or route")
+	pricingStrategies := flag.String("pricing", "metered", "comma separated pricing strategies to compare: fixed, metered or surge")
+	cabs := flag.Int("cabs", 20, "cabs in the simulated fleet")
+	ridersPerHour := flag.Float64("riders-per-hour", 60, "average riders requesting a cab each hour")
+	peakMultiplier := flag.Float64("peak-multiplier", 2, "how many times busier the 9am and 6pm hours are")
+	duration := flag.Duration("duration", 24*time.Hour, "simulated time to run for, starting at midnight")
+	seed := flag.Int64("seed", 1, "seed for riders and cab movements, runs with the same seed see the same riders")
+	riderPatience := flag.Duration("rider-patience", 10*time.Minute, "how long a rider waits for a cab before cancelling")
+	maxPickupRadius := flag.Float64("max-pickup-radius", 5, "furthest in km a cab is dispatched from, zero for no limit")
+	roadGraphPath := flag.String("road-graph", "", "road graph file to drive on, required by the route strategy")
+	outPath := flag.String("out", "", "CSV file to write the reports to, standard output when empty")
+	flag.Parse()
+
+	distanceCalculator := src.NewHaversineDistanceCalculator()
+	var router src.Router
+	if *roadGraphPath != "" {
+		roadGraph, err := src.LoadRoadGraph(*roadGraphPath, distanceCalculator)
+		if err != nil {
+			log.Fatalf("loading road graph: %v", err)
+		}
+		router = src.NewAStarRouter(roadGraph, distanceCalculator, src.RoutingPolicy{MaxSnapDistanceKm: 1, AccessSpeedKmph: 15, CacheSize: 10000})
+	}
+	config := src.SimulationConfig{
+		Duration: *duration,
+		Seed:     *seed,
+		Area:     src.BoundingBox{MinLat: 12.85, MinLon: 77.50, MaxLat: 13.05, MaxLon: 77.72},
+		Demand: src.DemandProfile{
+			RidersPerHour:     *ridersPerHour,
+			HourlyMultipliers: map[int]float64{0: 0.2, 1: 0.1, 2: 0.1, 3: 0.1, 4: 0.2, 5: 0.4, 9: *peakMultiplier, 18: *peakMultiplier},
+			Pickups: []src.DemandHotspot{
+				{Center: src.GeoPoint{Lat: 12.9352, Lon: 77.6245}, RadiusKm: 2, Weight: 3},
+				{Center: src.GeoPoint{Lat: 12.9716, Lon: 77.5946}, RadiusKm: 3, Weight: 2},
+				{Center: src.GeoPoint{Lat: 12.9698, Lon: 77.7000}, RadiusKm: 2, Weight: 1},
+			},
+		},
+		Cabs:             *cabs,
+		Category:         src.Sedan,
+		CabSpeedKmph:     24,
+		CruiseSpeedKmph:  12,
+		MovementInterval: time.Minute,
+		RiderPatience:    *riderPatience,
+	}
+
+	var reports []*src.SimulationReport
+	for _, cabFinding := range strings.Split(*cabFindingStrategies, ",") {
+		for _, pricing := range strings.Split(*pricingStrategies, ",") {
+			clock := src.NewManualClock(time.Date(2026, time.January, 5, 0, 0, 0, 0, time.Local))
+			cabService, err := newCabService(clock, cabFinding, pricing, *maxPickupRadius, router, distanceCalculator)
+			if err != nil {
+				log.Fatalf("%v", err)
+			}
+			runConfig := config
+			runConfig.Name = cabFinding + "/" + pricing
+			report, err := src.NewFleetSimulator(cabService, clock, distanceCalculator, router, runConfig).Run()
+			cabService.Close()
+			if err != nil {
+				log.Fatalf("simulating %s: %v", runConfig.Name, err)
+			}
+			log.Print(report)
+			reports = append(reports, report)
+		}
+	}
+
+	var out io.Writer = os.Stdout
+	if *outPath != "" {
+		file, err := os.Create(*outPath)
+		if err != nil {
+			log.Fatalf("creating %s: %v", *outPath, err)
+		}
+		defer file.Close()
+		out = file
+	}
+	if err := src.WriteSimulationCSV(out, reports); err != nil {
+		log.Fatalf("writing reports: %v", err)
+	}
+}
+
+// newCabService wires a service the way the server does, except that pending
+// rides wait for the simulated riders to give up instead of the queue deadline.
+func newCabService(clock src.Clock, cabFinding, pricing string, maxPickupRadiusKm float64, router src.Router, distanceCalculator src.DistanceCalculator) (src.CabService, error) {
+	idGenerationStrategy := src.NewIdGenerationUsingUUID()
+	userRepo := src.NewUserRepository(idGenerationStrategy)
+	cabRepo := src.NewCabRepository(idGenerationStrategy, src.NewGridGeoIndex(0.01, distanceCalculator))
+	rideRepo := src.NewRideRepository(idGenerationStrategy, src.NewGridGeoIndex(0.01, distanceCalculator), clock)
+	paymentRepo, ledgerRepo := src.NewPaymentRepository(), src.NewLedgerRepository()
+	eventBus := src.NewInMemoryEventBus(1024)
+	poolManager := src.NewInMemoryPoolManager(cabRepo, idGenerationStrategy, distanceCalculator, src.PoolPolicy{Capacity: 3})
+
+	var cabFindingStrategy src.CabFindingStrategy
+	switch cabFinding {
+	case "nearest":
+		cabFindingStrategy = src.NewNearestAvailableCarFindingStrategy(cabRepo, distanceCalculator, maxPickupRadiusKm)
+	case "rating":
+		cabFindingStrategy = src.NewRatingAwareCabFindingStrategy(cabRepo, distanceCalculator, maxPickupRadiusKm, 5, 0.5)
+	case "route":
+		if router == nil {
+			return nil, fmt.Errorf("the route strategy needs -road-graph")
+		}
+		cabFindingStrategy = src.NewRouteAwareCabFindingStrategy(cabRepo, router, 5, 20*time.Minute, 1)
+	default:
+		return nil, fmt.Errorf("unknown cab finding strategy %q", cabFinding)
+	}
+	rateCard := src.FareRateCard{BaseFare: 50, PerKm: 12, PerMinute: 2, WaitingPerMinute: 2, FreeWaitingTime: 3 * time.Minute, MinimumFare: 100, TaxPercent: 5, AverageSpeedKmph: 25}
+	var pricingStrategy src.PricingStrategy
+	switch pricing {
+	case "fixed":
+		pricingStrategy = src.NewFixPricingStrategy(rateCard.PerKm, distanceCalculator)
+	case "metered":
+		pricingStrategy = src.NewRoutedMeteredPricingStrategy(rateCard, router, distanceCalculator)
+	case "surge":
+		pricingStrategy = src.NewSurgePricingStrategy(src.NewRoutedMeteredPricingStrategy(rateCard, router, distanceCalculator), src.NewGridZoneResolver(0.05), rideRepo, cabRepo, 2.5, 5*time.Minute, clock)
+	default:
+		return nil, fmt.Errorf("unknown pricing strategy %q", pricing)
+	}
+
+	rideDispatcher := src.NewOfferDispatcher(cabRepo, rideRepo, cabFindingStrategy, src.NewInMemoryPendingRideQueue(24*time.Hour, 24*time.Hour, 24*time.Hour),
+		poolManager, eventBus, clock, time.Second, 3)
+	paymentProcessor := src.NewLedgerPaymentProcessor(paymentRepo, ledgerRepo, userRepo, src.NewFakePaymentGateway(), idGenerationStrategy, eventBus, clock)
+	return src.NewInMemoryCabService(userRepo, cabRepo, rideRepo, idGenerationStrategy, pricingStrategy, rideDispatcher, poolManager,
+		src.NewPostRideRatingManager(src.NewRatingRepository(), userRepo, cabRepo, rideRepo, eventBus, clock, src.RatingPolicy{SubmissionWindow: 24 * time.Hour, RollingWindow: 50, MaxTags: 5}),
+		src.NewPolicyCancellationManager(cabRepo, distanceCalculator, eventBus, clock, src.CancellationPolicy{FreeWindow: time.Hour, FreeDistanceKm: 100, MaxDriverCancellationRate: 1}),
+		paymentProcessor,
+		src.NewReservingPromotionManager(src.NewPromotionRepository(), userRepo, rideRepo, paymentProcessor, src.NewGridZoneResolver(0.05), idGenerationStrategy, eventBus, clock, src.PromotionPolicy{}),
+		src.NewLedgerDriverManager(src.NewEarningsRepository(), cabRepo, rideRepo, idGenerationStrategy, eventBus, clock, src.EarningsPolicy{CommissionPercent: 20}),
+		src.NewQueueingZoneManager(cabRepo, eventBus, clock, src.ZonePolicy{}), eventBus, clock), nil
+}
@@ -1,8 +1,17 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"errors"
 	"fmt"
 	"log"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"cab_booking.com/src"
@@ -10,23 +19,304 @@ import (
 
 func main() {
 	idGenerationStrategy := src.NewIdGenerationUsingUUID()
-	cabRepo := src.NewCabRepository(idGenerationStrategy)
-	pricingStrategy := src.NewFixPricingStrategy(10)
-	cabFidingStrategy := src.NewNearestAvailableCarFindingStrategy(cabRepo)
-	rideRepo := src.NewRideRepository(idGenerationStrategy)
+	distanceCalculator := src.NewHaversineDistanceCalculator()
+	cabRepo := src.NewCabRepository(idGenerationStrategy, src.NewGridGeoIndex(0.01, distanceCalculator))
+	clock := src.NewSystemClock()
+	rideRepo := src.NewRideRepository(idGenerationStrategy, src.NewGridGeoIndex(0.01, distanceCalculator), clock)
+	zoneResolver := src.NewPolygonZoneResolver([]src.Zone{
+		src.NewPolygonZone("koramangala", []src.GeoPoint{{Lat: 12.92, Lon: 77.61}, {Lat: 12.92, Lon: 77.64}, {Lat: 12.95, Lon: 77.64}, {Lat: 12.95, Lon: 77.61}}),
+	}, src.NewGridZoneResolver(0.05))
+	rateCards := map[src.VehicleCategory]src.FareRateCard{
+		src.Hatchback: {BaseFare: 40, PerKm: 10, PerMinute: 1, WaitingPerMinute: 1, FreeWaitingTime: 3 * time.Minute, PerStop: 20, FreeStopWaitingTime: 3 * time.Minute, MinimumFare: 80, TaxPercent: 5, AverageSpeedKmph: 25},
+		src.Sedan:     {BaseFare: 50, PerKm: 12, PerMinute: 2, WaitingPerMinute: 2, FreeWaitingTime: 3 * time.Minute, PerStop: 25, FreeStopWaitingTime: 3 * time.Minute, MinimumFare: 100, TaxPercent: 5, AverageSpeedKmph: 25},
+		src.SUV:       {BaseFare: 80, PerKm: 18, PerMinute: 3, WaitingPerMinute: 3, FreeWaitingTime: 3 * time.Minute, PerStop: 40, FreeStopWaitingTime: 3 * time.Minute, MinimumFare: 150, TaxPercent: 5, AverageSpeedKmph: 25},
+		src.Auto:      {BaseFare: 30, PerKm: 9, PerMinute: 1, WaitingPerMinute: 1, FreeWaitingTime: 3 * time.Minute, PerStop: 15, FreeStopWaitingTime: 3 * time.Minute, MinimumFare: 50, TaxPercent: 5, AverageSpeedKmph: 20},
+		src.Bike:      {BaseFare: 20, PerKm: 6, PerMinute: 1, WaitingPerMinute: 1, FreeWaitingTime: 3 * time.Minute, PerStop: 10, FreeStopWaitingTime: 3 * time.Minute, MinimumFare: 30, TaxPercent: 5, AverageSpeedKmph: 30},
+	}
+	categoryPricingStrategies := make(map[src.VehicleCategory]src.PricingStrategy, len(rateCards))
+	for category, rateCard := range rateCards {
+		categoryPricingStrategies[category] = src.NewMeteredPricingStrategy(rateCard, distanceCalculator)
+	}
+	poolManager := src.NewInMemoryPoolManager(cabRepo, idGenerationStrategy, distanceCalculator, src.PoolPolicy{
+		Capacity:            3,
+		MaxDetourFactor:     0.5,
+		MaxPickupDistanceKm: 3,
+		MaxFareShare:        0.8,
+		MinFareShare:        0.5,
+	})
+	promotionRepo := src.NewPromotionRepository()
+	pricingStrategy := src.NewPromotionPricingStrategy(src.NewPoolPricingStrategy(src.NewSurgePricingStrategy(src.NewCategoryPricingStrategy(categoryPricingStrategies, src.Sedan), zoneResolver, rideRepo, cabRepo, 2.5, 5*time.Minute, clock), poolManager), promotionRepo)
+	cabFidingStrategy := src.NewPoolAwareCabFindingStrategy(src.NewCancellationAwareCabFindingStrategy(src.NewNearestAvailableCarFindingStrategy(cabRepo, distanceCalculator, 0), clock), poolManager)
+	eventBus := src.NewInMemoryEventBus(256)
+	pendingRideQueue := src.NewInMemoryPendingRideQueue(1*time.Second, 100*time.Millisecond, 400*time.Millisecond)
+	rideDispatcher := src.NewOfferDispatcher(cabRepo, rideRepo, cabFidingStrategy, pendingRideQueue, poolManager, eventBus, clock, 200*time.Millisecond, 3)
 	userRepo := src.NewUserRepository(idGenerationStrategy)
 
-	cabService := src.NewInMemoryCabService(userRepo, cabRepo, rideRepo, idGenerationStrategy, pricingStrategy, cabFidingStrategy)
+	rideScheduler := src.NewLeadTimeRideScheduler(clock, rideRepo, rideDispatcher, eventBus, 20*time.Minute, time.Second)
+	defer rideScheduler.Close()
+
+	ratingManager := src.NewPostRideRatingManager(src.NewRatingRepository(), userRepo, cabRepo, rideRepo, eventBus, clock, src.RatingPolicy{
+		SubmissionWindow:    72 * time.Hour,
+		RollingWindow:       50,
+		ReviewThreshold:     3.5,
+		MinRatingsForReview: 10,
+		MaxTags:             5,
+	})
+	cancellationManager := src.NewPolicyCancellationManager(cabRepo, distanceCalculator, eventBus, clock, src.CancellationPolicy{
+		FreeWindow:                  2 * time.Minute,
+		FreeDistanceKm:              0.5,
+		BaseFee:                     50,
+		FeePerMinute:                5,
+		FeePerKm:                    10,
+		MaxFee:                      200,
+		MaxDriverCancellationRate:   0.3,
+		MinRidesForCancellationRate: 5,
+		DeprioritiseFor:             30 * time.Minute,
+	})
+	paymentProcessor := src.NewLedgerPaymentProcessor(src.NewPaymentRepository(), src.NewLedgerRepository(), userRepo, src.NewFakePaymentGateway(), idGenerationStrategy, eventBus, clock)
+	promotionManager := src.NewReservingPromotionManager(promotionRepo, userRepo, rideRepo, paymentProcessor, zoneResolver, idGenerationStrategy, eventBus, clock, src.PromotionPolicy{
+		ReferralDiscount: 50,
+		ReferralReward:   50,
+	})
+	driverManager := src.NewLedgerDriverManager(src.NewEarningsRepository(), cabRepo, rideRepo, idGenerationStrategy, eventBus, clock, src.EarningsPolicy{
+		CommissionPercent: 20,
+		DailyRideTarget:   10,
+		DailyTargetBonus:  200,
+	})
+	zoneManager := src.NewQueueingZoneManager(cabRepo, eventBus, clock, src.ZonePolicy{})
+	cabService := src.NewInMemoryCabService(userRepo, cabRepo, rideRepo, idGenerationStrategy, pricingStrategy, rideDispatcher, poolManager, ratingManager, cancellationManager, paymentProcessor, promotionManager, driverManager, zoneManager, eventBus, clock)
+	defer cabService.Close()
+
+	auditLog, err := os.CreateTemp("", "cab-booking-audit-*.log")
+	if err != nil {
+		log.Fatalf("Could not create the audit log: %v", err)
+	}
+	defer auditLog.Close()
+	eventBus.Subscribe(src.NewAuditLogWriter(auditLog))
+	eventBus.Subscribe(src.NewNotificationDispatcher(src.NewConsoleNotificationChannel(os.Stdout)))
 
 	// examples
-	user := cabService.RegisterUser("Jitendra")
-	cabService.RegisterCab("Swift")
+	user := mustRegisterUser(cabService, "Jitendra")
+	cab := mustRegisterCab(cabService, "Swift", src.Hatchback)
+	cabService.UpdateCabLocation(cab.GetId(), 12.9352, 77.6245)
 
 	// Test Scenario 1: Cab Booking to Completion
 	testCabBookingToCompletion(cabService, user)
 
 	// Test Scenario 2: Cab Booking with Cancellation
 	testCabBookingWithCancellation(cabService, user)
+
+	// Test Scenario 3: Drivers decline or ignore the offer
+	farCab := mustRegisterCab(cabService, "Dzire", src.Sedan)
+	cabService.UpdateCabLocation(farCab.GetId(), 13.0358, 77.5970)
+	testCabBookingWithNoDriverAccepting(cabService, user)
+
+	// Test Scenario 4: Surge pricing when requests outnumber cabs in a zone
+	testSurgePricing(cabService)
+
+	// Test Scenario 5: Many riders booking at the same time
+	time.Sleep(300 * time.Millisecond)
+	testParallelBookings(cabService)
+
+	// Test Scenario 6: Riders wait in the pending queue while every cab is busy
+	testPendingRideQueue(cabService)
+
+	// Test Scenario 7: Ride lifecycle events reach every subscriber
+	time.Sleep(300 * time.Millisecond)
+	testRideLifecycleEvents(cabService, eventBus)
+
+	// Test Scenario 11: Rides booked ahead are dispatched shortly before pickup
+	testScheduledRides()
+
+	// Test Scenario 12: Riders heading the same way share one cab
+	testPooledRides()
+
+	// Test Scenario 13: Riders compare categories and get a cab of the one they pick
+	testVehicleCategories()
+
+	// Test Scenario 14: Riders and drivers rate each other and ratings steer dispatch
+	testRatings()
+
+	// Test Scenario 15: Late cancellations cost a fee and drivers who cancel lose priority
+	testCancellations()
+
+	// Test Scenario 16: Rides are charged on completion and unpaid ones block booking
+	testPayments()
+
+	// Test Scenario 17: Promo codes and referral codes take money off the fare
+	testPromotions()
+
+	// Test Scenario 18: Drivers work shifts, earn per ride and get paid out in batches
+	testDriverShifts()
+
+	// Test Scenario 19: Pickups and fares follow the roads instead of straight lines
+	testRoadRouting()
+
+	// Test Scenario 20: A simulated day compares dispatch strategies on the same demand
+	testSimulation()
+
+	// Test Scenario 21: Bookings stay inside the service area and airport cabs are sent in queue order
+	testServiceAreas()
+
+	// Test Scenario 22: Riders and drivers page through their ride history with totals
+	testRideHistory()
+
+	// Test Scenario 23: The v2 service reports every failure and gives up on a booking when its context ends
+	testContextCabService()
+
+	// Test Scenario 24: Riders add stops on the way and pay for each stop and the wait at it
+	testMultiStopRides()
+	fmt.Println("Audit log written to", auditLog.Name())
+}
+
+type repositories struct {
+	userRepo      src.IUserRepository
+	cabRepo       src.ICabRepository
+	rideRepo      src.IRideRegistory
+	ratingRepo    src.IRatingRepository
+	paymentRepo   src.IPaymentRepository
+	ledgerRepo    src.ILedgerRepository
+	promotionRepo src.IPromotionRepository
+	earningsRepo  src.IEarningsRepository
+}
+
+func newInMemoryRepositories(clock src.Clock) repositories {
+	idGenerationStrategy := src.NewIdGenerationUsingUUID()
+	distanceCalculator := src.NewHaversineDistanceCalculator()
+	return repositories{
+		userRepo:      src.NewUserRepository(idGenerationStrategy),
+		cabRepo:       src.NewCabRepository(idGenerationStrategy, src.NewGridGeoIndex(0.01, distanceCalculator)),
+		rideRepo:      src.NewRideRepository(idGenerationStrategy, src.NewGridGeoIndex(0.01, distanceCalculator), clock),
+		ratingRepo:    src.NewRatingRepository(),
+		paymentRepo:   src.NewPaymentRepository(),
+		ledgerRepo:    src.NewLedgerRepository(),
+		promotionRepo: src.NewPromotionRepository(),
+		earningsRepo:  src.NewEarningsRepository(),
+	}
+}
+
+type eventRecorder struct {
+	events chan src.RideEvent
+}
+
+func (er *eventRecorder) GetName() string {
+	return "event-recorder"
+}
+
+func (er *eventRecorder) HandleEvent(event src.RideEvent) error {
+	er.events <- event
+	return nil
+}
+
+// scriptedDriver answers every offer the way the scenario tells it to, or
+// lets it expire when told nothing.
+type scriptedDriver struct {
+	cabService src.CabService
+	mu         sync.Mutex
+	answer     string
+}
+
+func (sd *scriptedDriver) GetName() string {
+	return "scripted-driver"
+}
+
+func (sd *scriptedDriver) HandleEvent(event src.RideEvent) error {
+	if event.Type != src.RideOffered {
+		return nil
+	}
+	sd.mu.Lock()
+	defer sd.mu.Unlock()
+	switch sd.answer {
+	case "accept":
+		return sd.cabService.AcceptRide(event.RideId, event.CabId)
+	case "reject":
+		return sd.cabService.RejectRide(event.RideId, event.CabId)
+	}
+	return nil
+}
+
+func (sd *scriptedDriver) setAnswer(answer string) {
+	sd.mu.Lock()
+	sd.answer = answer
+	sd.mu.Unlock()
+}
+
+type brokenSubscriber struct{}
+
+func (bs brokenSubscriber) GetName() string {
+	return "broken-subscriber"
+}
+
+func (bs brokenSubscriber) HandleEvent(event src.RideEvent) error {
+	panic("subscriber bug")
+}
+
+// acceptAllOffers plays every driver accepting whatever they are offered until
+// each ride either stopped searching or is left waiting in the pending queue.
+func acceptAllOffers(cabService src.CabService, rides []*src.Ride) {
+	for searching := true; searching; {
+		searching = false
+		for _, ride := range rides {
+			if rideStatus(cabService, ride.GetId()) != src.SearchingForCab {
+				continue
+			}
+			if _, err := cabService.GetPendingRide(ride.GetId()); err == nil {
+				continue
+			}
+			searching = true
+			if offer, err := cabService.GetRideOffer(ride.GetId()); err == nil && offer.GetStatus() == src.OfferPending {
+				go cabService.AcceptRide(ride.GetId(), offer.GetCabId())
+			}
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// rideStatus reads the status of a ride the scenario booked, which must exist.
+func rideStatus(cabService src.CabService, rideId string) src.RideStatus {
+	status, err := cabService.GetRideStatus(rideId)
+	if err != nil {
+		log.Fatalf("Expected ride %s to exist, got %v", rideId, err)
+	}
+	return status
+}
+
+func mustRegisterUser(cabService src.CabService, name string) *src.User {
+	user, err := cabService.RegisterUser(name)
+	if err != nil {
+		log.Fatalf("Expected %s to be registered, got %v", name, err)
+	}
+	return user
+}
+
+func mustRegisterCab(cabService src.CabService, name string, category src.VehicleCategory) *src.Cab {
+	cab, err := cabService.RegisterCab(name, category)
+	if err != nil {
+		log.Fatalf("Expected cab %s to be registered, got %v", name, err)
+	}
+	return cab
+}
+
+func mustBookRide(cabService src.CabService, userId string, startLat, startLon, endLat, endLon float64) *src.Ride {
+	ride, err := cabService.BookRide(userId, startLat, startLon, endLat, endLon)
+	if err != nil {
+		log.Fatalf("Expected the ride to be booked, got %v", err)
+	}
+	return ride
+}
+
+// waitForOffer polls the dispatcher the way a rider app would until the ride is
+// offered to a driver and returns the pending offer.
+func waitForOffer(cabService src.CabService, rideId string, attempt int) *src.RideOffer {
+	for i := 0; i < 100; i++ {
+		offer, err := cabService.GetRideOffer(rideId)
+		if err == nil && offer.GetAttempt() == attempt && offer.GetStatus() == src.OfferPending {
+			return offer
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	log.Fatalf("Expected ride %s to be offered to a driver (attempt %d)", rideId, attempt)
+	return nil
 }
 
 func testCabBookingToCompletion(cabService src.CabService, user *src.User) {
@@ -35,27 +325,62 @@ func testCabBookingToCompletion(cabService src.CabService, user *src.User) {
 	// Booking a ride
 	startLat, startLon := 12.9716, 77.5946 // Example coordinates (Bangalore)
 	endLat, endLon := 15.2958, 70.6396     // Example coordinates (Mysore)
-	ride := cabService.BookRide(user.GetId(), startLat, startLon, endLat, endLon)
+	ride := mustBookRide(cabService, user.GetId(), startLat, startLon, endLat, endLon)
 	fmt.Print(ride)
-	// Simulating the ride status update after 1 second
-	time.Sleep(1 * time.Second)
+
+	// Driver accepts the offer
+	offer := waitForOffer(cabService, ride.GetId(), 1)
+	fmt.Println(offer)
+	if err := cabService.AcceptRide(ride.GetId(), offer.GetCabId()); err != nil {
+		log.Fatalf("Expected driver to accept the ride, got %v", err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	ride, _ = cabService.GetRide(ride.GetId())
 	fmt.Print(ride)
 
 	// Check the ride status
-	status := cabService.GetRideStatus(ride.GetId())
+	status := rideStatus(cabService, ride.GetId())
 	if status != src.Confirmed {
 		log.Fatalf("Expected ride status to be 'Confirmed', got '%v'", status)
 	}
 
 	fmt.Println("Ride confirmed successfully.")
+	if _, err := cabService.GetRideStatus("nothing"); !errors.Is(err, src.ErrRideNotFound) {
+		log.Fatalf("Expected %v for the status of an unknown ride, got %v", src.ErrRideNotFound, err)
+	}
 
-	// Simulating ride completion
-	cabService.UpdateRideStatus(ride.GetId(), src.Completed)
-	status = cabService.GetRideStatus(ride.GetId())
+	// A ride cannot be completed before the rider is picked up
+	if _, err := cabService.UpdateRideStatus(ride.GetId(), src.Completed); !errors.Is(err, src.ErrInvalidTransition) {
+		log.Fatalf("Expected %v when completing a ride that was never picked up, got %v", src.ErrInvalidTransition, err)
+	}
+
+	// Simulating pickup and ride completion
+	if _, err := cabService.UpdateRideStatus(ride.GetId(), src.PickedUp); err != nil {
+		log.Fatalf("Expected ride to be picked up, got %v", err)
+	}
+	ride, err := cabService.UpdateRideStatus(ride.GetId(), src.Completed)
+	if err != nil {
+		log.Fatalf("Expected ride to be completed, got %v", err)
+	}
+	status = rideStatus(cabService, ride.GetId())
 	if status != src.Completed {
 		log.Fatalf("Expected ride status to be 'Completed', got '%v'", status)
 	}
 
+	// The rider was quoted an estimate, the final fare is itemised from the actual trip
+	fmt.Println(ride.GetFareEstimate())
+	finalFare := ride.GetFinalFare()
+	if finalFare == nil || !finalFare.IsFinal || finalFare.Total != ride.GetTotalAmount() {
+		log.Fatalf("Expected the completed ride to carry its final fare")
+	}
+	fmt.Println(finalFare)
+
+	timeline, _ := cabService.GetRideTimeline(ride.GetId())
+	if len(timeline) != 3 {
+		log.Fatalf("Expected 3 transitions in the ride timeline, got %d", len(timeline))
+	}
+	fmt.Println(timeline)
+
 	fmt.Println("Test Scenario 1 completed successfully.")
 }
 
@@ -65,20 +390,2114 @@ func testCabBookingWithCancellation(cabService src.CabService, user *src.User) {
 	// Booking a ride
 	startLat, startLon := 12.9716, 77.5946 // Example coordinates (Bangalore)
 	endLat, endLon := 6.2958, 70.6396      // Example coordinates (Mysore)
-	ride := cabService.BookRide(user.GetId(), startLat, startLon, endLat, endLon)
+	ride := mustBookRide(cabService, user.GetId(), startLat, startLon, endLat, endLon)
 	fmt.Print(ride)
-	// Simulating the ride status update after 1 second
-	time.Sleep(1 * time.Second)
+
+	offer := waitForOffer(cabService, ride.GetId(), 1)
+	cabService.AcceptRide(ride.GetId(), offer.GetCabId())
+	time.Sleep(50 * time.Millisecond)
+	ride, _ = cabService.GetRide(ride.GetId())
 	fmt.Print(ride)
 
 	// Canceling the ride
 	cabService.UpdateRideStatus(ride.GetId(), src.Canceled)
 
 	// Check the ride status
-	status := cabService.GetRideStatus(ride.GetId())
+	status := rideStatus(cabService, ride.GetId())
 	if status != src.Canceled {
 		log.Fatalf("Expected ride status to be 'Canceled', got '%v'", status)
 	}
 
 	fmt.Println("Test Scenario 2 completed successfully.")
 }
+
+func testCabBookingWithNoDriverAccepting(cabService src.CabService, user *src.User) {
+	fmt.Println("Starting Test Scenario 3: Cab Booking with No Driver Accepting")
+
+	startLat, startLon := 12.9716, 77.5946
+	endLat, endLon := 12.2958, 76.6394
+	ride := mustBookRide(cabService, user.GetId(), startLat, startLon, endLat, endLon)
+
+	// Nearest driver declines, the offer moves on to the next cab
+	firstOffer := waitForOffer(cabService, ride.GetId(), 1)
+	if err := cabService.RejectRide(ride.GetId(), firstOffer.GetCabId()); err != nil {
+		log.Fatalf("Expected driver to reject the ride, got %v", err)
+	}
+	secondOffer := waitForOffer(cabService, ride.GetId(), 2)
+	if secondOffer.GetCabId() == firstOffer.GetCabId() {
+		log.Fatalf("Expected ride to be offered to a different cab after rejection")
+	}
+	if err := cabService.AcceptRide(ride.GetId(), firstOffer.GetCabId()); err != src.ErrOfferNotForCab {
+		log.Fatalf("Expected %v when a driver accepts someone else's offer, got %v", src.ErrOfferNotForCab, err)
+	}
+
+	// Second driver lets the offer expire and no other cab is left to try, so the
+	// ride waits in the pending queue until its deadline passes
+	time.Sleep(300 * time.Millisecond)
+	pending, err := cabService.GetPendingRide(ride.GetId())
+	if err != nil {
+		log.Fatalf("Expected ride to wait in the pending queue, got %v", err)
+	}
+	fmt.Println(pending)
+	time.Sleep(time.Until(pending.GetDeadline()) + 200*time.Millisecond)
+	status := rideStatus(cabService, ride.GetId())
+	if status != src.NoCabFound {
+		log.Fatalf("Expected ride status to be 'NoCabFound', got '%v'", status)
+	}
+
+	fmt.Println("Test Scenario 3 completed successfully.")
+}
+
+func testSurgePricing(cabService src.CabService) {
+	fmt.Println("Starting Test Scenario 4: Surge Pricing")
+
+	// No cabs are waiting around Whitefield, so every new request raises demand
+	startLat, startLon := 12.9698, 77.7500
+	endLat, endLon := 12.9716, 77.5946
+	rides := make([]*src.Ride, 0)
+	for _, name := range []string{"Asha", "Ravi", "Meera"} {
+		rider := mustRegisterUser(cabService, name)
+		rides = append(rides, mustBookRide(cabService, rider.GetId(), startLat, startLon, endLat, endLon))
+	}
+	firstRide, lastRide := rides[0], rides[len(rides)-1]
+	fmt.Printf("First quote: %d (%.1fx), latest quote: %d (%.1fx)\n", firstRide.GetTotalAmount(), firstRide.GetSurgeMultiplier(), lastRide.GetTotalAmount(), lastRide.GetSurgeMultiplier())
+	if lastRide.GetSurgeMultiplier() <= firstRide.GetSurgeMultiplier() || lastRide.GetTotalAmount() <= firstRide.GetTotalAmount() {
+		log.Fatalf("Expected surge to rise as open requests outnumber cabs")
+	}
+	if lastRide.GetSurgeMultiplier() > 2.5 {
+		log.Fatalf("Expected surge to be capped at 2.5x, got %.1fx", lastRide.GetSurgeMultiplier())
+	}
+
+	// Riders polling for fares read the surge without adding to it
+	for i := 0; i < 20; i++ {
+		quotes, err := cabService.QuoteFares(startLat, startLon, endLat, endLon)
+		if err != nil || quotes[0].Fare.SurgeMultiplier != lastRide.GetSurgeMultiplier() {
+			log.Fatalf("Expected quotes at the %.1fx surge of the last booking, got %v", lastRide.GetSurgeMultiplier(), err)
+		}
+	}
+
+	for _, ride := range rides {
+		cabService.UpdateRideStatus(ride.GetId(), src.Canceled)
+	}
+
+	fmt.Println("Test Scenario 4 completed successfully.")
+}
+
+func testParallelBookings(cabService src.CabService) {
+	fmt.Println("Starting Test Scenario 5: Parallel Bookings")
+
+	startLat, startLon := 12.9716, 77.5946
+	endLat, endLon := 12.9352, 77.6245
+	for i := 0; i < 3; i++ {
+		cab := mustRegisterCab(cabService, fmt.Sprintf("Etios %d", i), src.Sedan)
+		cabService.UpdateCabLocation(cab.GetId(), startLat+float64(i)*0.002, startLon)
+	}
+	riders := 10
+	rides := make([]*src.Ride, riders)
+	var wg sync.WaitGroup
+	for i := 0; i < riders; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			rider := mustRegisterUser(cabService, fmt.Sprintf("Rider %d", i))
+			rides[i] = mustBookRide(cabService, rider.GetId(), startLat, startLon, endLat, endLon)
+		}(i)
+	}
+	wg.Wait()
+
+	// Every driver accepts whatever they are offered as fast as they can
+	acceptAllOffers(cabService, rides)
+
+	ridesPerCab := make(map[string]int)
+	for _, ride := range rides {
+		ride, _ = cabService.GetRide(ride.GetId())
+		if ride.GetStatus() == src.Confirmed {
+			ridesPerCab[ride.GetCabId()]++
+		}
+	}
+	for cabId, count := range ridesPerCab {
+		if count > 1 {
+			log.Fatalf("Expected cab %s to be assigned to at most one ride, got %d", cabId, count)
+		}
+	}
+	fmt.Printf("%d of %d riders got a cab\n", len(ridesPerCab), riders)
+
+	for _, ride := range rides {
+		cabService.UpdateRideStatus(ride.GetId(), src.Canceled)
+	}
+
+	fmt.Println("Test Scenario 5 completed successfully.")
+}
+
+func testPendingRideQueue(cabService src.CabService) {
+	fmt.Println("Starting Test Scenario 6: Pending Ride Queue")
+
+	startLat, startLon := 12.9716, 77.5946
+	endLat, endLon := 12.9352, 77.6245
+
+	// Keep every cab busy
+	busyRides := make([]*src.Ride, 0)
+	for cabService.GetPendingQueueStats().Depth == 0 {
+		rider := mustRegisterUser(cabService, "Commuter")
+		busyRides = append(busyRides, mustBookRide(cabService, rider.GetId(), startLat, startLon, endLat, endLon))
+		acceptAllOffers(cabService, busyRides[len(busyRides)-1:])
+	}
+	regularRide := busyRides[len(busyRides)-1]
+	busyRides = busyRides[:len(busyRides)-1]
+
+	// A priority rider joins the queue later but is served first
+	priorityRider := mustRegisterUser(cabService, "Priority Rider")
+	cabService.SetUserPriorityTier(priorityRider.GetId(), 1)
+	priorityRide := mustBookRide(cabService, priorityRider.GetId(), startLat, startLon, endLat, endLon)
+	time.Sleep(20 * time.Millisecond)
+
+	pending, err := cabService.GetPendingRide(priorityRide.GetId())
+	if err != nil || pending.GetPosition() != 1 {
+		log.Fatalf("Expected the priority ride to be first in the queue, got %v %v", pending, err)
+	}
+	stats := cabService.GetPendingQueueStats()
+	fmt.Printf("Queue depth: %d, by tier: %v, oldest wait: %v\n", stats.Depth, stats.DepthByTier, stats.OldestWait.Round(time.Millisecond))
+	if stats.Depth != 2 {
+		log.Fatalf("Expected 2 rides waiting in the queue, got %d", stats.Depth)
+	}
+
+	// A cab frees up and is offered to the priority rider straight away
+	cabService.UpdateRideStatus(busyRides[0].GetId(), src.PickedUp)
+	cabService.UpdateRideStatus(busyRides[0].GetId(), src.Completed)
+	offer := waitForOffer(cabService, priorityRide.GetId(), 1)
+	if _, err := cabService.GetRideOffer(regularRide.GetId()); err == nil {
+		log.Fatalf("Expected the regular ride to keep waiting while the priority ride is offered the cab")
+	}
+	cabService.AcceptRide(priorityRide.GetId(), offer.GetCabId())
+	time.Sleep(20 * time.Millisecond)
+	if status := rideStatus(cabService, priorityRide.GetId()); status != src.Confirmed {
+		log.Fatalf("Expected the priority ride to be confirmed, got '%v'", status)
+	}
+	if stats := cabService.GetPendingQueueStats(); stats.Depth != 1 || stats.Matched == 0 {
+		log.Fatalf("Expected one ride left in the queue after a match, got %+v", stats)
+	}
+
+	for _, ride := range append(busyRides, regularRide, priorityRide) {
+		cabService.UpdateRideStatus(ride.GetId(), src.Canceled)
+	}
+
+	fmt.Println("Test Scenario 6 completed successfully.")
+}
+
+func testRideLifecycleEvents(cabService src.CabService, eventBus src.EventBus) {
+	fmt.Println("Starting Test Scenario 7: Ride Lifecycle Events")
+
+	recorder := &eventRecorder{events: make(chan src.RideEvent, 256)}
+	unsubscribeRecorder := eventBus.Subscribe(recorder)
+	defer unsubscribeRecorder()
+	unsubscribeBroken := eventBus.Subscribe(brokenSubscriber{})
+	defer unsubscribeBroken()
+
+	rider := mustRegisterUser(cabService, "Nikhil")
+	ride := mustBookRide(cabService, rider.GetId(), 12.9716, 77.5946, 12.9352, 77.6245)
+	offer := waitForOffer(cabService, ride.GetId(), 1)
+	cabService.AcceptRide(ride.GetId(), offer.GetCabId())
+	time.Sleep(20 * time.Millisecond)
+	cabService.UpdateRideStatus(ride.GetId(), src.PickedUp)
+	cabService.UpdateRideStatus(ride.GetId(), src.Completed)
+
+	expected := []src.RideEventType{src.RideRequested, src.RideOffered, src.CabAssigned, src.RidePickedUp, src.RideCompleted}
+	received := make([]src.RideEventType, 0)
+	timeout := time.After(time.Second)
+	for len(received) < len(expected) {
+		select {
+		case event := <-recorder.events:
+			if event.RideId == ride.GetId() {
+				received = append(received, event.Type)
+			}
+		case <-timeout:
+			log.Fatalf("Expected events %v, got %v", expected, received)
+		}
+	}
+	for i := range expected {
+		if received[i] != expected[i] {
+			log.Fatalf("Expected events %v, got %v", expected, received)
+		}
+	}
+	fmt.Println("Received", received)
+
+	// A subscriber that falls far behind still gets every event, in order
+	slowBus := src.NewInMemoryEventBus(64)
+	slow := &eventRecorder{events: make(chan src.RideEvent)}
+	unsubscribeSlow := slowBus.Subscribe(slow)
+	defer unsubscribeSlow()
+	for i := 0; i < 500; i++ {
+		slowBus.Publish(src.RideEvent{Type: src.CabLocationUpdated, CabId: strconv.Itoa(i)})
+	}
+	for i := 0; i < 500; i++ {
+		select {
+		case event := <-slow.events:
+			if event.CabId != strconv.Itoa(i) {
+				log.Fatalf("Expected event %d next, got the one for %s", i, event.CabId)
+			}
+		case <-time.After(time.Second):
+			log.Fatalf("Expected all 500 events to reach the slow subscriber, got %d", i)
+		}
+	}
+
+	fmt.Println("Test Scenario 7 completed successfully.")
+}
+
+// callAPI sends the request body as JSON, decodes the JSON reply into response
+// when one is given and returns the HTTP status code.
+// waitForPending polls until the ride found no cab and waits in the pending
+// queue.
+func waitForPending(cabService src.CabService, rideId string) {
+	for i := 0; ; i++ {
+		if _, err := cabService.GetPendingRide(rideId); err == nil {
+			return
+		}
+		if i == 100 {
+			log.Fatalf("Expected ride %s to wait for a cab in the pending queue", rideId)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// newRatingManager gives the scenarios that do not exercise ratings one with a
+// lenient policy.
+func newRatingManager(repos repositories, eventBus src.EventBus, clock src.Clock) src.RatingManager {
+	return src.NewPostRideRatingManager(repos.ratingRepo, repos.userRepo, repos.cabRepo, repos.rideRepo, eventBus, clock, src.RatingPolicy{
+		SubmissionWindow: 24 * time.Hour,
+		RollingWindow:    50,
+		MaxTags:          5,
+	})
+}
+
+// newCancellationManager gives the scenarios that do not exercise cancellation
+// fees one that never charges and never deprioritises a driver.
+func newCancellationManager(repos repositories, eventBus src.EventBus, clock src.Clock) src.CancellationManager {
+	return src.NewPolicyCancellationManager(repos.cabRepo, src.NewHaversineDistanceCalculator(), eventBus, clock, src.CancellationPolicy{
+		FreeWindow:                time.Hour,
+		FreeDistanceKm:            100,
+		MaxDriverCancellationRate: 1,
+	})
+}
+
+// newPaymentProcessor gives the scenarios one that charges cards through the
+// fake gateway.
+func newPaymentProcessor(repos repositories, eventBus src.EventBus, clock src.Clock) src.PaymentProcessor {
+	return src.NewLedgerPaymentProcessor(repos.paymentRepo, repos.ledgerRepo, repos.userRepo, src.NewFakePaymentGateway(), src.NewIdGenerationUsingUUID(), eventBus, clock)
+}
+
+// newPromotionManager gives the scenarios that do not exercise promo codes one
+// that never rewards a referral.
+func newPromotionManager(repos repositories, eventBus src.EventBus, clock src.Clock) src.PromotionManager {
+	return src.NewReservingPromotionManager(repos.promotionRepo, repos.userRepo, repos.rideRepo, newPaymentProcessor(repos, eventBus, clock), src.NewGridZoneResolver(0.05),
+		src.NewIdGenerationUsingUUID(), eventBus, clock, src.PromotionPolicy{})
+}
+
+// newZoneManager gives the scenarios that do not exercise service areas one
+// that lets rides be booked anywhere.
+func newZoneManager(repos repositories, eventBus src.EventBus, clock src.Clock) src.ZoneManager {
+	return src.NewQueueingZoneManager(repos.cabRepo, eventBus, clock, src.ZonePolicy{})
+}
+
+// newDriverManager gives the scenarios that do not exercise driver earnings
+// one that keeps a flat commission and pays no bonus.
+func newDriverManager(repos repositories, eventBus src.EventBus, clock src.Clock) src.DriverManager {
+	return src.NewLedgerDriverManager(repos.earningsRepo, repos.cabRepo, repos.rideRepo, src.NewIdGenerationUsingUUID(), eventBus, clock, src.EarningsPolicy{CommissionPercent: 20})
+}
+
+func testScheduledRides() {
+	fmt.Println("Starting Test Scenario 11: Scheduled Rides")
+
+	clock := src.NewManualClock(time.Date(2026, time.March, 2, 5, 0, 0, 0, time.Local))
+	idGenerationStrategy := src.NewIdGenerationUsingUUID()
+	distanceCalculator := src.NewHaversineDistanceCalculator()
+	repos := newInMemoryRepositories(clock)
+	eventBus := src.NewInMemoryEventBus(64)
+	pricingStrategy := src.NewFixPricingStrategy(10, distanceCalculator)
+	poolManager := src.NewInMemoryPoolManager(repos.cabRepo, idGenerationStrategy, distanceCalculator, src.PoolPolicy{Capacity: 3})
+	rideDispatcher := src.NewOfferDispatcher(repos.cabRepo, repos.rideRepo, src.NewNearestAvailableCarFindingStrategy(repos.cabRepo, distanceCalculator, 0),
+		src.NewInMemoryPendingRideQueue(time.Second, 100*time.Millisecond, 400*time.Millisecond), poolManager, eventBus, clock, 200*time.Millisecond, 3)
+	rideScheduler := src.NewLeadTimeRideScheduler(clock, repos.rideRepo, rideDispatcher, eventBus, 30*time.Minute, time.Minute)
+	defer rideScheduler.Close()
+	cabService := src.NewInMemoryCabService(repos.userRepo, repos.cabRepo, repos.rideRepo, idGenerationStrategy, pricingStrategy, rideDispatcher, poolManager,
+		newRatingManager(repos, eventBus, clock), newCancellationManager(repos, eventBus, clock), newPaymentProcessor(repos, eventBus, clock), newPromotionManager(repos, eventBus, clock), newDriverManager(repos, eventBus, clock), newZoneManager(repos, eventBus, clock), eventBus, clock)
+	defer cabService.Close()
+
+	rider := mustRegisterUser(cabService, "Ishaan")
+	cab := mustRegisterCab(cabService, "Crysta", src.SUV)
+	cabService.UpdateCabLocation(cab.GetId(), 12.9716, 77.5946)
+	airport := src.GeoPoint{Lat: 13.1989, Lon: 77.7068}
+
+	if _, err := cabService.ScheduleRide(rider.GetId(), 12.9716, 77.5946, airport.Lat, airport.Lon, clock.Now().Add(-time.Minute)); !errors.Is(err, src.ErrInvalidPickupTime) {
+		log.Fatalf("Expected %v for a pickup in the past, got %v", src.ErrInvalidPickupTime, err)
+	}
+	ride, err := cabService.ScheduleRide(rider.GetId(), 12.9716, 77.5946, airport.Lat, airport.Lon, clock.Now().Add(2*time.Hour))
+	if err != nil || ride.GetStatus() != src.Scheduled || ride.GetFareEstimate() == nil {
+		log.Fatalf("Expected a quoted scheduled ride, got %v (%v)", ride, err)
+	}
+	fmt.Printf("Scheduled ride %s for %s, estimate %d\n", ride.GetId(), ride.GetScheduledPickupAt().Format(time.Kitchen), ride.GetTotalAmount())
+
+	// A ride cancelled before dispatch can no longer be moved
+	cancelled, _ := cabService.ScheduleRide(rider.GetId(), 12.9716, 77.5946, airport.Lat, airport.Lon, clock.Now().Add(time.Hour))
+	if _, err := cabService.UpdateRideStatus(cancelled.GetId(), src.Canceled); err != nil {
+		log.Fatalf("Expected a scheduled ride to be cancelled, got %v", err)
+	}
+	if _, err := cabService.RescheduleRide(cancelled.GetId(), clock.Now().Add(3*time.Hour)); !errors.Is(err, src.ErrRideNotScheduled) {
+		log.Fatalf("Expected %v when moving a cancelled ride, got %v", src.ErrRideNotScheduled, err)
+	}
+
+	// The rider moves the pickup back by an hour
+	if ride, err = cabService.RescheduleRide(ride.GetId(), clock.Now().Add(3*time.Hour)); err != nil {
+		log.Fatalf("Expected the ride to be rescheduled, got %v", err)
+	}
+	clock.Advance(2 * time.Hour)
+	if started := rideScheduler.DispatchDue(); len(started) != 0 || rideStatus(cabService, ride.GetId()) != src.Scheduled {
+		log.Fatalf("Expected the ride to wait until 30 minutes before its new pickup time")
+	}
+
+	// Within the lead time the scheduler's ticker starts dispatch
+	clock.Advance(31 * time.Minute)
+	for i := 0; rideStatus(cabService, ride.GetId()) == src.Scheduled; i++ {
+		if i == 100 {
+			log.Fatalf("Expected dispatch to start within the lead time")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	offer := waitForOffer(cabService, ride.GetId(), 1)
+	cabService.AcceptRide(ride.GetId(), offer.GetCabId())
+	for rideStatus(cabService, ride.GetId()) != src.Confirmed {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if _, err := cabService.RescheduleRide(ride.GetId(), clock.Now().Add(time.Hour)); !errors.Is(err, src.ErrRideNotScheduled) {
+		log.Fatalf("Expected %v once dispatch started, got %v", src.ErrRideNotScheduled, err)
+	}
+	timeline, _ := cabService.GetRideTimeline(ride.GetId())
+	if len(timeline) != 2 || timeline[0].From != src.Scheduled || !timeline[0].At.Equal(clock.Now()) {
+		log.Fatalf("Expected dispatch to start at %v, got %v", clock.Now(), timeline)
+	}
+
+	fmt.Println("Test Scenario 11 completed successfully.")
+}
+
+func testPooledRides() {
+	fmt.Println("Starting Test Scenario 12: Pooled Rides")
+
+	idGenerationStrategy := src.NewIdGenerationUsingUUID()
+	distanceCalculator := src.NewHaversineDistanceCalculator()
+	repos := newInMemoryRepositories(src.NewSystemClock())
+	eventBus := src.NewInMemoryEventBus(64)
+	poolPolicy := src.PoolPolicy{Capacity: 3, MaxDetourFactor: 0.5, MaxPickupDistanceKm: 3, MaxFareShare: 0.8, MinFareShare: 0.5}
+	poolManager := src.NewInMemoryPoolManager(repos.cabRepo, idGenerationStrategy, distanceCalculator, poolPolicy)
+	soloPricingStrategy := src.NewFixPricingStrategy(10, distanceCalculator)
+	cabFindingStrategy := src.NewPoolAwareCabFindingStrategy(src.NewNearestAvailableCarFindingStrategy(repos.cabRepo, distanceCalculator, 0), poolManager)
+	rideDispatcher := src.NewOfferDispatcher(repos.cabRepo, repos.rideRepo, cabFindingStrategy,
+		src.NewInMemoryPendingRideQueue(2*time.Second, 100*time.Millisecond, 400*time.Millisecond), poolManager, eventBus, src.NewSystemClock(), 200*time.Millisecond, 3)
+	cabService := src.NewInMemoryCabService(repos.userRepo, repos.cabRepo, repos.rideRepo, idGenerationStrategy,
+		src.NewPoolPricingStrategy(soloPricingStrategy, poolManager), rideDispatcher, poolManager,
+		newRatingManager(repos, eventBus, src.NewSystemClock()), newCancellationManager(repos, eventBus, src.NewSystemClock()),
+		newPaymentProcessor(repos, eventBus, src.NewSystemClock()), newPromotionManager(repos, eventBus, src.NewSystemClock()),
+		newDriverManager(repos, eventBus, src.NewSystemClock()), newZoneManager(repos, eventBus, src.NewSystemClock()), eventBus, src.NewSystemClock())
+	defer cabService.Close()
+
+	cab := mustRegisterCab(cabService, "Ertiga", src.SUV)
+	cabService.UpdateCabLocation(cab.GetId(), 12.9352, 77.6245)
+	bookPool := func(name string, startLat, startLon, endLat, endLon float64, seats int) *src.Ride {
+		ride, err := cabService.BookRide(mustRegisterUser(cabService, name).GetId(), startLat, startLon, endLat, endLon, src.WithPool(seats))
+		if err != nil {
+			log.Fatalf("Expected %s's pool ride to be booked, got %v", name, err)
+		}
+		return ride
+	}
+
+	if _, err := cabService.BookRide(mustRegisterUser(cabService, "Kabir").GetId(), 12.9352, 77.6245, 12.9716, 77.6412, src.WithPool(4)); !errors.Is(err, src.ErrInvalidSeats) {
+		log.Fatalf("Expected %v for more seats than a pooled cab has, got %v", src.ErrInvalidSeats, err)
+	}
+
+	// The first rider starts a pool with the free cab
+	first := bookPool("Meera", 12.9352, 77.6245, 12.9716, 77.6412, 1)
+	if share := first.GetFareEstimate().PoolShare; share != poolPolicy.MaxFareShare {
+		log.Fatalf("Expected an unmatched rider to be quoted the maximum share, got %.2f", share)
+	}
+	cabService.AcceptRide(first.GetId(), waitForOffer(cabService, first.GetId(), 1).GetCabId())
+
+	// A second rider heading the same way is offered the busy cab
+	second := bookPool("Rohan", 12.9450, 77.6290, 12.9780, 77.6400, 1)
+	offer := waitForOffer(cabService, second.GetId(), 1)
+	if offer.GetCabId() != cab.GetId() {
+		log.Fatalf("Expected the second rider to be offered the pooled cab, got %s", offer.GetCabId())
+	}
+	cabService.AcceptRide(second.GetId(), offer.GetCabId())
+	for rideStatus(cabService, second.GetId()) != src.Confirmed {
+		time.Sleep(5 * time.Millisecond)
+	}
+	trip, err := cabService.GetPoolTrip(second.GetId())
+	if err != nil || len(trip.GetRideIds()) != 2 || trip.GetRideIds()[0] != first.GetId() {
+		log.Fatalf("Expected both riders in one pool, first rider first, got %v (%v)", trip, err)
+	}
+	for _, stop := range trip.GetStops() {
+		fmt.Printf("  %-6v %s\n", stop.Kind, stop.RideId)
+	}
+
+	// A rider going the other way would drag everyone off route, and a group
+	// of two does not fit next to the riders already on board
+	opposite := bookPool("Farah", 12.9400, 77.6270, 12.9000, 77.6000, 1)
+	group := bookPool("Dev", 12.9460, 77.6300, 12.9700, 77.6420, 2)
+	waitForPending(cabService, opposite.GetId())
+	waitForPending(cabService, group.GetId())
+	cabService.UpdateRideStatus(opposite.GetId(), src.Canceled)
+	cabService.UpdateRideStatus(group.GetId(), src.Canceled)
+
+	// Riders are picked up and dropped in the planned order; the cab stays busy
+	// until the last one is out
+	for _, stop := range trip.GetStops() {
+		status := src.PickedUp
+		if stop.Kind == src.DropStop {
+			status = src.Completed
+		}
+		if _, err := cabService.UpdateRideStatus(stop.RideId, status); err != nil {
+			log.Fatalf("Expected ride %s to move to %v, got %v", stop.RideId, status, err)
+		}
+		cabStatus := repos.cabRepo.GetCabById(cab.GetId()).GetCabStatus()
+		if lastStop := stop == trip.GetStops()[len(trip.GetStops())-1]; lastStop != (cabStatus == src.ReadyToTakeRide) {
+			log.Fatalf("Expected the cab to be freed only after the last drop, got %v", cabStatus)
+		}
+	}
+	if _, err := cabService.GetPoolTrip(first.GetId()); !errors.Is(err, src.ErrNotInPool) {
+		log.Fatalf("Expected the pool to end with its last drop, got %v", err)
+	}
+
+	// Each rider pays for their share of the legs they rode
+	for _, ride := range []*src.Ride{first, second} {
+		ride, _ = cabService.GetRide(ride.GetId())
+		fare := ride.GetFinalFare()
+		solo := soloPricingStrategy.CalculateFinalFare(ride)
+		if fare.PoolShare < poolPolicy.MinFareShare || fare.PoolShare >= poolPolicy.MaxFareShare || fare.Total >= solo.Total {
+			log.Fatalf("Expected a shared ride to cost less than the solo fare %d, got %v", solo.Total, fare)
+		}
+		fmt.Printf("Ride %s paid %d instead of %d (share %.2f)\n", ride.GetId(), fare.Total, solo.Total, fare.PoolShare)
+	}
+
+	fmt.Println("Test Scenario 12 completed successfully.")
+}
+
+func testVehicleCategories() {
+	fmt.Println("Starting Test Scenario 13: Vehicle Categories")
+
+	idGenerationStrategy := src.NewIdGenerationUsingUUID()
+	distanceCalculator := src.NewHaversineDistanceCalculator()
+	repos := newInMemoryRepositories(src.NewSystemClock())
+	eventBus := src.NewInMemoryEventBus(64)
+	poolManager := src.NewInMemoryPoolManager(repos.cabRepo, idGenerationStrategy, distanceCalculator, src.PoolPolicy{Capacity: 3, MaxDetourFactor: 0.5, MaxFareShare: 0.8, MinFareShare: 0.5})
+	pricingStrategy := src.NewCategoryPricingStrategy(map[src.VehicleCategory]src.PricingStrategy{
+		src.Hatchback: src.NewFixPricingStrategy(10, distanceCalculator),
+		src.Sedan:     src.NewFixPricingStrategy(12, distanceCalculator),
+		src.SUV:       src.NewFixPricingStrategy(18, distanceCalculator),
+		src.Auto:      src.NewFixPricingStrategy(8, distanceCalculator),
+		src.Bike:      src.NewFixPricingStrategy(5, distanceCalculator),
+	}, src.Sedan)
+	rideDispatcher := src.NewOfferDispatcher(repos.cabRepo, repos.rideRepo, src.NewNearestAvailableCarFindingStrategy(repos.cabRepo, distanceCalculator, 0),
+		src.NewInMemoryPendingRideQueue(2*time.Second, 100*time.Millisecond, 400*time.Millisecond), poolManager, eventBus, src.NewSystemClock(), 200*time.Millisecond, 3)
+	cabService := src.NewInMemoryCabService(repos.userRepo, repos.cabRepo, repos.rideRepo, idGenerationStrategy, pricingStrategy, rideDispatcher, poolManager,
+		newRatingManager(repos, eventBus, src.NewSystemClock()), newCancellationManager(repos, eventBus, src.NewSystemClock()),
+		newPaymentProcessor(repos, eventBus, src.NewSystemClock()), newPromotionManager(repos, eventBus, src.NewSystemClock()),
+		newDriverManager(repos, eventBus, src.NewSystemClock()), newZoneManager(repos, eventBus, src.NewSystemClock()), eventBus, src.NewSystemClock())
+	defer cabService.Close()
+
+	rider := mustRegisterUser(cabService, "Tara")
+	auto := mustRegisterCab(cabService, "Ape", src.Auto)
+	cabService.UpdateCabLocation(auto.GetId(), 12.9352, 77.6245)
+	suv := mustRegisterCab(cabService, "XUV", src.SUV)
+	cabService.UpdateCabLocation(suv.GetId(), 12.9400, 77.6300)
+	bike := mustRegisterCab(cabService, "Splendor", src.Bike)
+	cabService.UpdateCabLocation(bike.GetId(), 12.9360, 77.6250)
+
+	// One call quotes every category
+	quotes, err := cabService.QuoteFares(12.9352, 77.6245, 12.9716, 77.6412)
+	if err != nil || len(quotes) != len(src.VehicleCategories()) {
+		log.Fatalf("Expected a quote per category, got %v (%v)", quotes, err)
+	}
+	quoted := make(map[src.VehicleCategory]int, len(quotes))
+	for _, quote := range quotes {
+		quoted[quote.Category] = quote.Fare.Total
+		fmt.Printf("  %-9v %d seats %5d\n", quote.Category, quote.Seats, quote.Fare.Total)
+	}
+	if !(quoted[src.Bike] < quoted[src.Auto] && quoted[src.Auto] < quoted[src.Hatchback] && quoted[src.Sedan] < quoted[src.SUV]) {
+		log.Fatalf("Expected each category to be priced at its own rates, got %v", quoted)
+	}
+
+	// An SUV ride skips the nearer auto and bike and is priced as quoted
+	ride, err := cabService.BookRide(rider.GetId(), 12.9352, 77.6245, 12.9716, 77.6412, src.WithVehicleCategory(src.SUV))
+	if err != nil || ride.GetTotalAmount() != quoted[src.SUV] {
+		log.Fatalf("Expected the SUV ride to be booked at its quote %d, got %v (%v)", quoted[src.SUV], ride, err)
+	}
+	if offer := waitForOffer(cabService, ride.GetId(), 1); offer.GetCabId() != suv.GetId() {
+		log.Fatalf("Expected the SUV ride to be offered to the SUV, got %s", offer.GetCabId())
+	}
+	cabService.AcceptRide(ride.GetId(), suv.GetId())
+
+	// A ride open to any category goes to the nearest cab, at the standard rates
+	anyRide := mustBookRide(cabService, rider.GetId(), 12.9352, 77.6245, 12.9716, 77.6412)
+	if offer := waitForOffer(cabService, anyRide.GetId(), 1); offer.GetCabId() != auto.GetId() || anyRide.GetTotalAmount() != quoted[src.Sedan] {
+		log.Fatalf("Expected the nearest cab at sedan rates, got %s for %d", offer.GetCabId(), anyRide.GetTotalAmount())
+	}
+	cabService.UpdateRideStatus(anyRide.GetId(), src.Canceled)
+
+	// Nobody drives a sedan, so a sedan ride waits instead of taking another category
+	sedanRide, _ := cabService.BookRide(rider.GetId(), 12.9352, 77.6245, 12.9716, 77.6412, src.WithVehicleCategory(src.Sedan))
+	waitForPending(cabService, sedanRide.GetId())
+	cabService.UpdateRideStatus(sedanRide.GetId(), src.Canceled)
+
+	if _, err := cabService.BookRide(rider.GetId(), 12.9352, 77.6245, 12.9716, 77.6412, src.WithVehicleCategory(src.Bike), src.WithPool(2)); !errors.Is(err, src.ErrInvalidSeats) {
+		log.Fatalf("Expected %v for two riders on a bike, got %v", src.ErrInvalidSeats, err)
+	}
+
+	fmt.Println("Test Scenario 13 completed successfully.")
+}
+
+func testRatings() {
+	fmt.Println("Starting Test Scenario 14: Two-Way Ratings")
+
+	clock := src.NewManualClock(time.Now())
+	idGenerationStrategy := src.NewIdGenerationUsingUUID()
+	distanceCalculator := src.NewHaversineDistanceCalculator()
+	repos := newInMemoryRepositories(clock)
+	eventBus := src.NewInMemoryEventBus(64)
+	recorder := &eventRecorder{events: make(chan src.RideEvent, 256)}
+	eventBus.Subscribe(recorder)
+	poolManager := src.NewInMemoryPoolManager(repos.cabRepo, idGenerationStrategy, distanceCalculator, src.PoolPolicy{Capacity: 3})
+	ratingPolicy := src.RatingPolicy{SubmissionWindow: 24 * time.Hour, RollingWindow: 5, ReviewThreshold: 3, MinRatingsForReview: 3, MaxTags: 3}
+	ratingManager := src.NewPostRideRatingManager(repos.ratingRepo, repos.userRepo, repos.cabRepo, repos.rideRepo, eventBus, clock, ratingPolicy)
+	rideDispatcher := src.NewOfferDispatcher(repos.cabRepo, repos.rideRepo, src.NewRatingAwareCabFindingStrategy(repos.cabRepo, distanceCalculator, 0, 3, 1),
+		src.NewInMemoryPendingRideQueue(2*time.Second, 100*time.Millisecond, 400*time.Millisecond), poolManager, eventBus, clock, 200*time.Millisecond, 3)
+	cabService := src.NewInMemoryCabService(repos.userRepo, repos.cabRepo, repos.rideRepo, idGenerationStrategy, src.NewFixPricingStrategy(10, distanceCalculator),
+		rideDispatcher, poolManager, ratingManager, newCancellationManager(repos, eventBus, clock), newPaymentProcessor(repos, eventBus, clock), newPromotionManager(repos, eventBus, clock), newDriverManager(repos, eventBus, clock), newZoneManager(repos, eventBus, clock), eventBus, clock)
+	defer cabService.Close()
+
+	rider := mustRegisterUser(cabService, "Zoya")
+	punch := mustRegisterCab(cabService, "Punch", src.Hatchback)
+	cabService.UpdateCabLocation(punch.GetId(), 12.9352, 77.6245)
+	takeRide := func(completed bool) *src.Ride {
+		ride := mustBookRide(cabService, rider.GetId(), 12.9352, 77.6245, 12.9716, 77.6412)
+		offer := waitForOffer(cabService, ride.GetId(), 1)
+		cabService.AcceptRide(ride.GetId(), offer.GetCabId())
+		for rideStatus(cabService, ride.GetId()) != src.Confirmed {
+			time.Sleep(5 * time.Millisecond)
+		}
+		if completed {
+			cabService.UpdateRideStatus(ride.GetId(), src.PickedUp)
+			cabService.UpdateRideStatus(ride.GetId(), src.Completed)
+		}
+		ride, _ = cabService.GetRide(ride.GetId())
+		return ride
+	}
+
+	// Nobody rates a ride that has not ended, or a ride they were not on
+	ride := takeRide(false)
+	if _, err := cabService.RateDriver(ride.GetId(), rider.GetId(), 5, nil); !errors.Is(err, src.ErrRideNotCompleted) {
+		log.Fatalf("Expected %v before the drop, got %v", src.ErrRideNotCompleted, err)
+	}
+	cabService.UpdateRideStatus(ride.GetId(), src.PickedUp)
+	cabService.UpdateRideStatus(ride.GetId(), src.Completed)
+	if _, err := cabService.RateDriver(ride.GetId(), mustRegisterUser(cabService, "Stranger").GetId(), 5, nil); !errors.Is(err, src.ErrNotRideParticipant) {
+		log.Fatalf("Expected %v for a stranger, got %v", src.ErrNotRideParticipant, err)
+	}
+	if _, err := cabService.RateRider(ride.GetId(), punch.GetId(), 6, nil); !errors.Is(err, src.ErrInvalidRating) {
+		log.Fatalf("Expected %v for six stars, got %v", src.ErrInvalidRating, err)
+	}
+
+	// Each side rates once; repeated tags collapse into one
+	rating, err := cabService.RateDriver(ride.GetId(), rider.GetId(), 2, []string{"Late", "late ", "rude"})
+	if err != nil || len(rating.GetTags()) != 2 || rating.GetSubjectId() != punch.GetId() {
+		log.Fatalf("Expected the driver to be rated with 2 tags, got %v (%v)", rating, err)
+	}
+	if _, err := cabService.RateDriver(ride.GetId(), rider.GetId(), 5, nil); !errors.Is(err, src.ErrAlreadyRated) {
+		log.Fatalf("Expected %v for a second rating, got %v", src.ErrAlreadyRated, err)
+	}
+	if _, err := cabService.RateRider(ride.GetId(), punch.GetId(), 5, []string{"polite"}); err != nil {
+		log.Fatalf("Expected the driver to rate the rider, got %v", err)
+	}
+	ratings, _ := cabService.GetRideRatings(ride.GetId())
+	rated, _ := cabService.GetUser(rider.GetId())
+	if len(ratings) != 2 || rated.GetRating() != 5 || rated.GetRatingCount() != 1 {
+		log.Fatalf("Expected both ratings and a five star rider, got %v and %.1f", ratings, rated.GetRating())
+	}
+
+	// Two more poor rides pull the driver's rolling average under the threshold
+	for _, stars := range []int{1, 1} {
+		ride := takeRide(true)
+		if _, err := cabService.RateDriver(ride.GetId(), rider.GetId(), stars, nil); err != nil {
+			log.Fatalf("Expected the driver to be rated, got %v", err)
+		}
+	}
+	driver, _ := cabService.GetCab(punch.GetId())
+	if !driver.IsFlaggedForReview() || driver.GetRatingCount() != 3 {
+		log.Fatalf("Expected a %.2f average over 3 ratings to flag the driver, got %v", driver.GetRating(), driver)
+	}
+	for flagged := false; !flagged; {
+		select {
+		case event := <-recorder.events:
+			flagged = event.Type == src.CabFlaggedForReview && event.CabId == punch.GetId()
+		case <-time.After(time.Second):
+			log.Fatalf("Expected the driver's review to be announced")
+		}
+	}
+	fmt.Printf("Driver %s flagged for review at %.2f stars\n", driver.GetName(), driver.GetRating())
+
+	// The window to rate closes a day after the drop
+	late := takeRide(true)
+	clock.Advance(ratingPolicy.SubmissionWindow + time.Minute)
+	if _, err := cabService.RateDriver(late.GetId(), rider.GetId(), 4, nil); !errors.Is(err, src.ErrRatingWindowClosed) {
+		log.Fatalf("Expected %v after the window, got %v", src.ErrRatingWindowClosed, err)
+	}
+
+	// A well rated driver a little further away wins the next ride
+	nexon := mustRegisterCab(cabService, "Nexon", src.Hatchback)
+	repos.cabRepo.UpdateCab(nexon.GetId(), func(cab *src.Cab) error {
+		cab.SetRating(4.9, 40)
+		return nil
+	})
+	cabService.UpdateCabLocation(nexon.GetId(), 12.9400, 77.6290)
+	ride = mustBookRide(cabService, rider.GetId(), 12.9352, 77.6245, 12.9716, 77.6412)
+	if offer := waitForOffer(cabService, ride.GetId(), 1); offer.GetCabId() != nexon.GetId() {
+		log.Fatalf("Expected the better rated driver to be offered the ride, got %s", offer.GetCabId())
+	}
+
+	fmt.Println("Test Scenario 14 completed successfully.")
+}
+
+func testCancellations() {
+	fmt.Println("Starting Test Scenario 15: Cancellation Policy")
+
+	// The dispatcher confirms rides on this clock too, so minutes past the free window are exact
+	clock := src.NewManualClock(time.Now())
+	idGenerationStrategy := src.NewIdGenerationUsingUUID()
+	distanceCalculator := src.NewHaversineDistanceCalculator()
+	repos := newInMemoryRepositories(clock)
+	eventBus := src.NewInMemoryEventBus(64)
+	recorder := &eventRecorder{events: make(chan src.RideEvent, 256)}
+	eventBus.Subscribe(recorder)
+	poolManager := src.NewInMemoryPoolManager(repos.cabRepo, idGenerationStrategy, distanceCalculator, src.PoolPolicy{Capacity: 3})
+	policy := src.CancellationPolicy{
+		FreeWindow:                  2 * time.Minute,
+		FreeDistanceKm:              0.5,
+		BaseFee:                     50,
+		FeePerMinute:                5,
+		FeePerKm:                    10,
+		MaxFee:                      200,
+		MaxDriverCancellationRate:   0.4,
+		MinRidesForCancellationRate: 2,
+		DeprioritiseFor:             time.Hour,
+	}
+	cabFindingStrategy := src.NewCancellationAwareCabFindingStrategy(src.NewNearestAvailableCarFindingStrategy(repos.cabRepo, distanceCalculator, 0), clock)
+	rideDispatcher := src.NewOfferDispatcher(repos.cabRepo, repos.rideRepo, cabFindingStrategy,
+		src.NewInMemoryPendingRideQueue(2*time.Second, 100*time.Millisecond, 400*time.Millisecond), poolManager, eventBus, clock, 200*time.Millisecond, 3)
+	cabService := src.NewInMemoryCabService(repos.userRepo, repos.cabRepo, repos.rideRepo, idGenerationStrategy, src.NewFixPricingStrategy(10, distanceCalculator),
+		rideDispatcher, poolManager, newRatingManager(repos, eventBus, clock), src.NewPolicyCancellationManager(repos.cabRepo, distanceCalculator, eventBus, clock, policy),
+		newPaymentProcessor(repos, eventBus, clock), newPromotionManager(repos, eventBus, clock), newDriverManager(repos, eventBus, clock), newZoneManager(repos, eventBus, clock), eventBus, clock)
+	defer cabService.Close()
+
+	rider := mustRegisterUser(cabService, "Anaya")
+	// Cash cannot be collected for a cancelled ride, so fees go on the card
+	if _, err := cabService.AddPaymentMethod(rider.GetId(), src.CardPayment, "4242 4242 4242 4242", true); err != nil {
+		log.Fatalf("Expected the card to be added, got %v", err)
+	}
+	alto := mustRegisterCab(cabService, "Alto", src.Hatchback)
+	cabService.UpdateCabLocation(alto.GetId(), 12.9352, 77.6245)
+	kwid := mustRegisterCab(cabService, "Kwid", src.Hatchback)
+	cabService.UpdateCabLocation(kwid.GetId(), 12.9400, 77.6290)
+	confirmRide := func() (*src.Ride, string) {
+		ride := mustBookRide(cabService, rider.GetId(), 12.9352, 77.6245, 12.9716, 77.6412)
+		offer := waitForOffer(cabService, ride.GetId(), 1)
+		cabService.AcceptRide(ride.GetId(), offer.GetCabId())
+		for rideStatus(cabService, ride.GetId()) != src.Confirmed {
+			time.Sleep(5 * time.Millisecond)
+		}
+		return ride, offer.GetCabId()
+	}
+	cancel := func(ride *src.Ride, cancelledBy src.CancellationActor, reason src.CancellationReason) *src.Cancellation {
+		ride, err := cabService.CancelRide(ride.GetId(), cancelledBy, reason)
+		if err != nil {
+			log.Fatalf("Expected the %v to cancel for %v, got %v", cancelledBy, reason, err)
+		}
+		fmt.Printf("  %v cancelled for %v: %v\n", cancelledBy, reason, ride.GetCancellation())
+		return ride.GetCancellation()
+	}
+
+	// Cancelling before a cab is found is free, and a driver has no ride to cancel yet
+	searching := mustBookRide(cabService, rider.GetId(), 12.9352, 77.6245, 12.9716, 77.6412)
+	waitForOffer(cabService, searching.GetId(), 1)
+	if _, err := cabService.CancelRide(searching.GetId(), src.CancelledByDriver, src.RiderNoShow); !errors.Is(err, src.ErrCabNotAssigned) {
+		log.Fatalf("Expected %v for a driver cancelling a ride without a cab, got %v", src.ErrCabNotAssigned, err)
+	}
+	if cancellation := cancel(searching, src.CancelledBySystem, src.OperationalIssue); cancellation.Fee != 0 || cancellation.FeeWaived {
+		log.Fatalf("Expected no fee before a cab is confirmed, got %v", cancellation)
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	// Within the free window the rider pays nothing
+	ride, _ := confirmRide()
+	clock.Advance(time.Minute)
+	if cancellation := cancel(ride, src.CancelledByRider, src.ChangeOfPlans); cancellation.Fee != 0 {
+		log.Fatalf("Expected a free cancellation within the window, got %v", cancellation)
+	}
+
+	// Later, with the driver a kilometre on their way, the rider pays for both
+	ride, cabId := confirmRide()
+	cabService.UpdateCabLocation(cabId, 12.9442, 77.6245)
+	clock.Advance(5 * time.Minute)
+	cancellation := cancel(ride, src.CancelledByRider, src.ChangeOfPlans)
+	expectedFee := policy.BaseFee + 3*policy.FeePerMinute + int(math.Round(cancellation.DriverDistanceKm*float64(policy.FeePerKm)))
+	if cancellation.DriverDistanceKm < 0.9 || cancellation.Fee != expectedFee || cancellation.AtFault != src.CancelledByRider {
+		log.Fatalf("Expected a fee of %d for 3 late minutes and %.2f km, got %v", expectedFee, cancellation.DriverDistanceKm, cancellation)
+	}
+	if ride, _ = cabService.GetRide(ride.GetId()); ride.GetTotalAmount() != expectedFee {
+		log.Fatalf("Expected the rider to be charged the fee, got %d", ride.GetTotalAmount())
+	}
+	if payment, err := cabService.GetRidePayment(ride.GetId()); err != nil || payment.GetStatus() != src.PaymentSucceeded || payment.GetAmount() != expectedFee {
+		log.Fatalf("Expected the fee to be taken from the card, got %v, %v", payment, err)
+	}
+	cabService.UpdateCabLocation(cabId, 12.9352, 77.6245)
+
+	// Cancellations the driver caused are free for the rider and count against the driver
+	ride, _ = confirmRide()
+	clock.Advance(5 * time.Minute)
+	if cancellation := cancel(ride, src.CancelledByRider, src.DriverDelayed); cancellation.Fee != 0 || !cancellation.FeeWaived || cancellation.AtFault != src.CancelledByDriver {
+		log.Fatalf("Expected the fee to be waived when the driver is late, got %v", cancellation)
+	}
+	ride, _ = confirmRide()
+	if _, err := cabService.CancelRide(ride.GetId(), src.CancelledByDriver, src.ChangeOfPlans); !errors.Is(err, src.ErrReasonNotAllowed) {
+		log.Fatalf("Expected %v for a driver giving a rider's reason, got %v", src.ErrReasonNotAllowed, err)
+	}
+	cancel(ride, src.CancelledByDriver, src.VehicleIssue)
+	driver, _ := cabService.GetCab(alto.GetId())
+	if driver.GetCancellations() != 2 || !driver.IsDeprioritised(clock.Now()) {
+		log.Fatalf("Expected two cancellations to deprioritise the driver, got %d", driver.GetCancellations())
+	}
+	for deprioritised := false; !deprioritised; {
+		select {
+		case event := <-recorder.events:
+			deprioritised = event.Type == src.CabDeprioritised && event.CabId == alto.GetId()
+		case <-time.After(time.Second):
+			log.Fatalf("Expected the driver to be told they were deprioritised")
+		}
+	}
+
+	// The next ride goes to the cab further away; a rider who does not show up pays
+	ride, cabId = confirmRide()
+	if cabId != kwid.GetId() {
+		log.Fatalf("Expected the deprioritised driver to be passed over, got %s", cabId)
+	}
+	clock.Advance(5 * time.Minute)
+	if cancellation := cancel(ride, src.CancelledByDriver, src.RiderNoShow); cancellation.Fee == 0 || cancellation.AtFault != src.CancelledByRider {
+		log.Fatalf("Expected the rider to pay for not showing up, got %v", cancellation)
+	}
+
+	// Once the penalty is over the nearest driver is back in line
+	clock.Advance(policy.DeprioritiseFor)
+	if _, cabId = confirmRide(); cabId != alto.GetId() {
+		log.Fatalf("Expected the driver to get rides again after the penalty, got %s", cabId)
+	}
+
+	fmt.Println("Test Scenario 15 completed successfully.")
+}
+
+func testPayments() {
+	fmt.Println("Starting Test Scenario 16: Payments")
+
+	clock := src.NewManualClock(time.Now())
+	idGenerationStrategy := src.NewIdGenerationUsingUUID()
+	distanceCalculator := src.NewHaversineDistanceCalculator()
+	repos := newInMemoryRepositories(clock)
+	eventBus := src.NewInMemoryEventBus(64)
+	recorder := &eventRecorder{events: make(chan src.RideEvent, 256)}
+	eventBus.Subscribe(recorder)
+	poolManager := src.NewInMemoryPoolManager(repos.cabRepo, idGenerationStrategy, distanceCalculator, src.PoolPolicy{Capacity: 3})
+	rideDispatcher := src.NewOfferDispatcher(repos.cabRepo, repos.rideRepo, src.NewNearestAvailableCarFindingStrategy(repos.cabRepo, distanceCalculator, 0),
+		src.NewInMemoryPendingRideQueue(2*time.Second, 100*time.Millisecond, 400*time.Millisecond), poolManager, eventBus, clock, 200*time.Millisecond, 3)
+	cabService := src.NewInMemoryCabService(repos.userRepo, repos.cabRepo, repos.rideRepo, idGenerationStrategy, src.NewFixPricingStrategy(10, distanceCalculator),
+		rideDispatcher, poolManager, newRatingManager(repos, eventBus, clock), newCancellationManager(repos, eventBus, clock), newPaymentProcessor(repos, eventBus, clock), newPromotionManager(repos, eventBus, clock), newDriverManager(repos, eventBus, clock), newZoneManager(repos, eventBus, clock), eventBus, clock)
+	defer cabService.Close()
+
+	rider := mustRegisterUser(cabService, "Meera")
+	nexon := mustRegisterCab(cabService, "Nexon", src.SUV)
+	cabService.UpdateCabLocation(nexon.GetId(), 12.9352, 77.6245)
+	takeRide := func(endLat, endLon float64, options ...src.BookingOption) (*src.Ride, *src.Payment) {
+		ride, err := cabService.BookRide(rider.GetId(), 12.9352, 77.6245, endLat, endLon, options...)
+		if err != nil {
+			log.Fatalf("Expected the ride to be booked, got %v", err)
+		}
+		offer := waitForOffer(cabService, ride.GetId(), 1)
+		cabService.AcceptRide(ride.GetId(), offer.GetCabId())
+		for rideStatus(cabService, ride.GetId()) != src.Confirmed {
+			time.Sleep(5 * time.Millisecond)
+		}
+		cabService.UpdateRideStatus(ride.GetId(), src.PickedUp)
+		ride, _ = cabService.UpdateRideStatus(ride.GetId(), src.Completed)
+		cabService.UpdateCabLocation(offer.GetCabId(), 12.9352, 77.6245)
+		payment, err := cabService.GetRidePayment(ride.GetId())
+		if err != nil {
+			log.Fatalf("Expected ride %s to be charged, got %v", ride.GetId(), err)
+		}
+		fmt.Printf("  ride of %d paid by %v: %v\n", ride.GetTotalAmount(), payment.GetMethodType(), payment.GetStatus())
+		return ride, payment
+	}
+	balanceOf := func() src.RiderBalance {
+		balance, _ := cabService.GetBalance(rider.GetId())
+		return balance
+	}
+
+	// Cards are checked when added, and only a card can top up the wallet
+	if _, err := cabService.AddPaymentMethod(rider.GetId(), src.CardPayment, "4242 4242 4242 4241", false); !errors.Is(err, src.ErrInvalidCard) {
+		log.Fatalf("Expected %v for a mistyped card, got %v", src.ErrInvalidCard, err)
+	}
+	card, _ := cabService.AddPaymentMethod(rider.GetId(), src.CardPayment, "4242 4242 4242 4242", false)
+	wallet, _ := cabService.AddPaymentMethod(rider.GetId(), src.WalletPayment, "", true)
+	cash, _ := cabService.AddPaymentMethod(rider.GetId(), src.CashPayment, "", false)
+	declined, _ := cabService.AddPaymentMethod(rider.GetId(), src.CardPayment, src.FakeDeclinedCard, false)
+	if _, err := cabService.TopUpWallet(rider.GetId(), cash.GetId(), 100); !errors.Is(err, src.ErrPaymentMethodNotAllowed) {
+		log.Fatalf("Expected %v for topping up with cash, got %v", src.ErrPaymentMethodNotAllowed, err)
+	}
+	if _, err := cabService.TopUpWallet(rider.GetId(), declined.GetId(), 100); !errors.Is(err, src.ErrCardDeclined) {
+		log.Fatalf("Expected %v for a declined top-up, got %v", src.ErrCardDeclined, err)
+	}
+	if balance, err := cabService.TopUpWallet(rider.GetId(), card.GetId(), 100); err != nil || balance.WalletBalance != 100 {
+		log.Fatalf("Expected 100 in the wallet, got %v, %v", balance, err)
+	}
+
+	// The default method pays for a completed ride
+	ride, payment := takeRide(12.9716, 77.6412)
+	if payment.GetMethodId() != wallet.GetId() || payment.GetStatus() != src.PaymentSucceeded || balanceOf().WalletBalance != 100-ride.GetTotalAmount() {
+		log.Fatalf("Expected the wallet to pay %d, got %v and %v", ride.GetTotalAmount(), payment, balanceOf())
+	}
+
+	// A declined card leaves the fare as a due, which blocks booking until it is paid
+	ride, payment = takeRide(12.9716, 77.6412, src.WithPaymentMethod(declined.GetId()))
+	if payment.GetStatus() != src.PaymentFailed || payment.GetAmountDue() != ride.GetTotalAmount() || balanceOf().OutstandingDues != ride.GetTotalAmount() {
+		log.Fatalf("Expected the fare to be owed, got %v and %v", payment, balanceOf())
+	}
+	for failed := false; !failed; {
+		select {
+		case event := <-recorder.events:
+			failed = event.Type == src.RidePaymentFailed && event.RideId == ride.GetId() && event.Amount == ride.GetTotalAmount()
+		case <-time.After(time.Second):
+			log.Fatalf("Expected the rider to be told the payment failed")
+		}
+	}
+	if _, err := cabService.BookRide(rider.GetId(), 12.9352, 77.6245, 12.9716, 77.6412); !errors.Is(err, src.ErrOutstandingDues) {
+		log.Fatalf("Expected %v while a fare is owed, got %v", src.ErrOutstandingDues, err)
+	}
+	if _, err := cabService.ScheduleRide(rider.GetId(), 12.9352, 77.6245, 12.9716, 77.6412, clock.Now().Add(time.Hour)); !errors.Is(err, src.ErrOutstandingDues) {
+		log.Fatalf("Expected %v for scheduling while a fare is owed, got %v", src.ErrOutstandingDues, err)
+	}
+	if _, err := cabService.PayDues(rider.GetId(), cash.GetId()); !errors.Is(err, src.ErrPaymentMethodNotAllowed) {
+		log.Fatalf("Expected %v for paying dues in cash, got %v", src.ErrPaymentMethodNotAllowed, err)
+	}
+	if _, err := cabService.PayDues(rider.GetId(), declined.GetId()); !errors.Is(err, src.ErrCardDeclined) {
+		log.Fatalf("Expected %v for the declined card again, got %v", src.ErrCardDeclined, err)
+	}
+	if balance, err := cabService.PayDues(rider.GetId(), card.GetId()); err != nil || balance.OutstandingDues != 0 {
+		log.Fatalf("Expected the dues to be paid by card, got %v, %v", balance, err)
+	}
+	if payment, _ = cabService.GetRidePayment(ride.GetId()); payment.GetStatus() != src.PaymentSucceeded || payment.GetMethodId() != card.GetId() || payment.GetReference() == "" {
+		log.Fatalf("Expected the settled payment to name the card, got %v", payment)
+	}
+
+	// A disputed card payment is refunded through the gateway, once
+	if payment, err := cabService.RefundRide(ride.GetId(), 0, "Rider was charged for a trip they did not take"); err != nil || payment.GetStatus() != src.PaymentRefunded {
+		log.Fatalf("Expected a full refund, got %v, %v", payment, err)
+	}
+	if _, err := cabService.RefundRide(ride.GetId(), 1, "Again"); !errors.Is(err, src.ErrRefundNotAllowed) {
+		log.Fatalf("Expected %v for refunding twice, got %v", src.ErrRefundNotAllowed, err)
+	}
+
+	// A fare the wallet cannot cover is owed, and a dispute on it waives the due
+	ride, payment = takeRide(13.1989, 77.7068, src.WithPaymentMethod(wallet.GetId()))
+	if payment.GetStatus() != src.PaymentFailed || !strings.Contains(payment.GetFailureReason(), src.ErrInsufficientWalletBalance.Error()) {
+		log.Fatalf("Expected the wallet to fall short, got %v", payment)
+	}
+	if payment, err := cabService.RefundRide(ride.GetId(), 0, "Airport drop was never made"); err != nil || payment.GetStatus() != src.PaymentRefunded || balanceOf().OutstandingDues != 0 {
+		log.Fatalf("Expected the due to be waived, got %v, %v", payment, err)
+	}
+	mustBookRide(cabService, rider.GetId(), 12.9352, 77.6245, 12.9716, 77.6412)
+
+	// Every movement is in the ledger and the balances add up from it
+	ledger, _ := cabService.GetLedger(rider.GetId())
+	kinds := make([]src.LedgerEntryKind, 0, len(ledger))
+	walletBalance, dues := 0, 0
+	for _, entry := range ledger {
+		kinds = append(kinds, entry.Kind)
+		walletBalance += entry.WalletDelta
+		dues += entry.DuesDelta
+	}
+	expectedKinds := []src.LedgerEntryKind{src.WalletTopUp, src.RideCharge, src.DueRecorded, src.DueSettled, src.RideRefund, src.DueRecorded, src.DueWaived}
+	if fmt.Sprint(kinds) != fmt.Sprint(expectedKinds) || walletBalance != balanceOf().WalletBalance || dues != 0 {
+		log.Fatalf("Expected ledger %v adding up to %v, got %v", expectedKinds, balanceOf(), kinds)
+	}
+	fmt.Println("Ledger", kinds)
+
+	fmt.Println("Test Scenario 16 completed successfully.")
+}
+
+func testPromotions() {
+	fmt.Println("Starting Test Scenario 17: Promotions")
+
+	clock := src.NewManualClock(time.Now())
+	idGenerationStrategy := src.NewIdGenerationUsingUUID()
+	distanceCalculator := src.NewHaversineDistanceCalculator()
+	repos := newInMemoryRepositories(clock)
+	eventBus := src.NewInMemoryEventBus(64)
+	recorder := &eventRecorder{events: make(chan src.RideEvent, 256)}
+	eventBus.Subscribe(recorder)
+	zoneResolver := src.NewPolygonZoneResolver([]src.Zone{
+		src.NewPolygonZone("koramangala", []src.GeoPoint{{Lat: 12.92, Lon: 77.61}, {Lat: 12.92, Lon: 77.64}, {Lat: 12.95, Lon: 77.64}, {Lat: 12.95, Lon: 77.61}}),
+	}, src.NewGridZoneResolver(0.05))
+	poolManager := src.NewInMemoryPoolManager(repos.cabRepo, idGenerationStrategy, distanceCalculator, src.PoolPolicy{Capacity: 3})
+	rideDispatcher := src.NewOfferDispatcher(repos.cabRepo, repos.rideRepo, src.NewNearestAvailableCarFindingStrategy(repos.cabRepo, distanceCalculator, 0),
+		src.NewInMemoryPendingRideQueue(2*time.Second, 100*time.Millisecond, 400*time.Millisecond), poolManager, eventBus, clock, 200*time.Millisecond, 3)
+	paymentProcessor := newPaymentProcessor(repos, eventBus, clock)
+	promotionManager := src.NewReservingPromotionManager(repos.promotionRepo, repos.userRepo, repos.rideRepo, paymentProcessor, zoneResolver, idGenerationStrategy, eventBus, clock,
+		src.PromotionPolicy{ReferralDiscount: 40, ReferralReward: 60})
+	cabService := src.NewInMemoryCabService(repos.userRepo, repos.cabRepo, repos.rideRepo, idGenerationStrategy,
+		src.NewPromotionPricingStrategy(src.NewFixPricingStrategy(10, distanceCalculator), repos.promotionRepo), rideDispatcher, poolManager,
+		newRatingManager(repos, eventBus, clock), newCancellationManager(repos, eventBus, clock), paymentProcessor, promotionManager, newDriverManager(repos, eventBus, clock), newZoneManager(repos, eventBus, clock), eventBus, clock)
+	defer cabService.Close()
+
+	koramangala := src.GeoPoint{Lat: 12.9352, Lon: 77.6245}
+	indiranagar := src.GeoPoint{Lat: 12.9716, Lon: 77.6412}
+	airport := src.GeoPoint{Lat: 13.1989, Lon: 77.7068}
+	cab := mustRegisterCab(cabService, "Ertiga", src.SUV)
+	cabService.UpdateCabLocation(cab.GetId(), koramangala.Lat, koramangala.Lon)
+	takeRide := func(userId string, pickup, drop src.GeoPoint, options ...src.BookingOption) *src.Ride {
+		ride, err := cabService.BookRide(userId, pickup.Lat, pickup.Lon, drop.Lat, drop.Lon, options...)
+		if err != nil {
+			log.Fatalf("Expected the ride to be booked, got %v", err)
+		}
+		offer := waitForOffer(cabService, ride.GetId(), 1)
+		cabService.AcceptRide(ride.GetId(), offer.GetCabId())
+		for rideStatus(cabService, ride.GetId()) != src.Confirmed {
+			time.Sleep(5 * time.Millisecond)
+		}
+		cabService.UpdateRideStatus(ride.GetId(), src.PickedUp)
+		ride, _ = cabService.UpdateRideStatus(ride.GetId(), src.Completed)
+		cabService.UpdateCabLocation(offer.GetCabId(), koramangala.Lat, koramangala.Lon)
+		return ride
+	}
+	waitForRedemption := func(userId, rideId string, status src.RedemptionStatus) src.PromoRedemption {
+		for i := 0; ; i++ {
+			redemptions, _ := cabService.GetPromoRedemptions(userId)
+			for _, redemption := range redemptions {
+				if redemption.RideId == rideId && redemption.Status == status {
+					return redemption
+				}
+			}
+			if i == 100 {
+				log.Fatalf("Expected the promo on ride %s to be %v, got %v", rideId, status, redemptions)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	// Promotions are checked when they are created and codes are case insensitive
+	if _, err := cabService.CreatePromotion(src.Promotion{Code: "HALFOFF", Kind: src.PercentageDiscount, Value: 150}); !errors.Is(err, src.ErrInvalidPromotion) {
+		log.Fatalf("Expected %v for a discount over 100%%, got %v", src.ErrInvalidPromotion, err)
+	}
+	if _, err := cabService.CreatePromotion(src.Promotion{Code: "welcome20", Kind: src.PercentageDiscount, Value: 20, MaxDiscount: 30}); err != nil {
+		log.Fatalf("Expected the promotion to be created, got %v", err)
+	}
+	if _, err := cabService.CreatePromotion(src.Promotion{Code: "WELCOME20", Kind: src.FlatDiscount, Value: 10}); !errors.Is(err, src.ErrPromoCodeTaken) {
+		log.Fatalf("Expected %v for a code in use, got %v", src.ErrPromoCodeTaken, err)
+	}
+	if _, err := cabService.BookRide(mustRegisterUser(cabService, "Zoya").GetId(), koramangala.Lat, koramangala.Lon, airport.Lat, airport.Lon, src.WithPromoCode("NOSUCHCODE")); !errors.Is(err, src.ErrPromoNotFound) {
+		log.Fatalf("Expected %v for an unknown code, got %v", src.ErrPromoNotFound, err)
+	}
+
+	// A percentage discount is capped and shows on the fare, and the rider pays the discounted total
+	rider := mustRegisterUser(cabService, "Kabir")
+	ride := takeRide(rider.GetId(), koramangala, airport, src.WithPromoCode("Welcome20"))
+	fare := ride.GetFinalFare()
+	if ride.GetPromoCode() != "WELCOME20" || fare.PromoCode != "WELCOME20" || fare.PromoDiscount != 30 || fare.Total != fare.Subtotal()+fare.Taxes-30 {
+		log.Fatalf("Expected 30 off the fare, got %v", fare)
+	}
+	if !strings.Contains(fare.String(), "Promo WELCOME20") || ride.GetFareEstimate().PromoDiscount != 30 {
+		log.Fatalf("Expected the discount on the estimate and the breakdown, got %v and %v", ride.GetFareEstimate(), fare)
+	}
+	if payment, err := cabService.GetRidePayment(ride.GetId()); err != nil || payment.GetAmount() != fare.Total {
+		log.Fatalf("Expected the rider to pay %d, got %v, %v", fare.Total, payment, err)
+	}
+	if redemption := waitForRedemption(rider.GetId(), ride.GetId(), src.RedemptionRedeemed); redemption.Discount != 30 {
+		log.Fatalf("Expected the redemption to record 30 off, got %v", redemption)
+	}
+	fmt.Println(fare)
+
+	// A flat discount never takes a fare below zero
+	cabService.CreatePromotion(src.Promotion{Code: "RIDEFREE", Kind: src.FlatDiscount, Value: 1000})
+	ride = takeRide(rider.GetId(), koramangala, indiranagar, src.WithPromoCode("RIDEFREE"))
+	if fare := ride.GetFinalFare(); fare.Total != 0 || fare.PromoDiscount != fare.Subtotal()+fare.Taxes {
+		log.Fatalf("Expected the whole fare to be waived, got %v", fare)
+	}
+
+	// Codes only work inside their window and in their zones
+	cabService.CreatePromotion(src.Promotion{Code: "WEEKEND", Kind: src.FlatDiscount, Value: 25, ValidFrom: clock.Now().Add(time.Hour), ValidUntil: clock.Now().Add(2 * time.Hour)})
+	if _, err := cabService.BookRide(rider.GetId(), koramangala.Lat, koramangala.Lon, indiranagar.Lat, indiranagar.Lon, src.WithPromoCode("WEEKEND")); !errors.Is(err, src.ErrPromoNotActive) {
+		log.Fatalf("Expected %v before the window opens, got %v", src.ErrPromoNotActive, err)
+	}
+	clock.Advance(90 * time.Minute)
+	if _, err := promotionManager.Reserve("WEEKEND", rider.GetId(), koramangala.Lat, koramangala.Lon); err != nil {
+		log.Fatalf("Expected the code to work inside its window, got %v", err)
+	}
+	clock.Advance(time.Hour)
+	if _, err := promotionManager.Reserve("WEEKEND", rider.GetId(), koramangala.Lat, koramangala.Lon); !errors.Is(err, src.ErrPromoNotActive) {
+		log.Fatalf("Expected %v after the window closes, got %v", src.ErrPromoNotActive, err)
+	}
+	cabService.CreatePromotion(src.Promotion{Code: "KORA15", Kind: src.FlatDiscount, Value: 15, ZoneIds: []string{"koramangala"}})
+	if _, err := cabService.BookRide(rider.GetId(), indiranagar.Lat, indiranagar.Lon, koramangala.Lat, koramangala.Lon, src.WithPromoCode("KORA15")); !errors.Is(err, src.ErrPromoNotApplicable) {
+		log.Fatalf("Expected %v for a pickup outside the zone, got %v", src.ErrPromoNotApplicable, err)
+	}
+	if ride = takeRide(rider.GetId(), koramangala, indiranagar, src.WithPromoCode("KORA15")); ride.GetFinalFare().PromoDiscount != 15 {
+		log.Fatalf("Expected 15 off a pickup in the zone, got %v", ride.GetFinalFare())
+	}
+
+	// First ride codes are turned down once a rider has taken a ride
+	cabService.CreatePromotion(src.Promotion{Code: "FIRST50", Kind: src.FlatDiscount, Value: 50, FirstRideOnly: true})
+	if _, err := cabService.BookRide(rider.GetId(), koramangala.Lat, koramangala.Lon, indiranagar.Lat, indiranagar.Lon, src.WithPromoCode("FIRST50")); !errors.Is(err, src.ErrPromoNotApplicable) {
+		log.Fatalf("Expected %v for a returning rider, got %v", src.ErrPromoNotApplicable, err)
+	}
+
+	// Riders racing for the last uses of a code never take more than its limits allow
+	cabService.CreatePromotion(src.Promotion{Code: "FLASH", Kind: src.FlatDiscount, Value: 10, TotalLimit: 5, PerUserLimit: 2})
+	riders := make([]*src.User, 4)
+	for i := range riders {
+		riders[i] = mustRegisterUser(cabService, fmt.Sprintf("Racer %d", i))
+	}
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	reservedBy := make(map[string]int)
+	limited := 0
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(rider *src.User) {
+			defer wg.Done()
+			_, err := promotionManager.Reserve("FLASH", rider.GetId(), koramangala.Lat, koramangala.Lon)
+			mu.Lock()
+			defer mu.Unlock()
+			switch {
+			case err == nil:
+				reservedBy[rider.GetId()]++
+			case errors.Is(err, src.ErrPromoLimitReached):
+				limited++
+			default:
+				log.Fatalf("Expected the reservation to succeed or hit a limit, got %v", err)
+			}
+		}(riders[i%len(riders)])
+	}
+	wg.Wait()
+	reserved := 0
+	for _, count := range reservedBy {
+		if count > 2 {
+			log.Fatalf("Expected no rider to reserve FLASH more than twice, got %v", reservedBy)
+		}
+		reserved += count
+	}
+	if reserved != 5 || limited != 15 {
+		log.Fatalf("Expected 5 reservations and 15 turned down, got %d and %d", reserved, limited)
+	}
+
+	// A cancelled ride gives its use of the code back
+	cabService.CreatePromotion(src.Promotion{Code: "ONCE", Kind: src.FlatDiscount, Value: 20, TotalLimit: 1})
+	first, second := mustRegisterUser(cabService, "Tara"), mustRegisterUser(cabService, "Vikram")
+	ride, err := cabService.BookRide(first.GetId(), koramangala.Lat, koramangala.Lon, indiranagar.Lat, indiranagar.Lon, src.WithPromoCode("ONCE"))
+	if err != nil {
+		log.Fatalf("Expected the ride to be booked, got %v", err)
+	}
+	if _, err := cabService.BookRide(second.GetId(), koramangala.Lat, koramangala.Lon, indiranagar.Lat, indiranagar.Lon, src.WithPromoCode("ONCE")); !errors.Is(err, src.ErrPromoLimitReached) {
+		log.Fatalf("Expected %v while the only use is held, got %v", src.ErrPromoLimitReached, err)
+	}
+	waitForOffer(cabService, ride.GetId(), 1)
+	cabService.CancelRide(ride.GetId(), src.CancelledByRider, src.ChangeOfPlans)
+	waitForRedemption(first.GetId(), ride.GetId(), src.RedemptionReleased)
+	cabService.UpdateCabLocation(cab.GetId(), koramangala.Lat, koramangala.Lon)
+	if ride = takeRide(second.GetId(), koramangala, indiranagar, src.WithPromoCode("ONCE")); ride.GetFinalFare().PromoDiscount != 20 {
+		log.Fatalf("Expected the released use to go to the next rider, got %v", ride.GetFinalFare())
+	}
+
+	// A referral code gives a new rider money off their first ride and credits the referrer's wallet
+	referralCode, err := cabService.GetReferralCode(rider.GetId())
+	if err != nil {
+		log.Fatalf("Expected a referral code, got %v", err)
+	}
+	if again, _ := cabService.GetReferralCode(rider.GetId()); again.Code != referralCode.Code {
+		log.Fatalf("Expected the rider to keep referral code %s, got %s", referralCode.Code, again.Code)
+	}
+	if _, err := cabService.BookRide(rider.GetId(), koramangala.Lat, koramangala.Lon, indiranagar.Lat, indiranagar.Lon, src.WithPromoCode(referralCode.Code)); !errors.Is(err, src.ErrPromoNotApplicable) {
+		log.Fatalf("Expected %v for a rider's own referral code, got %v", src.ErrPromoNotApplicable, err)
+	}
+	friend := mustRegisterUser(cabService, "Naina")
+	if ride = takeRide(friend.GetId(), koramangala, airport, src.WithPromoCode(strings.ToLower(referralCode.Code))); ride.GetFinalFare().PromoDiscount != 40 {
+		log.Fatalf("Expected 40 off the referred rider's first ride, got %v", ride.GetFinalFare())
+	}
+	for rewarded := false; !rewarded; {
+		select {
+		case event := <-recorder.events:
+			rewarded = event.Type == src.ReferralRewarded && event.RideId == ride.GetId() && event.UserId == rider.GetId() && event.Amount == 60
+		case <-time.After(time.Second):
+			log.Fatalf("Expected the referrer to be rewarded")
+		}
+	}
+	if balance, _ := cabService.GetBalance(rider.GetId()); balance.WalletBalance != 60 {
+		log.Fatalf("Expected 60 in the referrer's wallet, got %v", balance)
+	}
+	if _, err := cabService.BookRide(friend.GetId(), koramangala.Lat, koramangala.Lon, indiranagar.Lat, indiranagar.Lon, src.WithPromoCode(referralCode.Code)); !errors.Is(err, src.ErrPromoNotApplicable) {
+		log.Fatalf("Expected %v for a second ride on a referral code, got %v", src.ErrPromoNotApplicable, err)
+	}
+
+	fmt.Println("Test Scenario 17 completed successfully.")
+}
+
+func testDriverShifts() {
+	fmt.Println("Starting Test Scenario 18: Driver Shifts and Earnings")
+
+	// A Wednesday, so the week started two days before
+	clock := src.NewManualClock(time.Date(2026, time.March, 4, 8, 0, 0, 0, time.Local))
+	idGenerationStrategy := src.NewIdGenerationUsingUUID()
+	distanceCalculator := src.NewHaversineDistanceCalculator()
+	repos := newInMemoryRepositories(clock)
+	eventBus := src.NewInMemoryEventBus(64)
+	recorder := &eventRecorder{events: make(chan src.RideEvent, 256)}
+	eventBus.Subscribe(recorder)
+	poolManager := src.NewInMemoryPoolManager(repos.cabRepo, idGenerationStrategy, distanceCalculator, src.PoolPolicy{Capacity: 3})
+	rideDispatcher := src.NewOfferDispatcher(repos.cabRepo, repos.rideRepo, src.NewNearestAvailableCarFindingStrategy(repos.cabRepo, distanceCalculator, 0),
+		src.NewInMemoryPendingRideQueue(time.Hour, 100*time.Millisecond, 400*time.Millisecond), poolManager, eventBus, clock, 200*time.Millisecond, 3)
+	driverManager := src.NewLedgerDriverManager(repos.earningsRepo, repos.cabRepo, repos.rideRepo, idGenerationStrategy, eventBus, clock, src.EarningsPolicy{
+		CommissionPercent: 25,
+		DailyRideTarget:   3,
+		DailyTargetBonus:  100,
+	})
+	cabService := src.NewInMemoryCabService(repos.userRepo, repos.cabRepo, repos.rideRepo, idGenerationStrategy, src.NewFixPricingStrategy(10, distanceCalculator),
+		rideDispatcher, poolManager, newRatingManager(repos, eventBus, clock), newCancellationManager(repos, eventBus, clock), newPaymentProcessor(repos, eventBus, clock),
+		newPromotionManager(repos, eventBus, clock), driverManager, newZoneManager(repos, eventBus, clock), eventBus, clock)
+	defer cabService.Close()
+
+	rider := mustRegisterUser(cabService, "Farhan")
+	ertiga := mustRegisterCab(cabService, "Ertiga", src.SUV)
+	cabService.UpdateCabLocation(ertiga.GetId(), 12.9352, 77.6245)
+	cabId := ertiga.GetId()
+	statementOf := func(period src.StatementPeriod, at time.Time) *src.EarningsStatement {
+		statement, err := cabService.GetEarningsStatement(cabId, period, at)
+		if err != nil {
+			log.Fatalf("Expected a %v statement, got %v", period, err)
+		}
+		return statement
+	}
+	// Earnings are recorded when the driver manager hears the ride completed.
+	waitForRides := func(rides int) {
+		for i := 0; statementOf(src.WeeklyStatement, clock.Now()).Rides != rides; i++ {
+			if i == 100 {
+				log.Fatalf("Expected %d ride earnings to be recorded", rides)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	completeRide := func(ride *src.Ride) *src.Ride {
+		offer := waitForOffer(cabService, ride.GetId(), 1)
+		cabService.AcceptRide(ride.GetId(), offer.GetCabId())
+		for rideStatus(cabService, ride.GetId()) != src.Confirmed {
+			time.Sleep(5 * time.Millisecond)
+		}
+		cabService.UpdateRideStatus(ride.GetId(), src.PickedUp)
+		ride, _ = cabService.UpdateRideStatus(ride.GetId(), src.Completed)
+		cabService.UpdateCabLocation(offer.GetCabId(), 12.9352, 77.6245)
+		return ride
+	}
+	fares := 0
+	takeRide := func(rides int) {
+		ride := completeRide(mustBookRide(cabService, rider.GetId(), 12.9352, 77.6245, 12.9716, 77.6412))
+		fares += ride.GetFinalFare().Total
+		waitForRides(rides)
+	}
+	expectShift := func(what string, cab *src.Cab, err error, want src.CabStatus) {
+		if err != nil || cab.GetCabStatus() != want {
+			log.Fatalf("Expected %s to leave the cab %v, got %v, %v", what, want, cab, err)
+		}
+	}
+
+	// Drivers step away and come back, but only go on a break while online
+	clock.Advance(time.Hour)
+	cab, err := cabService.TakeBreak(cabId)
+	expectShift("a break", cab, err, src.OnBreak)
+	clock.Advance(30 * time.Minute)
+	cab, err = cabService.GoOffline(cabId)
+	expectShift("going offline", cab, err, src.InActive)
+	if _, err := cabService.TakeBreak(cabId); !errors.Is(err, src.ErrInvalidShiftChange) {
+		log.Fatalf("Expected %v for a break while offline, got %v", src.ErrInvalidShiftChange, err)
+	}
+	clock.Advance(30 * time.Minute)
+	cab, err = cabService.GoOnline(cabId)
+	expectShift("going online", cab, err, src.ReadyToTakeRide)
+	cab, err = cabService.GoOnline(cabId)
+	expectShift("going online twice", cab, err, src.ReadyToTakeRide)
+	if _, err := cabService.GoOffline("missing"); !errors.Is(err, src.ErrCabNotFound) {
+		log.Fatalf("Expected %v for an unknown cab, got %v", src.ErrCabNotFound, err)
+	}
+
+	// No shift change in the middle of a ride
+	ride := mustBookRide(cabService, rider.GetId(), 12.9352, 77.6245, 12.9716, 77.6412)
+	cabService.AcceptRide(ride.GetId(), waitForOffer(cabService, ride.GetId(), 1).GetCabId())
+	for rideStatus(cabService, ride.GetId()) != src.Confirmed {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if _, err := cabService.GoOffline(cabId); !errors.Is(err, src.ErrCabOnRide) {
+		log.Fatalf("Expected %v for going offline mid-ride, got %v", src.ErrCabOnRide, err)
+	}
+	if _, err := cabService.TakeBreak(cabId); !errors.Is(err, src.ErrCabOnRide) {
+		log.Fatalf("Expected %v for a break mid-ride, got %v", src.ErrCabOnRide, err)
+	}
+	cabService.UpdateRideStatus(ride.GetId(), src.PickedUp)
+	ride, _ = cabService.UpdateRideStatus(ride.GetId(), src.Completed)
+	cabService.UpdateCabLocation(cabId, 12.9352, 77.6245)
+	fares += ride.GetFinalFare().Total
+	waitForRides(1)
+
+	// The driver keeps the fare less the platform's commission
+	earning := statementOf(src.DailyStatement, clock.Now()).Entries[0]
+	commission := int(math.Round(float64(ride.GetFinalFare().Total) * 0.25))
+	if earning.Kind != src.RideEarning || earning.RideId != ride.GetId() || earning.Fare != ride.GetFinalFare().Total || earning.Commission != commission || earning.Amount != earning.Fare-commission {
+		log.Fatalf("Expected %d less %d commission for ride %s, got %v", ride.GetFinalFare().Total, commission, ride.GetId(), earning)
+	}
+	fmt.Println("  earning", earning)
+
+	// A ride booked while the only driver is offline waits for them to come back
+	clock.Advance(30 * time.Minute)
+	cabService.GoOffline(cabId)
+	ride = mustBookRide(cabService, rider.GetId(), 12.9352, 77.6245, 12.9716, 77.6412)
+	waitForPending(cabService, ride.GetId())
+	clock.Advance(15 * time.Minute)
+	cabService.GoOnline(cabId)
+	if ride = completeRide(ride); ride.GetCabId() != cabId {
+		log.Fatalf("Expected the waiting ride to go to the driver back online, got %v", ride)
+	}
+	fares += ride.GetFinalFare().Total
+	waitForRides(2)
+
+	// The third ride of the day earns the bonus on top
+	takeRide(3)
+	for bonus := false; !bonus; {
+		select {
+		case event := <-recorder.events:
+			bonus = event.Type == src.IncentiveEarned && event.CabId == cabId && event.Amount == 100
+		case <-time.After(time.Second):
+			log.Fatalf("Expected the driver to earn the daily bonus")
+		}
+	}
+	if _, err := cabService.AddDriverIncentive(cabId, 0, "Nothing"); !errors.Is(err, src.ErrInvalidAmount) {
+		log.Fatalf("Expected %v for an empty incentive, got %v", src.ErrInvalidAmount, err)
+	}
+	if _, err := cabService.AddDriverIncentive("missing", 50, "Airport shift"); !errors.Is(err, src.ErrCabNotFound) {
+		log.Fatalf("Expected %v for an unknown cab, got %v", src.ErrCabNotFound, err)
+	}
+	if incentive, err := cabService.AddDriverIncentive(cabId, 50, "Airport shift"); err != nil || incentive.Kind != src.Incentive || incentive.Amount != 50 {
+		log.Fatalf("Expected an incentive of 50, got %v, %v", incentive, err)
+	}
+	clock.Advance(105 * time.Minute)
+	cabService.GoOffline(cabId)
+
+	// The day's statement adds up the rides, the incentives and the time worked
+	wednesday := clock.Now()
+	daily := statementOf(src.DailyStatement, wednesday)
+	if daily.Rides != 3 || daily.Fares != fares || daily.Incentives != 150 || daily.NetEarnings != daily.RideEarnings+150 || daily.Fares-daily.Commission != daily.RideEarnings {
+		log.Fatalf("Expected 3 rides worth %d and 150 of incentives, got %v", fares, daily)
+	}
+	if daily.OnlineTime != 3*time.Hour+15*time.Minute || daily.BreakTime != 30*time.Minute {
+		log.Fatalf("Expected 3h15m online and 30m on a break, got %v and %v", daily.OnlineTime, daily.BreakTime)
+	}
+	fmt.Println(" ", daily)
+
+	// The next day's ride shows on its own day and on the week
+	clock.Advance(22 * time.Hour)
+	cabService.GoOnline(cabId)
+	takeRide(4)
+	clock.Advance(2 * time.Hour)
+	cabService.GoOffline(cabId)
+	if thursday := statementOf(src.DailyStatement, clock.Now()); thursday.Rides != 1 || thursday.Incentives != 0 || thursday.OnlineTime != 2*time.Hour {
+		log.Fatalf("Expected one ride and 2h online on Thursday, got %v", thursday)
+	}
+	weekly := statementOf(src.WeeklyStatement, wednesday)
+	monday := time.Date(2026, time.March, 2, 0, 0, 0, 0, time.Local)
+	if !weekly.From.Equal(monday) || !weekly.To.Equal(monday.AddDate(0, 0, 7)) || weekly.Rides != 4 || weekly.Incentives != 150 || weekly.OnlineTime != 5*time.Hour+15*time.Minute || weekly.BreakTime != 30*time.Minute {
+		log.Fatalf("Expected the week from Monday with 4 rides and 5h15m online, got %v", weekly)
+	}
+	fmt.Println(" ", weekly)
+
+	// A payout batch pays the whole balance once and exports for the bank
+	balance, _ := cabService.GetEarningsBalance(cabId)
+	if balance != weekly.NetEarnings {
+		log.Fatalf("Expected a balance of %d, got %d", weekly.NetEarnings, balance)
+	}
+	batch, err := cabService.CreatePayoutBatch()
+	if err != nil || batch.Total != balance || len(batch.Payouts) != 1 || batch.Payouts[0].CabId != cabId || batch.Payouts[0].CabName != "Ertiga" {
+		log.Fatalf("Expected a batch paying %d to Ertiga, got %v, %v", balance, batch, err)
+	}
+	for paid := false; !paid; {
+		select {
+		case event := <-recorder.events:
+			paid = event.Type == src.DriverPaidOut && event.CabId == cabId && event.Amount == balance
+		case <-time.After(time.Second):
+			log.Fatalf("Expected the driver to be told about the payout")
+		}
+	}
+	if balance, _ := cabService.GetEarningsBalance(cabId); balance != 0 {
+		log.Fatalf("Expected nothing owed after the payout, got %d", balance)
+	}
+	if paidOut := statementOf(src.WeeklyStatement, wednesday).PaidOut; paidOut != batch.Total {
+		log.Fatalf("Expected the week to show %d paid out, got %d", batch.Total, paidOut)
+	}
+	if _, err := cabService.CreatePayoutBatch(); !errors.Is(err, src.ErrNothingToPayOut) {
+		log.Fatalf("Expected %v with every balance paid, got %v", src.ErrNothingToPayOut, err)
+	}
+	var export bytes.Buffer
+	if err := batch.WriteCSV(&export); err != nil {
+		log.Fatalf("Could not export the batch: %v", err)
+	}
+	wantExport := fmt.Sprintf("batch_id,created_at,cab_id,driver,amount\n%s,%s,%s,Ertiga,%d\n", batch.Id, batch.CreatedAt.Format(time.RFC3339), cabId, balance)
+	if export.String() != wantExport {
+		log.Fatalf("Expected the export %q, got %q", wantExport, export.String())
+	}
+
+	fmt.Println("Test Scenario 18 completed successfully.")
+}
+
+// roadGraphJSON has two roads either side of a river with a bridge at the north
+// end, an expressway along the west bank, a one way lane off the west road and
+// a stretch of road nothing else joins.
+const roadGraphJSON = `{
+	"nodes": [
+		{"id": "w0", "lat": 12.930, "lon": 77.600}, {"id": "w1", "lat": 12.940, "lon": 77.600},
+		{"id": "w2", "lat": 12.950, "lon": 77.600}, {"id": "w3", "lat": 12.960, "lon": 77.600},
+		{"id": "e0", "lat": 12.930, "lon": 77.610}, {"id": "e1", "lat": 12.940, "lon": 77.610},
+		{"id": "e2", "lat": 12.950, "lon": 77.610}, {"id": "e3", "lat": 12.960, "lon": 77.610},
+		{"id": "lane", "lat": 12.925, "lon": 77.595},
+		{"id": "x0", "lat": 12.990, "lon": 77.650}, {"id": "x1", "lat": 12.995, "lon": 77.650}
+	],
+	"edges": [
+		{"from": "w0", "to": "w1", "speedKmph": 30}, {"from": "w1", "to": "w2", "speedKmph": 30}, {"from": "w2", "to": "w3", "speedKmph": 30},
+		{"from": "e0", "to": "e1", "speedKmph": 30}, {"from": "e1", "to": "e2", "speedKmph": 30}, {"from": "e2", "to": "e3", "speedKmph": 30},
+		{"from": "w3", "to": "e3", "speedKmph": 30},
+		{"from": "w0", "to": "w3", "lengthKm": 4, "speedKmph": 80},
+		{"from": "w0", "to": "lane", "speedKmph": 20, "oneWay": true},
+		{"from": "x0", "to": "x1", "speedKmph": 30}
+	]
+}`
+
+func testRoadRouting() {
+	fmt.Println("Starting Test Scenario 19: Road Routing")
+
+	idGenerationStrategy := src.NewIdGenerationUsingUUID()
+	distanceCalculator := src.NewHaversineDistanceCalculator()
+	if _, err := src.ReadRoadGraph(strings.NewReader(`{"nodes": [{"id": "a", "lat": 12.9, "lon": 77.6}], "edges": [{"from": "a", "to": "b", "speedKmph": 30}]}`), distanceCalculator); !errors.Is(err, src.ErrInvalidRoadGraph) {
+		log.Fatalf("Expected %v for an edge to an unknown node, got %v", src.ErrInvalidRoadGraph, err)
+	}
+	if _, err := src.ReadRoadGraph(strings.NewReader(`{"nodes": [{"id": "a", "lat": 12.9, "lon": 77.6}, {"id": "b", "lat": 13.0, "lon": 77.6}], "edges": [{"from": "a", "to": "b", "lengthKm": 1, "speedKmph": 30}]}`), distanceCalculator); !errors.Is(err, src.ErrInvalidRoadGraph) {
+		log.Fatalf("Expected %v for a road shorter than the straight line, got %v", src.ErrInvalidRoadGraph, err)
+	}
+	graphFile, err := os.CreateTemp("", "road-graph-*.json")
+	if err != nil {
+		log.Fatalf("Could not create the road graph file: %v", err)
+	}
+	defer os.Remove(graphFile.Name())
+	graphFile.WriteString(roadGraphJSON)
+	graphFile.Close()
+	roadGraph, err := src.LoadRoadGraph(graphFile.Name(), distanceCalculator)
+	if err != nil || roadGraph.GetNodeCount() != 11 {
+		log.Fatalf("Expected the road graph to load, got %v", err)
+	}
+	router := src.NewAStarRouter(roadGraph, distanceCalculator, src.RoutingPolicy{MaxSnapDistanceKm: 0.5, AccessSpeedKmph: 15, CacheSize: 2})
+	w0, w2, e0 := src.GeoPoint{Lat: 12.930, Lon: 77.600}, src.GeoPoint{Lat: 12.950, Lon: 77.600}, src.GeoPoint{Lat: 12.930, Lon: 77.610}
+	km := func(points ...src.GeoPoint) float64 {
+		total := 0.0
+		for i := 1; i < len(points); i++ {
+			total += distanceCalculator.Distance(points[i-1].Lat, points[i-1].Lon, points[i].Lat, points[i].Lon)
+		}
+		return total
+	}
+	within := func(got, want float64) bool {
+		return math.Abs(got-want) < 1e-6
+	}
+
+	// The fastest way over the river takes the expressway, though the west road is shorter
+	route, err := router.Route(w0.Lat, w0.Lon, e0.Lat, e0.Lon)
+	e3, e2, e1 := src.GeoPoint{Lat: 12.960, Lon: 77.610}, src.GeoPoint{Lat: 12.950, Lon: 77.610}, src.GeoPoint{Lat: 12.940, Lon: 77.610}
+	w3 := src.GeoPoint{Lat: 12.960, Lon: 77.600}
+	wantKm := 4 + km(w3, e3, e2, e1, e0)
+	wantDuration := time.Duration((4.0/80 + km(w3, e3, e2, e1, e0)/30) * float64(time.Hour))
+	if err != nil || len(route.Points) != 6 || route.Points[1] != w3 || !within(route.DistanceKm, wantKm) || (route.Duration-wantDuration).Abs() > time.Millisecond {
+		log.Fatalf("Expected %.2f km in %v by the expressway and the bridge, got %v, %v", wantKm, wantDuration, route, err)
+	}
+	fmt.Printf("  across the river: %v, %.2f km as the crow flies\n", route, km(w0, e0))
+	if route, err := router.Route(w0.Lat, w0.Lon, w2.Lat, w2.Lon); err != nil || len(route.Points) != 3 || !within(route.DistanceKm, km(w0, w2)) {
+		log.Fatalf("Expected the west road to w2, got %v, %v", route, err)
+	}
+
+	// Points are snapped to the nearest node, and the walk to it counts too
+	nearW0 := src.GeoPoint{Lat: 12.9302, Lon: 77.6001}
+	before := router.GetCacheStats()
+	snapped, err := router.Route(nearW0.Lat, nearW0.Lon, e0.Lat, e0.Lon)
+	if err != nil || !within(snapped.DistanceKm, wantKm+km(nearW0, w0)) || snapped.Duration <= route.Duration {
+		log.Fatalf("Expected the route from w0 plus the way to it, got %v, %v", snapped, err)
+	}
+	if stats := router.GetCacheStats(); stats.Hits != before.Hits+1 || stats.Size != 2 {
+		log.Fatalf("Expected the snapped route to come from the cache, got %+v after %+v", stats, before)
+	}
+	router.Route(e0.Lat, e0.Lon, w2.Lat, w2.Lon)
+	router.Route(w0.Lat, w0.Lon, e0.Lat, e0.Lon)
+	if stats := router.GetCacheStats(); stats.Size != 2 || stats.Misses != before.Misses+1 {
+		log.Fatalf("Expected the least recently used route to make way, got %+v", stats)
+	}
+
+	// No route off the network, against a one way lane or to roads nothing joins
+	if _, err := router.Route(13.2, 77.9, e0.Lat, e0.Lon); !errors.Is(err, src.ErrOffRoadNetwork) {
+		log.Fatalf("Expected %v far from any road, got %v", src.ErrOffRoadNetwork, err)
+	}
+	if _, err := router.Route(w0.Lat, w0.Lon, 12.925, 77.595); err != nil {
+		log.Fatalf("Expected the lane to be reachable, got %v", err)
+	}
+	if _, err := router.Route(12.925, 77.595, w0.Lat, w0.Lon); !errors.Is(err, src.ErrNoRoute) {
+		log.Fatalf("Expected %v against the one way lane, got %v", src.ErrNoRoute, err)
+	}
+	if _, err := router.Route(w0.Lat, w0.Lon, 12.990, 77.650); !errors.Is(err, src.ErrNoRoute) {
+		log.Fatalf("Expected %v to roads nothing joins, got %v", src.ErrNoRoute, err)
+	}
+
+	// Dispatch goes by time to the pickup, and fares by the road taken
+	clock := src.NewSystemClock()
+	repos := newInMemoryRepositories(clock)
+	eventBus := src.NewInMemoryEventBus(64)
+	poolManager := src.NewInMemoryPoolManager(repos.cabRepo, idGenerationStrategy, distanceCalculator, src.PoolPolicy{Capacity: 3})
+	rideDispatcher := src.NewOfferDispatcher(repos.cabRepo, repos.rideRepo, src.NewRouteAwareCabFindingStrategy(repos.cabRepo, router, 5, 10*time.Minute, 0),
+		src.NewInMemoryPendingRideQueue(2*time.Second, 100*time.Millisecond, 400*time.Millisecond), poolManager, eventBus, clock, 200*time.Millisecond, 3)
+	rateCard := src.FareRateCard{BaseFare: 50, PerKm: 12, PerMinute: 2, AverageSpeedKmph: 25}
+	cabService := src.NewInMemoryCabService(repos.userRepo, repos.cabRepo, repos.rideRepo, idGenerationStrategy, src.NewRoutedMeteredPricingStrategy(rateCard, router, distanceCalculator),
+		rideDispatcher, poolManager, newRatingManager(repos, eventBus, clock), newCancellationManager(repos, eventBus, clock), newPaymentProcessor(repos, eventBus, clock),
+		newPromotionManager(repos, eventBus, clock), newDriverManager(repos, eventBus, clock), newZoneManager(repos, eventBus, clock), eventBus, clock)
+	defer cabService.Close()
+	rider := mustRegisterUser(cabService, "Tanvi")
+	across := mustRegisterCab(cabService, "Across", src.Sedan)
+	cabService.UpdateCabLocation(across.GetId(), e0.Lat, e0.Lon)
+	upstream := mustRegisterCab(cabService, "Upstream", src.Sedan)
+	cabService.UpdateCabLocation(upstream.GetId(), w2.Lat, w2.Lon)
+
+	ride := mustBookRide(cabService, rider.GetId(), w0.Lat, w0.Lon, e0.Lat, e0.Lon)
+	estimate := ride.GetFareEstimate()
+	if !within(estimate.DistanceKm, route.DistanceKm) || estimate.Duration != route.Duration || estimate.DistanceFare != int(math.Round(route.DistanceKm*12)) ||
+		estimate.TimeFare != int(math.Round(route.Duration.Minutes()*2)) {
+		log.Fatalf("Expected the estimate to follow the route %v, got %v", route, estimate)
+	}
+	fmt.Println(estimate)
+	offer := waitForOffer(cabService, ride.GetId(), 1)
+	if offer.GetCabId() != upstream.GetId() {
+		log.Fatalf("Expected the cab up the same road to be offered the ride over the one across the river, got %s", offer.GetCabId())
+	}
+	cabService.AcceptRide(ride.GetId(), offer.GetCabId())
+	for rideStatus(cabService, ride.GetId()) != src.Confirmed {
+		time.Sleep(5 * time.Millisecond)
+	}
+	cabService.UpdateRideStatus(ride.GetId(), src.PickedUp)
+	if ride, _ = cabService.UpdateRideStatus(ride.GetId(), src.Completed); !within(ride.GetFinalFare().DistanceKm, route.DistanceKm) {
+		log.Fatalf("Expected the final fare to charge for the road taken, got %v", ride.GetFinalFare())
+	}
+	cabService.UpdateCabLocation(upstream.GetId(), w2.Lat, w2.Lon)
+
+	// The cab across the river is too far by road to be sent at all
+	ride = mustBookRide(cabService, rider.GetId(), w0.Lat, w0.Lon, w2.Lat, w2.Lon)
+	cabService.RejectRide(ride.GetId(), waitForOffer(cabService, ride.GetId(), 1).GetCabId())
+	waitForPending(cabService, ride.GetId())
+	cabService.CancelRide(ride.GetId(), src.CancelledByRider, src.ChangeOfPlans)
+
+	fmt.Println("Test Scenario 19 completed successfully.")
+}
+
+// newSimulatedCabService builds a service for the simulator on a manual clock.
+// Pending rides never expire or retry on their own in real time, riders give
+// up in simulated time instead and a freed cab retries them straight away.
+func newSimulatedCabService(clock src.Clock, pricingStrategy src.PricingStrategy, cabFindingStrategy func(cabRepo src.ICabRepository) src.CabFindingStrategy) src.CabService {
+	idGenerationStrategy := src.NewIdGenerationUsingUUID()
+	distanceCalculator := src.NewHaversineDistanceCalculator()
+	repos := newInMemoryRepositories(clock)
+	eventBus := src.NewInMemoryEventBus(256)
+	poolManager := src.NewInMemoryPoolManager(repos.cabRepo, idGenerationStrategy, distanceCalculator, src.PoolPolicy{Capacity: 3})
+	rideDispatcher := src.NewOfferDispatcher(repos.cabRepo, repos.rideRepo, cabFindingStrategy(repos.cabRepo),
+		src.NewInMemoryPendingRideQueue(time.Hour, time.Hour, time.Hour), poolManager, eventBus, clock, time.Second, 3)
+	return src.NewInMemoryCabService(repos.userRepo, repos.cabRepo, repos.rideRepo, idGenerationStrategy, pricingStrategy,
+		rideDispatcher, poolManager, newRatingManager(repos, eventBus, clock), newCancellationManager(repos, eventBus, clock), newPaymentProcessor(repos, eventBus, clock),
+		newPromotionManager(repos, eventBus, clock), newDriverManager(repos, eventBus, clock), newZoneManager(repos, eventBus, clock), eventBus, clock)
+}
+
+func testSimulation() {
+	fmt.Println("Starting Test Scenario 20: Fleet Simulation")
+
+	distanceCalculator := src.NewHaversineDistanceCalculator()
+	rateCard := src.FareRateCard{BaseFare: 50, PerKm: 12, PerMinute: 2, WaitingPerMinute: 1, FreeWaitingTime: 3 * time.Minute, AverageSpeedKmph: 25}
+	config := src.SimulationConfig{
+		Duration: 3 * time.Hour,
+		Seed:     42,
+		Area:     src.BoundingBox{MinLat: 12.90, MinLon: 77.58, MaxLat: 13.00, MaxLon: 77.68},
+		Demand: src.DemandProfile{
+			RidersPerHour:     30,
+			HourlyMultipliers: map[int]float64{9: 2},
+			Pickups: []src.DemandHotspot{
+				{Center: src.GeoPoint{Lat: 12.9352, Lon: 77.6245}, RadiusKm: 2, Weight: 3},
+				{Center: src.GeoPoint{Lat: 12.9716, Lon: 77.5946}, RadiusKm: 3, Weight: 1},
+			},
+		},
+		Cabs:             8,
+		Category:         src.Sedan,
+		CabSpeedKmph:     24,
+		CruiseSpeedKmph:  12,
+		MovementInterval: time.Minute,
+		RiderPatience:    10 * time.Minute,
+	}
+	simulate := func(name string, cabFindingStrategy func(cabRepo src.ICabRepository) src.CabFindingStrategy) *src.SimulationReport {
+		clock := src.NewManualClock(time.Date(2026, time.March, 2, 8, 0, 0, 0, time.Local))
+		cabService := newSimulatedCabService(clock, src.NewMeteredPricingStrategy(rateCard, distanceCalculator), cabFindingStrategy)
+		defer cabService.Close()
+		runConfig := config
+		runConfig.Name = name
+		report, err := src.NewFleetSimulator(cabService, clock, distanceCalculator, nil, runConfig).Run()
+		if err != nil {
+			log.Fatalf("Expected the %s simulation to run, got %v", name, err)
+		}
+		fmt.Println(" ", report)
+		return report
+	}
+
+	// A config that cannot run is turned away before anything is registered
+	invalid := config
+	invalid.Cabs = 0
+	clock := src.NewManualClock(time.Now())
+	cabService := newSimulatedCabService(clock, src.NewFixPricingStrategy(10, distanceCalculator), func(cabRepo src.ICabRepository) src.CabFindingStrategy {
+		return src.NewNearestAvailableCarFindingStrategy(cabRepo, distanceCalculator, 0)
+	})
+	defer cabService.Close()
+	if _, err := src.NewFleetSimulator(cabService, clock, distanceCalculator, nil, invalid).Run(); !errors.Is(err, src.ErrInvalidSimulation) {
+		log.Fatalf("Expected %v for a fleet without cabs, got %v", src.ErrInvalidSimulation, err)
+	}
+
+	// The same riders are served by the nearest cab anywhere and only within 2 km
+	reports := []*src.SimulationReport{
+		simulate("nearest", func(cabRepo src.ICabRepository) src.CabFindingStrategy {
+			return src.NewNearestAvailableCarFindingStrategy(cabRepo, distanceCalculator, 0)
+		}),
+		simulate("nearest-within-2km", func(cabRepo src.ICabRepository) src.CabFindingStrategy {
+			return src.NewNearestAvailableCarFindingStrategy(cabRepo, distanceCalculator, 2)
+		}),
+	}
+	if reports[0].Requested != reports[1].Requested {
+		log.Fatalf("Expected both runs to see the same riders, got %d and %d", reports[0].Requested, reports[1].Requested)
+	}
+	for _, report := range reports {
+		if report.Requested < 60 || report.Matched > report.Requested || report.Completed > report.Matched || report.Matched+report.Abandoned < report.Requested {
+			log.Fatalf("Expected every rider to be matched or give up, got %v", report)
+		}
+		if report.Completed == 0 || report.Revenue <= 0 || report.PassengerKm <= 0 || report.DeadHeadKm <= 0 {
+			log.Fatalf("Expected rides to be completed and paid for, got %v", report)
+		}
+		if report.WaitP50 <= 0 || report.WaitP50 > report.WaitP90 || report.WaitP90 > report.WaitP99 {
+			log.Fatalf("Expected wait percentiles to rise, got %v", report)
+		}
+		if report.MatchRate != float64(report.Matched)/float64(report.Requested) || report.Utilisation <= 0 || report.Utilisation > 1 {
+			log.Fatalf("Expected rates between 0 and 1, got %v", report)
+		}
+	}
+
+	// Both runs export side by side
+	var exported bytes.Buffer
+	if err := src.WriteSimulationCSV(&exported, reports); err != nil {
+		log.Fatalf("Expected the reports to export, got %v", err)
+	}
+	rows, err := csv.NewReader(&exported).ReadAll()
+	if err != nil || len(rows) != 3 || rows[0][0] != "name" || rows[1][0] != "nearest" || rows[2][0] != "nearest-within-2km" {
+		log.Fatalf("Expected a header and a row per run, got %v, %v", rows, err)
+	}
+	if rows[1][1] != strconv.Itoa(reports[0].Requested) || rows[2][12] != strconv.Itoa(reports[1].Revenue) {
+		log.Fatalf("Expected the rows to carry the reports, got %v", rows)
+	}
+
+	fmt.Println("Test Scenario 20 completed successfully.")
+}
+
+const zonesJSON = `{
+	"serviceAreas": [
+		{"id": "bengaluru", "vertices": [{"lat": 12.80, "lon": 77.40}, {"lat": 12.80, "lon": 77.85}, {"lat": 13.30, "lon": 77.85}, {"lat": 13.30, "lon": 77.40}]}
+	],
+	"specialZones": [
+		{"id": "airport", "vertices": [{"lat": 13.18, "lon": 77.69}, {"lat": 13.18, "lon": 77.72}, {"lat": 13.21, "lon": 77.72}, {"lat": 13.21, "lon": 77.69}],
+			"pickupSurcharge": 120, "dropSurcharge": 80, "queued": true}
+	]
+}`
+
+func waitForZoneQueue(cabService src.CabService, zoneId string, cabIds ...string) {
+	for i := 0; ; i++ {
+		queue, err := cabService.GetZoneQueue(zoneId)
+		if err != nil {
+			log.Fatalf("Expected the %s queue, got %v", zoneId, err)
+		}
+		queued := make([]string, 0, len(queue))
+		for _, queuedCab := range queue {
+			queued = append(queued, queuedCab.CabId)
+		}
+		if strings.Join(queued, ",") == strings.Join(cabIds, ",") {
+			return
+		}
+		if i == 100 {
+			log.Fatalf("Expected the %s queue to be %v, got %v", zoneId, cabIds, queued)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func testServiceAreas() {
+	fmt.Println("Starting Test Scenario 21: Service Areas and Airport Queues")
+
+	if _, err := src.ReadZonePolicy(strings.NewReader(`{"serviceAreas": [{"id": "line", "vertices": [{"lat": 12.9, "lon": 77.5}, {"lat": 13.0, "lon": 77.6}]}]}`)); !errors.Is(err, src.ErrInvalidZonePolicy) {
+		log.Fatalf("Expected %v for a zone of two vertices, got %v", src.ErrInvalidZonePolicy, err)
+	}
+	zonePolicy, err := src.ReadZonePolicy(strings.NewReader(zonesJSON))
+	if err != nil || len(zonePolicy.ServiceAreas) != 1 || len(zonePolicy.SpecialZones) != 1 {
+		log.Fatalf("Expected a service area and an airport, got %v, %v", zonePolicy, err)
+	}
+
+	clock := src.NewSystemClock()
+	idGenerationStrategy := src.NewIdGenerationUsingUUID()
+	distanceCalculator := src.NewHaversineDistanceCalculator()
+	repos := newInMemoryRepositories(clock)
+	eventBus := src.NewInMemoryEventBus(64)
+	zoneManager := src.NewQueueingZoneManager(repos.cabRepo, eventBus, clock, zonePolicy)
+	poolManager := src.NewInMemoryPoolManager(repos.cabRepo, idGenerationStrategy, distanceCalculator, src.PoolPolicy{Capacity: 3})
+	cabFindingStrategy := src.NewZoneQueueCabFindingStrategy(src.NewNearestAvailableCarFindingStrategy(repos.cabRepo, distanceCalculator, 0), zoneManager)
+	rideDispatcher := src.NewOfferDispatcher(repos.cabRepo, repos.rideRepo, cabFindingStrategy,
+		src.NewInMemoryPendingRideQueue(2*time.Second, 100*time.Millisecond, 400*time.Millisecond), poolManager, eventBus, clock, 200*time.Millisecond, 3)
+	pricingStrategy := src.NewZoneSurchargePricingStrategy(src.NewFixPricingStrategy(10, distanceCalculator), zoneManager)
+	cabService := src.NewInMemoryCabService(repos.userRepo, repos.cabRepo, repos.rideRepo, idGenerationStrategy, pricingStrategy,
+		rideDispatcher, poolManager, newRatingManager(repos, eventBus, clock), newCancellationManager(repos, eventBus, clock), newPaymentProcessor(repos, eventBus, clock),
+		newPromotionManager(repos, eventBus, clock), newDriverManager(repos, eventBus, clock), zoneManager, eventBus, clock)
+	defer cabService.Close()
+	rider := mustRegisterUser(cabService, "Ishaan")
+
+	// Pickups outside the service area are turned away, drops outside it are not
+	if _, err := cabService.BookRide(rider.GetId(), 12.2958, 76.6394, 12.9716, 77.5946); !errors.Is(err, src.ErrOutsideServiceArea) {
+		log.Fatalf("Expected %v for a pickup in Mysuru, got %v", src.ErrOutsideServiceArea, err)
+	}
+	if _, err := cabService.QuoteFares(12.2958, 76.6394, 12.9716, 77.5946); !errors.Is(err, src.ErrOutsideServiceArea) {
+		log.Fatalf("Expected %v quoting from Mysuru, got %v", src.ErrOutsideServiceArea, err)
+	}
+	if _, err := cabService.QuoteFares(12.9716, 77.5946, 12.2958, 76.6394); err != nil {
+		log.Fatalf("Expected a ride out of town to be quoted, got %v", err)
+	}
+
+	// Cabs free at the airport queue in the order they arrive
+	first := mustRegisterCab(cabService, "First", src.Sedan)
+	cabService.UpdateCabLocation(first.GetId(), 13.205, 77.715)
+	waitForZoneQueue(cabService, "airport", first.GetId())
+	second := mustRegisterCab(cabService, "Second", src.Sedan)
+	cabService.UpdateCabLocation(second.GetId(), 13.1990, 77.7070)
+	waitForZoneQueue(cabService, "airport", first.GetId(), second.GetId())
+	nearby := mustRegisterCab(cabService, "Nearby", src.Sedan)
+	cabService.UpdateCabLocation(nearby.GetId(), 13.1750, 77.7060)
+	if _, err := cabService.GetZoneQueue("nowhere"); !errors.Is(err, src.ErrZoneNotFound) {
+		log.Fatalf("Expected %v for a zone that does not exist, got %v", src.ErrZoneNotFound, err)
+	}
+
+	// The cab at the front gets the airport ride, not the one nearest the rider, and the rider pays the pickup surcharge
+	ride := mustBookRide(cabService, rider.GetId(), 13.1986, 77.7066, 12.9716, 77.5946)
+	if estimate := ride.GetFareEstimate(); estimate.ZoneSurcharge != 120 || estimate.PickupZoneId != "airport" || estimate.DropZoneId != "" {
+		log.Fatalf("Expected the airport pickup surcharge on the estimate, got %v", estimate)
+	}
+	offer := waitForOffer(cabService, ride.GetId(), 1)
+	if offer.GetCabId() != first.GetId() {
+		log.Fatalf("Expected the cab at the front of the queue to be offered the ride, got %s", offer.GetCabId())
+	}
+	cabService.AcceptRide(ride.GetId(), offer.GetCabId())
+	waitForZoneQueue(cabService, "airport", second.GetId())
+	cabService.UpdateRideStatus(ride.GetId(), src.PickedUp)
+	if ride, _ = cabService.UpdateRideStatus(ride.GetId(), src.Completed); ride.GetFinalFare().ZoneSurcharge != 120 {
+		log.Fatalf("Expected the final fare to keep the surcharge, got %v", ride.GetFinalFare())
+	}
+
+	// A queued driver who turns a ride down keeps their place while it goes further afield
+	ride = mustBookRide(cabService, rider.GetId(), 13.1986, 77.7066, 12.9716, 77.5946)
+	cabService.RejectRide(ride.GetId(), waitForOffer(cabService, ride.GetId(), 1).GetCabId())
+	if offer := waitForOffer(cabService, ride.GetId(), 2); offer.GetCabId() != nearby.GetId() {
+		log.Fatalf("Expected the ride to go to the nearest cab outside the queue, got %s", offer.GetCabId())
+	}
+	cabService.CancelRide(ride.GetId(), src.CancelledByRider, src.ChangeOfPlans)
+	waitForZoneQueue(cabService, "airport", second.GetId())
+
+	// A queued cab whose ride is cancelled before pickup takes its place in the queue again
+	ride = mustBookRide(cabService, rider.GetId(), 13.1986, 77.7066, 12.9716, 77.5946)
+	cabService.AcceptRide(ride.GetId(), waitForOffer(cabService, ride.GetId(), 1).GetCabId())
+	waitForZoneQueue(cabService, "airport")
+	cabService.CancelRide(ride.GetId(), src.CancelledByRider, src.ChangeOfPlans)
+	waitForZoneQueue(cabService, "airport", second.GetId())
+
+	// Rides to the airport pay the drop surcharge, and leaving the airport or going offline leaves the queue
+	quotes, _ := cabService.QuoteFares(12.9716, 77.5946, 13.1986, 77.7066)
+	if quotes[0].Fare.ZoneSurcharge != 80 || quotes[0].Fare.DropZoneId != "airport" {
+		log.Fatalf("Expected the airport drop surcharge on the quote, got %v", quotes[0].Fare)
+	}
+	cabService.UpdateCabLocation(nearby.GetId(), 13.2000, 77.7000)
+	waitForZoneQueue(cabService, "airport", second.GetId(), nearby.GetId())
+	cabService.GoOffline(second.GetId())
+	cabService.UpdateCabLocation(nearby.GetId(), 13.1750, 77.7060)
+	waitForZoneQueue(cabService, "airport")
+
+	fmt.Println("Test Scenario 21 completed successfully.")
+}
+
+func testRideHistory() {
+	fmt.Println("Starting Test Scenario 22: Ride History")
+
+	clock := src.NewSystemClock()
+	cabService := newSimulatedCabService(clock, src.NewFixPricingStrategy(10, src.NewHaversineDistanceCalculator()), func(cabRepo src.ICabRepository) src.CabFindingStrategy {
+		return src.NewNearestAvailableCarFindingStrategy(cabRepo, src.NewHaversineDistanceCalculator(), 0)
+	})
+	defer cabService.Close()
+	rider := mustRegisterUser(cabService, "Meera")
+	other := mustRegisterUser(cabService, "Arjun")
+	cab := mustRegisterCab(cabService, "Swift", src.Sedan)
+	cabService.UpdateCabLocation(cab.GetId(), 12.9352, 77.6245)
+
+	// Five completed rides and a cancelled one for the rider, one ride for someone else
+	var completed []*src.Ride
+	spend := 0
+	for i := 0; i < 5; i++ {
+		ride := mustBookRide(cabService, rider.GetId(), 12.9352, 77.6245, 12.9716, 77.5946)
+		cabService.AcceptRide(ride.GetId(), waitForOffer(cabService, ride.GetId(), 1).GetCabId())
+		time.Sleep(20 * time.Millisecond)
+		cabService.UpdateRideStatus(ride.GetId(), src.PickedUp)
+		ride, _ = cabService.UpdateRideStatus(ride.GetId(), src.Completed)
+		completed = append(completed, ride)
+		spend += ride.GetTotalAmount()
+	}
+	cancelled := mustBookRide(cabService, rider.GetId(), 12.9352, 77.6245, 12.9716, 77.5946)
+	cabService.CancelRide(cancelled.GetId(), src.CancelledByRider, src.ChangeOfPlans)
+	otherRide := mustBookRide(cabService, other.GetId(), 12.9352, 77.6245, 12.9716, 77.5946)
+	cabService.CancelRide(otherRide.GetId(), src.CancelledByRider, src.ChangeOfPlans)
+
+	// Pages of two walk the history newest first and end without a cursor
+	var seen []string
+	query := src.RideQuery{UserId: rider.GetId(), Order: src.NewestFirst, Limit: 2}
+	for pages := 0; ; pages++ {
+		page, err := cabService.QueryRides(query)
+		if err != nil || pages > 3 {
+			log.Fatalf("Expected the history to end after 3 pages, got %v", err)
+		}
+		if page.Totals.Rides != 6 || page.Totals.Completed != 5 || page.Totals.Canceled != 1 || page.Totals.Spend != spend {
+			log.Fatalf("Expected totals over all 6 rides on every page, got %+v", page.Totals)
+		}
+		for _, ride := range page.Rides {
+			seen = append(seen, ride.GetId())
+		}
+		if query.Cursor = page.NextCursor; query.Cursor == "" {
+			break
+		}
+	}
+	if len(seen) != 6 || seen[0] != cancelled.GetId() || seen[5] != completed[0].GetId() {
+		log.Fatalf("Expected all 6 rides newest first, got %v", seen)
+	}
+
+	// Filters narrow both the rides and the totals
+	page, _ := cabService.QueryRides(src.RideQuery{UserId: rider.GetId(), Statuses: []src.RideStatus{src.Canceled}})
+	if len(page.Rides) != 1 || page.Totals.Rides != 1 || page.Totals.Spend != 0 {
+		log.Fatalf("Expected the free cancellation only, got %+v", page.Totals)
+	}
+	page, _ = cabService.QueryRides(src.RideQuery{UserId: rider.GetId(), CreatedFrom: completed[3].GetCreatedAt(), CreatedTo: cancelled.GetCreatedAt()})
+	if len(page.Rides) != 2 || page.Rides[0].GetId() != completed[3].GetId() || page.Totals.DistanceKm <= 0 {
+		log.Fatalf("Expected the last two completed rides, got %d rides and %+v", len(page.Rides), page.Totals)
+	}
+	if _, err := cabService.QueryRides(src.RideQuery{UserId: "nobody"}); !errors.Is(err, src.ErrUserNotFound) {
+		log.Fatalf("Expected %v for an unknown rider, got %v", src.ErrUserNotFound, err)
+	}
+
+	fmt.Println("Test Scenario 22 completed successfully.")
+}
+
+func testContextCabService() {
+	fmt.Println("Starting Test Scenario 23: Context-Aware Cab Service")
+
+	clock := src.NewSystemClock()
+	idGenerationStrategy := src.NewIdGenerationUsingUUID()
+	distanceCalculator := src.NewHaversineDistanceCalculator()
+	repos := newInMemoryRepositories(clock)
+	eventBus := src.NewInMemoryEventBus(64)
+	poolManager := src.NewInMemoryPoolManager(repos.cabRepo, idGenerationStrategy, distanceCalculator, src.PoolPolicy{Capacity: 3})
+	rideDispatcher := src.NewOfferDispatcher(repos.cabRepo, repos.rideRepo, src.NewNearestAvailableCarFindingStrategy(repos.cabRepo, distanceCalculator, 0),
+		src.NewInMemoryPendingRideQueue(500*time.Millisecond, 50*time.Millisecond, 100*time.Millisecond), poolManager, eventBus, clock, 2*time.Second, 3)
+	cabService := src.NewInMemoryCabService(repos.userRepo, repos.cabRepo, repos.rideRepo, idGenerationStrategy, src.NewFixPricingStrategy(10, distanceCalculator),
+		rideDispatcher, poolManager, newRatingManager(repos, eventBus, clock), newCancellationManager(repos, eventBus, clock), newPaymentProcessor(repos, eventBus, clock),
+		newPromotionManager(repos, eventBus, clock), newDriverManager(repos, eventBus, clock), newZoneManager(repos, eventBus, clock), eventBus, clock)
+	defer cabService.Close()
+	driver := &scriptedDriver{cabService: cabService}
+	eventBus.Subscribe(driver)
+	serviceV2 := src.NewCabServiceV2(cabService)
+	ctx := context.Background()
+	expectError := func(what string, err, want error) {
+		if !errors.Is(err, want) {
+			log.Fatalf("Expected %v for %s, got %v", want, what, err)
+		}
+	}
+
+	// Unknown ids and bad input come back as sentinel errors instead of panics
+	_, err := serviceV2.GetRideStatus(ctx, "nothing")
+	expectError("the status of an unknown ride", err, src.ErrRideNotFound)
+	_, err = serviceV2.BookRide(ctx, "nobody", 12.9352, 77.6245, 12.9716, 77.5946)
+	expectError("a booking for an unknown rider", err, src.ErrUserNotFound)
+	_, err = serviceV2.RegisterUser(ctx, " ")
+	expectError("a rider without a name", err, src.ErrInvalidName)
+	_, err = serviceV2.RegisterCab(ctx, "Ghost", src.AnyCategory)
+	expectError("a cab without a category", err, src.ErrUnknownVehicleCategory)
+	expectError("accepting an unknown ride", serviceV2.AcceptRide(ctx, "nothing", "nobody"), src.ErrRideNotFound)
+	cancelledCtx, cancel := context.WithCancel(ctx)
+	cancel()
+	_, err = serviceV2.BookRide(cancelledCtx, "nobody", 12.9352, 77.6245, 12.9716, 77.5946)
+	expectError("a booking with a cancelled context", err, context.Canceled)
+
+	rider, _ := serviceV2.RegisterUser(ctx, "Kavya")
+	cab, _ := serviceV2.RegisterCab(ctx, "Dzire", src.Sedan)
+	serviceV2.UpdateCabLocation(ctx, cab.GetId(), 12.9300, 77.6200)
+
+	// Booking blocks until the driver accepts
+	driver.setAnswer("accept")
+	ride, err := serviceV2.BookRide(ctx, rider.GetId(), 12.9352, 77.6245, 12.9716, 77.5946)
+	if err != nil || ride.GetStatus() != src.Confirmed || ride.GetCabId() != cab.GetId() {
+		log.Fatalf("Expected the booking to return confirmed with the cab, got %v, %v", ride, err)
+	}
+	_, err = serviceV2.CancelRide(cancelledCtx, ride.GetId(), src.CancelledByRider, src.ChangeOfPlans)
+	expectError("a cancellation with a cancelled context", err, context.Canceled)
+	if status, _ := serviceV2.GetRideStatus(ctx, ride.GetId()); status != src.Confirmed {
+		log.Fatalf("Expected a cancellation given up on to leave the ride confirmed, got %v", status)
+	}
+	expectError("accepting as an unknown cab", serviceV2.AcceptRide(ctx, ride.GetId(), "nobody"), src.ErrCabNotFound)
+	expectError("accepting an offer already taken", serviceV2.AcceptRide(ctx, ride.GetId(), cab.GetId()), src.ErrNoPendingOffer)
+	_, err = serviceV2.UpdateRideStatus(ctx, ride.GetId(), src.Completed)
+	expectError("completing a ride before pickup", err, src.ErrInvalidTransition)
+	serviceV2.UpdateRideStatus(ctx, ride.GetId(), src.PickedUp)
+	if ride, err = serviceV2.UpdateRideStatus(ctx, ride.GetId(), src.Completed); err != nil || ride.GetStatus() != src.Completed {
+		log.Fatalf("Expected the ride to complete, got %v", err)
+	}
+
+	// A rider who gives up while the offer is out cancels the ride and frees the cab
+	driver.setAnswer("")
+	timeoutCtx, cancel := context.WithTimeout(ctx, 150*time.Millisecond)
+	defer cancel()
+	_, err = serviceV2.BookRide(timeoutCtx, rider.GetId(), 12.9352, 77.6245, 12.9716, 77.5946)
+	expectError("a booking that outlived its context", err, context.DeadlineExceeded)
+	rides, _ := serviceV2.QueryRides(ctx, src.RideQuery{UserId: rider.GetId(), Order: src.NewestFirst, Limit: 1})
+	abandoned := rides.Rides[0]
+	if offer, _ := serviceV2.GetRideOffer(ctx, abandoned.GetId()); abandoned.GetStatus() != src.Canceled || offer.GetStatus() != src.OfferWithdrawn {
+		log.Fatalf("Expected the abandoned ride cancelled and its offer withdrawn, got %v and %v", abandoned.GetStatus(), offer)
+	}
+	for i := 0; ; i++ {
+		if cab, _ = serviceV2.GetCab(ctx, cab.GetId()); cab.GetCabStatus() == src.ReadyToTakeRide {
+			break
+		} else if i == 100 {
+			log.Fatalf("Expected the cab to be free again, got %v", cab.GetCabStatus())
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	// A ride cancelled elsewhere while the booking waits ends the booking instead of confirming it
+	booked := make(chan error, 1)
+	go func() {
+		_, err := serviceV2.BookRide(ctx, rider.GetId(), 12.9352, 77.6245, 12.9716, 77.5946)
+		booked <- err
+	}()
+	for i := 0; ; i++ {
+		rides, _ = serviceV2.QueryRides(ctx, src.RideQuery{UserId: rider.GetId(), Order: src.NewestFirst, Limit: 1})
+		if waiting := rides.Rides[0]; waiting.GetId() != abandoned.GetId() {
+			serviceV2.CancelRide(ctx, waiting.GetId(), src.CancelledByRider, src.OtherReason)
+			break
+		} else if i == 100 {
+			log.Fatalf("Expected a second booking for the rider")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	expectError("a booking whose ride was cancelled", <-booked, src.ErrRideCanceled)
+
+	// A driver who turns every offer down leaves the rider without a cab once the pending wait runs out
+	driver.setAnswer("reject")
+	_, err = serviceV2.BookRide(ctx, rider.GetId(), 12.9352, 77.6245, 12.9716, 77.5946)
+	expectError("a booking every driver turned down", err, src.ErrNoCabAvailable)
+
+	// Tracking stops when its context does
+	driver.setAnswer("accept")
+	ride, _ = serviceV2.BookRide(ctx, rider.GetId(), 12.9352, 77.6245, 12.9716, 77.5946)
+	trackingCtx, stopTracking := context.WithCancel(ctx)
+	tracker, err := serviceV2.TrackRide(trackingCtx, ride.GetId())
+	if err != nil {
+		log.Fatalf("Expected to track the ride, got %v", err)
+	}
+	if update := <-tracker.Updates(); update.Type != src.CabLocationUpdated {
+		log.Fatalf("Expected tracking to start with where the cab is, got %v", update)
+	}
+	stopTracking()
+	time.Sleep(20 * time.Millisecond)
+	serviceV2.UpdateRideStatus(ctx, ride.GetId(), src.PickedUp)
+	select {
+	case update := <-tracker.Updates():
+		log.Fatalf("Expected no updates once tracking stopped, got %v", update)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	fmt.Println("Test Scenario 23 completed successfully.")
+}
+
+func testMultiStopRides() {
+	fmt.Println("Starting Test Scenario 24: Multi-Stop Rides")
+
+	clock := src.NewManualClock(time.Date(2026, time.March, 2, 18, 0, 0, 0, time.Local))
+	distanceCalculator := src.NewHaversineDistanceCalculator()
+	rateCard := src.FareRateCard{BaseFare: 50, PerKm: 12, PerMinute: 2, WaitingPerMinute: 2, FreeWaitingTime: 3 * time.Minute,
+		PerStop: 25, FreeStopWaitingTime: 3 * time.Minute, AverageSpeedKmph: 25}
+	cabService := newSimulatedCabService(clock, src.NewMeteredPricingStrategy(rateCard, distanceCalculator), func(cabRepo src.ICabRepository) src.CabFindingStrategy {
+		return src.NewNearestAvailableCarFindingStrategy(cabRepo, distanceCalculator, 0)
+	})
+	defer cabService.Close()
+	rider := mustRegisterUser(cabService, "Nikhil")
+	cab := mustRegisterCab(cabService, "Ertiga", src.Sedan)
+	cabService.UpdateCabLocation(cab.GetId(), 12.9352, 77.6245)
+	pickup, drop := src.GeoPoint{Lat: 12.9352, Lon: 77.6245}, src.GeoPoint{Lat: 12.9716, Lon: 77.5946}
+	friend, pharmacy, office := src.GeoPoint{Lat: 12.9450, Lon: 77.6100}, src.GeoPoint{Lat: 12.9550, Lon: 77.6050}, src.GeoPoint{Lat: 12.9600, Lon: 77.6000}
+	pathKm := func(points ...src.GeoPoint) float64 {
+		distanceKm := 0.0
+		for i := 1; i < len(points); i++ {
+			distanceKm += distanceCalculator.Distance(points[i-1].Lat, points[i-1].Lon, points[i].Lat, points[i].Lon)
+		}
+		return distanceKm
+	}
+
+	// Stops are checked when the ride is booked
+	bookings := map[string][]src.BookingOption{
+		"a pooled ride with a stop": {src.WithPool(1), src.WithStops(friend)},
+		"more stops than allowed":   {src.WithStops(friend, pharmacy, office, friend)},
+	}
+	for what, options := range bookings {
+		if _, err := cabService.BookRide(rider.GetId(), pickup.Lat, pickup.Lon, drop.Lat, drop.Lon, options...); !errors.Is(err, src.ErrInvalidStop) {
+			log.Fatalf("Expected %v for %s, got %v", src.ErrInvalidStop, what, err)
+		}
+	}
+	if _, err := cabService.BookRide(rider.GetId(), pickup.Lat, pickup.Lon, drop.Lat, drop.Lon, src.WithStops(src.GeoPoint{Lat: 95, Lon: 77.6})); !errors.Is(err, src.ErrInvalidCoordinates) {
+		log.Fatalf("Expected %v for a stop off the map, got %v", src.ErrInvalidCoordinates, err)
+	}
+
+	// The rider books with a stop, adds two more and takes one back out
+	ride, err := cabService.BookRide(rider.GetId(), pickup.Lat, pickup.Lon, drop.Lat, drop.Lon, src.WithStops(pharmacy))
+	if err != nil {
+		log.Fatalf("Expected the ride to be booked with a stop, got %v", err)
+	}
+	if estimate := ride.GetFareEstimate(); len(ride.GetStops()) != 1 || ride.GetStops()[0].Status != src.StopPending || estimate.Stops != 1 || estimate.StopCharge != rateCard.PerStop {
+		log.Fatalf("Expected the booking to be quoted with one pending stop, got %+v", ride.GetStops())
+	}
+	rideId := ride.GetId()
+	cabService.AddStop(rideId, 1, office.Lat, office.Lon)
+	if ride, err = cabService.AddStop(rideId, 0, friend.Lat, friend.Lon); err != nil {
+		log.Fatalf("Expected a stop to be added first, got %v", err)
+	}
+	if stops := ride.GetStops(); len(stops) != 3 || stops[0].Location != friend || stops[2].Location != office || ride.GetFareEstimate().StopCharge != 3*rateCard.PerStop {
+		log.Fatalf("Expected three stops in order quoted at three stop charges, got %+v", stops)
+	}
+	if math.Abs(ride.GetFareEstimate().DistanceKm-pathKm(pickup, friend, pharmacy, office, drop)) > 1e-9 {
+		log.Fatalf("Expected the estimate to run through every stop, got %.3f km", ride.GetFareEstimate().DistanceKm)
+	}
+	if _, err := cabService.AddStop(rideId, 3, friend.Lat, friend.Lon); !errors.Is(err, src.ErrInvalidStop) {
+		log.Fatalf("Expected %v for a fourth stop, got %v", src.ErrInvalidStop, err)
+	}
+	if ride, err = cabService.RemoveStop(rideId, 2); err != nil || len(ride.GetStops()) != 2 || ride.GetFareEstimate().Stops != 2 {
+		log.Fatalf("Expected the friend and the pharmacy to be left, got %v", err)
+	}
+
+	// Overlapping stop changes leave the ride quoted for the stops it ends up with
+	var changes sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		changes.Add(2)
+		go func() {
+			defer changes.Done()
+			cabService.AddStop(rideId, 2, office.Lat, office.Lon)
+		}()
+		go func() {
+			defer changes.Done()
+			cabService.RemoveStop(rideId, 2)
+		}()
+	}
+	changes.Wait()
+	if ride, _ = cabService.GetRide(rideId); ride.GetFareEstimate().Stops != len(ride.GetStops()) {
+		log.Fatalf("Expected the estimate to price the %d stops left, got %d", len(ride.GetStops()), ride.GetFareEstimate().Stops)
+	}
+	if len(ride.GetStops()) == 3 {
+		cabService.RemoveStop(rideId, 2)
+	}
+	if _, err := cabService.ArriveAtStop(rideId, 0); !errors.Is(err, src.ErrStopOutOfOrder) {
+		log.Fatalf("Expected %v for a stop reached before pickup, got %v", src.ErrStopOutOfOrder, err)
+	}
+
+	// Once the rider is on board the stops are fixed and visited in order
+	cabService.AcceptRide(rideId, waitForOffer(cabService, rideId, 1).GetCabId())
+	time.Sleep(20 * time.Millisecond)
+	if _, err := cabService.UpdateRideStatus(rideId, src.PickedUp); err != nil {
+		log.Fatalf("Expected the rider to be picked up, got %v", err)
+	}
+	if _, err := cabService.AddStop(rideId, 2, office.Lat, office.Lon); !errors.Is(err, src.ErrStopsLocked) {
+		log.Fatalf("Expected %v for a stop added on board, got %v", src.ErrStopsLocked, err)
+	}
+	if _, err := cabService.ArriveAtStop(rideId, 1); !errors.Is(err, src.ErrStopOutOfOrder) {
+		log.Fatalf("Expected %v for reaching the second stop first, got %v", src.ErrStopOutOfOrder, err)
+	}
+	if _, err := cabService.DepartStop(rideId, 0); !errors.Is(err, src.ErrStopOutOfOrder) {
+		log.Fatalf("Expected %v for leaving a stop not reached, got %v", src.ErrStopOutOfOrder, err)
+	}
+	tracker, err := cabService.TrackRide(rideId)
+	if err != nil {
+		log.Fatalf("Expected to track the ride, got %v", err)
+	}
+	defer tracker.Stop()
+
+	// The cab waits five minutes for the friend and the rider skips the pharmacy
+	clock.Advance(4 * time.Minute)
+	if _, err := cabService.ArriveAtStop(rideId, 0); err != nil {
+		log.Fatalf("Expected the cab to reach the first stop, got %v", err)
+	}
+	for arrived := false; !arrived; {
+		select {
+		case update := <-tracker.Updates():
+			if arrived = update.Type == src.CabArrivedAtStop; arrived && (update.StopIndex == nil || *update.StopIndex != 0 || update.Lat != friend.Lat) {
+				log.Fatalf("Expected the rider to be told the cab reached the first stop, got %+v", update)
+			}
+		case <-time.After(time.Second):
+			log.Fatalf("Expected the rider to be told the cab reached the first stop")
+		}
+	}
+	clock.Advance(5 * time.Minute)
+	if ride, err = cabService.DepartStop(rideId, 0); err != nil || ride.GetStops()[0].Status != src.StopDeparted || ride.GetStops()[1].Status != src.StopPending {
+		log.Fatalf("Expected the first stop to be left and the second still ahead, got %v", err)
+	}
+	clock.Advance(6 * time.Minute)
+	completed, err := cabService.UpdateRideStatus(rideId, src.Completed)
+	if err != nil {
+		log.Fatalf("Expected the ride to complete, got %v", err)
+	}
+	stops := completed.GetStops()
+	if stops[0].GetWaitingTime() != 5*time.Minute || stops[1].Status != src.StopSkipped {
+		log.Fatalf("Expected a five minute stop and a skipped one, got %+v", stops)
+	}
+
+	// Only the stop made is charged, with the wait past the free minutes, and the time standing there is not also charged as driving time
+	fare := completed.GetFinalFare()
+	if fare.Stops != 1 || fare.StopCharge != rateCard.PerStop || fare.StopWaitingTime != 2*time.Minute || fare.StopWaitingCharge != 2*rateCard.WaitingPerMinute {
+		log.Fatalf("Expected one stop with two charged minutes of waiting, got %+v", fare)
+	}
+	if fare.Duration != 10*time.Minute || math.Abs(fare.DistanceKm-pathKm(pickup, friend, drop)) > 1e-9 {
+		log.Fatalf("Expected ten minutes driving through the first stop only, got %v and %.3f km", fare.Duration, fare.DistanceKm)
+	}
+	if fare.Total != fare.BaseFare+fare.DistanceFare+fare.TimeFare+fare.WaitingCharge+fare.StopCharge+fare.StopWaitingCharge {
+		log.Fatalf("Expected the stop charges to add up to the total, got %+v", fare)
+	}
+	fmt.Println(fare)
+
+	fmt.Println("Test Scenario 24 completed successfully.")
+}
@@ -0,0 +1,182 @@
+package src
+
+import (
+	"fmt"
+	"math"
+	"slices"
+	"time"
+)
+
+// Cancellation records who called a ride off, why, and what it cost the rider.
+type Cancellation struct {
+	CancelledBy CancellationActor
+	Reason      CancellationReason
+	// AtFault is who the cancellation is blamed on. Only a rider at fault pays
+	// the fee and only a driver at fault has it counted against them.
+	AtFault          CancellationActor
+	SinceConfirmed   time.Duration
+	DriverDistanceKm float64
+	Fee              int
+	FeeWaived        bool
+	At               time.Time
+}
+
+func (c *Cancellation) String() string {
+	fee := fmt.Sprintf("fee %d", c.Fee)
+	if c.FeeWaived {
+		fee = "fee waived"
+	}
+	return fmt.Sprintf("{CancelledBy: %v, Reason: %v, AtFault: %v, %s}", c.CancelledBy, c.Reason, c.AtFault, fee)
+}
+
+func (c *Cancellation) clone() *Cancellation {
+	if c == nil {
+		return nil
+	}
+	clone := *c
+	return &clone
+}
+
+type CancellationPolicy struct {
+	// A rider cancels for free within FreeWindow of the cab being confirmed,
+	// as long as the driver has not moved more than FreeDistanceKm.
+	FreeWindow     time.Duration
+	FreeDistanceKm float64
+	BaseFee        int
+	// FeePerMinute is charged for every minute past FreeWindow and FeePerKm for
+	// every kilometre the driver moved since accepting.
+	FeePerMinute int
+	FeePerKm     int
+	MaxFee       int
+	// Drivers whose cancellation rate goes above MaxDriverCancellationRate,
+	// once they have accepted MinRidesForCancellationRate rides, are only
+	// offered rides no other cab can take for DeprioritiseFor.
+	MaxDriverCancellationRate   float64
+	MinRidesForCancellationRate int
+	DeprioritiseFor             time.Duration
+}
+
+// cancellationReasons lists the reasons each side may give.
+var cancellationReasons = map[CancellationActor][]CancellationReason{
+	CancelledByRider:  {OtherReason, ChangeOfPlans, WrongPickupLocation, DriverDelayed, DriverAskedToCancel, SafetyConcern},
+	CancelledByDriver: {OtherReason, RiderNoShow, WrongPickupLocation, VehicleIssue, SafetyConcern},
+	CancelledBySystem: {OtherReason, OperationalIssue},
+}
+
+// atFault blames the side that cancelled unless the reason points at the other
+// one. Nobody is blamed for a safety concern.
+func atFault(cancelledBy CancellationActor, reason CancellationReason) CancellationActor {
+	switch {
+	case reason == SafetyConcern:
+		return CancelledBySystem
+	case cancelledBy == CancelledByRider && (reason == DriverDelayed || reason == DriverAskedToCancel):
+		return CancelledByDriver
+	case cancelledBy == CancelledByDriver && (reason == RiderNoShow || reason == WrongPickupLocation):
+		return CancelledByRider
+	}
+	return cancelledBy
+}
+
+type CancellationManager interface {
+	// Assess works out the cancellation of the ride as it stands, without
+	// changing anything. The cab is the one assigned to the ride, if any.
+	Assess(ride *Ride, cab *Cab, cancelledBy CancellationActor, reason CancellationReason) (*Cancellation, error)
+	// RecordCancellation counts a cancelled ride against its driver when they
+	// were at fault.
+	RecordCancellation(ride *Ride)
+	GetPolicy() CancellationPolicy
+}
+
+type PolicyCancellationManager struct {
+	cabRepo            ICabRepository
+	distanceCalculator DistanceCalculator
+	eventBus           EventBus
+	clock              Clock
+	policy             CancellationPolicy
+}
+
+func NewPolicyCancellationManager(cabRepo ICabRepository, distanceCalculator DistanceCalculator, eventBus EventBus, clock Clock, policy CancellationPolicy) CancellationManager {
+	return &PolicyCancellationManager{
+		cabRepo:            cabRepo,
+		distanceCalculator: distanceCalculator,
+		eventBus:           eventBus,
+		clock:              clock,
+		policy:             policy,
+	}
+}
+
+func (pcm *PolicyCancellationManager) Assess(ride *Ride, cab *Cab, cancelledBy CancellationActor, reason CancellationReason) (*Cancellation, error) {
+	reasons, known := cancellationReasons[cancelledBy]
+	if !known {
+		return nil, fmt.Errorf("%w: %d", ErrUnknownCancellationActor, cancelledBy)
+	}
+	if !slices.Contains(reasons, reason) {
+		return nil, fmt.Errorf("%w: %v cannot cancel for %v", ErrReasonNotAllowed, cancelledBy, reason)
+	}
+	if cancelledBy == CancelledByDriver && ride.GetCabId() == "" {
+		return nil, ErrCabNotAssigned
+	}
+	if !CanTransitionRide(ride.GetStatus(), Canceled) {
+		return nil, &InvalidRideTransitionError{RideId: ride.GetId(), From: ride.GetStatus(), To: Canceled}
+	}
+
+	cancellation := &Cancellation{
+		CancelledBy: cancelledBy,
+		Reason:      reason,
+		AtFault:     atFault(cancelledBy, reason),
+		At:          pcm.clock.Now(),
+	}
+	confirmedAt, confirmed := ride.GetTransitionTime(Confirmed)
+	if !confirmed {
+		return cancellation, nil
+	}
+	cancellation.SinceConfirmed = cancellation.At.Sub(confirmedAt)
+	if acceptedFrom := ride.GetCabAcceptedFrom(); acceptedFrom != nil && cab != nil && cab.GetId() == ride.GetCabId() {
+		cabLat, cabLon := cab.GetCurrLocation()
+		cancellation.DriverDistanceKm = pcm.distanceCalculator.Distance(acceptedFrom.Lat, acceptedFrom.Lon, cabLat, cabLon)
+	}
+	fee := pcm.fee(cancellation.SinceConfirmed, cancellation.DriverDistanceKm)
+	if cancellation.AtFault == CancelledByRider {
+		cancellation.Fee = fee
+	} else {
+		cancellation.FeeWaived = fee > 0
+	}
+	return cancellation, nil
+}
+
+func (pcm *PolicyCancellationManager) fee(sinceConfirmed time.Duration, driverDistanceKm float64) int {
+	if sinceConfirmed <= pcm.policy.FreeWindow && driverDistanceKm <= pcm.policy.FreeDistanceKm {
+		return 0
+	}
+	billableMinutes := math.Ceil(max(0, sinceConfirmed-pcm.policy.FreeWindow).Minutes())
+	fee := pcm.policy.BaseFee + int(billableMinutes)*pcm.policy.FeePerMinute + int(math.Round(driverDistanceKm*float64(pcm.policy.FeePerKm)))
+	if pcm.policy.MaxFee > 0 {
+		fee = min(fee, pcm.policy.MaxFee)
+	}
+	return fee
+}
+
+func (pcm *PolicyCancellationManager) RecordCancellation(ride *Ride) {
+	cancellation := ride.GetCancellation()
+	if cancellation == nil || cancellation.AtFault != CancelledByDriver || ride.GetCabId() == "" {
+		return
+	}
+	now := pcm.clock.Now()
+	deprioritised := false
+	pcm.cabRepo.UpdateCab(ride.GetCabId(), func(cab *Cab) error {
+		cab.RecordCancellation()
+		acceptedRides := cab.GetCancellations() + cab.GetTotalRides()
+		if acceptedRides >= pcm.policy.MinRidesForCancellationRate && cab.GetCancellationRate() > pcm.policy.MaxDriverCancellationRate && !cab.IsDeprioritised(now) {
+			cab.DeprioritiseUntil(now.Add(pcm.policy.DeprioritiseFor))
+			deprioritised = true
+		}
+		return nil
+	})
+	if deprioritised {
+		pcm.eventBus.Publish(newRideEvent(CabDeprioritised, ride, pcm.clock.Now()))
+	}
+}
+
+func (pcm *PolicyCancellationManager) GetPolicy() CancellationPolicy {
+	return pcm.policy
+}
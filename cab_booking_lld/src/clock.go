@@ -0,0 +1,184 @@
+package src
+
+import (
+	"sync"
+	"time"
+)
+
+type Ticker interface {
+	C() <-chan time.Time
+	Stop()
+}
+
+// Timer is a pending AfterFunc call. Stop reports whether it stopped the call
+// before it ran.
+type Timer interface {
+	Stop() bool
+}
+
+// Clock is where time dependent components read the time from, so that they
+// can be driven by a ManualClock instead of waiting for real time to pass.
+type Clock interface {
+	Now() time.Time
+	NewTicker(interval time.Duration) Ticker
+	AfterFunc(d time.Duration, f func()) Timer
+}
+
+type SystemClock struct{}
+
+func NewSystemClock() Clock {
+	return SystemClock{}
+}
+
+func (sc SystemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (sc SystemClock) NewTicker(interval time.Duration) Ticker {
+	return systemTicker{ticker: time.NewTicker(interval)}
+}
+
+func (sc SystemClock) AfterFunc(d time.Duration, f func()) Timer {
+	return time.AfterFunc(d, f)
+}
+
+type systemTicker struct {
+	ticker *time.Ticker
+}
+
+func (st systemTicker) C() <-chan time.Time {
+	return st.ticker.C
+}
+
+func (st systemTicker) Stop() {
+	st.ticker.Stop()
+}
+
+// ManualClock only moves when Advance is called. AfterFunc calls run in time
+// order on the goroutine calling Advance, with the clock at their time, or
+// straight away when they are already due. Tickers fire once the clock is at
+// the end of the Advance and, like time.Ticker, drop ticks nobody is waiting for.
+type ManualClock struct {
+	mu       sync.Mutex
+	now      time.Time
+	tickers  map[*manualTicker]bool
+	timers   map[*manualTimer]bool
+	timerSeq int
+}
+
+func NewManualClock(start time.Time) *ManualClock {
+	return &ManualClock{
+		now:     start,
+		tickers: make(map[*manualTicker]bool),
+		timers:  make(map[*manualTimer]bool),
+	}
+}
+
+func (mc *ManualClock) Now() time.Time {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	return mc.now
+}
+
+func (mc *ManualClock) NewTicker(interval time.Duration) Ticker {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	mt := &manualTicker{
+		clock:    mc,
+		interval: interval,
+		next:     mc.now.Add(interval),
+		c:        make(chan time.Time, 1),
+	}
+	mc.tickers[mt] = true
+	return mt
+}
+
+func (mc *ManualClock) AfterFunc(d time.Duration, f func()) Timer {
+	mc.mu.Lock()
+	mc.timerSeq++
+	mt := &manualTimer{clock: mc, at: mc.now.Add(d), seq: mc.timerSeq, f: f}
+	if d <= 0 {
+		mc.mu.Unlock()
+		f()
+		return mt
+	}
+	mc.timers[mt] = true
+	mc.mu.Unlock()
+	return mt
+}
+
+func (mc *ManualClock) Advance(d time.Duration) {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	until := mc.now.Add(d)
+	for {
+		mt := mc.nextTimer(until)
+		if mt == nil {
+			break
+		}
+		delete(mc.timers, mt)
+		if mt.at.After(mc.now) {
+			mc.now = mt.at
+		}
+		// The call may use the clock, including to set another timer.
+		mc.mu.Unlock()
+		mt.f()
+		mc.mu.Lock()
+	}
+	mc.now = until
+	for mt := range mc.tickers {
+		for !mt.next.After(mc.now) {
+			select {
+			case mt.c <- mt.next:
+			default:
+			}
+			mt.next = mt.next.Add(mt.interval)
+		}
+	}
+}
+
+// nextTimer is the earliest timer due by until, the first one set on a tie.
+func (mc *ManualClock) nextTimer(until time.Time) *manualTimer {
+	var next *manualTimer
+	for mt := range mc.timers {
+		if mt.at.After(until) {
+			continue
+		}
+		if next == nil || mt.at.Before(next.at) || (mt.at.Equal(next.at) && mt.seq < next.seq) {
+			next = mt
+		}
+	}
+	return next
+}
+
+type manualTicker struct {
+	clock    *ManualClock
+	interval time.Duration
+	next     time.Time
+	c        chan time.Time
+}
+
+func (mt *manualTicker) C() <-chan time.Time {
+	return mt.c
+}
+
+func (mt *manualTicker) Stop() {
+	mt.clock.mu.Lock()
+	defer mt.clock.mu.Unlock()
+	delete(mt.clock.tickers, mt)
+}
+
+type manualTimer struct {
+	clock *ManualClock
+	at    time.Time
+	seq   int
+	f     func()
+}
+
+func (mt *manualTimer) Stop() bool {
+	mt.clock.mu.Lock()
+	defer mt.clock.mu.Unlock()
+	stopped := mt.clock.timers[mt]
+	delete(mt.clock.timers, mt)
+	return stopped
+}
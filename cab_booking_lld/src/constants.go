@@ -1,5 +1,11 @@
 package src
 
+import (
+	"errors"
+	"fmt"
+	"math"
+)
+
 type CabStatus int
 
 const (
@@ -9,6 +15,20 @@ const (
 	OnBreak
 )
 
+func (cs CabStatus) String() string {
+	switch cs {
+	case InActive:
+		return "InActive"
+	case Busy:
+		return "Busy"
+	case ReadyToTakeRide:
+		return "ReadyToTakeRide"
+	case OnBreak:
+		return "OnBreak"
+	}
+	return "Unknown"
+}
+
 type RideStatus int
 
 const (
@@ -17,4 +37,545 @@ const (
 	PickedUp
 	Completed
 	Canceled
+	NoCabFound
+	Scheduled
+)
+
+func (rs RideStatus) String() string {
+	switch rs {
+	case SearchingForCab:
+		return "SearchingForCab"
+	case Confirmed:
+		return "Confirmed"
+	case PickedUp:
+		return "PickedUp"
+	case Completed:
+		return "Completed"
+	case Canceled:
+		return "Canceled"
+	case NoCabFound:
+		return "NoCabFound"
+	case Scheduled:
+		return "Scheduled"
+	}
+	return "Unknown"
+}
+
+func ParseRideStatus(name string) (RideStatus, error) {
+	for status := SearchingForCab; status <= Scheduled; status++ {
+		if status.String() == name {
+			return status, nil
+		}
+	}
+	return 0, fmt.Errorf("%w: %q", ErrUnknownRideStatus, name)
+}
+
+type StopStatus int
+
+const (
+	StopPending StopStatus = iota
+	StopArrived
+	StopDeparted
+	StopSkipped
+)
+
+func (ss StopStatus) String() string {
+	switch ss {
+	case StopPending:
+		return "Pending"
+	case StopArrived:
+		return "Arrived"
+	case StopDeparted:
+		return "Departed"
+	case StopSkipped:
+		return "Skipped"
+	}
+	return "Unknown"
+}
+
+type OfferStatus int
+
+const (
+	OfferPending OfferStatus = iota
+	OfferAccepted
+	OfferRejected
+	OfferExpired
+	OfferWithdrawn
+)
+
+func (ofs OfferStatus) String() string {
+	switch ofs {
+	case OfferPending:
+		return "Pending"
+	case OfferAccepted:
+		return "Accepted"
+	case OfferRejected:
+		return "Rejected"
+	case OfferExpired:
+		return "Expired"
+	case OfferWithdrawn:
+		return "Withdrawn"
+	}
+	return "Unknown"
+}
+
+type RideType int
+
+const (
+	SoloRide RideType = iota
+	PoolRide
+)
+
+func (rt RideType) String() string {
+	switch rt {
+	case SoloRide:
+		return "Solo"
+	case PoolRide:
+		return "Pool"
+	}
+	return "Unknown"
+}
+
+func ParseRideType(name string) (RideType, error) {
+	for rideType := SoloRide; rideType <= PoolRide; rideType++ {
+		if rideType.String() == name {
+			return rideType, nil
+		}
+	}
+	return 0, fmt.Errorf("%w: %q", ErrUnknownRideType, name)
+}
+
+// VehicleCategory is the kind of vehicle a cab is. Riders may ask for
+// AnyCategory, which no cab is registered as.
+type VehicleCategory int
+
+const (
+	AnyCategory VehicleCategory = iota
+	Hatchback
+	Sedan
+	SUV
+	Auto
+	Bike
+)
+
+func (vc VehicleCategory) String() string {
+	switch vc {
+	case AnyCategory:
+		return "Any"
+	case Hatchback:
+		return "Hatchback"
+	case Sedan:
+		return "Sedan"
+	case SUV:
+		return "SUV"
+	case Auto:
+		return "Auto"
+	case Bike:
+		return "Bike"
+	}
+	return "Unknown"
+}
+
+// GetSeats is the number of riders the vehicle carries.
+func (vc VehicleCategory) GetSeats() int {
+	switch vc {
+	case Hatchback, Sedan:
+		return 4
+	case SUV:
+		return 6
+	case Auto:
+		return 3
+	case Bike:
+		return 1
+	}
+	return 0
+}
+
+// Matches reports whether a cab of category cabCategory serves a ride booked
+// for vc.
+func (vc VehicleCategory) Matches(cabCategory VehicleCategory) bool {
+	return vc == AnyCategory || vc == cabCategory
+}
+
+func ParseVehicleCategory(name string) (VehicleCategory, error) {
+	for category := AnyCategory; category <= Bike; category++ {
+		if category.String() == name {
+			return category, nil
+		}
+	}
+	return 0, fmt.Errorf("%w: %q", ErrUnknownVehicleCategory, name)
+}
+
+// VehicleCategories lists the categories cabs can be registered as.
+func VehicleCategories() []VehicleCategory {
+	return []VehicleCategory{Hatchback, Sedan, SUV, Auto, Bike}
+}
+
+// RatingAuthor says who rated whom: the rider rates the driver and the driver
+// rates the rider.
+type RatingAuthor int
+
+const (
+	RatedByRider RatingAuthor = iota
+	RatedByDriver
+)
+
+func (ra RatingAuthor) String() string {
+	switch ra {
+	case RatedByRider:
+		return "Rider"
+	case RatedByDriver:
+		return "Driver"
+	}
+	return "Unknown"
+}
+
+type StopKind int
+
+const (
+	PickupStop StopKind = iota
+	DropStop
+)
+
+func (sk StopKind) String() string {
+	switch sk {
+	case PickupStop:
+		return "Pickup"
+	case DropStop:
+		return "Drop"
+	}
+	return "Unknown"
+}
+
+// CancellationActor is who cancelled a ride, or who a cancellation is blamed on.
+type CancellationActor int
+
+const (
+	CancelledByRider CancellationActor = iota
+	CancelledByDriver
+	CancelledBySystem
+)
+
+func (ca CancellationActor) String() string {
+	switch ca {
+	case CancelledByRider:
+		return "Rider"
+	case CancelledByDriver:
+		return "Driver"
+	case CancelledBySystem:
+		return "System"
+	}
+	return "Unknown"
+}
+
+func ParseCancellationActor(name string) (CancellationActor, error) {
+	for actor := CancelledByRider; actor <= CancelledBySystem; actor++ {
+		if actor.String() == name {
+			return actor, nil
+		}
+	}
+	return 0, fmt.Errorf("%w: %q", ErrUnknownCancellationActor, name)
+}
+
+type CancellationReason int
+
+const (
+	OtherReason CancellationReason = iota
+	ChangeOfPlans
+	WrongPickupLocation
+	DriverDelayed
+	DriverAskedToCancel
+	RiderNoShow
+	VehicleIssue
+	SafetyConcern
+	OperationalIssue
+)
+
+func (cr CancellationReason) String() string {
+	switch cr {
+	case OtherReason:
+		return "Other"
+	case ChangeOfPlans:
+		return "ChangeOfPlans"
+	case WrongPickupLocation:
+		return "WrongPickupLocation"
+	case DriverDelayed:
+		return "DriverDelayed"
+	case DriverAskedToCancel:
+		return "DriverAskedToCancel"
+	case RiderNoShow:
+		return "RiderNoShow"
+	case VehicleIssue:
+		return "VehicleIssue"
+	case SafetyConcern:
+		return "SafetyConcern"
+	case OperationalIssue:
+		return "OperationalIssue"
+	}
+	return "Unknown"
+}
+
+func ParseCancellationReason(name string) (CancellationReason, error) {
+	for reason := OtherReason; reason <= OperationalIssue; reason++ {
+		if reason.String() == name {
+			return reason, nil
+		}
+	}
+	return 0, fmt.Errorf("%w: %q", ErrUnknownCancellationReason, name)
+}
+
+type PaymentMethodType int
+
+const (
+	WalletPayment PaymentMethodType = iota
+	CashPayment
+	CardPayment
+)
+
+func (pmt PaymentMethodType) String() string {
+	switch pmt {
+	case WalletPayment:
+		return "Wallet"
+	case CashPayment:
+		return "Cash"
+	case CardPayment:
+		return "Card"
+	}
+	return "Unknown"
+}
+
+func ParsePaymentMethodType(name string) (PaymentMethodType, error) {
+	for methodType := WalletPayment; methodType <= CardPayment; methodType++ {
+		if methodType.String() == name {
+			return methodType, nil
+		}
+	}
+	return 0, fmt.Errorf("%w: %q", ErrUnknownPaymentMethodType, name)
+}
+
+type PaymentStatus int
+
+const (
+	PaymentPending PaymentStatus = iota
+	PaymentSucceeded
+	// PaymentFailed payments are owed by the rider as outstanding dues.
+	PaymentFailed
+	PaymentPartiallyRefunded
+	PaymentRefunded
+)
+
+func (ps PaymentStatus) String() string {
+	switch ps {
+	case PaymentPending:
+		return "Pending"
+	case PaymentSucceeded:
+		return "Succeeded"
+	case PaymentFailed:
+		return "Failed"
+	case PaymentPartiallyRefunded:
+		return "PartiallyRefunded"
+	case PaymentRefunded:
+		return "Refunded"
+	}
+	return "Unknown"
+}
+
+type LedgerEntryKind int
+
+const (
+	WalletTopUp LedgerEntryKind = iota
+	RideCharge
+	DueRecorded
+	DueSettled
+	RideRefund
+	DueWaived
+	ReferralReward
+)
+
+func (lek LedgerEntryKind) String() string {
+	switch lek {
+	case WalletTopUp:
+		return "WalletTopUp"
+	case RideCharge:
+		return "RideCharge"
+	case DueRecorded:
+		return "DueRecorded"
+	case DueSettled:
+		return "DueSettled"
+	case RideRefund:
+		return "RideRefund"
+	case DueWaived:
+		return "DueWaived"
+	case ReferralReward:
+		return "ReferralReward"
+	}
+	return "Unknown"
+}
+
+type PromotionKind int
+
+const (
+	PercentageDiscount PromotionKind = iota
+	FlatDiscount
+)
+
+func (pk PromotionKind) String() string {
+	switch pk {
+	case PercentageDiscount:
+		return "Percentage"
+	case FlatDiscount:
+		return "Flat"
+	}
+	return "Unknown"
+}
+
+func ParsePromotionKind(name string) (PromotionKind, error) {
+	for kind := PercentageDiscount; kind <= FlatDiscount; kind++ {
+		if kind.String() == name {
+			return kind, nil
+		}
+	}
+	return 0, fmt.Errorf("%w: %q", ErrUnknownPromotionKind, name)
+}
+
+type RedemptionStatus int
+
+const (
+	// RedemptionReserved holds one use of the code for a ride that has not
+	// ended yet, so it counts against the limits like a redeemed one.
+	RedemptionReserved RedemptionStatus = iota
+	RedemptionRedeemed
+	RedemptionReleased
+)
+
+func (rs RedemptionStatus) String() string {
+	switch rs {
+	case RedemptionReserved:
+		return "Reserved"
+	case RedemptionRedeemed:
+		return "Redeemed"
+	case RedemptionReleased:
+		return "Released"
+	}
+	return "Unknown"
+}
+
+type EarningKind int
+
+const (
+	RideEarning EarningKind = iota
+	Incentive
+	Payout
+)
+
+func (ek EarningKind) String() string {
+	switch ek {
+	case RideEarning:
+		return "RideEarning"
+	case Incentive:
+		return "Incentive"
+	case Payout:
+		return "Payout"
+	}
+	return "Unknown"
+}
+
+type StatementPeriod int
+
+const (
+	DailyStatement StatementPeriod = iota
+	WeeklyStatement
+)
+
+func (sp StatementPeriod) String() string {
+	switch sp {
+	case DailyStatement:
+		return "Daily"
+	case WeeklyStatement:
+		return "Weekly"
+	}
+	return "Unknown"
+}
+
+func ParseStatementPeriod(name string) (StatementPeriod, error) {
+	for period := DailyStatement; period <= WeeklyStatement; period++ {
+		if period.String() == name {
+			return period, nil
+		}
+	}
+	return 0, fmt.Errorf("%w: %q", ErrUnknownStatementPeriod, name)
+}
+
+var ErrRideNotFound = errors.New("ride not found")
+var ErrCabNotFound = errors.New("cab not found")
+var ErrCabNotAvailable = errors.New("cab is not ready to take a ride")
+var ErrCabNotAssigned = errors.New("no cab assigned to ride")
+var ErrInvalidTransition = errors.New("invalid ride status transition")
+var ErrRideCanceled = errors.New("ride was cancelled before a cab was assigned")
+var ErrRideNotPending = errors.New("ride is not waiting in the pending queue")
+var ErrUserNotFound = errors.New("user not found")
+var ErrNoOfferForRide = errors.New("ride has not been offered to any cab yet")
+var ErrNoPendingOffer = errors.New("no pending offer for ride")
+var ErrOfferNotForCab = errors.New("ride is not offered to this cab")
+var ErrInvalidCoordinates = errors.New("coordinates are out of range")
+var ErrUnknownRideStatus = errors.New("unknown ride status")
+var ErrRideNotScheduled = errors.New("ride is not waiting for its scheduled pickup")
+var ErrInvalidPickupTime = errors.New("pickup time must be in the future")
+var ErrUnknownRideType = errors.New("unknown ride type")
+var ErrInvalidSeats = errors.New("seat count is out of range")
+var ErrPoolUnavailable = errors.New("pool cannot take the ride without breaking its seat or detour limits")
+var ErrNotInPool = errors.New("ride is not part of a pool")
+var ErrUnknownVehicleCategory = errors.New("unknown vehicle category")
+var ErrInvalidRating = errors.New("rating is out of range")
+var ErrRideNotCompleted = errors.New("ride has not been completed")
+var ErrRatingWindowClosed = errors.New("the time to rate this ride is over")
+var ErrAlreadyRated = errors.New("ride has already been rated")
+var ErrNotRideParticipant = errors.New("only the rider and the driver of a ride can rate it")
+var ErrUnknownCancellationActor = errors.New("unknown cancellation actor")
+var ErrUnknownCancellationReason = errors.New("unknown cancellation reason")
+var ErrReasonNotAllowed = errors.New("reason cannot be given by this canceller")
+var ErrUnknownPaymentMethodType = errors.New("unknown payment method type")
+var ErrPaymentMethodNotFound = errors.New("payment method not found")
+var ErrPaymentMethodNotAllowed = errors.New("payment method cannot be used for this")
+var ErrInvalidCard = errors.New("card number is not valid")
+var ErrCardDeclined = errors.New("card was declined")
+var ErrInsufficientWalletBalance = errors.New("wallet balance is too low")
+var ErrInvalidAmount = errors.New("amount must be positive")
+var ErrOutstandingDues = errors.New("rider has outstanding dues to clear before booking")
+var ErrPaymentNotFound = errors.New("ride has not been charged")
+var ErrAlreadyCharged = errors.New("ride has already been charged")
+var ErrRefundNotAllowed = errors.New("payment cannot be refunded by that amount")
+var ErrMissingRefundReason = errors.New("a refund needs the reason the ride was disputed")
+var ErrUnknownPromotionKind = errors.New("unknown promotion kind")
+var ErrInvalidPromotion = errors.New("promotion is not valid")
+var ErrPromoCodeTaken = errors.New("promo code is already in use")
+var ErrPromoNotFound = errors.New("promo code not found")
+var ErrPromoNotActive = errors.New("promo code is not valid at this time")
+var ErrPromoNotApplicable = errors.New("promo code does not apply to this ride")
+var ErrPromoLimitReached = errors.New("promo code has been used up")
+var ErrRedemptionNotFound = errors.New("promo redemption not found")
+var ErrCabOnRide = errors.New("cab is on a ride")
+var ErrInvalidShiftChange = errors.New("driver cannot make that shift change now")
+var ErrEarningAlreadyRecorded = errors.New("ride earning has already been recorded")
+var ErrUnknownStatementPeriod = errors.New("unknown statement period")
+var ErrNothingToPayOut = errors.New("no driver has earnings to pay out")
+var ErrPayoutBatchNotFound = errors.New("payout batch not found")
+var ErrInvalidRoadGraph = errors.New("road graph is not valid")
+var ErrOffRoadNetwork = errors.New("point is too far from the road network")
+var ErrNoRoute = errors.New("no road route between the points")
+var ErrInvalidSimulation = errors.New("invalid simulation config")
+var ErrOutsideServiceArea = errors.New("pickup is outside the service area")
+var ErrZoneNotFound = errors.New("zone not found")
+var ErrInvalidZonePolicy = errors.New("invalid zone policy")
+var ErrInvalidRideQuery = errors.New("invalid ride query")
+var ErrInvalidCursor = errors.New("page cursor is not valid")
+var ErrNoCabAvailable = errors.New("no cab available for the ride")
+var ErrInvalidName = errors.New("name is required")
+var ErrInvalidStop = errors.New("stop is not valid")
+var ErrStopsLocked = errors.New("stops can only be changed before pickup")
+var ErrStopOutOfOrder = errors.New("stops are visited in order once the rider is picked up")
+
+const (
+	earthRadiusKm  = 6371.0
+	kmPerDegreeLat = earthRadiusKm * math.Pi / 180
 )
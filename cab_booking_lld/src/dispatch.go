@@ -0,0 +1,424 @@
+package src
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+type RideOffer struct {
+	rideId      string
+	cabId       string
+	attempt     int
+	maxAttempts int
+	status      OfferStatus
+	offeredAt   time.Time
+	expiresAt   time.Time
+	response    chan struct{}
+}
+
+func (ro *RideOffer) String() string {
+	return fmt.Sprintf("{RideId: %s, CabId: %s, Attempt: %d/%d, Status: %v, ExpiresAt: %v}", ro.rideId, ro.cabId, ro.attempt, ro.maxAttempts, ro.status, ro.expiresAt)
+}
+
+func (ro RideOffer) GetRideId() string {
+	return ro.rideId
+}
+
+func (ro RideOffer) GetCabId() string {
+	return ro.cabId
+}
+
+func (ro RideOffer) GetAttempt() int {
+	return ro.attempt
+}
+
+func (ro RideOffer) GetMaxAttempts() int {
+	return ro.maxAttempts
+}
+
+func (ro RideOffer) GetStatus() OfferStatus {
+	return ro.status
+}
+
+func (ro RideOffer) GetOfferedAt() time.Time {
+	return ro.offeredAt
+}
+
+func (ro RideOffer) GetExpiresAt() time.Time {
+	return ro.expiresAt
+}
+
+type RideDispatcher interface {
+	Dispatch(ride *Ride)
+	RespondToOffer(rideId, cabId string, accepted bool) error
+	GetCurrentOffer(rideId string) (*RideOffer, error)
+	CancelDispatch(rideId string)
+	NotifyCabAvailable()
+	GetPendingRide(rideId string) (*PendingRide, error)
+	GetPendingQueueStats() PendingQueueStats
+	Close()
+}
+
+type dispatchRound struct {
+	ride        *Ride
+	attempts    int
+	triedCabIds map[string]bool
+}
+
+// OfferDispatcher offers a ride to one cab at a time and moves on to the next
+// best cab when the driver rejects or lets the offer expire. Rides for which no
+// cab is free wait in the pending queue and are retried whenever a cab frees up.
+type OfferDispatcher struct {
+	cabRepo            ICabRepository
+	rideRepo           IRideRegistory
+	cabFindingStrategy CabFindingStrategy
+	pendingQueue       PendingRideQueue
+	poolManager        PoolManager
+	eventBus           EventBus
+	clock              Clock
+	offerTimeout       time.Duration
+	maxAttempts        int
+	mu                 sync.Mutex
+	offers             map[string]*RideOffer
+	reservedCabs       map[string]string
+	rounds             map[string]*dispatchRound
+	retryMu            sync.Mutex
+	retryTimer         Timer
+	closed             bool
+}
+
+func NewOfferDispatcher(cabRepo ICabRepository, rideRepo IRideRegistory, cabFindingStrategy CabFindingStrategy, pendingQueue PendingRideQueue, poolManager PoolManager, eventBus EventBus, clock Clock, offerTimeout time.Duration, maxAttempts int) RideDispatcher {
+	od := &OfferDispatcher{
+		cabRepo:            cabRepo,
+		rideRepo:           rideRepo,
+		cabFindingStrategy: cabFindingStrategy,
+		pendingQueue:       pendingQueue,
+		poolManager:        poolManager,
+		eventBus:           eventBus,
+		clock:              clock,
+		offerTimeout:       offerTimeout,
+		maxAttempts:        maxAttempts,
+		offers:             make(map[string]*RideOffer),
+		reservedCabs:       make(map[string]string),
+		rounds:             make(map[string]*dispatchRound),
+	}
+	od.scheduleRetry()
+	return od
+}
+
+func (od *OfferDispatcher) Dispatch(ride *Ride) {
+	round := &dispatchRound{ride: ride, triedCabIds: make(map[string]bool)}
+	od.mu.Lock()
+	od.rounds[ride.GetId()] = round
+	od.mu.Unlock()
+
+	offer, live := od.offerToNextCab(round)
+	if !live {
+		od.finish(ride.GetId(), false)
+		return
+	}
+	if offer == nil {
+		od.park(round)
+		return
+	}
+	od.awaitOffers(round, offer)
+}
+
+// awaitOffers waits for the driver's answer and keeps offering the ride to the
+// next cab until one accepts, the attempts run out or no free cab is left.
+func (od *OfferDispatcher) awaitOffers(round *dispatchRound, offer *RideOffer) {
+	rideId := round.ride.GetId()
+	for offer != nil {
+		pending := offer
+		expiry := od.clock.AfterFunc(od.offerTimeout, func() { od.expireOffer(pending) })
+		<-offer.response
+		expiry.Stop()
+
+		if od.closeOffer(offer) == OfferAccepted && od.assignCab(round.ride, offer.cabId) {
+			od.finish(rideId, true)
+			return
+		}
+		if round.attempts >= od.maxAttempts {
+			break
+		}
+		next, live := od.offerToNextCab(round)
+		if !live {
+			break
+		}
+		if offer = next; offer == nil {
+			od.park(round)
+			return
+		}
+	}
+	od.finish(rideId, false)
+}
+
+// park queues a ride that found no free cab, or puts it back in its place in
+// the queue when it was already waiting there.
+func (od *OfferDispatcher) park(round *dispatchRound) {
+	rideId := round.ride.GetId()
+	if !od.pendingQueue.Contains(rideId) {
+		od.pendingQueue.Enqueue(rideId, round.ride.GetPriorityTier(), od.clock.Now())
+		return
+	}
+	if !od.pendingQueue.Reschedule(rideId, od.clock.Now()) {
+		od.finish(rideId, false)
+	}
+}
+
+func (od *OfferDispatcher) finish(rideId string, matched bool) {
+	od.pendingQueue.Complete(rideId, od.clock.Now(), matched)
+	od.mu.Lock()
+	delete(od.rounds, rideId)
+	od.mu.Unlock()
+	if matched {
+		return
+	}
+	_, err := od.rideRepo.UpdateRide(rideId, func(ride *Ride) error {
+		return ride.TransitionTo(NoCabFound, od.clock.Now())
+	})
+	if err == nil {
+		od.eventBus.Publish(newRideEvent(RideNoCabFound, od.rideRepo.GetRideById(rideId), od.clock.Now()))
+	}
+}
+
+// NotifyCabAvailable retries the pending rides off the caller's goroutine, or
+// on it with a ManualClock, which runs calls that are due straight away.
+func (od *OfferDispatcher) NotifyCabAvailable() {
+	od.clock.AfterFunc(0, func() { od.retryPendingRides(true) })
+}
+
+// scheduleRetry sets the timer for the next periodic retry of the pending rides.
+func (od *OfferDispatcher) scheduleRetry() {
+	od.mu.Lock()
+	defer od.mu.Unlock()
+	if !od.closed {
+		od.retryTimer = od.clock.AfterFunc(od.pendingQueue.GetRetryInterval(), od.retryPendingRidesPeriodically)
+	}
+}
+
+func (od *OfferDispatcher) retryPendingRidesPeriodically() {
+	od.retryPendingRides(false)
+	od.scheduleRetry()
+}
+
+// Close stops retrying pending rides in the background. Offers already out
+// still wait for their answer.
+func (od *OfferDispatcher) Close() {
+	od.mu.Lock()
+	defer od.mu.Unlock()
+	od.closed = true
+	od.retryTimer.Stop()
+}
+
+// retryPendingRides makes the offers for queued rides one by one in queue order,
+// so the rider waiting longest gets the first look at a freed cab.
+func (od *OfferDispatcher) retryPendingRides(ignoreBackoff bool) {
+	od.retryMu.Lock()
+	defer od.retryMu.Unlock()
+
+	now := od.clock.Now()
+	for _, rideId := range od.pendingQueue.ExpireOverdue(now) {
+		od.finish(rideId, false)
+	}
+	for _, pending := range od.pendingQueue.Checkout(now, ignoreBackoff) {
+		od.mu.Lock()
+		round, exists := od.rounds[pending.GetRideId()]
+		od.mu.Unlock()
+		if !exists || !od.isStillSearching(pending.GetRideId()) {
+			od.pendingQueue.Complete(pending.GetRideId(), now, false)
+			continue
+		}
+		offer, live := od.offerToNextCab(round)
+		if !live {
+			od.pendingQueue.Complete(pending.GetRideId(), now, false)
+			continue
+		}
+		if offer == nil {
+			od.park(round)
+			continue
+		}
+		go od.awaitOffers(round, offer)
+	}
+}
+
+func (od *OfferDispatcher) isStillSearching(rideId string) bool {
+	ride := od.rideRepo.GetRideById(rideId)
+	return ride != nil && ride.GetStatus() == SearchingForCab
+}
+
+// assignCab claims the cab before confirming the ride and hands the cab back if
+// the rider cancelled while the driver was deciding. Pool rides join the cab's
+// pool instead, which only claims the cab when the ride starts a new one.
+func (od *OfferDispatcher) assignCab(ride *Ride, cabId string) bool {
+	rideId := ride.GetId()
+	if ride.GetRideType() == PoolRide {
+		if err := od.poolManager.Join(ride, cabId); err != nil {
+			return false
+		}
+	} else if err := od.cabRepo.ClaimCab(cabId); err != nil {
+		return false
+	}
+	cab := od.cabRepo.GetCabById(cabId)
+	_, err := od.rideRepo.UpdateRide(rideId, func(ride *Ride) error {
+		if cab != nil {
+			ride.SetCabAcceptedFrom(cab.GetCurrLocation())
+		}
+		return ride.AssignCab(cabId, od.clock.Now())
+	})
+	if err != nil {
+		if ride.GetRideType() != PoolRide || od.poolManager.Leave(rideId) {
+			od.cabRepo.UpdateCabStatus(cabId, ReadyToTakeRide)
+		}
+		return false
+	}
+	od.eventBus.Publish(newRideEvent(CabAssigned, od.rideRepo.GetRideById(rideId), od.clock.Now()))
+	return true
+}
+
+// offerToNextCab looks for the cab without holding mu, since finding one can
+// be slow, and only takes it to record the offer. It reports false when the
+// round ended meanwhile, and looks again when another round reserved the cab.
+func (od *OfferDispatcher) offerToNextCab(round *dispatchRound) (*RideOffer, bool) {
+	for {
+		cab := od.cabFindingStrategy.FindCab(round.ride, od.excludedCabIds(round))
+		offer, live := od.recordOffer(round, cab)
+		if offer != nil || !live || cab == nil {
+			return offer, live
+		}
+	}
+}
+
+func (od *OfferDispatcher) excludedCabIds(round *dispatchRound) map[string]bool {
+	od.mu.Lock()
+	defer od.mu.Unlock()
+
+	excludedCabIds := make(map[string]bool, len(round.triedCabIds)+len(od.reservedCabs))
+	for cabId := range round.triedCabIds {
+		excludedCabIds[cabId] = true
+	}
+	for cabId := range od.reservedCabs {
+		excludedCabIds[cabId] = true
+	}
+	return excludedCabIds
+}
+
+// recordOffer reserves the cab for the round, unless the ride was cancelled or
+// the cab reserved by another round while the cab was being found.
+func (od *OfferDispatcher) recordOffer(round *dispatchRound, cab *Cab) (*RideOffer, bool) {
+	od.mu.Lock()
+	defer od.mu.Unlock()
+
+	rideId := round.ride.GetId()
+	if od.rounds[rideId] != round || !od.isStillSearching(rideId) {
+		return nil, false
+	}
+	if cab == nil {
+		return nil, true
+	}
+	if _, reserved := od.reservedCabs[cab.GetId()]; reserved {
+		return nil, true
+	}
+
+	round.attempts++
+	round.triedCabIds[cab.GetId()] = true
+	now := od.clock.Now()
+	offer := &RideOffer{
+		rideId:      rideId,
+		cabId:       cab.GetId(),
+		attempt:     round.attempts,
+		maxAttempts: od.maxAttempts,
+		status:      OfferPending,
+		offeredAt:   now,
+		expiresAt:   now.Add(od.offerTimeout),
+		response:    make(chan struct{}, 1),
+	}
+	od.offers[offer.rideId] = offer
+	od.reservedCabs[offer.cabId] = offer.rideId
+
+	event := newRideEvent(RideOffered, round.ride, od.clock.Now())
+	event.CabId = offer.cabId
+	od.eventBus.Publish(event)
+	return offer, true
+}
+
+// expireOffer settles the offer under the lock so that a driver answering at
+// the same moment the timer fires cannot both accept and expire it.
+func (od *OfferDispatcher) expireOffer(offer *RideOffer) {
+	od.mu.Lock()
+	defer od.mu.Unlock()
+
+	if offer.status == OfferPending {
+		offer.status = OfferExpired
+		offer.response <- struct{}{}
+	}
+}
+
+// closeOffer frees the cab the answered offer had reserved.
+func (od *OfferDispatcher) closeOffer(offer *RideOffer) OfferStatus {
+	od.mu.Lock()
+	defer od.mu.Unlock()
+
+	delete(od.reservedCabs, offer.cabId)
+	return offer.status
+}
+
+func (od *OfferDispatcher) RespondToOffer(rideId, cabId string, accepted bool) error {
+	od.mu.Lock()
+	defer od.mu.Unlock()
+
+	offer, exists := od.offers[rideId]
+	if !exists || offer.status != OfferPending {
+		return ErrNoPendingOffer
+	}
+	if offer.cabId != cabId {
+		return ErrOfferNotForCab
+	}
+	if accepted {
+		offer.status = OfferAccepted
+	} else {
+		offer.status = OfferRejected
+	}
+	offer.response <- struct{}{}
+	return nil
+}
+
+// CancelDispatch withdraws a pending offer so the reserved cab is released right
+// away, and takes the ride out of the pending queue.
+func (od *OfferDispatcher) CancelDispatch(rideId string) {
+	od.mu.Lock()
+	if offer, exists := od.offers[rideId]; exists && offer.status == OfferPending {
+		offer.status = OfferWithdrawn
+		offer.response <- struct{}{}
+	}
+	od.mu.Unlock()
+
+	if od.pendingQueue.Contains(rideId) {
+		od.pendingQueue.Complete(rideId, od.clock.Now(), false)
+		od.mu.Lock()
+		delete(od.rounds, rideId)
+		od.mu.Unlock()
+	}
+}
+
+func (od *OfferDispatcher) GetCurrentOffer(rideId string) (*RideOffer, error) {
+	od.mu.Lock()
+	defer od.mu.Unlock()
+
+	offer, exists := od.offers[rideId]
+	if !exists {
+		return nil, ErrNoOfferForRide
+	}
+	snapshot := *offer
+	snapshot.response = nil
+	return &snapshot, nil
+}
+
+func (od *OfferDispatcher) GetPendingRide(rideId string) (*PendingRide, error) {
+	return od.pendingQueue.Get(rideId)
+}
+
+func (od *OfferDispatcher) GetPendingQueueStats() PendingQueueStats {
+	return od.pendingQueue.GetStats(od.clock.Now())
+}
@@ -0,0 +1,413 @@
+package src
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ShiftChange records a driver going online, taking a break or going offline.
+// Rides do not change the shift, so the time a driver is Busy counts as online.
+type ShiftChange struct {
+	CabId  string
+	Status CabStatus
+	At     time.Time
+}
+
+// EarningEntry records one movement of money between the platform and a
+// driver. Amount is what the entry adds to what the driver is owed, so payouts
+// are negative and the driver's balance is the sum over their entries.
+type EarningEntry struct {
+	Id     string
+	CabId  string
+	RideId string
+	Kind   EarningKind
+	// Fare and Commission are set on ride earnings, whose Amount is the fare
+	// less the commission.
+	Fare       int
+	Commission int
+	Amount     int
+	BatchId    string
+	Note       string
+	At         time.Time
+}
+
+func (ee EarningEntry) String() string {
+	return fmt.Sprintf("{Kind: %v, RideId: %s, Fare: %d, Commission: %d, Amount: %+d}", ee.Kind, ee.RideId, ee.Fare, ee.Commission, ee.Amount)
+}
+
+type EarningsPolicy struct {
+	CommissionPercent float64
+	// A driver who completes DailyRideTarget rides in a day earns
+	// DailyTargetBonus on top. Either being zero turns the bonus off.
+	DailyRideTarget  int
+	DailyTargetBonus int
+}
+
+// EarningsStatement sums up what a driver earned and how long they worked over
+// a day or a week. Days start at midnight and weeks on Monday, both in the
+// time zone of the time the statement was asked for.
+type EarningsStatement struct {
+	CabId        string
+	Period       StatementPeriod
+	From         time.Time
+	To           time.Time
+	Rides        int
+	Fares        int
+	Commission   int
+	RideEarnings int
+	Incentives   int
+	// NetEarnings is what the driver earned over the period, before payouts.
+	NetEarnings int
+	PaidOut     int
+	OnlineTime  time.Duration
+	BreakTime   time.Duration
+	Entries     []EarningEntry
+}
+
+func (es *EarningsStatement) String() string {
+	return fmt.Sprintf("%v statement %s to %s: %d rides, fares %d, commission %d, incentives %d, net %d, online %v, on break %v",
+		es.Period, es.From.Format(time.DateOnly), es.To.Add(-time.Nanosecond).Format(time.DateOnly), es.Rides, es.Fares, es.Commission,
+		es.Incentives, es.NetEarnings, es.OnlineTime.Round(time.Minute), es.BreakTime.Round(time.Minute))
+}
+
+type DriverPayout struct {
+	CabId   string
+	CabName string
+	Amount  int
+}
+
+// PayoutBatch pays every driver what they were owed when it was created.
+type PayoutBatch struct {
+	Id        string
+	CreatedAt time.Time
+	Payouts   []DriverPayout
+	Total     int
+}
+
+// WriteCSV exports the batch for the bank, one row per driver.
+func (pb *PayoutBatch) WriteCSV(w io.Writer) error {
+	writer := csv.NewWriter(w)
+	writer.Write([]string{"batch_id", "created_at", "cab_id", "driver", "amount"})
+	for _, payout := range pb.Payouts {
+		writer.Write([]string{pb.Id, pb.CreatedAt.Format(time.RFC3339), payout.CabId, payout.CabName, strconv.Itoa(payout.Amount)})
+	}
+	writer.Flush()
+	return writer.Error()
+}
+
+type DriverManager interface {
+	// StartFirstShift logs the shift a newly registered cab comes in on, so time
+	// online counts from registration rather than from the first shift change.
+	StartFirstShift(cabId string) (*Cab, error)
+	// GoOnline, TakeBreak and GoOffline change the driver's shift. None of them
+	// is allowed while the cab is on a ride, and asking for the shift the
+	// driver is already on changes nothing.
+	GoOnline(cabId string) (*Cab, error)
+	TakeBreak(cabId string) (*Cab, error)
+	GoOffline(cabId string) (*Cab, error)
+	AddIncentive(cabId string, amount int, note string) (*EarningEntry, error)
+	GetEarningsBalance(cabId string) (int, error)
+	// GetStatement covers the day or the week that at falls in.
+	GetStatement(cabId string, period StatementPeriod, at time.Time) (*EarningsStatement, error)
+	// CreatePayoutBatch pays out every driver's balance.
+	CreatePayoutBatch() (*PayoutBatch, error)
+	GetPayoutBatch(batchId string) (*PayoutBatch, error)
+	GetPolicy() EarningsPolicy
+}
+
+// LedgerDriverManager keeps each driver's shifts and earnings in append-only
+// logs. It records a ride's earning when it hears the ride completed.
+type LedgerDriverManager struct {
+	earningsRepo         IEarningsRepository
+	cabRepo              ICabRepository
+	rideRepo             IRideRegistory
+	idGenerationStrategy IdGenerationStrategy
+	eventBus             EventBus
+	clock                Clock
+	policy               EarningsPolicy
+	// shiftMu keeps each shift change and its log entry in the same order.
+	shiftMu sync.Mutex
+	// earningsMu orders balance reads with the entries that follow them, so a
+	// payout never misses an earning recorded while the batch was made.
+	earningsMu sync.Mutex
+}
+
+func NewLedgerDriverManager(earningsRepo IEarningsRepository, cabRepo ICabRepository, rideRepo IRideRegistory, idGenerationStrategy IdGenerationStrategy, eventBus EventBus, clock Clock, policy EarningsPolicy) DriverManager {
+	ldm := &LedgerDriverManager{
+		earningsRepo:         earningsRepo,
+		cabRepo:              cabRepo,
+		rideRepo:             rideRepo,
+		idGenerationStrategy: idGenerationStrategy,
+		eventBus:             eventBus,
+		clock:                clock,
+		policy:               policy,
+	}
+	eventBus.Subscribe(ldm)
+	return ldm
+}
+
+func (ldm *LedgerDriverManager) StartFirstShift(cabId string) (*Cab, error) {
+	ldm.shiftMu.Lock()
+	defer ldm.shiftMu.Unlock()
+	cab := ldm.cabRepo.GetCabById(cabId)
+	if cab == nil {
+		return nil, ErrCabNotFound
+	}
+	if err := ldm.logShiftChange(cabId, cab.GetCabStatus(), CabWentOnline); err != nil {
+		return nil, err
+	}
+	return cab, nil
+}
+
+func (ldm *LedgerDriverManager) GoOnline(cabId string) (*Cab, error) {
+	return ldm.changeShift(cabId, ReadyToTakeRide, CabWentOnline)
+}
+
+func (ldm *LedgerDriverManager) TakeBreak(cabId string) (*Cab, error) {
+	return ldm.changeShift(cabId, OnBreak, CabOnBreak)
+}
+
+func (ldm *LedgerDriverManager) GoOffline(cabId string) (*Cab, error) {
+	return ldm.changeShift(cabId, InActive, CabWentOffline)
+}
+
+// changeShift checks and changes the status in one repository update, so a
+// dispatch claiming the cab at the same time either wins or sees the new shift.
+// A driver who goes offline while deciding on an offer loses the ride to the
+// next cab.
+func (ldm *LedgerDriverManager) changeShift(cabId string, status CabStatus, eventType RideEventType) (*Cab, error) {
+	ldm.shiftMu.Lock()
+	defer ldm.shiftMu.Unlock()
+	unchanged := false
+	cab, err := ldm.cabRepo.UpdateCab(cabId, func(cab *Cab) error {
+		switch {
+		case cab.GetCabStatus() == Busy:
+			return fmt.Errorf("%w: finish the ride before changing shift", ErrCabOnRide)
+		case status == OnBreak && cab.GetCabStatus() == InActive:
+			return fmt.Errorf("%w: go online before taking a break", ErrInvalidShiftChange)
+		}
+		unchanged = cab.GetCabStatus() == status
+		return cab.SetCabStatus(status)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if unchanged {
+		return cab, nil
+	}
+	if err := ldm.logShiftChange(cabId, status, eventType); err != nil {
+		return nil, err
+	}
+	return cab, nil
+}
+
+// logShiftChange must be called with shiftMu held.
+func (ldm *LedgerDriverManager) logShiftChange(cabId string, status CabStatus, eventType RideEventType) error {
+	if err := ldm.earningsRepo.RecordShiftChange(ShiftChange{CabId: cabId, Status: status, At: ldm.clock.Now()}); err != nil {
+		return err
+	}
+	ldm.eventBus.Publish(RideEvent{Type: eventType, CabId: cabId, OccurredAt: ldm.clock.Now()})
+	return nil
+}
+
+func (ldm *LedgerDriverManager) AddIncentive(cabId string, amount int, note string) (*EarningEntry, error) {
+	if amount <= 0 {
+		return nil, ErrInvalidAmount
+	}
+	if ldm.cabRepo.GetCabById(cabId) == nil {
+		return nil, ErrCabNotFound
+	}
+	ldm.earningsMu.Lock()
+	defer ldm.earningsMu.Unlock()
+	return ldm.appendIncentive(cabId, amount, note)
+}
+
+// appendIncentive must be called with earningsMu held.
+func (ldm *LedgerDriverManager) appendIncentive(cabId string, amount int, note string) (*EarningEntry, error) {
+	entry := EarningEntry{Id: ldm.idGenerationStrategy.GenerateId(), CabId: cabId, Kind: Incentive, Amount: amount, Note: note, At: ldm.clock.Now()}
+	if err := ldm.earningsRepo.AppendEarning(entry); err != nil {
+		return nil, err
+	}
+	ldm.eventBus.Publish(RideEvent{Type: IncentiveEarned, CabId: cabId, Amount: amount, OccurredAt: ldm.clock.Now()})
+	return &entry, nil
+}
+
+func (ldm *LedgerDriverManager) GetEarningsBalance(cabId string) (int, error) {
+	if ldm.cabRepo.GetCabById(cabId) == nil {
+		return 0, ErrCabNotFound
+	}
+	return ldm.earningsRepo.GetEarningsBalance(cabId), nil
+}
+
+func (ldm *LedgerDriverManager) GetStatement(cabId string, period StatementPeriod, at time.Time) (*EarningsStatement, error) {
+	if ldm.cabRepo.GetCabById(cabId) == nil {
+		return nil, ErrCabNotFound
+	}
+	from := startOfDay(at)
+	to := from.AddDate(0, 0, 1)
+	switch period {
+	case DailyStatement:
+	case WeeklyStatement:
+		// Weekday counts from Sunday, weeks start on Monday.
+		from = from.AddDate(0, 0, -(int(from.Weekday())+6)%7)
+		to = from.AddDate(0, 0, 7)
+	default:
+		return nil, fmt.Errorf("%w: %d", ErrUnknownStatementPeriod, period)
+	}
+	statement := &EarningsStatement{CabId: cabId, Period: period, From: from, To: to, Entries: ldm.earningsRepo.FindEarnings(cabId, from, to)}
+	for _, entry := range statement.Entries {
+		switch entry.Kind {
+		case RideEarning:
+			statement.Rides++
+			statement.Fares += entry.Fare
+			statement.Commission += entry.Commission
+			statement.RideEarnings += entry.Amount
+		case Incentive:
+			statement.Incentives += entry.Amount
+		case Payout:
+			statement.PaidOut -= entry.Amount
+		}
+	}
+	statement.NetEarnings = statement.RideEarnings + statement.Incentives
+	statement.OnlineTime, statement.BreakTime = ldm.shiftTimes(cabId, from, to)
+	return statement, nil
+}
+
+// shiftTimes adds up the time between from and to, or until now for a period
+// still under way, that the driver spent online and on break.
+func (ldm *LedgerDriverManager) shiftTimes(cabId string, from, to time.Time) (time.Duration, time.Duration) {
+	if now := ldm.clock.Now(); now.Before(to) {
+		to = now
+	}
+	var online, onBreak time.Duration
+	changes := ldm.earningsRepo.FindShiftChanges(cabId, from, to)
+	for i, change := range changes {
+		start, end := change.At, to
+		if start.Before(from) {
+			start = from
+		}
+		if i+1 < len(changes) {
+			end = changes[i+1].At
+		}
+		if !end.After(start) {
+			continue
+		}
+		switch change.Status {
+		case ReadyToTakeRide:
+			online += end.Sub(start)
+		case OnBreak:
+			onBreak += end.Sub(start)
+		}
+	}
+	return online, onBreak
+}
+
+func startOfDay(at time.Time) time.Time {
+	return time.Date(at.Year(), at.Month(), at.Day(), 0, 0, 0, 0, at.Location())
+}
+
+func (ldm *LedgerDriverManager) CreatePayoutBatch() (*PayoutBatch, error) {
+	ldm.earningsMu.Lock()
+	defer ldm.earningsMu.Unlock()
+	balances := ldm.earningsRepo.GetEarningsBalances()
+	cabIds := make([]string, 0, len(balances))
+	for cabId, balance := range balances {
+		if balance > 0 {
+			cabIds = append(cabIds, cabId)
+		}
+	}
+	if len(cabIds) == 0 {
+		return nil, ErrNothingToPayOut
+	}
+	sort.Strings(cabIds)
+	batchId := ldm.idGenerationStrategy.GenerateId()
+	now := ldm.clock.Now()
+	for _, cabId := range cabIds {
+		entry := EarningEntry{Id: ldm.idGenerationStrategy.GenerateId(), CabId: cabId, Kind: Payout, Amount: -balances[cabId], BatchId: batchId, At: now}
+		if err := ldm.earningsRepo.AppendEarning(entry); err != nil {
+			return nil, err
+		}
+		ldm.eventBus.Publish(RideEvent{Type: DriverPaidOut, CabId: cabId, Amount: balances[cabId], OccurredAt: ldm.clock.Now()})
+	}
+	return ldm.GetPayoutBatch(batchId)
+}
+
+func (ldm *LedgerDriverManager) GetPayoutBatch(batchId string) (*PayoutBatch, error) {
+	entries := ldm.earningsRepo.FindPayoutBatch(batchId)
+	if len(entries) == 0 {
+		return nil, ErrPayoutBatchNotFound
+	}
+	batch := &PayoutBatch{Id: batchId, CreatedAt: entries[0].At, Payouts: make([]DriverPayout, 0, len(entries))}
+	for _, entry := range entries {
+		payout := DriverPayout{CabId: entry.CabId, Amount: -entry.Amount}
+		if cab := ldm.cabRepo.GetCabById(entry.CabId); cab != nil {
+			payout.CabName = cab.GetName()
+		}
+		batch.Payouts = append(batch.Payouts, payout)
+		batch.Total += payout.Amount
+	}
+	return batch, nil
+}
+
+func (ldm *LedgerDriverManager) GetPolicy() EarningsPolicy {
+	return ldm.policy
+}
+
+func (ldm *LedgerDriverManager) GetName() string {
+	return "driver-manager"
+}
+
+// HandleEvent records the driver's earning from a completed ride. The driver
+// is paid on the fare before any promo discount, which the platform covers.
+func (ldm *LedgerDriverManager) HandleEvent(event RideEvent) error {
+	if event.Type != RideCompleted {
+		return nil
+	}
+	ride := ldm.rideRepo.GetRideById(event.RideId)
+	if ride == nil {
+		return ErrRideNotFound
+	}
+	finalFare := ride.GetFinalFare()
+	if ride.GetCabId() == "" || finalFare == nil {
+		return nil
+	}
+	fare := finalFare.Total + finalFare.PromoDiscount
+	commission := int(math.Round(float64(fare) * ldm.policy.CommissionPercent / 100))
+	ldm.earningsMu.Lock()
+	defer ldm.earningsMu.Unlock()
+	now := ldm.clock.Now()
+	entry := EarningEntry{
+		Id:         ldm.idGenerationStrategy.GenerateId(),
+		CabId:      ride.GetCabId(),
+		RideId:     ride.GetId(),
+		Kind:       RideEarning,
+		Fare:       fare,
+		Commission: commission,
+		Amount:     fare - commission,
+		At:         now,
+	}
+	if err := ldm.earningsRepo.AppendEarning(entry); err != nil {
+		return err
+	}
+	if ldm.policy.DailyRideTarget <= 0 || ldm.policy.DailyTargetBonus <= 0 {
+		return nil
+	}
+	day := startOfDay(now)
+	rides := 0
+	for _, earning := range ldm.earningsRepo.FindEarnings(ride.GetCabId(), day, day.AddDate(0, 0, 1)) {
+		if earning.Kind == RideEarning {
+			rides++
+		}
+	}
+	if rides != ldm.policy.DailyRideTarget {
+		return nil
+	}
+	_, err := ldm.appendIncentive(ride.GetCabId(), ldm.policy.DailyTargetBonus, fmt.Sprintf("Completed %d rides on %s", rides, day.Format(time.DateOnly)))
+	return err
+}
@@ -1,23 +1,40 @@
 package src
 
-import "fmt"
+import (
+	"fmt"
+	"time"
+)
 
 type User struct {
-	id   string
-	name string
+	id           string
+	name         string
+	priorityTier int
+	rating       float64
+	ratingCount  int
 }
 
 type Cab struct {
-	id         string
-	name       string
-	cabStatus  CabStatus
-	totalRides int
-	currLocLat float64
-	currLocLon float64
+	id                 string
+	name               string
+	category           VehicleCategory
+	cabStatus          CabStatus
+	totalRides         int
+	currLocLat         float64
+	currLocLon         float64
+	rating             float64
+	ratingCount        int
+	flaggedForReview   bool
+	cancellations      int
+	deprioritisedUntil time.Time
+}
+
+func (c *Cab) clone() *Cab {
+	clone := *c
+	return &clone
 }
 
 func (c *Cab) String() string {
-	return fmt.Sprintf("\n\n{Id: %s\n, Name: %s\n, Status: %v\n, TotalRides: %d}\n\n\n", c.id, c.name, c.cabStatus, c.totalRides)
+	return fmt.Sprintf("\n\n{Id: %s\n, Name: %s\n, Category: %v\n, Status: %v\n, TotalRides: %d}\n\n\n", c.id, c.name, c.category, c.cabStatus, c.totalRides)
 }
 
 type Ride struct {
@@ -28,8 +45,26 @@ type Ride struct {
 	endPointLat   float64
 	endPointLon   float64
 	totalAmount   int
+	fareEstimate  *FareBreakdown
+	finalFare     *FareBreakdown
+	surgeZoneId   string
+	surge         float64
 	status        RideStatus
+	priorityTier  int
 	cabId         *string
+	createdAt     time.Time
+	pickupAt      time.Time
+	rideType      RideType
+	seats         int
+	category      VehicleCategory
+	timeline      []RideTransition
+	stops         []RideStop
+	// cabAcceptedFrom is where the cab was when it took the ride.
+	cabAcceptedFrom *GeoPoint
+	cancellation    *Cancellation
+	// paymentMethodId is empty when the rider's default method is used.
+	paymentMethodId string
+	promoCode       string
 }
 
 func (r *Ride) String() string {
@@ -37,7 +72,24 @@ func (r *Ride) String() string {
 	if r.cabId != nil {
 		cabId = *r.cabId
 	}
-	return fmt.Sprintf("\n\n{Id: %s\n, UserId: %s\n, Status: %v\n, CabId: %v\n, TotalAmount: %d}\n\n\n", r.id, r.userId, r.status, cabId, r.totalAmount)
+	return fmt.Sprintf("\n\n{Id: %s\n, UserId: %s\n, Status: %v\n, CabId: %v\n, TotalAmount: %d\n, Surge: %.1fx}\n\n\n", r.id, r.userId, r.status, cabId, r.totalAmount, r.surge)
+}
+
+// clone returns a deep copy so that callers outside the repository never share
+// mutable state with the stored ride.
+func (r *Ride) clone() *Ride {
+	clone := *r
+	if r.cabId != nil {
+		cabId := *r.cabId
+		clone.cabId = &cabId
+	}
+	clone.fareEstimate = r.fareEstimate.clone()
+	clone.finalFare = r.finalFare.clone()
+	clone.timeline = r.GetTimeline()
+	clone.stops = r.GetStops()
+	clone.cabAcceptedFrom = r.GetCabAcceptedFrom()
+	clone.cancellation = r.GetCancellation()
+	return &clone
 }
 
 func NewUser(id string, name string) *User {
@@ -55,10 +107,40 @@ func (u User) GetName() string {
 	return u.name
 }
 
-func NewCab(id string, name string) *Cab {
+func (u User) GetPriorityTier() int {
+	return u.priorityTier
+}
+
+func (u *User) SetPriorityTier(priorityTier int) {
+	u.priorityTier = priorityTier
+}
+
+// GetRating is the rolling average of the ratings drivers gave the user, zero
+// until the first one.
+func (u User) GetRating() float64 {
+	return u.rating
+}
+
+// GetRatingCount is the number of ratings the user received over all time.
+func (u User) GetRatingCount() int {
+	return u.ratingCount
+}
+
+func (u *User) SetRating(rating float64, ratingCount int) {
+	u.rating = rating
+	u.ratingCount = ratingCount
+}
+
+func (u *User) clone() *User {
+	clone := *u
+	return &clone
+}
+
+func NewCab(id string, name string, category VehicleCategory) *Cab {
 	return &Cab{
 		id:         id,
 		name:       name,
+		category:   category,
 		cabStatus:  ReadyToTakeRide,
 		totalRides: 0,
 	}
@@ -78,6 +160,38 @@ func (c Cab) GetId() string {
 	return c.id
 }
 
+func (c Cab) GetName() string {
+	return c.name
+}
+
+func (c Cab) GetCategory() VehicleCategory {
+	return c.category
+}
+
+// GetRating is the rolling average of the ratings riders gave the driver, zero
+// until the first one.
+func (c Cab) GetRating() float64 {
+	return c.rating
+}
+
+// GetRatingCount is the number of ratings the driver received over all time.
+func (c Cab) GetRatingCount() int {
+	return c.ratingCount
+}
+
+func (c *Cab) SetRating(rating float64, ratingCount int) {
+	c.rating = rating
+	c.ratingCount = ratingCount
+}
+
+func (c Cab) IsFlaggedForReview() bool {
+	return c.flaggedForReview
+}
+
+func (c *Cab) SetFlaggedForReview(flaggedForReview bool) {
+	c.flaggedForReview = flaggedForReview
+}
+
 func (c Cab) GetTotalRides() int {
 	return c.totalRides
 }
@@ -96,7 +210,37 @@ func (c *Cab) IncreaseCabRides() bool {
 	return true
 }
 
-func NewRide(id, userId string, startPointLat, startPointLon, endPointLat, endPointLon float64) *Ride {
+// GetCancellations counts the rides cancelled through the driver's fault.
+func (c Cab) GetCancellations() int {
+	return c.cancellations
+}
+
+func (c *Cab) RecordCancellation() {
+	c.cancellations++
+}
+
+// GetCancellationRate is the share of the rides the driver accepted that were
+// cancelled through their fault.
+func (c Cab) GetCancellationRate() float64 {
+	if c.cancellations == 0 {
+		return 0
+	}
+	return float64(c.cancellations) / float64(c.cancellations+c.totalRides)
+}
+
+func (c Cab) GetDeprioritisedUntil() time.Time {
+	return c.deprioritisedUntil
+}
+
+func (c Cab) IsDeprioritised(at time.Time) bool {
+	return at.Before(c.deprioritisedUntil)
+}
+
+func (c *Cab) DeprioritiseUntil(until time.Time) {
+	c.deprioritisedUntil = until
+}
+
+func NewRide(id, userId string, startPointLat, startPointLon, endPointLat, endPointLon float64, createdAt time.Time) *Ride {
 	return &Ride{
 		id:            id,
 		userId:        userId,
@@ -105,12 +249,43 @@ func NewRide(id, userId string, startPointLat, startPointLon, endPointLat, endPo
 		endPointLat:   endPointLat,
 		endPointLon:   endPointLon,
 		status:        SearchingForCab,
+		surge:         1,
+		seats:         1,
+		createdAt:     createdAt,
+		timeline:      make([]RideTransition, 0),
 	}
 }
 
-func (r *Ride) AssignCab(cabId string) {
+// NewScheduledRide creates a ride that waits in Scheduled until dispatch for
+// its pickup time starts.
+func NewScheduledRide(id, userId string, startPointLat, startPointLon, endPointLat, endPointLon float64, createdAt, pickupAt time.Time) *Ride {
+	ride := NewRide(id, userId, startPointLat, startPointLon, endPointLat, endPointLon, createdAt)
+	ride.status = Scheduled
+	ride.pickupAt = pickupAt
+	return ride
+}
+
+func (r *Ride) AssignCab(cabId string, at time.Time) error {
+	if !CanTransitionRide(r.status, Confirmed) {
+		return &InvalidRideTransitionError{RideId: r.id, From: r.status, To: Confirmed}
+	}
 	r.cabId = &cabId
-	r.status = Confirmed
+	return r.TransitionTo(Confirmed, at)
+}
+
+func (r *Ride) TransitionTo(status RideStatus, at time.Time) error {
+	if !CanTransitionRide(r.status, status) {
+		return &InvalidRideTransitionError{RideId: r.id, From: r.status, To: status}
+	}
+	if status == Confirmed && r.cabId == nil {
+		return ErrCabNotAssigned
+	}
+	if status == Completed {
+		r.settleStops(at)
+	}
+	r.timeline = append(r.timeline, RideTransition{From: r.status, To: status, At: at})
+	r.status = status
+	return nil
 }
 
 func (r Ride) GetId() string {
@@ -122,6 +297,9 @@ func (r Ride) GetUserId() string {
 }
 
 func (r Ride) GetCabId() string {
+	if r.cabId == nil {
+		return ""
+	}
 	return *r.cabId
 }
 
@@ -137,8 +315,146 @@ func (r *Ride) SetTotalAmount(totalAmount int) {
 	r.totalAmount = totalAmount
 }
 
-func (r *Ride) SetRideStatus(status RideStatus) {
-	r.status = status
+func (r Ride) GetFareEstimate() *FareBreakdown {
+	return r.fareEstimate.clone()
+}
+
+func (r *Ride) SetFareEstimate(fareEstimate *FareBreakdown) {
+	r.fareEstimate = fareEstimate
+	r.totalAmount = fareEstimate.Total
+	if fareEstimate.SurgeMultiplier > 0 {
+		r.surgeZoneId = fareEstimate.SurgeZoneId
+		r.surge = fareEstimate.SurgeMultiplier
+	}
+}
+
+func (r Ride) GetFinalFare() *FareBreakdown {
+	return r.finalFare.clone()
+}
+
+func (r *Ride) SetFinalFare(finalFare *FareBreakdown) {
+	r.finalFare = finalFare
+	r.totalAmount = finalFare.Total
+}
+
+func (r Ride) GetSurgeMultiplier() float64 {
+	return r.surge
+}
+
+func (r Ride) GetSurgeZoneId() string {
+	return r.surgeZoneId
+}
+
+func (r Ride) GetPriorityTier() int {
+	return r.priorityTier
+}
+
+func (r *Ride) SetPriorityTier(priorityTier int) {
+	r.priorityTier = priorityTier
+}
+
+func (r Ride) GetCreatedAt() time.Time {
+	return r.createdAt
+}
+
+// GetScheduledPickupAt is the zero time for rides booked for immediate pickup.
+func (r Ride) GetScheduledPickupAt() time.Time {
+	return r.pickupAt
+}
+
+func (r Ride) IsScheduled() bool {
+	return !r.pickupAt.IsZero()
+}
+
+func (r *Ride) Reschedule(pickupAt time.Time) error {
+	if r.status != Scheduled {
+		return ErrRideNotScheduled
+	}
+	r.pickupAt = pickupAt
+	return nil
+}
+
+func (r Ride) GetRideType() RideType {
+	return r.rideType
+}
+
+// GetSeats is the number of seats the rider needs, which only matters when the
+// ride is pooled.
+func (r Ride) GetSeats() int {
+	return r.seats
+}
+
+func (r *Ride) SetRideType(rideType RideType, seats int) {
+	r.rideType = rideType
+	r.seats = seats
+}
+
+// GetVehicleCategory is the category the rider asked for, AnyCategory when
+// any cab will do.
+func (r Ride) GetVehicleCategory() VehicleCategory {
+	return r.category
+}
+
+func (r *Ride) SetVehicleCategory(category VehicleCategory) {
+	r.category = category
+}
+
+func (r Ride) GetCabAcceptedFrom() *GeoPoint {
+	if r.cabAcceptedFrom == nil {
+		return nil
+	}
+	acceptedFrom := *r.cabAcceptedFrom
+	return &acceptedFrom
+}
+
+func (r *Ride) SetCabAcceptedFrom(lat, lon float64) {
+	r.cabAcceptedFrom = &GeoPoint{Lat: lat, Lon: lon}
+}
+
+func (r Ride) GetCancellation() *Cancellation {
+	return r.cancellation.clone()
+}
+
+// Cancel ends the ride and charges the rider the cancellation fee, if any.
+func (r *Ride) Cancel(cancellation *Cancellation) error {
+	if err := r.TransitionTo(Canceled, cancellation.At); err != nil {
+		return err
+	}
+	r.cancellation = cancellation
+	r.totalAmount = cancellation.Fee
+	return nil
+}
+
+func (r Ride) GetPaymentMethodId() string {
+	return r.paymentMethodId
+}
+
+func (r *Ride) SetPaymentMethodId(paymentMethodId string) {
+	r.paymentMethodId = paymentMethodId
+}
+
+// GetPromoCode is the code the ride was booked with, empty when none was used.
+func (r Ride) GetPromoCode() string {
+	return r.promoCode
+}
+
+func (r *Ride) SetPromoCode(promoCode string) {
+	r.promoCode = promoCode
+}
+
+func (r Ride) GetTransitionTime(status RideStatus) (time.Time, bool) {
+	for _, transition := range r.timeline {
+		if transition.To == status {
+			return transition.At, true
+		}
+	}
+	return time.Time{}, false
+}
+
+func (r Ride) GetTimeline() []RideTransition {
+	timeline := make([]RideTransition, len(r.timeline))
+	copy(timeline, r.timeline)
+	return timeline
 }
 
 func (r Ride) GetStartPoint() (float64, float64) {
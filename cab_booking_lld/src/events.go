@@ -0,0 +1,281 @@
+package src
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+type RideEventType int
+
+const (
+	RideRequested RideEventType = iota
+	RideOffered
+	CabAssigned
+	RidePickedUp
+	RideCompleted
+	RideCanceled
+	RideNoCabFound
+	CabLocationUpdated
+	RideScheduled
+	RideRescheduled
+	CabFlaggedForReview
+	CabDeprioritised
+	RidePaid
+	RidePaymentFailed
+	RideRefunded
+	ReferralRewarded
+	CabWentOnline
+	CabWentOffline
+	CabOnBreak
+	IncentiveEarned
+	DriverPaidOut
+	RideStopsChanged
+	CabArrivedAtStop
+	CabDepartedStop
+)
+
+func (ret RideEventType) String() string {
+	switch ret {
+	case RideRequested:
+		return "RideRequested"
+	case RideOffered:
+		return "RideOffered"
+	case CabAssigned:
+		return "CabAssigned"
+	case RidePickedUp:
+		return "RidePickedUp"
+	case RideCompleted:
+		return "RideCompleted"
+	case RideCanceled:
+		return "RideCanceled"
+	case RideNoCabFound:
+		return "RideNoCabFound"
+	case CabLocationUpdated:
+		return "CabLocationUpdated"
+	case RideScheduled:
+		return "RideScheduled"
+	case RideRescheduled:
+		return "RideRescheduled"
+	case CabFlaggedForReview:
+		return "CabFlaggedForReview"
+	case CabDeprioritised:
+		return "CabDeprioritised"
+	case RidePaid:
+		return "RidePaid"
+	case RidePaymentFailed:
+		return "RidePaymentFailed"
+	case RideRefunded:
+		return "RideRefunded"
+	case ReferralRewarded:
+		return "ReferralRewarded"
+	case CabWentOnline:
+		return "CabWentOnline"
+	case CabWentOffline:
+		return "CabWentOffline"
+	case CabOnBreak:
+		return "CabOnBreak"
+	case IncentiveEarned:
+		return "IncentiveEarned"
+	case DriverPaidOut:
+		return "DriverPaidOut"
+	case RideStopsChanged:
+		return "RideStopsChanged"
+	case CabArrivedAtStop:
+		return "CabArrivedAtStop"
+	case CabDepartedStop:
+		return "CabDepartedStop"
+	}
+	return "Unknown"
+}
+
+func (ret RideEventType) MarshalJSON() ([]byte, error) {
+	return json.Marshal(ret.String())
+}
+
+type RideEvent struct {
+	Type     RideEventType `json:"type"`
+	RideId   string        `json:"rideId,omitempty"`
+	UserId   string        `json:"userId,omitempty"`
+	CabId    string        `json:"cabId,omitempty"`
+	Lat      float64       `json:"lat,omitempty"`
+	Lon      float64       `json:"lon,omitempty"`
+	PickupAt *time.Time    `json:"pickupAt,omitempty"`
+	// StopIndex is the stop a stop event is about, counting from zero.
+	StopIndex *int `json:"stopIndex,omitempty"`
+	// CancellationFee is what the rider is charged for a cancelled ride.
+	CancellationFee int `json:"cancellationFee,omitempty"`
+	// Amount is the money a payment or earnings event moved.
+	Amount     int       `json:"amount,omitempty"`
+	OccurredAt time.Time `json:"occurredAt"`
+}
+
+func (re RideEvent) String() string {
+	return fmt.Sprintf("{Type: %v, RideId: %s, UserId: %s, CabId: %s}", re.Type, re.RideId, re.UserId, re.CabId)
+}
+
+func newRideEvent(eventType RideEventType, ride *Ride, at time.Time) RideEvent {
+	event := RideEvent{
+		Type:       eventType,
+		RideId:     ride.GetId(),
+		UserId:     ride.GetUserId(),
+		CabId:      ride.GetCabId(),
+		OccurredAt: at,
+	}
+	if ride.IsScheduled() {
+		pickupAt := ride.GetScheduledPickupAt()
+		event.PickupAt = &pickupAt
+	}
+	if ride.cancellation != nil {
+		event.CancellationFee = ride.cancellation.Fee
+	}
+	return event
+}
+
+func newPaymentEvent(eventType RideEventType, payment *Payment, at time.Time) RideEvent {
+	return RideEvent{
+		Type:       eventType,
+		RideId:     payment.GetRideId(),
+		UserId:     payment.GetUserId(),
+		Amount:     payment.GetAmount(),
+		OccurredAt: at,
+	}
+}
+
+type EventSubscriber interface {
+	GetName() string
+	HandleEvent(event RideEvent) error
+}
+
+type EventBus interface {
+	Publish(event RideEvent)
+	Subscribe(subscriber EventSubscriber) (unsubscribe func())
+}
+
+// eventSubscription queues the events of one subscriber until its goroutine
+// gets to them. The queue has no bound, so a slow subscriber is never skipped.
+type eventSubscription struct {
+	subscriber EventSubscriber
+	mu         sync.Mutex
+	queue      []RideEvent
+	closed     bool
+	wake       chan struct{}
+}
+
+func (es *eventSubscription) push(event RideEvent) int {
+	es.mu.Lock()
+	defer es.mu.Unlock()
+	if es.closed {
+		return 0
+	}
+	es.queue = append(es.queue, event)
+	select {
+	case es.wake <- struct{}{}:
+	default:
+	}
+	return len(es.queue)
+}
+
+// next waits for the queued events and takes them all. It returns false once
+// the subscription is closed and nothing is left.
+func (es *eventSubscription) next() ([]RideEvent, bool) {
+	for {
+		es.mu.Lock()
+		events, closed := es.queue, es.closed
+		es.queue = nil
+		es.mu.Unlock()
+		if len(events) > 0 {
+			return events, true
+		}
+		if closed {
+			return nil, false
+		}
+		<-es.wake
+	}
+}
+
+func (es *eventSubscription) close() {
+	es.mu.Lock()
+	defer es.mu.Unlock()
+	es.closed = true
+	select {
+	case es.wake <- struct{}{}:
+	default:
+	}
+}
+
+// InMemoryEventBus delivers every event to each subscriber on that subscriber's
+// own goroutine, in the order they were published. A slow subscriber only
+// builds up its own backlog, which is logged once it reaches backlogWarning,
+// and a failing or panicking one never affects the others.
+type InMemoryEventBus struct {
+	backlogWarning int
+	mu             sync.RWMutex
+	subscriptions  map[*eventSubscription]bool
+}
+
+func NewInMemoryEventBus(backlogWarning int) EventBus {
+	return &InMemoryEventBus{
+		backlogWarning: backlogWarning,
+		subscriptions:  make(map[*eventSubscription]bool),
+	}
+}
+
+func (imeb *InMemoryEventBus) Publish(event RideEvent) {
+	imeb.mu.RLock()
+	defer imeb.mu.RUnlock()
+	for subscription := range imeb.subscriptions {
+		if backlog := subscription.push(event); imeb.backlogWarning > 0 && backlog == imeb.backlogWarning {
+			log.Printf("event bus: %s is falling behind with %d events waiting", subscription.subscriber.GetName(), backlog)
+		}
+	}
+}
+
+// Subscribe starts delivering events to the subscriber. Events published
+// before unsubscribing are still delivered.
+func (imeb *InMemoryEventBus) Subscribe(subscriber EventSubscriber) func() {
+	subscription := &eventSubscription{
+		subscriber: subscriber,
+		wake:       make(chan struct{}, 1),
+	}
+	imeb.mu.Lock()
+	imeb.subscriptions[subscription] = true
+	imeb.mu.Unlock()
+
+	go imeb.deliver(subscription)
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			imeb.mu.Lock()
+			delete(imeb.subscriptions, subscription)
+			imeb.mu.Unlock()
+			subscription.close()
+		})
+	}
+}
+
+func (imeb *InMemoryEventBus) deliver(subscription *eventSubscription) {
+	for {
+		events, open := subscription.next()
+		if !open {
+			return
+		}
+		for _, event := range events {
+			imeb.handle(subscription.subscriber, event)
+		}
+	}
+}
+
+func (imeb *InMemoryEventBus) handle(subscriber EventSubscriber, event RideEvent) {
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			log.Printf("event bus: %s panicked handling %v: %v", subscriber.GetName(), event.Type, recovered)
+		}
+	}()
+	if err := subscriber.HandleEvent(event); err != nil {
+		log.Printf("event bus: %s failed handling %v: %v", subscriber.GetName(), event.Type, err)
+	}
+}
@@ -0,0 +1,114 @@
+package src
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"time"
+)
+
+type FareRateCard struct {
+	BaseFare         int
+	PerKm            int
+	PerMinute        int
+	WaitingPerMinute int
+	FreeWaitingTime  time.Duration
+	// PerStop is charged for every stop on the way, and time at a stop past
+	// FreeStopWaitingTime is charged at WaitingPerMinute.
+	PerStop             int
+	FreeStopWaitingTime time.Duration
+	MinimumFare         int
+	TaxPercent          float64
+	AverageSpeedKmph    float64
+}
+
+// FareBreakdown is the itemised fare of a ride. Pricing strategies fill in the
+// line items and call Settle to derive the minimum fare top up, taxes and total.
+// A promo discount comes off the total after taxes.
+type FareBreakdown struct {
+	BaseFare              int
+	DistanceFare          int
+	TimeFare              int
+	WaitingCharge         int
+	StopCharge            int
+	StopWaitingCharge     int
+	SurgeCharge           int
+	ZoneSurcharge         int
+	PoolDiscount          int
+	MinimumFareAdjustment int
+	Taxes                 int
+	PromoDiscount         int
+	Total                 int
+	SurgeMultiplier       float64
+	SurgeZoneId           string
+	PickupZoneId          string
+	DropZoneId            string
+	PoolShare             float64
+	PromoCode             string
+	MinimumFare           int
+	TaxPercent            float64
+	DistanceKm            float64
+	Duration              time.Duration
+	WaitingTime           time.Duration
+	Stops                 int
+	StopWaitingTime       time.Duration
+	IsFinal               bool
+}
+
+func (fb *FareBreakdown) Subtotal() int {
+	return fb.BaseFare + fb.DistanceFare + fb.TimeFare + fb.WaitingCharge + fb.StopCharge + fb.StopWaitingCharge + fb.SurgeCharge + fb.ZoneSurcharge - fb.PoolDiscount
+}
+
+func (fb *FareBreakdown) Settle() {
+	chargeable := fb.Subtotal()
+	fb.MinimumFareAdjustment = max(0, fb.MinimumFare-chargeable)
+	taxable := chargeable + fb.MinimumFareAdjustment
+	fb.Taxes = int(math.Round(float64(taxable) * fb.TaxPercent / 100))
+	fb.Total = max(0, taxable+fb.Taxes-fb.PromoDiscount)
+}
+
+func (fb *FareBreakdown) String() string {
+	kind := "Estimate"
+	if fb.IsFinal {
+		kind = "Final"
+	}
+	lines := []string{fmt.Sprintf("%s fare (%.2f km, %v):", kind, fb.DistanceKm, fb.Duration.Round(time.Second))}
+	items := []struct {
+		name   string
+		amount int
+	}{
+		{"Base fare", fb.BaseFare},
+		{"Distance", fb.DistanceFare},
+		{"Time", fb.TimeFare},
+		{"Waiting", fb.WaitingCharge},
+		{fmt.Sprintf("Stops (%d)", fb.Stops), fb.StopCharge},
+		{"Waiting at stops", fb.StopWaitingCharge},
+		{"Surge", fb.SurgeCharge},
+		{"Zone surcharge", fb.ZoneSurcharge},
+		{"Pool discount", -fb.PoolDiscount},
+		{"Minimum fare adjustment", fb.MinimumFareAdjustment},
+		{"Taxes", fb.Taxes},
+		{"Promo " + fb.PromoCode, -fb.PromoDiscount},
+	}
+	for _, item := range items {
+		if item.amount != 0 {
+			lines = append(lines, fmt.Sprintf("  %-24s %6d", item.name, item.amount))
+		}
+	}
+	lines = append(lines, fmt.Sprintf("  %-24s %6d", "Total", fb.Total))
+	return strings.Join(lines, "\n")
+}
+
+type FareQuote struct {
+	Category VehicleCategory
+	Seats    int
+	Fare     *FareBreakdown
+}
+
+func (fb *FareBreakdown) clone() *FareBreakdown {
+	if fb == nil {
+		return nil
+	}
+	clone := *fb
+	return &clone
+}
@@ -0,0 +1,222 @@
+package src
+
+import (
+	"math"
+	"sort"
+)
+
+type GeoIndexResult struct {
+	Id         string
+	Lat        float64
+	Lon        float64
+	DistanceKm float64
+}
+
+// GeoIndex keeps the last known position of every indexed id so that nearby
+// lookups only touch the cells around the query point instead of every entity.
+type GeoIndex interface {
+	Upsert(id string, lat, lon float64)
+	Remove(id string)
+	Nearest(lat, lon float64, k int, accept func(id string) bool) []GeoIndexResult
+	WithinRadius(lat, lon, radiusKm float64, accept func(id string) bool) []GeoIndexResult
+	WithinBounds(bounds BoundingBox, accept func(id string) bool) []GeoIndexResult
+}
+
+type gridCell struct {
+	row int
+	col int
+}
+
+type gridPoint struct {
+	lat float64
+	lon float64
+}
+
+type GridGeoIndex struct {
+	cellSizeDeg        float64
+	distanceCalculator DistanceCalculator
+	cells              map[gridCell]map[string]gridPoint
+	points             map[string]gridCell
+	minRow, maxRow     int
+	minCol, maxCol     int
+}
+
+func NewGridGeoIndex(cellSizeDeg float64, distanceCalculator DistanceCalculator) GeoIndex {
+	return &GridGeoIndex{
+		cellSizeDeg:        cellSizeDeg,
+		distanceCalculator: distanceCalculator,
+		cells:              make(map[gridCell]map[string]gridPoint),
+		points:             make(map[string]gridCell),
+	}
+}
+
+func (ggi *GridGeoIndex) cellFor(lat, lon float64) gridCell {
+	return gridCell{
+		row: int(math.Floor(lat / ggi.cellSizeDeg)),
+		col: int(math.Floor(lon / ggi.cellSizeDeg)),
+	}
+}
+
+func (ggi *GridGeoIndex) Upsert(id string, lat, lon float64) {
+	ggi.Remove(id)
+	cell := ggi.cellFor(lat, lon)
+	if _, exists := ggi.cells[cell]; !exists {
+		ggi.cells[cell] = make(map[string]gridPoint)
+	}
+	ggi.cells[cell][id] = gridPoint{lat: lat, lon: lon}
+	if len(ggi.points) == 0 {
+		ggi.minRow, ggi.maxRow, ggi.minCol, ggi.maxCol = cell.row, cell.row, cell.col, cell.col
+	} else {
+		ggi.minRow, ggi.maxRow = min(ggi.minRow, cell.row), max(ggi.maxRow, cell.row)
+		ggi.minCol, ggi.maxCol = min(ggi.minCol, cell.col), max(ggi.maxCol, cell.col)
+	}
+	ggi.points[id] = cell
+}
+
+func (ggi *GridGeoIndex) Remove(id string) {
+	cell, exists := ggi.points[id]
+	if !exists {
+		return
+	}
+	delete(ggi.cells[cell], id)
+	if len(ggi.cells[cell]) == 0 {
+		delete(ggi.cells, cell)
+	}
+	delete(ggi.points, id)
+}
+
+func (ggi *GridGeoIndex) collectCell(cell gridCell, lat, lon float64, accept func(id string) bool, results []GeoIndexResult) []GeoIndexResult {
+	for id, point := range ggi.cells[cell] {
+		if accept != nil && !accept(id) {
+			continue
+		}
+		results = append(results, GeoIndexResult{
+			Id:         id,
+			Lat:        point.lat,
+			Lon:        point.lon,
+			DistanceKm: ggi.distanceCalculator.Distance(lat, lon, point.lat, point.lon),
+		})
+	}
+	return results
+}
+
+// Nearest walks outwards ring by ring and stops once no unvisited cell can hold
+// anything closer than the k-th result found so far.
+func (ggi *GridGeoIndex) Nearest(lat, lon float64, k int, accept func(id string) bool) []GeoIndexResult {
+	results := make([]GeoIndexResult, 0)
+	if k <= 0 || len(ggi.points) == 0 {
+		return results
+	}
+	center := ggi.cellFor(lat, lon)
+	maxRing := max(
+		abs(center.row-ggi.minRow), abs(ggi.maxRow-center.row),
+		abs(center.col-ggi.minCol), abs(ggi.maxCol-center.col),
+	)
+	for ring := 0; ring <= maxRing; ring++ {
+		if len(results) >= k && ggi.ringLowerBoundKm(lat, ring) > results[k-1].DistanceKm {
+			break
+		}
+		if 8*ring > len(ggi.cells) {
+			// the remaining rings are mostly empty, visiting the occupied cells is cheaper
+			for cell := range ggi.cells {
+				if max(abs(cell.row-center.row), abs(cell.col-center.col)) >= ring {
+					results = ggi.collectCell(cell, lat, lon, accept, results)
+				}
+			}
+			sortByDistance(results)
+			break
+		}
+		for row := center.row - ring; row <= center.row+ring; row++ {
+			for col := center.col - ring; col <= center.col+ring; col++ {
+				if abs(row-center.row) != ring && abs(col-center.col) != ring {
+					continue
+				}
+				results = ggi.collectCell(gridCell{row: row, col: col}, lat, lon, accept, results)
+			}
+		}
+		sortByDistance(results)
+	}
+	if len(results) > k {
+		results = results[:k]
+	}
+	return results
+}
+
+func (ggi *GridGeoIndex) WithinRadius(lat, lon, radiusKm float64, accept func(id string) bool) []GeoIndexResult {
+	results := make([]GeoIndexResult, 0)
+	latDelta := radiusKm / kmPerDegreeLat
+	lonDelta := radiusKm / (kmPerDegreeLat * math.Max(math.Cos(toRadians(math.Min(math.Abs(lat)+latDelta, 89))), 0.01))
+	minCell := ggi.cellFor(lat-latDelta, lon-lonDelta)
+	maxCell := ggi.cellFor(lat+latDelta, lon+lonDelta)
+	ggi.forEachCellBetween(minCell, maxCell, func(cell gridCell) {
+		results = ggi.collectCell(cell, lat, lon, accept, results)
+	})
+	filtered := results[:0]
+	for _, result := range results {
+		if result.DistanceKm <= radiusKm {
+			filtered = append(filtered, result)
+		}
+	}
+	sortByDistance(filtered)
+	return filtered
+}
+
+func (ggi *GridGeoIndex) WithinBounds(bounds BoundingBox, accept func(id string) bool) []GeoIndexResult {
+	results := make([]GeoIndexResult, 0)
+	minCell := ggi.cellFor(bounds.MinLat, bounds.MinLon)
+	maxCell := ggi.cellFor(bounds.MaxLat, bounds.MaxLon)
+	ggi.forEachCellBetween(minCell, maxCell, func(cell gridCell) {
+		for id, point := range ggi.cells[cell] {
+			if !bounds.Contains(point.lat, point.lon) || (accept != nil && !accept(id)) {
+				continue
+			}
+			results = append(results, GeoIndexResult{Id: id, Lat: point.lat, Lon: point.lon})
+		}
+	})
+	return results
+}
+
+// forEachCellBetween visits the occupied cells of the rectangle, iterating the
+// occupied cells directly when the rectangle is larger than the populated grid.
+func (ggi *GridGeoIndex) forEachCellBetween(minCell, maxCell gridCell, visit func(cell gridCell)) {
+	if (maxCell.row-minCell.row+1)*(maxCell.col-minCell.col+1) > len(ggi.cells) {
+		for cell := range ggi.cells {
+			if cell.row >= minCell.row && cell.row <= maxCell.row && cell.col >= minCell.col && cell.col <= maxCell.col {
+				visit(cell)
+			}
+		}
+		return
+	}
+	for row := minCell.row; row <= maxCell.row; row++ {
+		for col := minCell.col; col <= maxCell.col; col++ {
+			if _, exists := ggi.cells[gridCell{row: row, col: col}]; exists {
+				visit(gridCell{row: row, col: col})
+			}
+		}
+	}
+}
+
+// ringLowerBoundKm is the shortest possible distance from the query point to
+// any cell of the given ring. Longitude degrees shrink towards the poles so the
+// bound uses the narrowest latitude the ring can reach.
+func (ggi *GridGeoIndex) ringLowerBoundKm(lat float64, ring int) float64 {
+	if ring <= 1 {
+		return 0
+	}
+	gapDeg := float64(ring-1) * ggi.cellSizeDeg
+	narrowestLat := math.Min(math.Abs(lat)+float64(ring)*ggi.cellSizeDeg, 90)
+	return gapDeg * kmPerDegreeLat * math.Cos(toRadians(narrowestLat))
+}
+
+func sortByDistance(results []GeoIndexResult) {
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].DistanceKm < results[j].DistanceKm
+	})
+}
+
+func abs(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
@@ -0,0 +1,261 @@
+package src
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// SpecialZone is a zone with rules of its own, such as an airport. Rides that
+// start or end in it carry a fixed surcharge, and in a queued zone cabs waiting
+// inside take its rides in the order they arrived.
+type SpecialZone struct {
+	Zone            Zone
+	PickupSurcharge int
+	DropSurcharge   int
+	Queued          bool
+}
+
+// ZonePolicy bounds where rides can be booked. No service areas means rides
+// can be booked anywhere.
+type ZonePolicy struct {
+	ServiceAreas []Zone
+	SpecialZones []SpecialZone
+}
+
+// zonePolicyFile is the layout of a zones file. Each zone is a polygon of at
+// least three vertices.
+type zonePolicyFile struct {
+	ServiceAreas []zoneFileEntry `json:"serviceAreas"`
+	SpecialZones []struct {
+		zoneFileEntry
+		PickupSurcharge int  `json:"pickupSurcharge"`
+		DropSurcharge   int  `json:"dropSurcharge"`
+		Queued          bool `json:"queued"`
+	} `json:"specialZones"`
+}
+
+type zoneFileEntry struct {
+	Id       string `json:"id"`
+	Vertices []struct {
+		Lat float64 `json:"lat"`
+		Lon float64 `json:"lon"`
+	} `json:"vertices"`
+}
+
+func LoadZonePolicy(path string) (ZonePolicy, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return ZonePolicy{}, err
+	}
+	defer file.Close()
+	return ReadZonePolicy(file)
+}
+
+func ReadZonePolicy(r io.Reader) (ZonePolicy, error) {
+	var policyFile zonePolicyFile
+	decoder := json.NewDecoder(r)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&policyFile); err != nil {
+		return ZonePolicy{}, fmt.Errorf("%w: %v", ErrInvalidZonePolicy, err)
+	}
+	var policy ZonePolicy
+	zoneIds := make(map[string]bool)
+	toZone := func(entry zoneFileEntry) (Zone, error) {
+		if entry.Id == "" || zoneIds[entry.Id] {
+			return nil, fmt.Errorf("%w: zone id %q is empty or repeated", ErrInvalidZonePolicy, entry.Id)
+		}
+		zoneIds[entry.Id] = true
+		if len(entry.Vertices) < 3 {
+			return nil, fmt.Errorf("%w: zone %s needs at least three vertices", ErrInvalidZonePolicy, entry.Id)
+		}
+		vertices := make([]GeoPoint, 0, len(entry.Vertices))
+		for _, vertex := range entry.Vertices {
+			if err := ValidateCoordinates(vertex.Lat, vertex.Lon); err != nil {
+				return nil, fmt.Errorf("%w: zone %s: %v", ErrInvalidZonePolicy, entry.Id, err)
+			}
+			vertices = append(vertices, GeoPoint{Lat: vertex.Lat, Lon: vertex.Lon})
+		}
+		return NewPolygonZone(entry.Id, vertices), nil
+	}
+	for _, entry := range policyFile.ServiceAreas {
+		zone, err := toZone(entry)
+		if err != nil {
+			return ZonePolicy{}, err
+		}
+		policy.ServiceAreas = append(policy.ServiceAreas, zone)
+	}
+	for _, entry := range policyFile.SpecialZones {
+		zone, err := toZone(entry.zoneFileEntry)
+		if err != nil {
+			return ZonePolicy{}, err
+		}
+		if entry.PickupSurcharge < 0 || entry.DropSurcharge < 0 {
+			return ZonePolicy{}, fmt.Errorf("%w: zone %s has a negative surcharge", ErrInvalidZonePolicy, entry.Id)
+		}
+		policy.SpecialZones = append(policy.SpecialZones, SpecialZone{Zone: zone, PickupSurcharge: entry.PickupSurcharge, DropSurcharge: entry.DropSurcharge, Queued: entry.Queued})
+	}
+	return policy, nil
+}
+
+type QueuedCab struct {
+	CabId    string
+	ZoneId   string
+	JoinedAt time.Time
+	Position int
+}
+
+type ZoneManager interface {
+	IsServiced(lat, lon float64) bool
+	GetSpecialZone(lat, lon float64) *SpecialZone
+	GetZoneQueue(zoneId string) ([]QueuedCab, error)
+	FindQueuedCab(zoneId string, ride *Ride, excludedCabIds map[string]bool) *Cab
+	GetPolicy() ZonePolicy
+}
+
+// QueueingZoneManager keeps a first in, first out queue of the cabs ready
+// inside each queued zone. A cab joins at the back when it is seen free in the
+// zone and loses its place when it leaves, takes a ride, or stops working.
+type QueueingZoneManager struct {
+	cabRepo ICabRepository
+	clock   Clock
+	policy  ZonePolicy
+	mu      sync.Mutex
+	queues  map[string][]QueuedCab
+}
+
+func NewQueueingZoneManager(cabRepo ICabRepository, eventBus EventBus, clock Clock, policy ZonePolicy) ZoneManager {
+	qzm := &QueueingZoneManager{
+		cabRepo: cabRepo,
+		clock:   clock,
+		policy:  policy,
+		queues:  make(map[string][]QueuedCab),
+	}
+	for _, specialZone := range policy.SpecialZones {
+		if specialZone.Queued {
+			qzm.queues[specialZone.Zone.GetId()] = nil
+		}
+	}
+	eventBus.Subscribe(qzm)
+	return qzm
+}
+
+func (qzm *QueueingZoneManager) IsServiced(lat, lon float64) bool {
+	if len(qzm.policy.ServiceAreas) == 0 {
+		return true
+	}
+	for _, serviceArea := range qzm.policy.ServiceAreas {
+		if serviceArea.Contains(lat, lon) {
+			return true
+		}
+	}
+	return false
+}
+
+// GetSpecialZone returns the first special zone containing the point, nil when
+// it is in none.
+func (qzm *QueueingZoneManager) GetSpecialZone(lat, lon float64) *SpecialZone {
+	for i := range qzm.policy.SpecialZones {
+		if qzm.policy.SpecialZones[i].Zone.Contains(lat, lon) {
+			specialZone := qzm.policy.SpecialZones[i]
+			return &specialZone
+		}
+	}
+	return nil
+}
+
+func (qzm *QueueingZoneManager) GetZoneQueue(zoneId string) ([]QueuedCab, error) {
+	qzm.mu.Lock()
+	defer qzm.mu.Unlock()
+	queue, exists := qzm.queues[zoneId]
+	if !exists {
+		return nil, fmt.Errorf("%w: %s", ErrZoneNotFound, zoneId)
+	}
+	snapshot := make([]QueuedCab, len(queue))
+	for i, queuedCab := range queue {
+		queuedCab.Position = i + 1
+		snapshot[i] = queuedCab
+	}
+	return snapshot, nil
+}
+
+// FindQueuedCab returns the cab nearest the front of the zone's queue that
+// can take the ride. Cabs passed over keep their place.
+func (qzm *QueueingZoneManager) FindQueuedCab(zoneId string, ride *Ride, excludedCabIds map[string]bool) *Cab {
+	queue, err := qzm.GetZoneQueue(zoneId)
+	if err != nil {
+		return nil
+	}
+	for _, queuedCab := range queue {
+		if excludedCabIds[queuedCab.CabId] {
+			continue
+		}
+		cab := qzm.cabRepo.GetCabById(queuedCab.CabId)
+		if cab == nil || cab.GetCabStatus() != ReadyToTakeRide || !ride.GetVehicleCategory().Matches(cab.GetCategory()) {
+			continue
+		}
+		return cab
+	}
+	return nil
+}
+
+func (qzm *QueueingZoneManager) GetPolicy() ZonePolicy {
+	return qzm.policy
+}
+
+func (qzm *QueueingZoneManager) GetName() string {
+	return "zone-manager"
+}
+
+// HandleEvent keeps the queues in step with where cabs are and whether they
+// are free. Events for one cab arrive in order, so a cab is never queued
+// behind a cab that reached the zone after it.
+func (qzm *QueueingZoneManager) HandleEvent(event RideEvent) error {
+	switch event.Type {
+	case CabLocationUpdated, CabWentOnline, RideCompleted, RideCanceled, RideNoCabFound:
+		qzm.trackCab(event.CabId)
+	case CabAssigned, CabOnBreak, CabWentOffline:
+		qzm.mu.Lock()
+		qzm.leave(event.CabId)
+		qzm.mu.Unlock()
+	}
+	return nil
+}
+
+func (qzm *QueueingZoneManager) trackCab(cabId string) {
+	cab := qzm.cabRepo.GetCabById(cabId)
+	if cab == nil {
+		return
+	}
+	zoneId := ""
+	if cab.GetCabStatus() == ReadyToTakeRide {
+		if specialZone := qzm.GetSpecialZone(cab.GetCurrLocation()); specialZone != nil && specialZone.Queued {
+			zoneId = specialZone.Zone.GetId()
+		}
+	}
+	qzm.mu.Lock()
+	defer qzm.mu.Unlock()
+	for _, queuedCab := range qzm.queues[zoneId] {
+		if queuedCab.CabId == cabId {
+			return
+		}
+	}
+	qzm.leave(cabId)
+	if zoneId != "" {
+		qzm.queues[zoneId] = append(qzm.queues[zoneId], QueuedCab{CabId: cabId, ZoneId: zoneId, JoinedAt: qzm.clock.Now()})
+	}
+}
+
+func (qzm *QueueingZoneManager) leave(cabId string) {
+	for zoneId, queue := range qzm.queues {
+		for i, queuedCab := range queue {
+			if queuedCab.CabId == cabId {
+				qzm.queues[zoneId] = append(queue[:i:i], queue[i+1:]...)
+				return
+			}
+		}
+	}
+}
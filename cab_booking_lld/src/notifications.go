@@ -0,0 +1,203 @@
+package src
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+type RecipientRole int
+
+const (
+	Rider RecipientRole = iota
+	Driver
+)
+
+func (rr RecipientRole) String() string {
+	if rr == Driver {
+		return "Driver"
+	}
+	return "Rider"
+}
+
+func (rr RecipientRole) MarshalJSON() ([]byte, error) {
+	return json.Marshal(rr.String())
+}
+
+type Notification struct {
+	RecipientId   string        `json:"recipientId"`
+	RecipientRole RecipientRole `json:"recipientRole"`
+	Message       string        `json:"message"`
+	Event         RideEvent     `json:"event"`
+}
+
+type NotificationChannel interface {
+	Send(notification Notification) error
+}
+
+type ConsoleNotificationChannel struct {
+	out io.Writer
+	mu  sync.Mutex
+}
+
+func NewConsoleNotificationChannel(out io.Writer) NotificationChannel {
+	return &ConsoleNotificationChannel{
+		out: out,
+	}
+}
+
+func (cnc *ConsoleNotificationChannel) Send(notification Notification) error {
+	cnc.mu.Lock()
+	defer cnc.mu.Unlock()
+	_, err := fmt.Fprintf(cnc.out, "[notify %v %s] %s\n", notification.RecipientRole, notification.RecipientId, notification.Message)
+	return err
+}
+
+type WebhookNotificationChannel struct {
+	url    string
+	client *http.Client
+}
+
+func NewWebhookNotificationChannel(url string, timeout time.Duration) NotificationChannel {
+	return &WebhookNotificationChannel{
+		url:    url,
+		client: &http.Client{Timeout: timeout},
+	}
+}
+
+func (wnc *WebhookNotificationChannel) Send(notification Notification) error {
+	body, err := json.Marshal(notification)
+	if err != nil {
+		return err
+	}
+	response, err := wnc.client.Post(wnc.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode >= 300 {
+		return fmt.Errorf("webhook %s responded with %s", wnc.url, response.Status)
+	}
+	return nil
+}
+
+// NotificationDispatcher turns ride events into messages for the rider and the
+// driver and sends them through every configured channel.
+type NotificationDispatcher struct {
+	channels []NotificationChannel
+}
+
+func NewNotificationDispatcher(channels ...NotificationChannel) EventSubscriber {
+	return &NotificationDispatcher{
+		channels: channels,
+	}
+}
+
+func (nd *NotificationDispatcher) GetName() string {
+	return "notification-dispatcher"
+}
+
+func (nd *NotificationDispatcher) HandleEvent(event RideEvent) error {
+	errs := make([]error, 0)
+	for _, notification := range nd.notificationsFor(event) {
+		for _, channel := range nd.channels {
+			if err := channel.Send(notification); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (nd *NotificationDispatcher) notificationsFor(event RideEvent) []Notification {
+	toRider := func(message string) Notification {
+		return Notification{RecipientId: event.UserId, RecipientRole: Rider, Message: message, Event: event}
+	}
+	toDriver := func(message string) Notification {
+		return Notification{RecipientId: event.CabId, RecipientRole: Driver, Message: message, Event: event}
+	}
+	switch event.Type {
+	case RideRequested:
+		return []Notification{toRider("We are looking for a cab for your ride " + event.RideId)}
+	case RideOffered:
+		return []Notification{toDriver("New ride request " + event.RideId + ", accept it before it expires")}
+	case CabAssigned:
+		return []Notification{
+			toRider("Cab " + event.CabId + " is on its way"),
+			toDriver("Ride " + event.RideId + " is yours, head to the pickup point"),
+		}
+	case RidePickedUp:
+		return []Notification{toRider("Enjoy your ride")}
+	case RideCompleted:
+		return []Notification{
+			toRider("You have reached your destination, thanks for riding with us"),
+			toDriver("Ride " + event.RideId + " completed"),
+		}
+	case RideCanceled:
+		message := "Ride " + event.RideId + " was cancelled"
+		if event.CancellationFee > 0 {
+			message += fmt.Sprintf(", a cancellation fee of %d applies", event.CancellationFee)
+		}
+		notifications := []Notification{toRider(message)}
+		if event.CabId != "" {
+			notifications = append(notifications, toDriver("Ride "+event.RideId+" was cancelled"))
+		}
+		return notifications
+	case RideScheduled:
+		return []Notification{toRider("Your ride " + event.RideId + " is scheduled for pickup at " + event.PickupAt.Format(time.Kitchen))}
+	case RideRescheduled:
+		return []Notification{toRider("Your ride " + event.RideId + " now picks you up at " + event.PickupAt.Format(time.Kitchen))}
+	case RideNoCabFound:
+		return []Notification{toRider("Sorry, no cab is available for ride " + event.RideId + " right now")}
+	case CabFlaggedForReview:
+		return []Notification{toDriver("Your rating has dropped below our standard, your account will be reviewed")}
+	case CabDeprioritised:
+		return []Notification{toDriver("You have cancelled too many rides, you will get fewer ride requests for a while")}
+	case RidePaid:
+		return []Notification{toRider(fmt.Sprintf("We received your payment of %d for ride %s", event.Amount, event.RideId))}
+	case RidePaymentFailed:
+		return []Notification{toRider(fmt.Sprintf("We could not take %d for ride %s, please clear it before your next booking", event.Amount, event.RideId))}
+	case RideRefunded:
+		return []Notification{toRider(fmt.Sprintf("%d for ride %s has been refunded", event.Amount, event.RideId))}
+	case ReferralRewarded:
+		return []Notification{toRider(fmt.Sprintf("Someone you referred took their first ride, %d has been added to your wallet", event.Amount))}
+	case CabWentOnline:
+		return []Notification{toDriver("You are online, ride requests will start coming in")}
+	case CabWentOffline:
+		return []Notification{toDriver("You are offline, see you on your next shift")}
+	case CabOnBreak:
+		return []Notification{toDriver("Enjoy your break, ride requests are paused until you are back online")}
+	case IncentiveEarned:
+		return []Notification{toDriver(fmt.Sprintf("You earned an incentive of %d", event.Amount))}
+	case DriverPaidOut:
+		return []Notification{toDriver(fmt.Sprintf("A payout of %d is on its way to you", event.Amount))}
+	}
+	return nil
+}
+
+// AuditLogWriter appends every event as one JSON line.
+type AuditLogWriter struct {
+	mu      sync.Mutex
+	encoder *json.Encoder
+}
+
+func NewAuditLogWriter(out io.Writer) EventSubscriber {
+	return &AuditLogWriter{
+		encoder: json.NewEncoder(out),
+	}
+}
+
+func (alw *AuditLogWriter) GetName() string {
+	return "audit-log"
+}
+
+func (alw *AuditLogWriter) HandleEvent(event RideEvent) error {
+	alw.mu.Lock()
+	defer alw.mu.Unlock()
+	return alw.encoder.Encode(event)
+}
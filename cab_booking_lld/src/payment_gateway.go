@@ -0,0 +1,111 @@
+package src
+
+import (
+	"fmt"
+	"sync"
+)
+
+// PaymentGateway is the card processor. Cards are registered once and kept as
+// the gateway's token, so card numbers never reach the repositories.
+type PaymentGateway interface {
+	RegisterCard(cardNumber string) (token string, last4 string, err error)
+	// Charge returns the gateway's reference for the charge. Retrying with the
+	// same idempotencyKey returns the first charge instead of taking it twice.
+	Charge(token string, amount int, idempotencyKey string) (reference string, err error)
+	Refund(reference string, amount int) error
+}
+
+// FakeDeclinedCard is accepted by the fake gateway but every charge to it is
+// declined.
+const FakeDeclinedCard = "4000000000000002"
+
+type fakeCharge struct {
+	amount   int
+	refunded int
+}
+
+// FakePaymentGateway approves every charge to a valid card except
+// FakeDeclinedCard. It keeps everything in memory and is meant for local runs.
+type FakePaymentGateway struct {
+	cards       map[string]string
+	charges     map[string]*fakeCharge
+	idempotency map[string]string
+	nextId      int
+	mu          sync.Mutex
+}
+
+func NewFakePaymentGateway() PaymentGateway {
+	return &FakePaymentGateway{
+		cards:       make(map[string]string),
+		charges:     make(map[string]*fakeCharge),
+		idempotency: make(map[string]string),
+	}
+}
+
+func (fpg *FakePaymentGateway) RegisterCard(cardNumber string) (string, string, error) {
+	if !isLuhnValid(cardNumber) {
+		return "", "", ErrInvalidCard
+	}
+	fpg.mu.Lock()
+	defer fpg.mu.Unlock()
+	fpg.nextId++
+	token := fmt.Sprintf("tok_%d", fpg.nextId)
+	fpg.cards[token] = cardNumber
+	return token, cardNumber[len(cardNumber)-4:], nil
+}
+
+func (fpg *FakePaymentGateway) Charge(token string, amount int, idempotencyKey string) (string, error) {
+	fpg.mu.Lock()
+	defer fpg.mu.Unlock()
+	if reference, exists := fpg.idempotency[idempotencyKey]; exists {
+		return reference, nil
+	}
+	cardNumber, exists := fpg.cards[token]
+	if !exists {
+		return "", fmt.Errorf("%w: unknown card token", ErrCardDeclined)
+	}
+	if cardNumber == FakeDeclinedCard {
+		return "", ErrCardDeclined
+	}
+	fpg.nextId++
+	reference := fmt.Sprintf("ch_%d", fpg.nextId)
+	fpg.charges[reference] = &fakeCharge{amount: amount}
+	fpg.idempotency[idempotencyKey] = reference
+	return reference, nil
+}
+
+func (fpg *FakePaymentGateway) Refund(reference string, amount int) error {
+	fpg.mu.Lock()
+	defer fpg.mu.Unlock()
+	charge, exists := fpg.charges[reference]
+	if !exists {
+		return fmt.Errorf("%w: unknown charge %s", ErrRefundNotAllowed, reference)
+	}
+	if charge.refunded+amount > charge.amount {
+		return fmt.Errorf("%w: %d of %d already refunded", ErrRefundNotAllowed, charge.refunded, charge.amount)
+	}
+	charge.refunded += amount
+	return nil
+}
+
+// isLuhnValid checks the length and check digit of a card number.
+func isLuhnValid(cardNumber string) bool {
+	if len(cardNumber) < 12 || len(cardNumber) > 19 {
+		return false
+	}
+	sum := 0
+	for i := len(cardNumber) - 1; i >= 0; i-- {
+		digit := int(cardNumber[i] - '0')
+		if digit < 0 || digit > 9 {
+			return false
+		}
+		if (len(cardNumber)-i)%2 == 0 {
+			digit *= 2
+			if digit > 9 {
+				digit -= 9
+			}
+		}
+		sum += digit
+	}
+	return sum%10 == 0
+}
@@ -0,0 +1,595 @@
+package src
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// PaymentMethod is one way a rider pays. Wallet and cash methods carry no
+// details; a card is kept only as the gateway's token for it.
+type PaymentMethod struct {
+	id           string
+	userId       string
+	methodType   PaymentMethodType
+	gatewayToken string
+	label        string
+	isDefault    bool
+	createdAt    time.Time
+}
+
+func NewPaymentMethod(id, userId string, methodType PaymentMethodType, gatewayToken, label string, createdAt time.Time) *PaymentMethod {
+	return &PaymentMethod{
+		id:           id,
+		userId:       userId,
+		methodType:   methodType,
+		gatewayToken: gatewayToken,
+		label:        label,
+		createdAt:    createdAt,
+	}
+}
+
+func (pm *PaymentMethod) String() string {
+	return fmt.Sprintf("{Id: %s, Type: %v, Label: %s, Default: %t}", pm.id, pm.methodType, pm.label, pm.isDefault)
+}
+
+func (pm *PaymentMethod) clone() *PaymentMethod {
+	clone := *pm
+	return &clone
+}
+
+func (pm PaymentMethod) GetId() string {
+	return pm.id
+}
+
+func (pm PaymentMethod) GetUserId() string {
+	return pm.userId
+}
+
+func (pm PaymentMethod) GetMethodType() PaymentMethodType {
+	return pm.methodType
+}
+
+func (pm PaymentMethod) GetGatewayToken() string {
+	return pm.gatewayToken
+}
+
+// GetLabel is what the rider sees for the method, e.g. "Card ending 4242".
+func (pm PaymentMethod) GetLabel() string {
+	return pm.label
+}
+
+func (pm PaymentMethod) IsDefault() bool {
+	return pm.isDefault
+}
+
+func (pm PaymentMethod) GetCreatedAt() time.Time {
+	return pm.createdAt
+}
+
+// cashOnDelivery is used for riders who have not stored a payment method.
+var cashOnDelivery = PaymentMethod{methodType: CashPayment, label: "Cash"}
+
+// Payment is the charge for one ride, from the attempt through any refunds.
+type Payment struct {
+	id            string
+	rideId        string
+	userId        string
+	methodId      string
+	methodType    PaymentMethodType
+	amount        int
+	refunded      int
+	status        PaymentStatus
+	reference     string
+	failureReason string
+	createdAt     time.Time
+	updatedAt     time.Time
+}
+
+func NewPayment(id string, ride *Ride, method PaymentMethod, createdAt time.Time) *Payment {
+	return &Payment{
+		id:         id,
+		rideId:     ride.GetId(),
+		userId:     ride.GetUserId(),
+		methodId:   method.GetId(),
+		methodType: method.GetMethodType(),
+		amount:     ride.GetTotalAmount(),
+		status:     PaymentPending,
+		createdAt:  createdAt,
+		updatedAt:  createdAt,
+	}
+}
+
+func (p *Payment) String() string {
+	return fmt.Sprintf("{Id: %s, RideId: %s, Method: %v, Amount: %d, Refunded: %d, Status: %v}", p.id, p.rideId, p.methodType, p.amount, p.refunded, p.status)
+}
+
+func (p *Payment) clone() *Payment {
+	clone := *p
+	return &clone
+}
+
+func (p Payment) GetId() string {
+	return p.id
+}
+
+func (p Payment) GetRideId() string {
+	return p.rideId
+}
+
+func (p Payment) GetUserId() string {
+	return p.userId
+}
+
+// GetMethodId is empty when the rider paid cash without storing a method.
+func (p Payment) GetMethodId() string {
+	return p.methodId
+}
+
+func (p Payment) GetMethodType() PaymentMethodType {
+	return p.methodType
+}
+
+func (p Payment) GetAmount() int {
+	return p.amount
+}
+
+// GetRefunded is what was given back, or waived while the payment was still due.
+func (p Payment) GetRefunded() int {
+	return p.refunded
+}
+
+// GetAmountDue is what the rider still owes on a failed payment.
+func (p Payment) GetAmountDue() int {
+	if p.status != PaymentFailed {
+		return 0
+	}
+	return p.amount - p.refunded
+}
+
+func (p Payment) GetStatus() PaymentStatus {
+	return p.status
+}
+
+// GetReference is the gateway's reference for card payments.
+func (p Payment) GetReference() string {
+	return p.reference
+}
+
+func (p Payment) GetFailureReason() string {
+	return p.failureReason
+}
+
+func (p Payment) GetCreatedAt() time.Time {
+	return p.createdAt
+}
+
+func (p Payment) GetUpdatedAt() time.Time {
+	return p.updatedAt
+}
+
+func (p *Payment) succeed(method PaymentMethod, reference string, at time.Time) {
+	p.methodId = method.GetId()
+	p.methodType = method.GetMethodType()
+	p.status = PaymentSucceeded
+	p.reference = reference
+	p.failureReason = ""
+	p.updatedAt = at
+}
+
+func (p *Payment) fail(reason string, at time.Time) {
+	p.status = PaymentFailed
+	p.failureReason = reason
+	p.updatedAt = at
+}
+
+func (p *Payment) refund(amount int, at time.Time) {
+	p.refunded += amount
+	p.updatedAt = at
+	if p.status == PaymentFailed {
+		if p.refunded == p.amount {
+			p.status = PaymentRefunded
+		}
+		return
+	}
+	p.status = PaymentPartiallyRefunded
+	if p.refunded == p.amount {
+		p.status = PaymentRefunded
+	}
+}
+
+// LedgerEntry records one movement of money. Amount is always positive; the
+// deltas say how the movement changed the rider's wallet and dues, so the
+// balances are the sums of the deltas over the rider's entries.
+type LedgerEntry struct {
+	Id          string
+	UserId      string
+	RideId      string
+	PaymentId   string
+	Kind        LedgerEntryKind
+	Method      PaymentMethodType
+	Amount      int
+	WalletDelta int
+	DuesDelta   int
+	Reference   string
+	Note        string
+	At          time.Time
+}
+
+func (le LedgerEntry) String() string {
+	return fmt.Sprintf("{Kind: %v, Method: %v, Amount: %d, Wallet: %+d, Dues: %+d}", le.Kind, le.Method, le.Amount, le.WalletDelta, le.DuesDelta)
+}
+
+func newLedgerEntry(id, userId string, kind LedgerEntryKind, method PaymentMethodType, amount int, at time.Time) LedgerEntry {
+	entry := LedgerEntry{Id: id, UserId: userId, Kind: kind, Method: method, Amount: amount, At: at}
+	switch kind {
+	case WalletTopUp, ReferralReward:
+		entry.WalletDelta = amount
+	case RideCharge, DueSettled:
+		if method == WalletPayment {
+			entry.WalletDelta = -amount
+		}
+		if kind == DueSettled {
+			entry.DuesDelta = -amount
+		}
+	case RideRefund:
+		if method == WalletPayment {
+			entry.WalletDelta = amount
+		}
+	case DueRecorded:
+		entry.DuesDelta = amount
+	case DueWaived:
+		entry.DuesDelta = -amount
+	}
+	return entry
+}
+
+type RiderBalance struct {
+	UserId          string
+	WalletBalance   int
+	OutstandingDues int
+}
+
+type PaymentProcessor interface {
+	AddPaymentMethod(userId string, methodType PaymentMethodType, cardNumber string, makeDefault bool) (*PaymentMethod, error)
+	GetPaymentMethods(userId string) ([]PaymentMethod, error)
+	SetDefaultPaymentMethod(userId, methodId string) error
+	// GetPaymentMethod returns the rider's method, failing if it belongs to
+	// someone else.
+	GetPaymentMethod(userId, methodId string) (*PaymentMethod, error)
+	TopUpWallet(userId, methodId string, amount int) (RiderBalance, error)
+	GetBalance(userId string) (RiderBalance, error)
+	// PayDues charges the method for the rider's failed payments, oldest
+	// first, and stops at the first one it cannot pay.
+	PayDues(userId, methodId string) (RiderBalance, error)
+	// ChargeRide takes the ride's total amount with the method it was booked
+	// with. A payment that fails is kept as an outstanding due, so only a ride
+	// that cannot be charged at all returns an error.
+	ChargeRide(ride *Ride) (*Payment, error)
+	GetRidePayment(rideId string) (*Payment, error)
+	// RefundRide gives back amount of a disputed ride's payment, or all that is
+	// left of it when amount is 0. A payment still due is waived instead.
+	RefundRide(rideId string, amount int, reason string) (*Payment, error)
+	GetLedger(userId string) ([]LedgerEntry, error)
+	// RewardReferral credits the referrer's wallet for the referred rider's
+	// first ride.
+	RewardReferral(referrerId, rideId string, amount int) (RiderBalance, error)
+}
+
+type LedgerPaymentProcessor struct {
+	paymentRepo          IPaymentRepository
+	ledgerRepo           ILedgerRepository
+	userRepo             IUserRepository
+	gateway              PaymentGateway
+	idGenerationStrategy IdGenerationStrategy
+	eventBus             EventBus
+	clock                Clock
+	// mu orders every balance check with the entries that follow it, so two
+	// charges cannot both spend the same wallet money.
+	mu sync.Mutex
+}
+
+func NewLedgerPaymentProcessor(paymentRepo IPaymentRepository, ledgerRepo ILedgerRepository, userRepo IUserRepository, gateway PaymentGateway, idGenerationStrategy IdGenerationStrategy, eventBus EventBus, clock Clock) PaymentProcessor {
+	return &LedgerPaymentProcessor{
+		paymentRepo:          paymentRepo,
+		ledgerRepo:           ledgerRepo,
+		userRepo:             userRepo,
+		gateway:              gateway,
+		idGenerationStrategy: idGenerationStrategy,
+		eventBus:             eventBus,
+		clock:                clock,
+	}
+}
+
+func (lpp *LedgerPaymentProcessor) AddPaymentMethod(userId string, methodType PaymentMethodType, cardNumber string, makeDefault bool) (*PaymentMethod, error) {
+	if lpp.userRepo.GetUserById(userId) == nil {
+		return nil, ErrUserNotFound
+	}
+	var token, label string
+	switch methodType {
+	case WalletPayment, CashPayment:
+		label = methodType.String()
+	case CardPayment:
+		var last4 string
+		var err error
+		if token, last4, err = lpp.gateway.RegisterCard(strings.ReplaceAll(cardNumber, " ", "")); err != nil {
+			return nil, err
+		}
+		label = "Card ending " + last4
+	default:
+		return nil, fmt.Errorf("%w: %d", ErrUnknownPaymentMethodType, methodType)
+	}
+	method := NewPaymentMethod(lpp.idGenerationStrategy.GenerateId(), userId, methodType, token, label, lpp.clock.Now())
+	if err := lpp.paymentRepo.SavePaymentMethod(method); err != nil {
+		return nil, err
+	}
+	// A rider's first method becomes the default so rides have one to use.
+	if makeDefault || len(lpp.paymentRepo.FindPaymentMethods(userId)) == 1 {
+		if err := lpp.paymentRepo.SetDefaultPaymentMethod(userId, method.GetId()); err != nil {
+			return nil, err
+		}
+	}
+	return lpp.paymentRepo.GetPaymentMethodById(method.GetId()), nil
+}
+
+func (lpp *LedgerPaymentProcessor) GetPaymentMethods(userId string) ([]PaymentMethod, error) {
+	if lpp.userRepo.GetUserById(userId) == nil {
+		return nil, ErrUserNotFound
+	}
+	return lpp.paymentRepo.FindPaymentMethods(userId), nil
+}
+
+func (lpp *LedgerPaymentProcessor) SetDefaultPaymentMethod(userId, methodId string) error {
+	if _, err := lpp.GetPaymentMethod(userId, methodId); err != nil {
+		return err
+	}
+	return lpp.paymentRepo.SetDefaultPaymentMethod(userId, methodId)
+}
+
+func (lpp *LedgerPaymentProcessor) GetPaymentMethod(userId, methodId string) (*PaymentMethod, error) {
+	method := lpp.paymentRepo.GetPaymentMethodById(methodId)
+	if method == nil || method.GetUserId() != userId {
+		return nil, ErrPaymentMethodNotFound
+	}
+	return method, nil
+}
+
+// methodForRide is the method the ride was booked with, else the rider's
+// default, else cash.
+func (lpp *LedgerPaymentProcessor) methodForRide(ride *Ride) PaymentMethod {
+	if methodId := ride.GetPaymentMethodId(); methodId != "" {
+		if method, err := lpp.GetPaymentMethod(ride.GetUserId(), methodId); err == nil {
+			return *method
+		}
+	}
+	for _, method := range lpp.paymentRepo.FindPaymentMethods(ride.GetUserId()) {
+		if method.IsDefault() {
+			return method
+		}
+	}
+	return cashOnDelivery
+}
+
+func (lpp *LedgerPaymentProcessor) TopUpWallet(userId, methodId string, amount int) (RiderBalance, error) {
+	if amount <= 0 {
+		return RiderBalance{}, fmt.Errorf("%w: %d", ErrInvalidAmount, amount)
+	}
+	method, err := lpp.GetPaymentMethod(userId, methodId)
+	if err != nil {
+		return RiderBalance{}, err
+	}
+	if method.GetMethodType() != CardPayment {
+		return RiderBalance{}, fmt.Errorf("%w: the wallet is topped up by card", ErrPaymentMethodNotAllowed)
+	}
+	topUpId := lpp.idGenerationStrategy.GenerateId()
+	reference, err := lpp.gateway.Charge(method.GetGatewayToken(), amount, "top-up:"+topUpId)
+	if err != nil {
+		return RiderBalance{}, err
+	}
+	lpp.mu.Lock()
+	defer lpp.mu.Unlock()
+	entry := newLedgerEntry(topUpId, userId, WalletTopUp, CardPayment, amount, lpp.clock.Now())
+	entry.Reference = reference
+	if err := lpp.ledgerRepo.AppendEntry(entry); err != nil {
+		return RiderBalance{}, err
+	}
+	return lpp.ledgerRepo.GetBalance(userId), nil
+}
+
+func (lpp *LedgerPaymentProcessor) GetBalance(userId string) (RiderBalance, error) {
+	if lpp.userRepo.GetUserById(userId) == nil {
+		return RiderBalance{}, ErrUserNotFound
+	}
+	return lpp.ledgerRepo.GetBalance(userId), nil
+}
+
+func (lpp *LedgerPaymentProcessor) ChargeRide(ride *Ride) (*Payment, error) {
+	if ride.GetTotalAmount() <= 0 {
+		return nil, nil
+	}
+	method := lpp.methodForRide(ride)
+	now := lpp.clock.Now()
+	payment := NewPayment(lpp.idGenerationStrategy.GenerateId(), ride, method, now)
+	if err := lpp.paymentRepo.SavePayment(payment); err != nil {
+		return nil, err
+	}
+
+	var reference string
+	var err error
+	switch {
+	case method.GetMethodType() == CashPayment && ride.GetStatus() == Canceled:
+		// Nobody is in the cab to hand over cash, so the fee waits as a due.
+		err = fmt.Errorf("%w: cash cannot be collected for a cancelled ride", ErrPaymentMethodNotAllowed)
+	case method.GetMethodType() != WalletPayment:
+		// A card charge does not read the balance, and the idempotency key
+		// keeps a retry from charging twice, so the gateway is called without mu.
+		reference, err = lpp.take(method, ride.GetUserId(), payment.GetAmount(), "ride:"+ride.GetId())
+	}
+	lpp.mu.Lock()
+	if method.GetMethodType() == WalletPayment {
+		reference, err = lpp.take(method, ride.GetUserId(), payment.GetAmount(), "ride:"+ride.GetId())
+	}
+	kind := RideCharge
+	if err != nil {
+		kind = DueRecorded
+	}
+	entry := newLedgerEntry(lpp.idGenerationStrategy.GenerateId(), ride.GetUserId(), kind, method.GetMethodType(), payment.GetAmount(), now)
+	entry.RideId, entry.PaymentId, entry.Reference = ride.GetId(), payment.GetId(), reference
+	appendErr := lpp.ledgerRepo.AppendEntry(entry)
+	lpp.mu.Unlock()
+	if appendErr != nil {
+		return nil, appendErr
+	}
+	payment, updateErr := lpp.paymentRepo.UpdatePayment(payment.GetId(), func(payment *Payment) error {
+		if err != nil {
+			payment.fail(err.Error(), now)
+		} else {
+			payment.succeed(method, reference, now)
+		}
+		return nil
+	})
+	if updateErr != nil {
+		return nil, updateErr
+	}
+	if err != nil {
+		lpp.eventBus.Publish(newPaymentEvent(RidePaymentFailed, payment, lpp.clock.Now()))
+	} else {
+		lpp.eventBus.Publish(newPaymentEvent(RidePaid, payment, lpp.clock.Now()))
+	}
+	return payment, nil
+}
+
+// take moves amount from the rider through the method. A wallet charge must be
+// taken with mu held, since it depends on the balance it reads.
+func (lpp *LedgerPaymentProcessor) take(method PaymentMethod, userId string, amount int, idempotencyKey string) (string, error) {
+	switch method.GetMethodType() {
+	case WalletPayment:
+		if balance := lpp.ledgerRepo.GetBalance(userId); balance.WalletBalance < amount {
+			return "", fmt.Errorf("%w: %d needed, %d available", ErrInsufficientWalletBalance, amount, balance.WalletBalance)
+		}
+		return "", nil
+	case CardPayment:
+		return lpp.gateway.Charge(method.GetGatewayToken(), amount, idempotencyKey)
+	}
+	// Cash is collected by the driver at the drop.
+	return "", nil
+}
+
+func (lpp *LedgerPaymentProcessor) PayDues(userId, methodId string) (RiderBalance, error) {
+	method, err := lpp.GetPaymentMethod(userId, methodId)
+	if err != nil {
+		return RiderBalance{}, err
+	}
+	if method.GetMethodType() == CashPayment {
+		return RiderBalance{}, fmt.Errorf("%w: dues are paid from the wallet or by card", ErrPaymentMethodNotAllowed)
+	}
+	lpp.mu.Lock()
+	defer lpp.mu.Unlock()
+	for _, due := range lpp.paymentRepo.FindPaymentsForUser(userId, PaymentFailed) {
+		amount := due.GetAmountDue()
+		reference, err := lpp.take(*method, userId, amount, "due:"+due.GetId())
+		if err != nil {
+			return lpp.ledgerRepo.GetBalance(userId), err
+		}
+		now := lpp.clock.Now()
+		entry := newLedgerEntry(lpp.idGenerationStrategy.GenerateId(), userId, DueSettled, method.GetMethodType(), amount, now)
+		entry.RideId, entry.PaymentId, entry.Reference = due.GetRideId(), due.GetId(), reference
+		if err := lpp.ledgerRepo.AppendEntry(entry); err != nil {
+			return lpp.ledgerRepo.GetBalance(userId), err
+		}
+		payment, err := lpp.paymentRepo.UpdatePayment(due.GetId(), func(payment *Payment) error {
+			payment.succeed(*method, reference, now)
+			return nil
+		})
+		if err != nil {
+			return lpp.ledgerRepo.GetBalance(userId), err
+		}
+		lpp.eventBus.Publish(newPaymentEvent(RidePaid, payment, lpp.clock.Now()))
+	}
+	return lpp.ledgerRepo.GetBalance(userId), nil
+}
+
+func (lpp *LedgerPaymentProcessor) GetRidePayment(rideId string) (*Payment, error) {
+	payment := lpp.paymentRepo.GetPaymentForRide(rideId)
+	if payment == nil {
+		return nil, ErrPaymentNotFound
+	}
+	return payment, nil
+}
+
+func (lpp *LedgerPaymentProcessor) RefundRide(rideId string, amount int, reason string) (*Payment, error) {
+	if strings.TrimSpace(reason) == "" {
+		return nil, ErrMissingRefundReason
+	}
+	if amount < 0 {
+		return nil, fmt.Errorf("%w: %d", ErrInvalidAmount, amount)
+	}
+	lpp.mu.Lock()
+	defer lpp.mu.Unlock()
+	payment, err := lpp.GetRidePayment(rideId)
+	if err != nil {
+		return nil, err
+	}
+	refundable := payment.GetAmount() - payment.GetRefunded()
+	if payment.GetStatus() == PaymentPending || refundable == 0 || amount > refundable {
+		return nil, fmt.Errorf("%w: %d of %d can be refunded", ErrRefundNotAllowed, refundable, payment.GetAmount())
+	}
+	if amount == 0 {
+		amount = refundable
+	}
+
+	kind, method := RideRefund, payment.GetMethodType()
+	switch {
+	case payment.GetStatus() == PaymentFailed:
+		kind = DueWaived
+	case method == CardPayment:
+		if err := lpp.gateway.Refund(payment.GetReference(), amount); err != nil {
+			return nil, err
+		}
+	default:
+		// Cash cannot be handed back, so it is refunded to the wallet.
+		method = WalletPayment
+	}
+	now := lpp.clock.Now()
+	entry := newLedgerEntry(lpp.idGenerationStrategy.GenerateId(), payment.GetUserId(), kind, method, amount, now)
+	entry.RideId, entry.PaymentId, entry.Reference, entry.Note = rideId, payment.GetId(), payment.GetReference(), reason
+	if err := lpp.ledgerRepo.AppendEntry(entry); err != nil {
+		return nil, err
+	}
+	payment, err = lpp.paymentRepo.UpdatePayment(payment.GetId(), func(payment *Payment) error {
+		payment.refund(amount, now)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	event := newPaymentEvent(RideRefunded, payment, lpp.clock.Now())
+	event.Amount = amount
+	lpp.eventBus.Publish(event)
+	return payment, nil
+}
+
+func (lpp *LedgerPaymentProcessor) GetLedger(userId string) ([]LedgerEntry, error) {
+	if lpp.userRepo.GetUserById(userId) == nil {
+		return nil, ErrUserNotFound
+	}
+	return lpp.ledgerRepo.FindEntriesForUser(userId), nil
+}
+
+func (lpp *LedgerPaymentProcessor) RewardReferral(referrerId, rideId string, amount int) (RiderBalance, error) {
+	if amount <= 0 {
+		return RiderBalance{}, fmt.Errorf("%w: %d", ErrInvalidAmount, amount)
+	}
+	if lpp.userRepo.GetUserById(referrerId) == nil {
+		return RiderBalance{}, ErrUserNotFound
+	}
+	lpp.mu.Lock()
+	defer lpp.mu.Unlock()
+	entry := newLedgerEntry(lpp.idGenerationStrategy.GenerateId(), referrerId, ReferralReward, WalletPayment, amount, lpp.clock.Now())
+	entry.RideId = rideId
+	if err := lpp.ledgerRepo.AppendEntry(entry); err != nil {
+		return RiderBalance{}, err
+	}
+	return lpp.ledgerRepo.GetBalance(referrerId), nil
+}
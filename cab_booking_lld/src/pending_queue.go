@@ -0,0 +1,260 @@
+package src
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+type PendingRide struct {
+	rideId        string
+	tier          int
+	sequence      uint64
+	enqueuedAt    time.Time
+	deadline      time.Time
+	retries       int
+	nextAttemptAt time.Time
+	inFlight      bool
+	position      int
+}
+
+func (pr *PendingRide) String() string {
+	return fmt.Sprintf("{RideId: %s, Tier: %d, Position: %d, Retries: %d, Deadline: %v}", pr.rideId, pr.tier, pr.position, pr.retries, pr.deadline)
+}
+
+func (pr PendingRide) GetRideId() string {
+	return pr.rideId
+}
+
+func (pr PendingRide) GetTier() int {
+	return pr.tier
+}
+
+func (pr PendingRide) GetEnqueuedAt() time.Time {
+	return pr.enqueuedAt
+}
+
+func (pr PendingRide) GetDeadline() time.Time {
+	return pr.deadline
+}
+
+func (pr PendingRide) GetRetries() int {
+	return pr.retries
+}
+
+func (pr PendingRide) GetNextAttemptAt() time.Time {
+	return pr.nextAttemptAt
+}
+
+// IsInFlight says a dispatch retry has the ride checked out right now.
+func (pr PendingRide) IsInFlight() bool {
+	return pr.inFlight
+}
+
+// GetPosition is the 1-based place of the ride in the queue when the snapshot
+// was taken, higher tiers are served first.
+func (pr PendingRide) GetPosition() int {
+	return pr.position
+}
+
+type PendingQueueStats struct {
+	Depth              int
+	DepthByTier        map[int]int
+	OldestWait         time.Duration
+	AverageWait        time.Duration
+	Matched            int
+	Expired            int
+	AverageMatchedWait time.Duration
+}
+
+type PendingRideQueue interface {
+	Enqueue(rideId string, tier int, now time.Time) *PendingRide
+	Checkout(now time.Time, ignoreBackoff bool) []*PendingRide
+	Reschedule(rideId string, now time.Time) bool
+	Complete(rideId string, now time.Time, matched bool)
+	ExpireOverdue(now time.Time) []string
+	Contains(rideId string) bool
+	Get(rideId string) (*PendingRide, error)
+	GetStats(now time.Time) PendingQueueStats
+	GetRetryInterval() time.Duration
+}
+
+// InMemoryPendingRideQueue keeps rides that could not be matched, ordered by
+// tier (highest first) and then by arrival. A ride keeps its place while it is
+// being retried and backs off exponentially between unsuccessful attempts.
+type InMemoryPendingRideQueue struct {
+	maxWait      time.Duration
+	baseBackoff  time.Duration
+	maxBackoff   time.Duration
+	mu           sync.Mutex
+	entries      map[string]*PendingRide
+	nextSequence uint64
+	matched      int
+	expired      int
+	matchedWait  time.Duration
+}
+
+func NewInMemoryPendingRideQueue(maxWait, baseBackoff, maxBackoff time.Duration) PendingRideQueue {
+	return &InMemoryPendingRideQueue{
+		maxWait:     maxWait,
+		baseBackoff: baseBackoff,
+		maxBackoff:  maxBackoff,
+		entries:     make(map[string]*PendingRide),
+	}
+}
+
+func (iprq *InMemoryPendingRideQueue) Enqueue(rideId string, tier int, now time.Time) *PendingRide {
+	iprq.mu.Lock()
+	defer iprq.mu.Unlock()
+	if entry, exists := iprq.entries[rideId]; exists {
+		return iprq.snapshot(entry)
+	}
+	iprq.nextSequence++
+	entry := &PendingRide{
+		rideId:        rideId,
+		tier:          tier,
+		sequence:      iprq.nextSequence,
+		enqueuedAt:    now,
+		deadline:      now.Add(iprq.maxWait),
+		nextAttemptAt: now.Add(iprq.baseBackoff),
+	}
+	iprq.entries[rideId] = entry
+	return iprq.snapshot(entry)
+}
+
+// Checkout hands out the rides that are due for another attempt in queue order
+// and marks them in flight until they are rescheduled or completed.
+func (iprq *InMemoryPendingRideQueue) Checkout(now time.Time, ignoreBackoff bool) []*PendingRide {
+	iprq.mu.Lock()
+	defer iprq.mu.Unlock()
+	due := make([]*PendingRide, 0)
+	for _, entry := range iprq.ordered() {
+		if entry.inFlight || (!ignoreBackoff && now.Before(entry.nextAttemptAt)) {
+			continue
+		}
+		entry.inFlight = true
+		due = append(due, iprq.snapshot(entry))
+	}
+	return due
+}
+
+// Reschedule puts an in flight ride back to wait and reports false when its
+// deadline has passed, in which case the ride is dropped from the queue.
+func (iprq *InMemoryPendingRideQueue) Reschedule(rideId string, now time.Time) bool {
+	iprq.mu.Lock()
+	defer iprq.mu.Unlock()
+	entry, exists := iprq.entries[rideId]
+	if !exists {
+		return false
+	}
+	if !now.Before(entry.deadline) {
+		delete(iprq.entries, rideId)
+		iprq.expired++
+		return false
+	}
+	entry.inFlight = false
+	entry.retries++
+	backoff := iprq.baseBackoff << min(entry.retries, 16)
+	entry.nextAttemptAt = now.Add(min(backoff, iprq.maxBackoff))
+	return true
+}
+
+func (iprq *InMemoryPendingRideQueue) Complete(rideId string, now time.Time, matched bool) {
+	iprq.mu.Lock()
+	defer iprq.mu.Unlock()
+	entry, exists := iprq.entries[rideId]
+	if !exists {
+		return
+	}
+	delete(iprq.entries, rideId)
+	if matched {
+		iprq.matched++
+		iprq.matchedWait += now.Sub(entry.enqueuedAt)
+	}
+}
+
+func (iprq *InMemoryPendingRideQueue) ExpireOverdue(now time.Time) []string {
+	iprq.mu.Lock()
+	defer iprq.mu.Unlock()
+	expired := make([]string, 0)
+	for rideId, entry := range iprq.entries {
+		if !entry.inFlight && !now.Before(entry.deadline) {
+			delete(iprq.entries, rideId)
+			iprq.expired++
+			expired = append(expired, rideId)
+		}
+	}
+	return expired
+}
+
+func (iprq *InMemoryPendingRideQueue) Contains(rideId string) bool {
+	iprq.mu.Lock()
+	defer iprq.mu.Unlock()
+	_, exists := iprq.entries[rideId]
+	return exists
+}
+
+func (iprq *InMemoryPendingRideQueue) Get(rideId string) (*PendingRide, error) {
+	iprq.mu.Lock()
+	defer iprq.mu.Unlock()
+	if _, exists := iprq.entries[rideId]; !exists {
+		return nil, ErrRideNotPending
+	}
+	for position, entry := range iprq.ordered() {
+		if entry.rideId == rideId {
+			snapshot := iprq.snapshot(entry)
+			snapshot.position = position + 1
+			return snapshot, nil
+		}
+	}
+	return nil, ErrRideNotPending
+}
+
+func (iprq *InMemoryPendingRideQueue) GetStats(now time.Time) PendingQueueStats {
+	iprq.mu.Lock()
+	defer iprq.mu.Unlock()
+	stats := PendingQueueStats{
+		Depth:       len(iprq.entries),
+		DepthByTier: make(map[int]int),
+		Matched:     iprq.matched,
+		Expired:     iprq.expired,
+	}
+	totalWait := time.Duration(0)
+	for _, entry := range iprq.entries {
+		wait := now.Sub(entry.enqueuedAt)
+		stats.DepthByTier[entry.tier]++
+		stats.OldestWait = max(stats.OldestWait, wait)
+		totalWait += wait
+	}
+	if stats.Depth > 0 {
+		stats.AverageWait = totalWait / time.Duration(stats.Depth)
+	}
+	if iprq.matched > 0 {
+		stats.AverageMatchedWait = iprq.matchedWait / time.Duration(iprq.matched)
+	}
+	return stats
+}
+
+func (iprq *InMemoryPendingRideQueue) GetRetryInterval() time.Duration {
+	return iprq.baseBackoff
+}
+
+func (iprq *InMemoryPendingRideQueue) ordered() []*PendingRide {
+	entries := make([]*PendingRide, 0, len(iprq.entries))
+	for _, entry := range iprq.entries {
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].tier != entries[j].tier {
+			return entries[i].tier > entries[j].tier
+		}
+		return entries[i].sequence < entries[j].sequence
+	})
+	return entries
+}
+
+func (iprq *InMemoryPendingRideQueue) snapshot(entry *PendingRide) *PendingRide {
+	snapshot := *entry
+	return &snapshot
+}
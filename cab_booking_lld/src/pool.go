@@ -0,0 +1,472 @@
+package src
+
+import (
+	"fmt"
+	"math"
+	"sync"
+)
+
+type PoolPolicy struct {
+	// Capacity is the number of rider seats a pooled cab offers.
+	Capacity int
+	// MaxDetourFactor bounds how much longer than the direct distance any
+	// rider's in-cab distance may become, e.g. 0.4 allows 40% extra.
+	MaxDetourFactor float64
+	// MaxPickupDistanceKm bounds how far the cab drives, along its remaining
+	// stops, before it picks up a rider who joins an existing pool.
+	MaxPickupDistanceKm float64
+	// MaxFareShare is the share of the solo fare a pool rider pays at most.
+	// It is also what riders are quoted before they are matched.
+	MaxFareShare float64
+	MinFareShare float64
+}
+
+type PoolStop struct {
+	RideId string
+	Kind   StopKind
+	Lat    float64
+	Lon    float64
+}
+
+// PoolTrip is the route of one pooled cab. Stops before visitedStops have been
+// made; the rest are the planned order of the remaining pickups and drops.
+type PoolTrip struct {
+	id           string
+	cabId        string
+	capacity     int
+	stops        []PoolStop
+	visitedStops int
+	seats        map[string]int
+	directKm     map[string]float64
+}
+
+func (pt *PoolTrip) String() string {
+	return fmt.Sprintf("{Id: %s, CabId: %s, Riders: %d, Stops: %d/%d}", pt.id, pt.cabId, len(pt.seats), pt.visitedStops, len(pt.stops))
+}
+
+func (pt *PoolTrip) clone() *PoolTrip {
+	clone := *pt
+	clone.stops = pt.GetStops()
+	clone.seats = make(map[string]int, len(pt.seats))
+	for rideId, seats := range pt.seats {
+		clone.seats[rideId] = seats
+	}
+	clone.directKm = make(map[string]float64, len(pt.directKm))
+	for rideId, directKm := range pt.directKm {
+		clone.directKm[rideId] = directKm
+	}
+	return &clone
+}
+
+func (pt PoolTrip) GetId() string {
+	return pt.id
+}
+
+func (pt PoolTrip) GetCabId() string {
+	return pt.cabId
+}
+
+func (pt PoolTrip) GetCapacity() int {
+	return pt.capacity
+}
+
+func (pt PoolTrip) GetStops() []PoolStop {
+	stops := make([]PoolStop, len(pt.stops))
+	copy(stops, pt.stops)
+	return stops
+}
+
+func (pt PoolTrip) GetVisitedStops() int {
+	return pt.visitedStops
+}
+
+// GetRideIds lists the riders in pickup order.
+func (pt PoolTrip) GetRideIds() []string {
+	rideIds := make([]string, 0, len(pt.seats))
+	for _, stop := range pt.stops {
+		if stop.Kind == PickupStop {
+			rideIds = append(rideIds, stop.RideId)
+		}
+	}
+	return rideIds
+}
+
+func (pt PoolTrip) stopIndex(rideId string, kind StopKind) int {
+	for i, stop := range pt.stops {
+		if stop.RideId == rideId && stop.Kind == kind {
+			return i
+		}
+	}
+	return -1
+}
+
+// visit moves the stop to the front of the remaining stops, since the driver
+// does not always keep to the planned order, and marks it made.
+func (pt *PoolTrip) visit(rideId string, kind StopKind) error {
+	index := pt.stopIndex(rideId, kind)
+	if index < 0 {
+		return ErrNotInPool
+	}
+	if index < pt.visitedStops {
+		return nil
+	}
+	stop := pt.stops[index]
+	copy(pt.stops[pt.visitedStops+1:index+1], pt.stops[pt.visitedStops:index])
+	pt.stops[pt.visitedStops] = stop
+	pt.visitedStops++
+	return nil
+}
+
+func (pt PoolTrip) isOver() bool {
+	return pt.visitedStops == len(pt.stops)
+}
+
+type PoolManager interface {
+	FindPoolCab(ride *Ride, excludedCabIds map[string]bool) *Cab
+	Join(ride *Ride, cabId string) error
+	Leave(rideId string) (tripOver bool)
+	MarkPickedUp(rideId string) error
+	MarkDropped(rideId string) (tripOver bool, err error)
+	GetTrip(rideId string) (*PoolTrip, error)
+	GetFareShare(rideId string) float64
+	GetPolicy() PoolPolicy
+}
+
+// InMemoryPoolManager matches pool riders into the trips of cabs already
+// serving a pool. A rider joins the trip, and the place in its route, that adds
+// the fewest kilometres while every rider stays within the detour limit and the
+// cab never carries more riders than it has seats.
+type InMemoryPoolManager struct {
+	cabRepo              ICabRepository
+	idGenerationStrategy IdGenerationStrategy
+	distanceCalculator   DistanceCalculator
+	policy               PoolPolicy
+	mu                   sync.Mutex
+	trips                map[string]*PoolTrip
+	tripIdByCabId        map[string]string
+	tripIdByRideId       map[string]string
+}
+
+func NewInMemoryPoolManager(cabRepo ICabRepository, idGenerationStrategy IdGenerationStrategy, distanceCalculator DistanceCalculator, policy PoolPolicy) PoolManager {
+	return &InMemoryPoolManager{
+		cabRepo:              cabRepo,
+		idGenerationStrategy: idGenerationStrategy,
+		distanceCalculator:   distanceCalculator,
+		policy:               policy,
+		trips:                make(map[string]*PoolTrip),
+		tripIdByCabId:        make(map[string]string),
+		tripIdByRideId:       make(map[string]string),
+	}
+}
+
+type poolInsertion struct {
+	stops   []PoolStop
+	addedKm float64
+}
+
+// FindPoolCab returns the busy cab whose trip the ride joins most cheaply, or
+// nil when no trip can take it.
+func (ipm *InMemoryPoolManager) FindPoolCab(ride *Ride, excludedCabIds map[string]bool) *Cab {
+	ipm.mu.Lock()
+	defer ipm.mu.Unlock()
+
+	var bestCab *Cab
+	var best *poolInsertion
+	for cabId, tripId := range ipm.tripIdByCabId {
+		if excludedCabIds[cabId] {
+			continue
+		}
+		cab := ipm.cabRepo.GetCabById(cabId)
+		if cab == nil || !ride.GetVehicleCategory().Matches(cab.GetCategory()) {
+			continue
+		}
+		insertion := ipm.planInsertion(ipm.trips[tripId], ride, cab)
+		if insertion != nil && (best == nil || insertion.addedKm < best.addedKm) {
+			bestCab, best = cab, insertion
+		}
+	}
+	return bestCab
+}
+
+// Join adds the ride to the trip of the cab, or starts a trip when the cab is
+// not serving a pool yet, in which case the cab is claimed like for a solo ride.
+func (ipm *InMemoryPoolManager) Join(ride *Ride, cabId string) error {
+	ipm.mu.Lock()
+	defer ipm.mu.Unlock()
+
+	if _, exists := ipm.tripIdByRideId[ride.GetId()]; exists {
+		return nil
+	}
+	tripId, exists := ipm.tripIdByCabId[cabId]
+	if !exists {
+		return ipm.startTrip(ride, cabId)
+	}
+	trip := ipm.trips[tripId]
+	cab := ipm.cabRepo.GetCabById(cabId)
+	if cab == nil {
+		return ErrCabNotFound
+	}
+	insertion := ipm.planInsertion(trip, ride, cab)
+	if insertion == nil {
+		return ErrPoolUnavailable
+	}
+	trip.stops = insertion.stops
+	trip.seats[ride.GetId()] = ride.GetSeats()
+	trip.directKm[ride.GetId()] = ipm.directKm(ride)
+	ipm.tripIdByRideId[ride.GetId()] = tripId
+	return nil
+}
+
+// startTrip offers the policy's seats, or fewer when the vehicle is smaller.
+func (ipm *InMemoryPoolManager) startTrip(ride *Ride, cabId string) error {
+	cab := ipm.cabRepo.GetCabById(cabId)
+	if cab == nil {
+		return ErrCabNotFound
+	}
+	capacity := min(ipm.policy.Capacity, cab.GetCategory().GetSeats())
+	if ride.GetSeats() > capacity {
+		return ErrPoolUnavailable
+	}
+	if err := ipm.cabRepo.ClaimCab(cabId); err != nil {
+		return err
+	}
+	pickup, drop := poolStops(ride)
+	trip := &PoolTrip{
+		id:       ipm.idGenerationStrategy.GenerateId(),
+		cabId:    cabId,
+		capacity: capacity,
+		stops:    []PoolStop{pickup, drop},
+		seats:    map[string]int{ride.GetId(): ride.GetSeats()},
+		directKm: map[string]float64{ride.GetId(): ipm.directKm(ride)},
+	}
+	ipm.trips[trip.id] = trip
+	ipm.tripIdByCabId[cabId] = trip.id
+	ipm.tripIdByRideId[ride.GetId()] = trip.id
+	return nil
+}
+
+// Leave takes a rider who has not been picked up out of their trip. It reports
+// whether that left the trip with nothing to do, so the caller frees the cab.
+func (ipm *InMemoryPoolManager) Leave(rideId string) bool {
+	ipm.mu.Lock()
+	defer ipm.mu.Unlock()
+
+	trip, exists := ipm.tripOf(rideId)
+	if !exists || trip.stopIndex(rideId, PickupStop) < trip.visitedStops {
+		return false
+	}
+	stops := make([]PoolStop, 0, len(trip.stops))
+	for _, stop := range trip.stops {
+		if stop.RideId != rideId {
+			stops = append(stops, stop)
+		}
+	}
+	trip.stops = stops
+	delete(trip.seats, rideId)
+	delete(trip.directKm, rideId)
+	delete(ipm.tripIdByRideId, rideId)
+	return ipm.endIfOver(trip)
+}
+
+func (ipm *InMemoryPoolManager) MarkPickedUp(rideId string) error {
+	ipm.mu.Lock()
+	defer ipm.mu.Unlock()
+
+	trip, exists := ipm.tripOf(rideId)
+	if !exists {
+		return ErrNotInPool
+	}
+	return trip.visit(rideId, PickupStop)
+}
+
+// MarkDropped reports whether the rider was the last one on the trip, in
+// which case the trip ends and the caller frees the cab.
+func (ipm *InMemoryPoolManager) MarkDropped(rideId string) (bool, error) {
+	ipm.mu.Lock()
+	defer ipm.mu.Unlock()
+
+	trip, exists := ipm.tripOf(rideId)
+	if !exists {
+		return false, ErrNotInPool
+	}
+	if err := trip.visit(rideId, PickupStop); err != nil {
+		return false, err
+	}
+	if err := trip.visit(rideId, DropStop); err != nil {
+		return false, err
+	}
+	return ipm.endIfOver(trip), nil
+}
+
+func (ipm *InMemoryPoolManager) GetTrip(rideId string) (*PoolTrip, error) {
+	ipm.mu.Lock()
+	defer ipm.mu.Unlock()
+
+	trip, exists := ipm.tripOf(rideId)
+	if !exists {
+		return nil, ErrNotInPool
+	}
+	return trip.clone(), nil
+}
+
+// GetFareShare is the share of the solo fare the rider pays. Every leg of the
+// route is split among the seats on board for it, so a rider pays for the
+// kilometres they rode alone in full and for shared ones in part. Riders not
+// matched into a trip yet are quoted the maximum share.
+func (ipm *InMemoryPoolManager) GetFareShare(rideId string) float64 {
+	ipm.mu.Lock()
+	defer ipm.mu.Unlock()
+
+	trip, exists := ipm.tripOf(rideId)
+	if !exists || trip.directKm[rideId] == 0 {
+		return ipm.policy.MaxFareShare
+	}
+	onBoard := seatsOnBoard(trip.stops, trip.seats)
+	pickup, drop := trip.stopIndex(rideId, PickupStop), trip.stopIndex(rideId, DropStop)
+	costKm := 0.0
+	for leg := pickup; leg < drop; leg++ {
+		costKm += ipm.legKm(trip.stops, leg) * float64(trip.seats[rideId]) / float64(onBoard[leg])
+	}
+	share := costKm / trip.directKm[rideId]
+	return math.Max(ipm.policy.MinFareShare, math.Min(ipm.policy.MaxFareShare, share))
+}
+
+func (ipm *InMemoryPoolManager) GetPolicy() PoolPolicy {
+	return ipm.policy
+}
+
+func (ipm *InMemoryPoolManager) tripOf(rideId string) (*PoolTrip, bool) {
+	tripId, exists := ipm.tripIdByRideId[rideId]
+	if !exists {
+		return nil, false
+	}
+	return ipm.trips[tripId], true
+}
+
+func (ipm *InMemoryPoolManager) endIfOver(trip *PoolTrip) bool {
+	if !trip.isOver() {
+		return false
+	}
+	delete(ipm.trips, trip.id)
+	delete(ipm.tripIdByCabId, trip.cabId)
+	for rideId, tripId := range ipm.tripIdByRideId {
+		if tripId == trip.id {
+			delete(ipm.tripIdByRideId, rideId)
+		}
+	}
+	return true
+}
+
+// planInsertion tries every place for the ride's pickup and drop among the
+// remaining stops, keeping the order of the stops already planned, and returns
+// the feasible one that adds the fewest kilometres to the route.
+func (ipm *InMemoryPoolManager) planInsertion(trip *PoolTrip, ride *Ride, cab *Cab) *poolInsertion {
+	seats := make(map[string]int, len(trip.seats)+1)
+	directKm := make(map[string]float64, len(trip.directKm)+1)
+	for rideId := range trip.seats {
+		seats[rideId] = trip.seats[rideId]
+		directKm[rideId] = trip.directKm[rideId]
+	}
+	seats[ride.GetId()] = ride.GetSeats()
+	directKm[ride.GetId()] = ipm.directKm(ride)
+
+	cabLat, cabLon := cab.GetCurrLocation()
+	currentKm := ipm.remainingKm(trip.stops, trip.visitedStops, cabLat, cabLon)
+	pickup, drop := poolStops(ride)
+	var best *poolInsertion
+	for pickupAt := trip.visitedStops; pickupAt <= len(trip.stops); pickupAt++ {
+		for dropAt := pickupAt; dropAt <= len(trip.stops); dropAt++ {
+			stops := make([]PoolStop, 0, len(trip.stops)+2)
+			stops = append(stops, trip.stops[:pickupAt]...)
+			stops = append(stops, pickup)
+			stops = append(stops, trip.stops[pickupAt:dropAt]...)
+			stops = append(stops, drop)
+			stops = append(stops, trip.stops[dropAt:]...)
+			if !ipm.isFeasible(stops, trip.visitedStops, pickupAt, trip.capacity, seats, directKm, cabLat, cabLon) {
+				continue
+			}
+			addedKm := ipm.remainingKm(stops, trip.visitedStops, cabLat, cabLon) - currentKm
+			if best == nil || addedKm < best.addedKm {
+				best = &poolInsertion{stops: stops, addedKm: addedKm}
+			}
+		}
+	}
+	return best
+}
+
+func (ipm *InMemoryPoolManager) isFeasible(stops []PoolStop, visitedStops, pickupAt, capacity int, seats map[string]int, directKm map[string]float64, cabLat, cabLon float64) bool {
+	for _, onBoard := range seatsOnBoard(stops, seats) {
+		if onBoard > capacity {
+			return false
+		}
+	}
+	if ipm.policy.MaxPickupDistanceKm > 0 {
+		approachKm := ipm.remainingKm(stops[:pickupAt+1], visitedStops, cabLat, cabLon)
+		if approachKm > ipm.policy.MaxPickupDistanceKm {
+			return false
+		}
+	}
+	pickups := make(map[string]int, len(seats))
+	for i, stop := range stops {
+		if stop.Kind == PickupStop {
+			pickups[stop.RideId] = i
+			continue
+		}
+		if i < visitedStops {
+			continue
+		}
+		inCabKm := 0.0
+		for leg := pickups[stop.RideId]; leg < i; leg++ {
+			inCabKm += ipm.legKm(stops, leg)
+		}
+		if inCabKm > directKm[stop.RideId]*(1+ipm.policy.MaxDetourFactor)+1e-9 {
+			return false
+		}
+	}
+	return true
+}
+
+// remainingKm is the distance from the cab through the stops not made yet.
+func (ipm *InMemoryPoolManager) remainingKm(stops []PoolStop, visitedStops int, cabLat, cabLon float64) float64 {
+	if visitedStops >= len(stops) {
+		return 0
+	}
+	km := ipm.distanceCalculator.Distance(cabLat, cabLon, stops[visitedStops].Lat, stops[visitedStops].Lon)
+	for leg := visitedStops; leg < len(stops)-1; leg++ {
+		km += ipm.legKm(stops, leg)
+	}
+	return km
+}
+
+func (ipm *InMemoryPoolManager) legKm(stops []PoolStop, leg int) float64 {
+	return ipm.distanceCalculator.Distance(stops[leg].Lat, stops[leg].Lon, stops[leg+1].Lat, stops[leg+1].Lon)
+}
+
+func (ipm *InMemoryPoolManager) directKm(ride *Ride) float64 {
+	startPointLat, startPointLon := ride.GetStartPoint()
+	endPointLat, endPointLon := ride.GetEndPoint()
+	return ipm.distanceCalculator.Distance(startPointLat, startPointLon, endPointLat, endPointLon)
+}
+
+func poolStops(ride *Ride) (PoolStop, PoolStop) {
+	startPointLat, startPointLon := ride.GetStartPoint()
+	endPointLat, endPointLon := ride.GetEndPoint()
+	return PoolStop{RideId: ride.GetId(), Kind: PickupStop, Lat: startPointLat, Lon: startPointLon},
+		PoolStop{RideId: ride.GetId(), Kind: DropStop, Lat: endPointLat, Lon: endPointLon}
+}
+
+// seatsOnBoard returns, for every leg of the route, the seats taken while the
+// cab drives from stop i to stop i+1.
+func seatsOnBoard(stops []PoolStop, seats map[string]int) []int {
+	onBoard := make([]int, max(0, len(stops)-1))
+	taken := 0
+	for i := 0; i < len(onBoard); i++ {
+		if stops[i].Kind == PickupStop {
+			taken += seats[stops[i].RideId]
+		} else {
+			taken -= seats[stops[i].RideId]
+		}
+		onBoard[i] = taken
+	}
+	return onBoard
+}
@@ -0,0 +1,376 @@
+package src
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Promotion is a discount riders get by booking with its code. Zero limits,
+// zero validity bounds and an empty zone list put no restriction on it.
+type Promotion struct {
+	Code string
+	Kind PromotionKind
+	// Value is the percentage taken off for PercentageDiscount promotions and
+	// the amount taken off for FlatDiscount ones.
+	Value int
+	// MaxDiscount caps what a percentage discount takes off one ride.
+	MaxDiscount   int
+	FirstRideOnly bool
+	PerUserLimit  int
+	TotalLimit    int
+	ValidFrom     time.Time
+	ValidUntil    time.Time
+	// ZoneIds are the zones, as the zone resolver names them, that the pickup
+	// has to be in.
+	ZoneIds []string
+	// ReferrerId is set on referral codes. The referrer is rewarded when a rider
+	// completes their first ride with the code.
+	ReferrerId string
+	CreatedAt  time.Time
+}
+
+func (p *Promotion) String() string {
+	return fmt.Sprintf("{Code: %s, Kind: %v, Value: %d, MaxDiscount: %d}", p.Code, p.Kind, p.Value, p.MaxDiscount)
+}
+
+func (p *Promotion) clone() *Promotion {
+	clone := *p
+	clone.ZoneIds = slices.Clone(p.ZoneIds)
+	return &clone
+}
+
+// IsActive reports whether the code can be booked with at the time. ValidUntil
+// is exclusive.
+func (p Promotion) IsActive(at time.Time) bool {
+	return !at.Before(p.ValidFrom) && (p.ValidUntil.IsZero() || at.Before(p.ValidUntil))
+}
+
+// Discount is what the promotion takes off a fare of amount, never more than
+// the fare itself.
+func (p Promotion) Discount(amount int) int {
+	discount := p.Value
+	if p.Kind == PercentageDiscount {
+		discount = int(math.Round(float64(amount) * float64(p.Value) / 100))
+		if p.MaxDiscount > 0 {
+			discount = min(discount, p.MaxDiscount)
+		}
+	}
+	return max(0, min(discount, amount))
+}
+
+func (p Promotion) validate() error {
+	if p.Code == "" || strings.ContainsFunc(p.Code, func(r rune) bool { return r == ' ' || r == '\t' }) {
+		return fmt.Errorf("%w: code %q must be one word", ErrInvalidPromotion, p.Code)
+	}
+	switch p.Kind {
+	case PercentageDiscount:
+		if p.Value < 1 || p.Value > 100 {
+			return fmt.Errorf("%w: a percentage must be between 1 and 100, got %d", ErrInvalidPromotion, p.Value)
+		}
+	case FlatDiscount:
+		if p.Value < 1 {
+			return fmt.Errorf("%w: a flat discount must be positive, got %d", ErrInvalidPromotion, p.Value)
+		}
+	default:
+		return fmt.Errorf("%w: %d", ErrUnknownPromotionKind, p.Kind)
+	}
+	if p.MaxDiscount < 0 || p.PerUserLimit < 0 || p.TotalLimit < 0 {
+		return fmt.Errorf("%w: caps and limits cannot be negative", ErrInvalidPromotion)
+	}
+	if !p.ValidUntil.IsZero() && !p.ValidUntil.After(p.ValidFrom) {
+		return fmt.Errorf("%w: it has to end after it starts", ErrInvalidPromotion)
+	}
+	return nil
+}
+
+// normalisePromoCode makes codes case insensitive.
+func normalisePromoCode(code string) string {
+	return strings.ToUpper(strings.TrimSpace(code))
+}
+
+// PromoRedemption is one use of a promo code. It is reserved when the ride is
+// booked and redeemed or released once the ride ends.
+type PromoRedemption struct {
+	Id     string
+	Code   string
+	UserId string
+	// RideId is empty for the moment between reserving the code and booking
+	// the ride with it.
+	RideId string
+	Status RedemptionStatus
+	// Discount is what the rider saved on the final fare of a redeemed ride.
+	Discount   int
+	ReservedAt time.Time
+	UpdatedAt  time.Time
+}
+
+func (pr PromoRedemption) String() string {
+	return fmt.Sprintf("{Code: %s, UserId: %s, RideId: %s, Status: %v, Discount: %d}", pr.Code, pr.UserId, pr.RideId, pr.Status, pr.Discount)
+}
+
+func (pr *PromoRedemption) redeem(discount int, at time.Time) {
+	pr.Status = RedemptionRedeemed
+	pr.Discount = discount
+	pr.UpdatedAt = at
+}
+
+func (pr *PromoRedemption) release(at time.Time) {
+	pr.Status = RedemptionReleased
+	pr.UpdatedAt = at
+}
+
+type PromotionPolicy struct {
+	// A referral code takes ReferralDiscount off the referred rider's first
+	// ride, and the referrer gets ReferralReward in their wallet once that
+	// ride is completed.
+	ReferralDiscount int
+	ReferralReward   int
+}
+
+type PromotionManager interface {
+	CreatePromotion(promotion Promotion) (*Promotion, error)
+	GetPromotion(code string) (*Promotion, error)
+	// GetReferralCode returns the rider's referral promotion, which is created
+	// the first time they ask for it.
+	GetReferralCode(userId string) (*Promotion, error)
+	// Reserve checks the code for a booking by the rider from the pickup point
+	// and holds one use of it until the ride ends. The limits are checked and
+	// the use recorded in one step, so racing bookings cannot go past them.
+	Reserve(code, userId string, pickupLat, pickupLon float64) (*PromoRedemption, error)
+	// AttachRide ties a reservation to the ride booked with it.
+	AttachRide(redemptionId, rideId string) error
+	// Release gives back a reservation whose ride could not be booked.
+	Release(redemptionId string) error
+	GetRedemptions(userId string) ([]PromoRedemption, error)
+	GetPolicy() PromotionPolicy
+}
+
+// ReservingPromotionManager follows rides on the event bus: a completed ride
+// redeems its reservation and a ride that ends any other way releases it, so
+// the use counts again towards the code's limits.
+type ReservingPromotionManager struct {
+	promotionRepo        IPromotionRepository
+	userRepo             IUserRepository
+	rideRepo             IRideRegistory
+	paymentProcessor     PaymentProcessor
+	zoneResolver         ZoneResolver
+	idGenerationStrategy IdGenerationStrategy
+	eventBus             EventBus
+	clock                Clock
+	policy               PromotionPolicy
+	// referralMu keeps two first requests for a rider's referral code from
+	// creating two codes.
+	referralMu sync.Mutex
+}
+
+func NewReservingPromotionManager(promotionRepo IPromotionRepository, userRepo IUserRepository, rideRepo IRideRegistory, paymentProcessor PaymentProcessor, zoneResolver ZoneResolver, idGenerationStrategy IdGenerationStrategy, eventBus EventBus, clock Clock, policy PromotionPolicy) PromotionManager {
+	rpm := &ReservingPromotionManager{
+		promotionRepo:        promotionRepo,
+		userRepo:             userRepo,
+		rideRepo:             rideRepo,
+		paymentProcessor:     paymentProcessor,
+		zoneResolver:         zoneResolver,
+		idGenerationStrategy: idGenerationStrategy,
+		eventBus:             eventBus,
+		clock:                clock,
+		policy:               policy,
+	}
+	eventBus.Subscribe(rpm)
+	return rpm
+}
+
+func (rpm *ReservingPromotionManager) CreatePromotion(promotion Promotion) (*Promotion, error) {
+	promotion.Code = normalisePromoCode(promotion.Code)
+	if promotion.ReferrerId != "" {
+		return nil, fmt.Errorf("%w: referral codes are handed out to riders", ErrInvalidPromotion)
+	}
+	if err := promotion.validate(); err != nil {
+		return nil, err
+	}
+	promotion.ZoneIds = slices.Clone(promotion.ZoneIds)
+	promotion.CreatedAt = rpm.clock.Now()
+	if err := rpm.promotionRepo.SavePromotion(&promotion); err != nil {
+		return nil, err
+	}
+	return promotion.clone(), nil
+}
+
+func (rpm *ReservingPromotionManager) GetPromotion(code string) (*Promotion, error) {
+	promotion := rpm.promotionRepo.GetPromotion(normalisePromoCode(code))
+	if promotion == nil {
+		return nil, ErrPromoNotFound
+	}
+	return promotion, nil
+}
+
+func (rpm *ReservingPromotionManager) GetReferralCode(userId string) (*Promotion, error) {
+	if rpm.userRepo.GetUserById(userId) == nil {
+		return nil, ErrUserNotFound
+	}
+	rpm.referralMu.Lock()
+	defer rpm.referralMu.Unlock()
+	if promotion := rpm.promotionRepo.GetReferralPromotion(userId); promotion != nil {
+		return promotion, nil
+	}
+	var err error
+	// A clash with an existing code is unlikely, and a fresh id is enough to
+	// get past it.
+	for attempt := 0; attempt < 3; attempt++ {
+		promotion := &Promotion{
+			Code:          "REF" + referralSuffix(rpm.idGenerationStrategy.GenerateId()),
+			Kind:          FlatDiscount,
+			Value:         rpm.policy.ReferralDiscount,
+			FirstRideOnly: true,
+			PerUserLimit:  1,
+			ReferrerId:    userId,
+			CreatedAt:     rpm.clock.Now(),
+		}
+		if err = promotion.validate(); err != nil {
+			return nil, err
+		}
+		if err = rpm.promotionRepo.SavePromotion(promotion); err == nil {
+			return promotion.clone(), nil
+		}
+		if !errors.Is(err, ErrPromoCodeTaken) {
+			return nil, err
+		}
+	}
+	return nil, err
+}
+
+// referralSuffix takes the first eight letters and digits of an id.
+func referralSuffix(id string) string {
+	suffix := make([]rune, 0, 8)
+	for _, r := range strings.ToUpper(id) {
+		if (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') {
+			suffix = append(suffix, r)
+		}
+		if len(suffix) == cap(suffix) {
+			break
+		}
+	}
+	return string(suffix)
+}
+
+func (rpm *ReservingPromotionManager) Reserve(code, userId string, pickupLat, pickupLon float64) (*PromoRedemption, error) {
+	promotion, err := rpm.GetPromotion(code)
+	if err != nil {
+		return nil, err
+	}
+	now := rpm.clock.Now()
+	if !promotion.IsActive(now) {
+		return nil, fmt.Errorf("%w: %s", ErrPromoNotActive, promotion.Code)
+	}
+	if len(promotion.ZoneIds) > 0 {
+		if zoneId := rpm.zoneResolver.ResolveZone(pickupLat, pickupLon).GetId(); !slices.Contains(promotion.ZoneIds, zoneId) {
+			return nil, fmt.Errorf("%w: %s is not valid for pickups in %s", ErrPromoNotApplicable, promotion.Code, zoneId)
+		}
+	}
+	if promotion.ReferrerId == userId {
+		return nil, fmt.Errorf("%w: riders cannot use their own referral code", ErrPromoNotApplicable)
+	}
+	redemption := &PromoRedemption{
+		Id:         rpm.idGenerationStrategy.GenerateId(),
+		Code:       promotion.Code,
+		UserId:     userId,
+		Status:     RedemptionReserved,
+		ReservedAt: now,
+		UpdatedAt:  now,
+	}
+	if err := rpm.promotionRepo.ReserveRedemption(promotion, redemption, rpm.hasTakenRide); err != nil {
+		return nil, err
+	}
+	return redemption, nil
+}
+
+// hasTakenRide counts every ride the rider booked that did not fall through,
+// including the ones still under way.
+func (rpm *ReservingPromotionManager) hasTakenRide(userId string) bool {
+	for _, ride := range rpm.rideRepo.TotalRideForUser(userId) {
+		if ride.GetStatus() != Canceled && ride.GetStatus() != NoCabFound {
+			return true
+		}
+	}
+	return false
+}
+
+func (rpm *ReservingPromotionManager) AttachRide(redemptionId, rideId string) error {
+	_, err := rpm.promotionRepo.UpdateRedemption(redemptionId, func(redemption *PromoRedemption) error {
+		redemption.RideId = rideId
+		return nil
+	})
+	return err
+}
+
+func (rpm *ReservingPromotionManager) Release(redemptionId string) error {
+	now := rpm.clock.Now()
+	_, err := rpm.promotionRepo.UpdateRedemption(redemptionId, func(redemption *PromoRedemption) error {
+		redemption.release(now)
+		return nil
+	})
+	return err
+}
+
+func (rpm *ReservingPromotionManager) GetRedemptions(userId string) ([]PromoRedemption, error) {
+	if rpm.userRepo.GetUserById(userId) == nil {
+		return nil, ErrUserNotFound
+	}
+	return rpm.promotionRepo.FindRedemptionsForUser(userId), nil
+}
+
+func (rpm *ReservingPromotionManager) GetPolicy() PromotionPolicy {
+	return rpm.policy
+}
+
+func (rpm *ReservingPromotionManager) GetName() string {
+	return "promotion-manager"
+}
+
+func (rpm *ReservingPromotionManager) HandleEvent(event RideEvent) error {
+	if event.Type != RideCompleted && event.Type != RideCanceled && event.Type != RideNoCabFound {
+		return nil
+	}
+	reserved := rpm.promotionRepo.GetRedemptionForRide(event.RideId)
+	if reserved == nil {
+		return nil
+	}
+	ride := rpm.rideRepo.GetRideById(event.RideId)
+	if ride == nil {
+		return ErrRideNotFound
+	}
+	now := rpm.clock.Now()
+	redeemed := false
+	redemption, err := rpm.promotionRepo.UpdateRedemption(reserved.Id, func(redemption *PromoRedemption) error {
+		if redemption.Status != RedemptionReserved {
+			return nil
+		}
+		if event.Type != RideCompleted {
+			redemption.release(now)
+			return nil
+		}
+		discount := 0
+		if finalFare := ride.GetFinalFare(); finalFare != nil {
+			discount = finalFare.PromoDiscount
+		}
+		redemption.redeem(discount, now)
+		redeemed = true
+		return nil
+	})
+	if err != nil || !redeemed {
+		return err
+	}
+	promotion := rpm.promotionRepo.GetPromotion(redemption.Code)
+	if promotion == nil || promotion.ReferrerId == "" || rpm.policy.ReferralReward <= 0 {
+		return nil
+	}
+	if _, err := rpm.paymentProcessor.RewardReferral(promotion.ReferrerId, ride.GetId(), rpm.policy.ReferralReward); err != nil {
+		return err
+	}
+	rpm.eventBus.Publish(RideEvent{Type: ReferralRewarded, RideId: ride.GetId(), UserId: promotion.ReferrerId, Amount: rpm.policy.ReferralReward, OccurredAt: rpm.clock.Now()})
+	return nil
+}
@@ -0,0 +1,231 @@
+package src
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	minStars         = 1
+	maxStars         = 5
+	maxRatingTagSize = 32
+)
+
+type Rating struct {
+	rideId      string
+	author      RatingAuthor
+	raterId     string
+	subjectId   string
+	stars       int
+	tags        []string
+	submittedAt time.Time
+}
+
+func NewRating(rideId string, author RatingAuthor, raterId, subjectId string, stars int, tags []string, submittedAt time.Time) *Rating {
+	return &Rating{
+		rideId:      rideId,
+		author:      author,
+		raterId:     raterId,
+		subjectId:   subjectId,
+		stars:       stars,
+		tags:        tags,
+		submittedAt: submittedAt,
+	}
+}
+
+func (r *Rating) String() string {
+	return fmt.Sprintf("{RideId: %s, By: %v, Stars: %d, Tags: %v}", r.rideId, r.author, r.stars, r.tags)
+}
+
+func (r *Rating) clone() *Rating {
+	clone := *r
+	clone.tags = r.GetTags()
+	return &clone
+}
+
+func (r Rating) GetRideId() string {
+	return r.rideId
+}
+
+func (r Rating) GetAuthor() RatingAuthor {
+	return r.author
+}
+
+// GetRaterId is the user id of a rider or the cab id of a driver.
+func (r Rating) GetRaterId() string {
+	return r.raterId
+}
+
+// GetSubjectId is the cab id when a rider rated the driver and the user id
+// when the driver rated the rider.
+func (r Rating) GetSubjectId() string {
+	return r.subjectId
+}
+
+func (r Rating) GetStars() int {
+	return r.stars
+}
+
+func (r Rating) GetTags() []string {
+	tags := make([]string, len(r.tags))
+	copy(tags, r.tags)
+	return tags
+}
+
+func (r Rating) GetSubmittedAt() time.Time {
+	return r.submittedAt
+}
+
+type RatingPolicy struct {
+	// SubmissionWindow is how long after the drop a ride can be rated.
+	SubmissionWindow time.Duration
+	// RollingWindow is the number of latest ratings a rolling average covers.
+	RollingWindow int
+	// Drivers whose rolling average falls below ReviewThreshold, once they have
+	// at least MinRatingsForReview ratings, are flagged for review.
+	ReviewThreshold     float64
+	MinRatingsForReview int
+	MaxTags             int
+}
+
+type RatingManager interface {
+	RateDriver(rideId, userId string, stars int, tags []string) (*Rating, error)
+	RateRider(rideId, cabId string, stars int, tags []string) (*Rating, error)
+	GetRideRatings(rideId string) ([]Rating, error)
+}
+
+// PostRideRatingManager takes one rating from each side of a completed ride
+// and keeps the rolling averages on the rated cab or user up to date.
+type PostRideRatingManager struct {
+	ratingRepo IRatingRepository
+	userRepo   IUserRepository
+	cabRepo    ICabRepository
+	rideRepo   IRideRegistory
+	eventBus   EventBus
+	clock      Clock
+	policy     RatingPolicy
+	// mu orders the save and the average that follows it, so two ratings for
+	// the same driver cannot each write an average missing the other.
+	mu sync.Mutex
+}
+
+func NewPostRideRatingManager(ratingRepo IRatingRepository, userRepo IUserRepository, cabRepo ICabRepository, rideRepo IRideRegistory, eventBus EventBus, clock Clock, policy RatingPolicy) RatingManager {
+	return &PostRideRatingManager{
+		ratingRepo: ratingRepo,
+		userRepo:   userRepo,
+		cabRepo:    cabRepo,
+		rideRepo:   rideRepo,
+		eventBus:   eventBus,
+		clock:      clock,
+		policy:     policy,
+	}
+}
+
+func (prm *PostRideRatingManager) RateDriver(rideId, userId string, stars int, tags []string) (*Rating, error) {
+	return prm.rate(rideId, RatedByRider, userId, stars, tags)
+}
+
+func (prm *PostRideRatingManager) RateRider(rideId, cabId string, stars int, tags []string) (*Rating, error) {
+	return prm.rate(rideId, RatedByDriver, cabId, stars, tags)
+}
+
+func (prm *PostRideRatingManager) rate(rideId string, author RatingAuthor, raterId string, stars int, tags []string) (*Rating, error) {
+	ride := prm.rideRepo.GetRideById(rideId)
+	if ride == nil {
+		return nil, ErrRideNotFound
+	}
+	subjectId := ride.GetCabId()
+	if author == RatedByDriver {
+		subjectId = ride.GetUserId()
+	}
+	if (author == RatedByRider && raterId != ride.GetUserId()) || (author == RatedByDriver && raterId != ride.GetCabId()) {
+		return nil, ErrNotRideParticipant
+	}
+	completedAt, completed := ride.GetTransitionTime(Completed)
+	if !completed {
+		return nil, ErrRideNotCompleted
+	}
+	now := prm.clock.Now()
+	if now.After(completedAt.Add(prm.policy.SubmissionWindow)) {
+		return nil, ErrRatingWindowClosed
+	}
+	if stars < minStars || stars > maxStars {
+		return nil, fmt.Errorf("%w: %d stars", ErrInvalidRating, stars)
+	}
+	tags, err := prm.normalizeTags(tags)
+	if err != nil {
+		return nil, err
+	}
+
+	prm.mu.Lock()
+	defer prm.mu.Unlock()
+	rating := NewRating(rideId, author, raterId, subjectId, stars, tags, now)
+	if err := prm.ratingRepo.SaveRating(rating); err != nil {
+		return nil, err
+	}
+	average := prm.rollingAverage(author, subjectId)
+	if author == RatedByDriver {
+		prm.userRepo.UpdateUser(subjectId, func(user *User) error {
+			user.SetRating(average, user.GetRatingCount()+1)
+			return nil
+		})
+		return rating.clone(), nil
+	}
+
+	wasFlagged := false
+	cab, err := prm.cabRepo.UpdateCab(subjectId, func(cab *Cab) error {
+		wasFlagged = cab.IsFlaggedForReview()
+		cab.SetRating(average, cab.GetRatingCount()+1)
+		// The flag follows the rolling average, so a driver whose ratings
+		// recover drops out of review again.
+		cab.SetFlaggedForReview(cab.GetRatingCount() >= prm.policy.MinRatingsForReview && average < prm.policy.ReviewThreshold)
+		return nil
+	})
+	if err == nil && cab.IsFlaggedForReview() && !wasFlagged {
+		prm.eventBus.Publish(newRideEvent(CabFlaggedForReview, ride, prm.clock.Now()))
+	}
+	return rating.clone(), nil
+}
+
+func (prm *PostRideRatingManager) rollingAverage(author RatingAuthor, subjectId string) float64 {
+	recent := prm.ratingRepo.FindRecentRatings(author, subjectId, prm.policy.RollingWindow)
+	if len(recent) == 0 {
+		return 0
+	}
+	total := 0
+	for _, rating := range recent {
+		total += rating.GetStars()
+	}
+	return float64(total) / float64(len(recent))
+}
+
+// normalizeTags lowercases the feedback tags and drops blanks and repeats, so
+// "Polite" and "polite " count as the same tag.
+func (prm *PostRideRatingManager) normalizeTags(tags []string) ([]string, error) {
+	normalized := make([]string, 0, len(tags))
+	seen := make(map[string]bool, len(tags))
+	for _, tag := range tags {
+		tag = strings.ToLower(strings.TrimSpace(tag))
+		if tag == "" || seen[tag] {
+			continue
+		}
+		if len(tag) > maxRatingTagSize {
+			return nil, fmt.Errorf("%w: tag %q is longer than %d characters", ErrInvalidRating, tag, maxRatingTagSize)
+		}
+		seen[tag] = true
+		normalized = append(normalized, tag)
+	}
+	if len(normalized) > prm.policy.MaxTags {
+		return nil, fmt.Errorf("%w: at most %d tags", ErrInvalidRating, prm.policy.MaxTags)
+	}
+	return normalized, nil
+}
+
+func (prm *PostRideRatingManager) GetRideRatings(rideId string) ([]Rating, error) {
+	if prm.rideRepo.GetRideById(rideId) == nil {
+		return nil, ErrRideNotFound
+	}
+	return prm.ratingRepo.FindRatingsForRide(rideId), nil
+}
@@ -1,28 +1,113 @@
 package src
 
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Repositories hand out copies of the stored entities. Every change goes through
+// a repository method so that it is applied under the repository lock.
+
 type IUserRepository interface {
-	CreateUser(name string) *User
+	CreateUser(name string) (*User, error)
 	GetUserById(id string) *User
+	UpdateUser(id string, update func(user *User) error) (*User, error)
 }
 
 type ICabRepository interface {
-	CreateCab(name string) *Cab
+	CreateCab(name string, category VehicleCategory) (*Cab, error)
 	FindAvailableCabs() []Cab
+	FindNearestAvailableCabs(lat, lon float64, k int, category VehicleCategory) []Cab
+	FindAvailableCabsWithinRadius(lat, lon, radiusKm float64) []Cab
+	CountAvailableCabsInZone(zone Zone) int
 	UpdateCabStatus(id string, newStatus CabStatus) error
 	UpdateCabLocation(id string, lat, lon float64) error
+	ClaimCab(id string) error
+	UpdateCab(id string, update func(cab *Cab) error) (*Cab, error)
 	GetCabById(id string) *Cab
 }
 
 type IRideRegistory interface {
-	CreateRide(userId string, startPointLat, startPointLon, endPointLat, endPointLon float64) *Ride
+	CreateRide(userId string, startPointLat, startPointLon, endPointLat, endPointLon float64) (*Ride, error)
+	CreateScheduledRide(userId string, startPointLat, startPointLon, endPointLat, endPointLon float64, pickupAt time.Time) (*Ride, error)
 	UpdateRideStatus(id string, newStatus RideStatus) error
+	AssignCab(id string, cabId string) error
+	UpdateRide(id string, update func(ride *Ride) error) (*Ride, error)
 	GetRideById(id string) *Ride
 	TotalRideForUser(userId string) []Ride
+	QueryRides(query RideQuery) (*RidePage, error)
+	FindScheduledRidesDueBy(pickupBy time.Time) []Ride
+	FindOpenRides() []Ride
+	CountOpenRidesInZone(zone Zone) int
+}
+
+type IRatingRepository interface {
+	SaveRating(rating *Rating) error
+	FindRatingsForRide(rideId string) []Rating
+	FindRecentRatings(author RatingAuthor, subjectId string, limit int) []Rating
+}
+
+type IPaymentRepository interface {
+	SavePaymentMethod(method *PaymentMethod) error
+	GetPaymentMethodById(id string) *PaymentMethod
+	FindPaymentMethods(userId string) []PaymentMethod
+	SetDefaultPaymentMethod(userId, methodId string) error
+	SavePayment(payment *Payment) error
+	UpdatePayment(id string, update func(payment *Payment) error) (*Payment, error)
+	GetPaymentForRide(rideId string) *Payment
+	FindPaymentsForUser(userId string, status PaymentStatus) []Payment
+}
+
+// ILedgerRepository only ever appends, so the ledger is a full history of the
+// money that moved.
+type ILedgerRepository interface {
+	AppendEntry(entry LedgerEntry) error
+	FindEntriesForUser(userId string) []LedgerEntry
+	GetBalance(userId string) RiderBalance
+}
+
+// IPromotionRepository counts the uses of a code and records a new one in one
+// step, so limits hold however many bookings race for the last use.
+type IPromotionRepository interface {
+	SavePromotion(promotion *Promotion) error
+	GetPromotion(code string) *Promotion
+	GetReferralPromotion(referrerId string) *Promotion
+	// ReserveRedemption records the redemption unless the promotion's limits
+	// rule it out or, for a first ride offer, the rider holds another one or
+	// hasTakenRide says they have ridden. All of it is checked under one lock,
+	// so overlapping bookings cannot both claim a rider's first ride. Released
+	// redemptions do not count.
+	ReserveRedemption(promotion *Promotion, redemption *PromoRedemption, hasTakenRide func(userId string) bool) error
+	UpdateRedemption(id string, update func(redemption *PromoRedemption) error) (*PromoRedemption, error)
+	GetRedemptionForRide(rideId string) *PromoRedemption
+	FindRedemptionsForUser(userId string) []PromoRedemption
+}
+
+// IEarningsRepository keeps the drivers' earnings and shift changes, both only
+// ever appended to.
+type IEarningsRepository interface {
+	// AppendEarning fails with ErrEarningAlreadyRecorded for a second ride
+	// earning from the same ride.
+	AppendEarning(entry EarningEntry) error
+	// FindEarnings returns the cab's entries made from from up to to, in the
+	// order they were made.
+	FindEarnings(cabId string, from, to time.Time) []EarningEntry
+	FindPayoutBatch(batchId string) []EarningEntry
+	GetEarningsBalance(cabId string) int
+	GetEarningsBalances() map[string]int
+	RecordShiftChange(change ShiftChange) error
+	GetLastShiftChange(cabId string) *ShiftChange
+	// FindShiftChanges returns the cab's changes from from up to to, after the
+	// last change before from so the shift the period started in is known.
+	FindShiftChanges(cabId string, from, to time.Time) []ShiftChange
 }
 
 type UserRepository struct {
 	idGenerationStrategy IdGenerationStrategy
 	userMap              map[string]*User
+	mu                   sync.RWMutex
 }
 
 func NewUserRepository(idGenerationStrategy IdGenerationStrategy) IUserRepository {
@@ -32,36 +117,63 @@ func NewUserRepository(idGenerationStrategy IdGenerationStrategy) IUserRepositor
 	}
 }
 
-func (ur *UserRepository) CreateUser(name string) *User {
+func (ur *UserRepository) CreateUser(name string) (*User, error) {
+	ur.mu.Lock()
+	defer ur.mu.Unlock()
 	newUser := NewUser(ur.idGenerationStrategy.GenerateId(), name)
 	ur.userMap[newUser.GetId()] = newUser
-	return newUser
+	return newUser.clone(), nil
 }
-func (ur UserRepository) GetUserById(id string) *User {
+func (ur *UserRepository) GetUserById(id string) *User {
+	ur.mu.RLock()
+	defer ur.mu.RUnlock()
 	if user, exists := ur.userMap[id]; exists {
-		return user
+		return user.clone()
 	}
 	return nil
 }
+func (ur *UserRepository) UpdateUser(id string, update func(user *User) error) (*User, error) {
+	ur.mu.Lock()
+	defer ur.mu.Unlock()
+	user, exists := ur.userMap[id]
+	if !exists {
+		return nil, ErrUserNotFound
+	}
+	updated := user.clone()
+	if err := update(updated); err != nil {
+		return nil, err
+	}
+	ur.userMap[id] = updated
+	return updated.clone(), nil
+}
 
 type CabRepository struct {
 	idGenerationStrategy IdGenerationStrategy
 	cabMap               map[string]*Cab
+	cabLocationIndex     GeoIndex
+	mu                   sync.RWMutex
 }
 
-func NewCabRepository(idGenerationStrategy IdGenerationStrategy) ICabRepository {
+func NewCabRepository(idGenerationStrategy IdGenerationStrategy, cabLocationIndex GeoIndex) ICabRepository {
 	return &CabRepository{
 		idGenerationStrategy: idGenerationStrategy,
 		cabMap:               make(map[string]*Cab),
+		cabLocationIndex:     cabLocationIndex,
 	}
 }
 
-func (cr *CabRepository) CreateCab(name string) *Cab {
-	newCab := NewCab(cr.idGenerationStrategy.GenerateId(), name)
+func (cr *CabRepository) CreateCab(name string, category VehicleCategory) (*Cab, error) {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	newCab := NewCab(cr.idGenerationStrategy.GenerateId(), name, category)
 	cr.cabMap[newCab.GetId()] = newCab
-	return newCab
+	cabLat, cabLon := newCab.GetCurrLocation()
+	cr.cabLocationIndex.Upsert(newCab.GetId(), cabLat, cabLon)
+	return newCab.clone(), nil
 }
 func (cr *CabRepository) FindAvailableCabs() []Cab {
+	cr.mu.RLock()
+	defer cr.mu.RUnlock()
 	cabs := make([]Cab, 0)
 	for _, cab := range cr.cabMap {
 		if cab.GetCabStatus() == ReadyToTakeRide {
@@ -70,60 +182,720 @@ func (cr *CabRepository) FindAvailableCabs() []Cab {
 	}
 	return cabs
 }
-func (cr *CabRepository) UpdateCabStatus(id string, newStatus CabStatus) error {
-	if cab, exists := cr.cabMap[id]; exists {
-		cab.SetCabStatus(newStatus)
+
+// FindNearestAvailableCabs returns up to k available cabs that match the
+// category, nearest first.
+func (cr *CabRepository) FindNearestAvailableCabs(lat, lon float64, k int, category VehicleCategory) []Cab {
+	cr.mu.RLock()
+	defer cr.mu.RUnlock()
+	return cr.cabsFromIndexResults(cr.cabLocationIndex.Nearest(lat, lon, k, func(id string) bool {
+		return cr.isCabAvailable(id) && category.Matches(cr.cabMap[id].GetCategory())
+	}))
+}
+func (cr *CabRepository) FindAvailableCabsWithinRadius(lat, lon, radiusKm float64) []Cab {
+	cr.mu.RLock()
+	defer cr.mu.RUnlock()
+	return cr.cabsFromIndexResults(cr.cabLocationIndex.WithinRadius(lat, lon, radiusKm, cr.isCabAvailable))
+}
+func (cr *CabRepository) CountAvailableCabsInZone(zone Zone) int {
+	cr.mu.RLock()
+	defer cr.mu.RUnlock()
+	count := 0
+	for _, result := range cr.cabLocationIndex.WithinBounds(zone.GetBounds(), cr.isCabAvailable) {
+		if zone.Contains(result.Lat, result.Lon) {
+			count++
+		}
 	}
-	return nil
+	return count
+}
+func (cr *CabRepository) isCabAvailable(id string) bool {
+	cab, exists := cr.cabMap[id]
+	return exists && cab.GetCabStatus() == ReadyToTakeRide
+}
+func (cr *CabRepository) cabsFromIndexResults(results []GeoIndexResult) []Cab {
+	cabs := make([]Cab, 0, len(results))
+	for _, result := range results {
+		cabs = append(cabs, *cr.cabMap[result.Id])
+	}
+	return cabs
+}
+func (cr *CabRepository) UpdateCabStatus(id string, newStatus CabStatus) error {
+	_, err := cr.UpdateCab(id, func(cab *Cab) error {
+		return cab.SetCabStatus(newStatus)
+	})
+	return err
 }
 func (cr *CabRepository) UpdateCabLocation(id string, lat, lon float64) error {
-	if cab, exists := cr.cabMap[id]; exists {
-		cab.SetCurrLocation(lat, lon)
+	_, err := cr.UpdateCab(id, func(cab *Cab) error {
+		return cab.SetCurrLocation(lat, lon)
+	})
+	return err
+}
+
+// ClaimCab marks the cab Busy only if it is still ready to take a ride, so two
+// dispatches racing for the same cab cannot both get it.
+func (cr *CabRepository) ClaimCab(id string) error {
+	_, err := cr.UpdateCab(id, func(cab *Cab) error {
+		if cab.GetCabStatus() != ReadyToTakeRide {
+			return ErrCabNotAvailable
+		}
+		return cab.SetCabStatus(Busy)
+	})
+	return err
+}
+func (cr *CabRepository) UpdateCab(id string, update func(cab *Cab) error) (*Cab, error) {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	cab, exists := cr.cabMap[id]
+	if !exists {
+		return nil, ErrCabNotFound
 	}
-	return nil
+	updated := cab.clone()
+	if err := update(updated); err != nil {
+		return nil, err
+	}
+	cr.cabMap[id] = updated
+	cabLat, cabLon := updated.GetCurrLocation()
+	cr.cabLocationIndex.Upsert(id, cabLat, cabLon)
+	return updated.clone(), nil
 }
 func (cr *CabRepository) GetCabById(id string) *Cab {
+	cr.mu.RLock()
+	defer cr.mu.RUnlock()
 	if cab, exists := cr.cabMap[id]; exists {
-		return cab
+		return cab.clone()
 	}
 	return nil
 }
 
+// RideRegistory indexes rides by user and by their current cab, so the ride
+// history of one of them never scans every ride.
 type RideRegistory struct {
 	idGenerationStrategy IdGenerationStrategy
 	rideMap              map[string]*Ride
+	ridesByUser          map[string]map[string]bool
+	ridesByCab           map[string]map[string]bool
+	scheduledRides       map[string]bool
+	openRideIndex        GeoIndex
+	clock                Clock
+	mu                   sync.RWMutex
 }
 
-func NewRideRepository(idGenerationStrategy IdGenerationStrategy) IRideRegistory {
+func NewRideRepository(idGenerationStrategy IdGenerationStrategy, openRideIndex GeoIndex, clock Clock) IRideRegistory {
 	return &RideRegistory{
 		idGenerationStrategy: idGenerationStrategy,
 		rideMap:              make(map[string]*Ride),
+		ridesByUser:          make(map[string]map[string]bool),
+		ridesByCab:           make(map[string]map[string]bool),
+		scheduledRides:       make(map[string]bool),
+		openRideIndex:        openRideIndex,
+		clock:                clock,
 	}
 }
 
-func (rr *RideRegistory) CreateRide(userId string, startPointLat, startPointLon, endPointLat, endPointLon float64) *Ride {
-	newRide := NewRide(rr.idGenerationStrategy.GenerateId(), userId, startPointLat, startPointLat, endPointLat, endPointLat)
+func (rr *RideRegistory) CreateRide(userId string, startPointLat, startPointLon, endPointLat, endPointLon float64) (*Ride, error) {
+	rr.mu.Lock()
+	defer rr.mu.Unlock()
+	newRide := NewRide(rr.idGenerationStrategy.GenerateId(), userId, startPointLat, startPointLon, endPointLat, endPointLon, rr.clock.Now())
+	rr.rideMap[newRide.GetId()] = newRide
+	addToIndex(rr.ridesByUser, userId, newRide.GetId())
+	rr.openRideIndex.Upsert(newRide.GetId(), startPointLat, startPointLon)
+	return newRide.clone(), nil
+}
+
+// CreateScheduledRide keeps the ride out of the open rides until dispatch for
+// it starts, so it does not count towards demand before then.
+func (rr *RideRegistory) CreateScheduledRide(userId string, startPointLat, startPointLon, endPointLat, endPointLon float64, pickupAt time.Time) (*Ride, error) {
+	rr.mu.Lock()
+	defer rr.mu.Unlock()
+	newRide := NewScheduledRide(rr.idGenerationStrategy.GenerateId(), userId, startPointLat, startPointLon, endPointLat, endPointLon, rr.clock.Now(), pickupAt)
 	rr.rideMap[newRide.GetId()] = newRide
-	return newRide
+	addToIndex(rr.ridesByUser, userId, newRide.GetId())
+	rr.scheduledRides[newRide.GetId()] = true
+	return newRide.clone(), nil
 }
 func (rr *RideRegistory) UpdateRideStatus(id string, newStatus RideStatus) error {
-	if ride, exists := rr.rideMap[id]; exists {
-		ride.SetRideStatus(newStatus)
+	_, err := rr.UpdateRide(id, func(ride *Ride) error {
+		return ride.TransitionTo(newStatus, rr.clock.Now())
+	})
+	return err
+}
+func (rr *RideRegistory) AssignCab(id string, cabId string) error {
+	_, err := rr.UpdateRide(id, func(ride *Ride) error {
+		return ride.AssignCab(cabId, rr.clock.Now())
+	})
+	return err
+}
+
+// UpdateRide applies the update to a copy of the ride and only stores it when
+// the update succeeds, so a rejected transition leaves the ride untouched.
+func (rr *RideRegistory) UpdateRide(id string, update func(ride *Ride) error) (*Ride, error) {
+	rr.mu.Lock()
+	defer rr.mu.Unlock()
+	ride, exists := rr.rideMap[id]
+	if !exists {
+		return nil, ErrRideNotFound
 	}
-	return nil
+	updated := ride.clone()
+	if err := update(updated); err != nil {
+		return nil, err
+	}
+	rr.rideMap[id] = updated
+	if ride.GetCabId() != updated.GetCabId() {
+		removeFromIndex(rr.ridesByCab, ride.GetCabId(), id)
+		addToIndex(rr.ridesByCab, updated.GetCabId(), id)
+	}
+	if updated.GetStatus() == SearchingForCab {
+		rr.openRideIndex.Upsert(id, updated.startPointLat, updated.startPointLon)
+	} else {
+		rr.openRideIndex.Remove(id)
+	}
+	if updated.GetStatus() != Scheduled {
+		delete(rr.scheduledRides, id)
+	}
+	return updated.clone(), nil
 }
 func (rr *RideRegistory) GetRideById(id string) *Ride {
+	rr.mu.RLock()
+	defer rr.mu.RUnlock()
 	if ride, exists := rr.rideMap[id]; exists {
-		return ride
+		return ride.clone()
 	}
 	return nil
 }
 func (rr *RideRegistory) TotalRideForUser(userId string) []Ride {
+	rr.mu.RLock()
+	defer rr.mu.RUnlock()
+	rides := make([]Ride, 0, len(rr.ridesByUser[userId]))
+	for rideId := range rr.ridesByUser[userId] {
+		rides = append(rides, *rr.rideMap[rideId].clone())
+	}
+	sort.Slice(rides, func(i, j int) bool {
+		return rides[i].GetCreatedAt().Before(rides[j].GetCreatedAt())
+	})
+	return rides
+}
+
+// QueryRides walks the smaller of the user and cab indexes the query names.
+func (rr *RideRegistory) QueryRides(query RideQuery) (*RidePage, error) {
+	query, cursor, err := query.normalize()
+	if err != nil {
+		return nil, err
+	}
+	rr.mu.RLock()
+	defer rr.mu.RUnlock()
+	rideIds := rr.ridesByUser[query.UserId]
+	if query.UserId == "" || (query.CabId != "" && len(rr.ridesByCab[query.CabId]) < len(rideIds)) {
+		rideIds = rr.ridesByCab[query.CabId]
+	}
+	rides := make([]Ride, 0)
+	for rideId := range rideIds {
+		if ride := rr.rideMap[rideId]; query.matches(ride) {
+			rides = append(rides, *ride.clone())
+		}
+	}
+	return pageRides(rides, query, cursor), nil
+}
+
+// FindScheduledRidesDueBy only looks at the rides still waiting in Scheduled,
+// which UpdateRide drops as soon as dispatch for them starts or they are canceled.
+func (rr *RideRegistory) FindScheduledRidesDueBy(pickupBy time.Time) []Ride {
+	rr.mu.RLock()
+	defer rr.mu.RUnlock()
+	rides := make([]Ride, 0)
+	for rideId := range rr.scheduledRides {
+		if ride := rr.rideMap[rideId]; !ride.GetScheduledPickupAt().After(pickupBy) {
+			rides = append(rides, *ride.clone())
+		}
+	}
+	sort.Slice(rides, func(i, j int) bool {
+		return rides[i].GetScheduledPickupAt().Before(rides[j].GetScheduledPickupAt())
+	})
+	return rides
+}
+
+// FindOpenRides returns the rides still searching for a cab, oldest first.
+func (rr *RideRegistory) FindOpenRides() []Ride {
+	rr.mu.RLock()
+	defer rr.mu.RUnlock()
 	rides := make([]Ride, 0)
 	for _, ride := range rr.rideMap {
-		if ride.GetUserId() == userId {
-			rides = append(rides, *ride)
+		if ride.GetStatus() == SearchingForCab {
+			rides = append(rides, *ride.clone())
 		}
 	}
+	sort.Slice(rides, func(i, j int) bool {
+		return rides[i].GetCreatedAt().Before(rides[j].GetCreatedAt())
+	})
 	return rides
 }
+func (rr *RideRegistory) CountOpenRidesInZone(zone Zone) int {
+	rr.mu.RLock()
+	defer rr.mu.RUnlock()
+	count := 0
+	for _, result := range rr.openRideIndex.WithinBounds(zone.GetBounds(), nil) {
+		if zone.Contains(result.Lat, result.Lon) {
+			count++
+		}
+	}
+	return count
+}
+
+func addToIndex(index map[string]map[string]bool, key, rideId string) {
+	if key == "" {
+		return
+	}
+	if index[key] == nil {
+		index[key] = make(map[string]bool)
+	}
+	index[key][rideId] = true
+}
+
+func removeFromIndex(index map[string]map[string]bool, key, rideId string) {
+	delete(index[key], rideId)
+	if len(index[key]) == 0 {
+		delete(index, key)
+	}
+}
+
+type ratingKey struct {
+	id     string
+	author RatingAuthor
+}
+
+type RatingRepository struct {
+	ratingMap        map[ratingKey]*Rating
+	ratingsBySubject map[ratingKey][]*Rating
+	mu               sync.RWMutex
+}
+
+func NewRatingRepository() IRatingRepository {
+	return &RatingRepository{
+		ratingMap:        make(map[ratingKey]*Rating),
+		ratingsBySubject: make(map[ratingKey][]*Rating),
+	}
+}
+
+// SaveRating keeps one rating per ride from each side and rejects the second.
+func (rr *RatingRepository) SaveRating(rating *Rating) error {
+	rr.mu.Lock()
+	defer rr.mu.Unlock()
+	key := ratingKey{id: rating.GetRideId(), author: rating.GetAuthor()}
+	if _, exists := rr.ratingMap[key]; exists {
+		return ErrAlreadyRated
+	}
+	stored := rating.clone()
+	rr.ratingMap[key] = stored
+	subjectKey := ratingKey{id: rating.GetSubjectId(), author: rating.GetAuthor()}
+	rr.ratingsBySubject[subjectKey] = append(rr.ratingsBySubject[subjectKey], stored)
+	return nil
+}
+func (rr *RatingRepository) FindRatingsForRide(rideId string) []Rating {
+	rr.mu.RLock()
+	defer rr.mu.RUnlock()
+	ratings := make([]Rating, 0, 2)
+	for _, author := range []RatingAuthor{RatedByRider, RatedByDriver} {
+		if rating, exists := rr.ratingMap[ratingKey{id: rideId, author: author}]; exists {
+			ratings = append(ratings, *rating.clone())
+		}
+	}
+	return ratings
+}
+
+// FindRecentRatings returns up to limit ratings the subject received from the
+// author's side, newest first.
+func (rr *RatingRepository) FindRecentRatings(author RatingAuthor, subjectId string, limit int) []Rating {
+	rr.mu.RLock()
+	defer rr.mu.RUnlock()
+	received := rr.ratingsBySubject[ratingKey{id: subjectId, author: author}]
+	ratings := make([]Rating, 0, min(limit, len(received)))
+	for i := len(received) - 1; i >= 0 && len(ratings) < limit; i-- {
+		ratings = append(ratings, *received[i].clone())
+	}
+	return ratings
+}
+
+type PaymentRepository struct {
+	methodMap       map[string]*PaymentMethod
+	methodsByUser   map[string][]*PaymentMethod
+	paymentMap      map[string]*Payment
+	paymentByRide   map[string]*Payment
+	paymentsForUser map[string][]*Payment
+	mu              sync.RWMutex
+}
+
+func NewPaymentRepository() IPaymentRepository {
+	return &PaymentRepository{
+		methodMap:       make(map[string]*PaymentMethod),
+		methodsByUser:   make(map[string][]*PaymentMethod),
+		paymentMap:      make(map[string]*Payment),
+		paymentByRide:   make(map[string]*Payment),
+		paymentsForUser: make(map[string][]*Payment),
+	}
+}
+
+func (pr *PaymentRepository) SavePaymentMethod(method *PaymentMethod) error {
+	pr.mu.Lock()
+	defer pr.mu.Unlock()
+	stored := method.clone()
+	pr.methodMap[method.GetId()] = stored
+	pr.methodsByUser[method.GetUserId()] = append(pr.methodsByUser[method.GetUserId()], stored)
+	return nil
+}
+func (pr *PaymentRepository) GetPaymentMethodById(id string) *PaymentMethod {
+	pr.mu.RLock()
+	defer pr.mu.RUnlock()
+	if method, exists := pr.methodMap[id]; exists {
+		return method.clone()
+	}
+	return nil
+}
+
+// FindPaymentMethods returns the rider's methods in the order they were added.
+func (pr *PaymentRepository) FindPaymentMethods(userId string) []PaymentMethod {
+	pr.mu.RLock()
+	defer pr.mu.RUnlock()
+	methods := make([]PaymentMethod, 0, len(pr.methodsByUser[userId]))
+	for _, method := range pr.methodsByUser[userId] {
+		methods = append(methods, *method.clone())
+	}
+	return methods
+}
+func (pr *PaymentRepository) SetDefaultPaymentMethod(userId, methodId string) error {
+	pr.mu.Lock()
+	defer pr.mu.Unlock()
+	if method, exists := pr.methodMap[methodId]; !exists || method.GetUserId() != userId {
+		return ErrPaymentMethodNotFound
+	}
+	for _, method := range pr.methodsByUser[userId] {
+		method.isDefault = method.GetId() == methodId
+	}
+	return nil
+}
+
+// SavePayment keeps one payment per ride and rejects the second.
+func (pr *PaymentRepository) SavePayment(payment *Payment) error {
+	pr.mu.Lock()
+	defer pr.mu.Unlock()
+	if _, exists := pr.paymentByRide[payment.GetRideId()]; exists {
+		return ErrAlreadyCharged
+	}
+	stored := payment.clone()
+	pr.paymentMap[payment.GetId()] = stored
+	pr.paymentByRide[payment.GetRideId()] = stored
+	pr.paymentsForUser[payment.GetUserId()] = append(pr.paymentsForUser[payment.GetUserId()], stored)
+	return nil
+}
+func (pr *PaymentRepository) UpdatePayment(id string, update func(payment *Payment) error) (*Payment, error) {
+	pr.mu.Lock()
+	defer pr.mu.Unlock()
+	payment, exists := pr.paymentMap[id]
+	if !exists {
+		return nil, ErrPaymentNotFound
+	}
+	updated := payment.clone()
+	if err := update(updated); err != nil {
+		return nil, err
+	}
+	*payment = *updated
+	return updated.clone(), nil
+}
+func (pr *PaymentRepository) GetPaymentForRide(rideId string) *Payment {
+	pr.mu.RLock()
+	defer pr.mu.RUnlock()
+	if payment, exists := pr.paymentByRide[rideId]; exists {
+		return payment.clone()
+	}
+	return nil
+}
+
+// FindPaymentsForUser returns the rider's payments in the status, oldest first.
+func (pr *PaymentRepository) FindPaymentsForUser(userId string, status PaymentStatus) []Payment {
+	pr.mu.RLock()
+	defer pr.mu.RUnlock()
+	payments := make([]Payment, 0)
+	for _, payment := range pr.paymentsForUser[userId] {
+		if payment.GetStatus() == status {
+			payments = append(payments, *payment.clone())
+		}
+	}
+	return payments
+}
+
+type LedgerRepository struct {
+	entriesByUser map[string][]LedgerEntry
+	balances      map[string]RiderBalance
+	mu            sync.RWMutex
+}
+
+func NewLedgerRepository() ILedgerRepository {
+	return &LedgerRepository{
+		entriesByUser: make(map[string][]LedgerEntry),
+		balances:      make(map[string]RiderBalance),
+	}
+}
+
+func (lr *LedgerRepository) AppendEntry(entry LedgerEntry) error {
+	lr.mu.Lock()
+	defer lr.mu.Unlock()
+	lr.entriesByUser[entry.UserId] = append(lr.entriesByUser[entry.UserId], entry)
+	balance := lr.balances[entry.UserId]
+	balance.WalletBalance += entry.WalletDelta
+	balance.OutstandingDues += entry.DuesDelta
+	lr.balances[entry.UserId] = balance
+	return nil
+}
+
+// FindEntriesForUser returns the rider's entries in the order they were made.
+func (lr *LedgerRepository) FindEntriesForUser(userId string) []LedgerEntry {
+	lr.mu.RLock()
+	defer lr.mu.RUnlock()
+	entries := make([]LedgerEntry, len(lr.entriesByUser[userId]))
+	copy(entries, lr.entriesByUser[userId])
+	return entries
+}
+func (lr *LedgerRepository) GetBalance(userId string) RiderBalance {
+	lr.mu.RLock()
+	defer lr.mu.RUnlock()
+	balance := lr.balances[userId]
+	balance.UserId = userId
+	return balance
+}
+
+type PromotionRepository struct {
+	promotionMap       map[string]*Promotion
+	referralByUser     map[string]*Promotion
+	redemptionMap      map[string]*PromoRedemption
+	redemptionsForCode map[string][]*PromoRedemption
+	redemptionsForUser map[string][]*PromoRedemption
+	redemptionByRide   map[string]*PromoRedemption
+	mu                 sync.RWMutex
+}
+
+func NewPromotionRepository() IPromotionRepository {
+	return &PromotionRepository{
+		promotionMap:       make(map[string]*Promotion),
+		referralByUser:     make(map[string]*Promotion),
+		redemptionMap:      make(map[string]*PromoRedemption),
+		redemptionsForCode: make(map[string][]*PromoRedemption),
+		redemptionsForUser: make(map[string][]*PromoRedemption),
+		redemptionByRide:   make(map[string]*PromoRedemption),
+	}
+}
+
+func (pr *PromotionRepository) SavePromotion(promotion *Promotion) error {
+	pr.mu.Lock()
+	defer pr.mu.Unlock()
+	if _, exists := pr.promotionMap[promotion.Code]; exists {
+		return fmt.Errorf("%w: %s", ErrPromoCodeTaken, promotion.Code)
+	}
+	stored := promotion.clone()
+	pr.promotionMap[promotion.Code] = stored
+	if promotion.ReferrerId != "" {
+		pr.referralByUser[promotion.ReferrerId] = stored
+	}
+	return nil
+}
+func (pr *PromotionRepository) GetPromotion(code string) *Promotion {
+	pr.mu.RLock()
+	defer pr.mu.RUnlock()
+	if promotion, exists := pr.promotionMap[code]; exists {
+		return promotion.clone()
+	}
+	return nil
+}
+func (pr *PromotionRepository) GetReferralPromotion(referrerId string) *Promotion {
+	pr.mu.RLock()
+	defer pr.mu.RUnlock()
+	if promotion, exists := pr.referralByUser[referrerId]; exists {
+		return promotion.clone()
+	}
+	return nil
+}
+func (pr *PromotionRepository) ReserveRedemption(promotion *Promotion, redemption *PromoRedemption, hasTakenRide func(userId string) bool) error {
+	pr.mu.Lock()
+	defer pr.mu.Unlock()
+	if promotion.FirstRideOnly && hasTakenRide(redemption.UserId) {
+		return errNotFirstRide(promotion)
+	}
+	used, usedByUser := 0, 0
+	for _, existing := range pr.redemptionsForCode[promotion.Code] {
+		if existing.Status == RedemptionReleased {
+			continue
+		}
+		used++
+		if existing.UserId == redemption.UserId {
+			usedByUser++
+		}
+	}
+	if err := checkPromotionLimits(promotion, used, usedByUser); err != nil {
+		return err
+	}
+	if promotion.FirstRideOnly {
+		for _, existing := range pr.redemptionsForUser[redemption.UserId] {
+			if other := pr.promotionMap[existing.Code]; existing.Status != RedemptionReleased && other != nil && other.FirstRideOnly {
+				return fmt.Errorf("%w: the rider already has a first ride offer on %s", ErrPromoNotApplicable, existing.Code)
+			}
+		}
+	}
+	stored := *redemption
+	pr.redemptionMap[redemption.Id] = &stored
+	pr.redemptionsForCode[redemption.Code] = append(pr.redemptionsForCode[redemption.Code], &stored)
+	pr.redemptionsForUser[redemption.UserId] = append(pr.redemptionsForUser[redemption.UserId], &stored)
+	if redemption.RideId != "" {
+		pr.redemptionByRide[redemption.RideId] = &stored
+	}
+	return nil
+}
+
+func errNotFirstRide(promotion *Promotion) error {
+	return fmt.Errorf("%w: %s is only for a rider's first ride", ErrPromoNotApplicable, promotion.Code)
+}
+
+func checkPromotionLimits(promotion *Promotion, used, usedByUser int) error {
+	if promotion.TotalLimit > 0 && used >= promotion.TotalLimit {
+		return fmt.Errorf("%w: all %d uses of %s are taken", ErrPromoLimitReached, promotion.TotalLimit, promotion.Code)
+	}
+	if promotion.PerUserLimit > 0 && usedByUser >= promotion.PerUserLimit {
+		return fmt.Errorf("%w: %s can be used %d times per rider", ErrPromoLimitReached, promotion.Code, promotion.PerUserLimit)
+	}
+	return nil
+}
+
+func (pr *PromotionRepository) UpdateRedemption(id string, update func(redemption *PromoRedemption) error) (*PromoRedemption, error) {
+	pr.mu.Lock()
+	defer pr.mu.Unlock()
+	redemption, exists := pr.redemptionMap[id]
+	if !exists {
+		return nil, ErrRedemptionNotFound
+	}
+	updated := *redemption
+	if err := update(&updated); err != nil {
+		return nil, err
+	}
+	*redemption = updated
+	if updated.RideId != "" {
+		pr.redemptionByRide[updated.RideId] = redemption
+	}
+	return &updated, nil
+}
+func (pr *PromotionRepository) GetRedemptionForRide(rideId string) *PromoRedemption {
+	pr.mu.RLock()
+	defer pr.mu.RUnlock()
+	if redemption, exists := pr.redemptionByRide[rideId]; exists {
+		copied := *redemption
+		return &copied
+	}
+	return nil
+}
+
+// FindRedemptionsForUser returns the rider's redemptions in the order they were
+// reserved.
+func (pr *PromotionRepository) FindRedemptionsForUser(userId string) []PromoRedemption {
+	pr.mu.RLock()
+	defer pr.mu.RUnlock()
+	redemptions := make([]PromoRedemption, 0, len(pr.redemptionsForUser[userId]))
+	for _, redemption := range pr.redemptionsForUser[userId] {
+		redemptions = append(redemptions, *redemption)
+	}
+	return redemptions
+}
+
+type EarningsRepository struct {
+	entriesByCab map[string][]EarningEntry
+	earnedRides  map[string]bool
+	balances     map[string]int
+	shiftsByCab  map[string][]ShiftChange
+	batchEntries map[string][]EarningEntry
+	mu           sync.RWMutex
+}
+
+func NewEarningsRepository() IEarningsRepository {
+	return &EarningsRepository{
+		entriesByCab: make(map[string][]EarningEntry),
+		earnedRides:  make(map[string]bool),
+		balances:     make(map[string]int),
+		shiftsByCab:  make(map[string][]ShiftChange),
+		batchEntries: make(map[string][]EarningEntry),
+	}
+}
+
+func (er *EarningsRepository) AppendEarning(entry EarningEntry) error {
+	er.mu.Lock()
+	defer er.mu.Unlock()
+	if entry.Kind == RideEarning {
+		if er.earnedRides[entry.RideId] {
+			return fmt.Errorf("%w: %s", ErrEarningAlreadyRecorded, entry.RideId)
+		}
+		er.earnedRides[entry.RideId] = true
+	}
+	er.entriesByCab[entry.CabId] = append(er.entriesByCab[entry.CabId], entry)
+	er.balances[entry.CabId] += entry.Amount
+	if entry.BatchId != "" {
+		er.batchEntries[entry.BatchId] = append(er.batchEntries[entry.BatchId], entry)
+	}
+	return nil
+}
+func (er *EarningsRepository) FindEarnings(cabId string, from, to time.Time) []EarningEntry {
+	er.mu.RLock()
+	defer er.mu.RUnlock()
+	entries := make([]EarningEntry, 0)
+	for _, entry := range er.entriesByCab[cabId] {
+		if !entry.At.Before(from) && entry.At.Before(to) {
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
+func (er *EarningsRepository) FindPayoutBatch(batchId string) []EarningEntry {
+	er.mu.RLock()
+	defer er.mu.RUnlock()
+	entries := make([]EarningEntry, len(er.batchEntries[batchId]))
+	copy(entries, er.batchEntries[batchId])
+	return entries
+}
+func (er *EarningsRepository) GetEarningsBalance(cabId string) int {
+	er.mu.RLock()
+	defer er.mu.RUnlock()
+	return er.balances[cabId]
+}
+func (er *EarningsRepository) GetEarningsBalances() map[string]int {
+	er.mu.RLock()
+	defer er.mu.RUnlock()
+	balances := make(map[string]int, len(er.balances))
+	for cabId, balance := range er.balances {
+		balances[cabId] = balance
+	}
+	return balances
+}
+func (er *EarningsRepository) RecordShiftChange(change ShiftChange) error {
+	er.mu.Lock()
+	defer er.mu.Unlock()
+	er.shiftsByCab[change.CabId] = append(er.shiftsByCab[change.CabId], change)
+	return nil
+}
+func (er *EarningsRepository) GetLastShiftChange(cabId string) *ShiftChange {
+	er.mu.RLock()
+	defer er.mu.RUnlock()
+	changes := er.shiftsByCab[cabId]
+	if len(changes) == 0 {
+		return nil
+	}
+	last := changes[len(changes)-1]
+	return &last
+}
+func (er *EarningsRepository) FindShiftChanges(cabId string, from, to time.Time) []ShiftChange {
+	er.mu.RLock()
+	defer er.mu.RUnlock()
+	changes := make([]ShiftChange, 0)
+	for _, change := range er.shiftsByCab[cabId] {
+		if !change.At.Before(to) {
+			break
+		}
+		if change.At.Before(from) {
+			changes = changes[:0]
+		}
+		changes = append(changes, change)
+	}
+	return changes
+}
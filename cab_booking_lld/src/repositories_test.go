@@ -0,0 +1,541 @@
+package src_test
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"cab_booking.com/src"
+)
+
+type repositories struct {
+	userRepo      src.IUserRepository
+	cabRepo       src.ICabRepository
+	rideRepo      src.IRideRegistory
+	ratingRepo    src.IRatingRepository
+	paymentRepo   src.IPaymentRepository
+	ledgerRepo    src.ILedgerRepository
+	promotionRepo src.IPromotionRepository
+	earningsRepo  src.IEarningsRepository
+	clock         *src.ManualClock
+}
+
+func newInMemoryRepositories(clock *src.ManualClock) repositories {
+	idGenerationStrategy := src.NewIdGenerationUsingUUID()
+	distanceCalculator := src.NewHaversineDistanceCalculator()
+	return repositories{
+		userRepo:      src.NewUserRepository(idGenerationStrategy),
+		cabRepo:       src.NewCabRepository(idGenerationStrategy, src.NewGridGeoIndex(0.01, distanceCalculator)),
+		rideRepo:      src.NewRideRepository(idGenerationStrategy, src.NewGridGeoIndex(0.01, distanceCalculator), clock),
+		ratingRepo:    src.NewRatingRepository(),
+		paymentRepo:   src.NewPaymentRepository(),
+		ledgerRepo:    src.NewLedgerRepository(),
+		promotionRepo: src.NewPromotionRepository(),
+		earningsRepo:  src.NewEarningsRepository(),
+		clock:         clock,
+	}
+}
+
+func openSQLiteRepositories(t *testing.T, path string, clock *src.ManualClock) (repositories, func()) {
+	t.Helper()
+	db, err := src.OpenSQLiteDatabase(path)
+	if err != nil {
+		t.Fatalf("opening %s: %v", path, err)
+	}
+	idGenerationStrategy := src.NewIdGenerationUsingUUID()
+	distanceCalculator := src.NewHaversineDistanceCalculator()
+	cabRepo, err := src.NewSQLiteCabRepository(db, idGenerationStrategy, src.NewGridGeoIndex(0.01, distanceCalculator))
+	if err != nil {
+		t.Fatalf("loading cabs from %s: %v", path, err)
+	}
+	rideRepo, err := src.NewSQLiteRideRepository(db, idGenerationStrategy, src.NewGridGeoIndex(0.01, distanceCalculator), clock)
+	if err != nil {
+		t.Fatalf("loading rides from %s: %v", path, err)
+	}
+	return repositories{
+		userRepo:      src.NewSQLiteUserRepository(db, idGenerationStrategy),
+		cabRepo:       cabRepo,
+		rideRepo:      rideRepo,
+		ratingRepo:    src.NewSQLiteRatingRepository(db),
+		paymentRepo:   src.NewSQLitePaymentRepository(db),
+		ledgerRepo:    src.NewSQLiteLedgerRepository(db),
+		promotionRepo: src.NewSQLitePromotionRepository(db),
+		earningsRepo:  src.NewSQLiteEarningsRepository(db),
+		clock:         clock,
+	}, func() { db.Close() }
+}
+
+func expect(t *testing.T, condition bool, format string, args ...any) {
+	t.Helper()
+	if !condition {
+		t.Fatalf(format, args...)
+	}
+}
+
+// testRepositoryConformance checks the behaviour every repository
+// implementation has to share, whatever it stores the entities in.
+func testRepositoryConformance(t *testing.T, repos repositories) {
+	zone := src.NewPolygonZone("indiranagar", []src.GeoPoint{{Lat: 12.96, Lon: 77.63}, {Lat: 12.96, Lon: 77.65}, {Lat: 12.98, Lon: 77.65}, {Lat: 12.98, Lon: 77.63}})
+
+	// Users
+	user, err := repos.userRepo.CreateUser("Kavya")
+	expect(t, err == nil, "expected the user to be created, got %v", err)
+	expect(t, repos.userRepo.GetUserById(user.GetId()).GetName() == "Kavya", "expected the user to be stored")
+	expect(t, repos.userRepo.GetUserById("missing") == nil, "expected no user for an unknown id")
+	updated, err := repos.userRepo.UpdateUser(user.GetId(), func(user *src.User) error {
+		user.SetPriorityTier(2)
+		return nil
+	})
+	expect(t, err == nil && updated.GetPriorityTier() == 2, "expected the priority tier to be updated, got %v", err)
+	_, err = repos.userRepo.UpdateUser(user.GetId(), func(user *src.User) error {
+		user.SetPriorityTier(9)
+		return errors.New("rejected")
+	})
+	expect(t, err != nil && repos.userRepo.GetUserById(user.GetId()).GetPriorityTier() == 2, "expected a failed update to leave the user untouched")
+	_, err = repos.userRepo.UpdateUser("missing", func(user *src.User) error { return nil })
+	expect(t, errors.Is(err, src.ErrUserNotFound), "expected %v, got %v", src.ErrUserNotFound, err)
+	_, err = repos.userRepo.UpdateUser(user.GetId(), func(user *src.User) error {
+		user.SetRating(4.5, 2)
+		return nil
+	})
+	rated := repos.userRepo.GetUserById(user.GetId())
+	expect(t, err == nil && rated.GetRating() == 4.5 && rated.GetRatingCount() == 2, "expected the rider rating to be stored, got %v", err)
+
+	// Cabs
+	near, err := repos.cabRepo.CreateCab("Near", src.Sedan)
+	expect(t, err == nil, "expected the cab to be created, got %v", err)
+	far, err := repos.cabRepo.CreateCab("Far", src.Hatchback)
+	expect(t, err == nil, "expected the cab to be created, got %v", err)
+	expect(t, repos.cabRepo.UpdateCabLocation(near.GetId(), 12.970, 77.640) == nil, "expected the cab location to be updated")
+	expect(t, repos.cabRepo.UpdateCabLocation(far.GetId(), 12.990, 77.660) == nil, "expected the cab location to be updated")
+	nearest := repos.cabRepo.FindNearestAvailableCabs(12.971, 77.641, 2, src.AnyCategory)
+	expect(t, len(nearest) == 2 && nearest[0].GetId() == near.GetId(), "expected the nearest cab first, got %v", nearest)
+	nearest = repos.cabRepo.FindNearestAvailableCabs(12.971, 77.641, 2, src.Hatchback)
+	expect(t, len(nearest) == 1 && nearest[0].GetId() == far.GetId() && nearest[0].GetCategory() == src.Hatchback, "expected only the hatchback, got %v", nearest)
+	expect(t, len(repos.cabRepo.FindAvailableCabsWithinRadius(12.971, 77.641, 1)) == 1, "expected one cab within 1 km")
+	expect(t, repos.cabRepo.CountAvailableCabsInZone(zone) == 1, "expected one available cab in the zone")
+	expect(t, repos.cabRepo.ClaimCab(near.GetId()) == nil, "expected the cab to be claimed")
+	expect(t, errors.Is(repos.cabRepo.ClaimCab(near.GetId()), src.ErrCabNotAvailable), "expected a busy cab not to be claimed twice")
+	expect(t, repos.cabRepo.CountAvailableCabsInZone(zone) == 0, "expected a busy cab not to count as available")
+	nearest = repos.cabRepo.FindNearestAvailableCabs(12.971, 77.641, 2, src.AnyCategory)
+	expect(t, len(nearest) == 1 && nearest[0].GetId() == far.GetId(), "expected only the free cab, got %v", nearest)
+	expect(t, errors.Is(repos.cabRepo.UpdateCabStatus("missing", src.Busy), src.ErrCabNotFound), "expected %v for an unknown cab", src.ErrCabNotFound)
+	expect(t, repos.cabRepo.GetCabById("missing") == nil, "expected no cab for an unknown id")
+	cab, err := repos.cabRepo.UpdateCab(near.GetId(), func(cab *src.Cab) error {
+		cab.IncreaseCabRides()
+		return cab.SetCabStatus(src.ReadyToTakeRide)
+	})
+	expect(t, err == nil && cab.GetTotalRides() == 1 && repos.cabRepo.GetCabById(near.GetId()).GetCabStatus() == src.ReadyToTakeRide, "expected the cab to be released after its ride")
+	_, err = repos.cabRepo.UpdateCab(far.GetId(), func(cab *src.Cab) error {
+		cab.SetRating(2.5, 12)
+		cab.SetFlaggedForReview(true)
+		return nil
+	})
+	flagged := repos.cabRepo.GetCabById(far.GetId())
+	expect(t, err == nil && flagged.GetRating() == 2.5 && flagged.GetRatingCount() == 12 && flagged.IsFlaggedForReview(), "expected the driver rating and review flag to be stored, got %v", err)
+	expect(t, repos.cabRepo.GetCabById(near.GetId()).GetDeprioritisedUntil().IsZero(), "expected a new cab not to be deprioritised")
+	deprioritisedUntil := time.Now().Add(time.Hour)
+	_, err = repos.cabRepo.UpdateCab(near.GetId(), func(cab *src.Cab) error {
+		cab.RecordCancellation()
+		cab.DeprioritiseUntil(deprioritisedUntil)
+		return nil
+	})
+	deprioritised := repos.cabRepo.GetCabById(near.GetId())
+	expect(t, err == nil && deprioritised.GetCancellations() == 1 && deprioritised.GetDeprioritisedUntil().Equal(deprioritisedUntil), "expected the driver's cancellations to be stored, got %v", err)
+
+	// Only one of many concurrent claims on the same cab wins
+	var wg sync.WaitGroup
+	var claimsMu sync.Mutex
+	claims := 0
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if repos.cabRepo.ClaimCab(far.GetId()) == nil {
+				claimsMu.Lock()
+				claims++
+				claimsMu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	expect(t, claims == 1, "expected exactly one concurrent claim to win, got %d", claims)
+
+	// Rides
+	ride, err := repos.rideRepo.CreateRide(user.GetId(), 12.970, 77.640, 12.935, 77.624)
+	expect(t, err == nil && ride.GetStatus() == src.SearchingForCab, "expected a new ride to be searching for a cab, got %v", err)
+	expect(t, ride.GetCreatedAt().Equal(repos.clock.Now()), "expected the ride to be created at the clock's time, got %v", ride.GetCreatedAt())
+	expect(t, repos.rideRepo.CountOpenRidesInZone(zone) == 1, "expected one open ride in the zone")
+	fare := &src.FareBreakdown{BaseFare: 50, DistanceFare: 60, MinimumFare: 100, TaxPercent: 5, SurgeMultiplier: 1.5, SurgeZoneId: zone.GetId(), Duration: 10 * time.Minute}
+	fare.Settle()
+	_, err = repos.rideRepo.UpdateRide(ride.GetId(), func(ride *src.Ride) error {
+		ride.SetFareEstimate(fare)
+		ride.SetPriorityTier(2)
+		ride.SetRideType(src.PoolRide, 2)
+		ride.SetVehicleCategory(src.SUV)
+		ride.SetPaymentMethodId("card-1")
+		return nil
+	})
+	expect(t, err == nil, "expected the fare estimate to be stored, got %v", err)
+	err = repos.rideRepo.UpdateRideStatus(ride.GetId(), src.PickedUp)
+	expect(t, errors.Is(err, src.ErrInvalidTransition), "expected %v, got %v", src.ErrInvalidTransition, err)
+	expect(t, repos.rideRepo.GetRideById(ride.GetId()).GetStatus() == src.SearchingForCab, "expected a rejected transition to leave the ride untouched")
+	expect(t, errors.Is(repos.rideRepo.UpdateRideStatus(ride.GetId(), src.Confirmed), src.ErrCabNotAssigned), "expected a ride without a cab not to be confirmed")
+	repos.clock.Advance(time.Minute)
+	expect(t, repos.rideRepo.AssignCab(ride.GetId(), near.GetId()) == nil, "expected the cab to be assigned")
+	expect(t, repos.rideRepo.CountOpenRidesInZone(zone) == 0, "expected an assigned ride to leave the open rides")
+	expect(t, repos.rideRepo.UpdateRideStatus(ride.GetId(), src.PickedUp) == nil, "expected the rider to be picked up")
+	expect(t, errors.Is(repos.rideRepo.UpdateRideStatus("missing", src.PickedUp), src.ErrRideNotFound), "expected %v for an unknown ride", src.ErrRideNotFound)
+	expect(t, repos.rideRepo.GetRideById("missing") == nil, "expected no ride for an unknown id")
+
+	stored := repos.rideRepo.GetRideById(ride.GetId())
+	expect(t, stored.GetCabId() == near.GetId() && stored.GetStatus() == src.PickedUp && stored.GetPriorityTier() == 2, "expected the stored ride to be picked up by its cab, got %v", stored)
+	expect(t, stored.GetFareEstimate() != nil && stored.GetFareEstimate().Total == fare.Total && stored.GetSurgeMultiplier() == 1.5, "expected the fare estimate to round trip")
+	expect(t, stored.GetRideType() == src.PoolRide && stored.GetSeats() == 2 && stored.GetVehicleCategory() == src.SUV, "expected the ride type and seats to round trip, got %v/%d", stored.GetRideType(), stored.GetSeats())
+	expect(t, stored.GetPaymentMethodId() == "card-1", "expected the payment method to round trip, got %q", stored.GetPaymentMethodId())
+	expect(t, len(stored.GetTimeline()) == 2 && stored.GetTimeline()[0].At.Equal(repos.clock.Now()), "expected 2 transitions stamped by the clock, got %v", stored.GetTimeline())
+	repos.clock.Advance(time.Minute)
+	second, err := repos.rideRepo.CreateRide(user.GetId(), 12.935, 77.624, 12.970, 77.640)
+	expect(t, err == nil, "expected the second ride to be created, got %v", err)
+	expect(t, len(repos.rideRepo.TotalRideForUser(user.GetId())) == 2, "expected 2 rides for the user")
+	expect(t, len(repos.rideRepo.TotalRideForUser("missing")) == 0, "expected no rides for an unknown user")
+
+	// Scheduled rides stay out of the open rides until dispatch starts
+	repos.clock.Advance(time.Minute)
+	pickupAt := repos.clock.Now().Add(2 * time.Hour)
+	scheduled, err := repos.rideRepo.CreateScheduledRide(user.GetId(), 12.970, 77.640, 12.935, 77.624, pickupAt)
+	expect(t, err == nil && scheduled.GetStatus() == src.Scheduled && repos.rideRepo.CountOpenRidesInZone(zone) == 0, "expected a scheduled ride not to be open, got %v", err)
+	expect(t, len(repos.rideRepo.FindScheduledRidesDueBy(pickupAt.Add(-time.Minute))) == 0, "expected no ride due before its pickup")
+	due := repos.rideRepo.FindScheduledRidesDueBy(pickupAt)
+	expect(t, len(due) == 1 && due[0].GetScheduledPickupAt().Equal(pickupAt), "expected the scheduled ride to be due at its pickup, got %v", due)
+	commuter, err := repos.userRepo.CreateUser("Meera")
+	expect(t, err == nil, "expected the user to be created, got %v", err)
+	earlier, _ := repos.rideRepo.CreateScheduledRide(commuter.GetId(), 12.970, 77.640, 12.935, 77.624, pickupAt.Add(-30*time.Minute))
+	abandoned, _ := repos.rideRepo.CreateScheduledRide(commuter.GetId(), 12.970, 77.640, 12.935, 77.624, pickupAt.Add(-time.Hour))
+	expect(t, repos.rideRepo.UpdateRideStatus(abandoned.GetId(), src.Canceled) == nil, "expected the scheduled ride to be canceled")
+	due = repos.rideRepo.FindScheduledRidesDueBy(pickupAt)
+	expect(t, len(due) == 2 && due[0].GetId() == earlier.GetId() && due[1].GetId() == scheduled.GetId(), "expected the rides still scheduled in pickup order, got %v", due)
+	expect(t, repos.rideRepo.UpdateRideStatus(earlier.GetId(), src.Canceled) == nil, "expected the scheduled ride to be canceled")
+	expect(t, repos.rideRepo.UpdateRideStatus(scheduled.GetId(), src.SearchingForCab) == nil, "expected dispatch to start")
+	expect(t, repos.rideRepo.CountOpenRidesInZone(zone) == 1, "expected the ride to be open once dispatch started")
+	expect(t, len(repos.rideRepo.FindScheduledRidesDueBy(pickupAt)) == 0, "expected a dispatched ride to no longer be due")
+	open := repos.rideRepo.FindOpenRides()
+	expect(t, len(open) == 2 && open[0].GetId() == second.GetId() && open[1].GetId() == scheduled.GetId(), "expected the rides searching for a cab oldest first, got %v", open)
+
+	// Cancellations
+	cancellation := src.Cancellation{CancelledBy: src.CancelledByDriver, Reason: src.RiderNoShow, AtFault: src.CancelledByRider,
+		SinceConfirmed: 6 * time.Minute, DriverDistanceKm: 1.2, Fee: 87, At: time.Now().Truncate(time.Second)}
+	_, err = repos.rideRepo.UpdateRide(scheduled.GetId(), func(ride *src.Ride) error {
+		ride.SetCabAcceptedFrom(12.970, 77.640)
+		return ride.Cancel(&cancellation)
+	})
+	cancelled := repos.rideRepo.GetRideById(scheduled.GetId())
+	expect(t, err == nil && cancelled.GetStatus() == src.Canceled && cancelled.GetTotalAmount() == 87, "expected the ride to be cancelled for a fee, got %v", err)
+	storedCancellation := cancelled.GetCancellation()
+	expect(t, storedCancellation != nil && storedCancellation.Reason == src.RiderNoShow && storedCancellation.AtFault == src.CancelledByRider &&
+		storedCancellation.At.Equal(cancellation.At) && storedCancellation.SinceConfirmed == cancellation.SinceConfirmed, "expected the cancellation to round trip, got %v", storedCancellation)
+	expect(t, cancelled.GetCabAcceptedFrom() != nil && cancelled.GetCabAcceptedFrom().Lat == 12.970, "expected where the cab accepted from to round trip")
+
+	// Stops
+	expect(t, len(cancelled.GetStops()) == 0, "expected a ride booked without stops to have none")
+	_, err = repos.rideRepo.UpdateRide(second.GetId(), func(ride *src.Ride) error {
+		if err := ride.AddStop(0, 12.950, 77.630); err != nil {
+			return err
+		}
+		return ride.AddStop(0, 12.940, 77.627)
+	})
+	stops := repos.rideRepo.GetRideById(second.GetId()).GetStops()
+	expect(t, err == nil && len(stops) == 2 && stops[0].Location.Lat == 12.940 && stops[1].Location.Lat == 12.950 && stops[1].Status == src.StopPending,
+		"expected the stops to round trip in order, got %v (%v)", stops, err)
+
+	// Ride history
+	finalFare := &src.FareBreakdown{BaseFare: 50, DistanceFare: 150, TaxPercent: 5, DistanceKm: 12.5, IsFinal: true}
+	finalFare.Settle()
+	_, err = repos.rideRepo.UpdateRide(ride.GetId(), func(ride *src.Ride) error {
+		ride.SetFinalFare(finalFare)
+		return ride.TransitionTo(src.Completed, time.Now())
+	})
+	expect(t, err == nil, "expected the ride to complete, got %v", err)
+	page, err := repos.rideRepo.QueryRides(src.RideQuery{UserId: user.GetId(), Limit: 2})
+	expect(t, err == nil && len(page.Rides) == 2 && page.Rides[0].GetId() == ride.GetId() && page.Rides[1].GetId() == second.GetId() && page.NextCursor != "",
+		"expected the two oldest rides and a cursor, got %v", err)
+	expect(t, page.Totals == src.RideTotals{Rides: 3, Completed: 1, Canceled: 1, Spend: finalFare.Total + 87, DistanceKm: 12.5}, "expected totals over every ride, got %+v", page.Totals)
+	page, err = repos.rideRepo.QueryRides(src.RideQuery{UserId: user.GetId(), Limit: 2, Cursor: page.NextCursor})
+	expect(t, err == nil && len(page.Rides) == 1 && page.Rides[0].GetId() == scheduled.GetId() && page.NextCursor == "", "expected the last ride on the second page, got %v", err)
+	page, _ = repos.rideRepo.QueryRides(src.RideQuery{UserId: user.GetId(), Order: src.NewestFirst, Limit: 1})
+	expect(t, len(page.Rides) == 1 && page.Rides[0].GetId() == scheduled.GetId(), "expected the newest ride first")
+	page, _ = repos.rideRepo.QueryRides(src.RideQuery{UserId: user.GetId(), Statuses: []src.RideStatus{src.Completed, src.PickedUp}})
+	expect(t, len(page.Rides) == 1 && page.Totals.Rides == 1 && page.Rides[0].GetId() == ride.GetId(), "expected only the completed ride, got %d", len(page.Rides))
+	page, _ = repos.rideRepo.QueryRides(src.RideQuery{UserId: user.GetId(), CreatedFrom: second.GetCreatedAt(), CreatedTo: scheduled.GetCreatedAt()})
+	expect(t, len(page.Rides) == 1 && page.Rides[0].GetId() == second.GetId(), "expected the created range to include its start only")
+	page, _ = repos.rideRepo.QueryRides(src.RideQuery{CabId: near.GetId()})
+	expect(t, len(page.Rides) == 1 && page.Rides[0].GetId() == ride.GetId() && page.Totals.DistanceKm == 12.5, "expected the cab's ride")
+	page, _ = repos.rideRepo.QueryRides(src.RideQuery{CabId: far.GetId()})
+	expect(t, len(page.Rides) == 0 && page.Totals.Rides == 0, "expected no rides for an idle cab")
+	_, err = repos.rideRepo.QueryRides(src.RideQuery{UserId: user.GetId(), Cursor: "not a cursor"})
+	expect(t, errors.Is(err, src.ErrInvalidCursor), "expected %v, got %v", src.ErrInvalidCursor, err)
+	_, err = repos.rideRepo.QueryRides(src.RideQuery{Limit: 5})
+	expect(t, errors.Is(err, src.ErrInvalidRideQuery), "expected %v without a user or cab, got %v", src.ErrInvalidRideQuery, err)
+
+	// Ratings
+	submittedAt := time.Now().Truncate(time.Second)
+	expect(t, repos.ratingRepo.SaveRating(src.NewRating(ride.GetId(), src.RatedByRider, user.GetId(), near.GetId(), 4, []string{"polite", "clean car"}, submittedAt)) == nil, "expected the rating to be saved")
+	err = repos.ratingRepo.SaveRating(src.NewRating(ride.GetId(), src.RatedByRider, user.GetId(), near.GetId(), 1, nil, submittedAt))
+	expect(t, errors.Is(err, src.ErrAlreadyRated), "expected %v for a second rating, got %v", src.ErrAlreadyRated, err)
+	expect(t, repos.ratingRepo.SaveRating(src.NewRating(ride.GetId(), src.RatedByDriver, near.GetId(), user.GetId(), 5, nil, submittedAt)) == nil, "expected the driver to rate the rider too")
+	expect(t, repos.ratingRepo.SaveRating(src.NewRating(scheduled.GetId(), src.RatedByRider, user.GetId(), near.GetId(), 2, nil, submittedAt.Add(time.Minute))) == nil, "expected the rating to be saved")
+	rideRatings := repos.ratingRepo.FindRatingsForRide(ride.GetId())
+	expect(t, len(rideRatings) == 2, "expected both sides' ratings for the ride, got %v", rideRatings)
+	for _, rating := range rideRatings {
+		if rating.GetAuthor() == src.RatedByRider {
+			expect(t, rating.GetStars() == 4 && len(rating.GetTags()) == 2 && rating.GetTags()[1] == "clean car" && rating.GetSubmittedAt().Equal(submittedAt), "expected the rating to round trip, got %v", rating)
+		}
+	}
+	recent := repos.ratingRepo.FindRecentRatings(src.RatedByRider, near.GetId(), 1)
+	expect(t, len(recent) == 1 && recent[0].GetRideId() == scheduled.GetId(), "expected the latest rating only, got %v", recent)
+	expect(t, len(repos.ratingRepo.FindRecentRatings(src.RatedByRider, near.GetId(), 10)) == 2, "expected both of the driver's ratings")
+	expect(t, len(repos.ratingRepo.FindRecentRatings(src.RatedByDriver, near.GetId(), 10)) == 0, "expected the rider rating not to count for the driver")
+
+	// Payment methods
+	addedAt := time.Now().Truncate(time.Second)
+	card := src.NewPaymentMethod("card-1", user.GetId(), src.CardPayment, "tok_1", "Card ending 4242", addedAt)
+	expect(t, repos.paymentRepo.SavePaymentMethod(card) == nil, "expected the card to be saved")
+	expect(t, repos.paymentRepo.SavePaymentMethod(src.NewPaymentMethod("wallet-1", user.GetId(), src.WalletPayment, "", "Wallet", addedAt.Add(time.Second))) == nil, "expected the wallet to be saved")
+	expect(t, repos.paymentRepo.SetDefaultPaymentMethod(user.GetId(), "card-1") == nil, "expected the card to become the default")
+	expect(t, repos.paymentRepo.SetDefaultPaymentMethod(user.GetId(), "wallet-1") == nil, "expected the wallet to become the default")
+	err = repos.paymentRepo.SetDefaultPaymentMethod("someone-else", "wallet-1")
+	expect(t, errors.Is(err, src.ErrPaymentMethodNotFound), "expected %v for another rider's method, got %v", src.ErrPaymentMethodNotFound, err)
+	methods := repos.paymentRepo.FindPaymentMethods(user.GetId())
+	expect(t, len(methods) == 2 && methods[0].GetId() == "card-1" && !methods[0].IsDefault() && methods[1].IsDefault(), "expected only the wallet to be the default, got %v", methods)
+	storedCard := repos.paymentRepo.GetPaymentMethodById("card-1")
+	expect(t, storedCard != nil && storedCard.GetGatewayToken() == "tok_1" && storedCard.GetCreatedAt().Equal(addedAt), "expected the card to round trip, got %v", storedCard)
+	expect(t, repos.paymentRepo.GetPaymentMethodById("missing") == nil, "expected no payment method for an unknown id")
+
+	// Payments
+	payment := src.NewPayment("payment-1", stored, *card, addedAt)
+	expect(t, repos.paymentRepo.SavePayment(payment) == nil, "expected the payment to be saved")
+	err = repos.paymentRepo.SavePayment(src.NewPayment("payment-2", stored, *card, addedAt))
+	expect(t, errors.Is(err, src.ErrAlreadyCharged), "expected %v for charging a ride twice, got %v", src.ErrAlreadyCharged, err)
+	_, err = repos.paymentRepo.UpdatePayment("missing", func(payment *src.Payment) error { return nil })
+	expect(t, errors.Is(err, src.ErrPaymentNotFound), "expected %v, got %v", src.ErrPaymentNotFound, err)
+	_, err = repos.paymentRepo.UpdatePayment("payment-1", func(payment *src.Payment) error {
+		return errors.New("rejected")
+	})
+	expect(t, err != nil && repos.paymentRepo.GetPaymentForRide(ride.GetId()).GetStatus() == src.PaymentPending, "expected a failed update to leave the payment untouched")
+	// Payments only change state through the processor, so a failed charge is
+	// recorded through a cash attempt on a cancelled ride.
+	processor := src.NewLedgerPaymentProcessor(repos.paymentRepo, repos.ledgerRepo, repos.userRepo, src.NewFakePaymentGateway(), src.NewIdGenerationUsingUUID(), src.NewInMemoryEventBus(8), src.NewSystemClock())
+	failed, err := processor.ChargeRide(cancelled)
+	expect(t, err == nil && failed.GetStatus() == src.PaymentFailed, "expected a cancelled ride's cash fee to be owed, got %v, %v", failed, err)
+	_, err = processor.ChargeRide(cancelled)
+	expect(t, errors.Is(err, src.ErrAlreadyCharged), "expected %v for charging a ride twice, got %v", src.ErrAlreadyCharged, err)
+	owed := repos.paymentRepo.FindPaymentsForUser(user.GetId(), src.PaymentFailed)
+	expect(t, len(owed) == 1 && owed[0].GetRideId() == cancelled.GetId() && owed[0].GetAmountDue() == 87 && owed[0].GetFailureReason() != "", "expected the unpaid fee, got %v", owed)
+	expect(t, len(repos.paymentRepo.FindPaymentsForUser(user.GetId(), src.PaymentPending)) == 1, "expected the other payment to still be pending")
+	expect(t, repos.paymentRepo.GetPaymentForRide("missing") == nil, "expected no payment for an unknown ride")
+
+	// Ledger
+	expect(t, repos.ledgerRepo.GetBalance(user.GetId()).OutstandingDues == 87, "expected the fee to be owed, got %v", repos.ledgerRepo.GetBalance(user.GetId()))
+	topUp := src.LedgerEntry{Id: "entry-1", UserId: user.GetId(), Kind: src.WalletTopUp, Method: src.CardPayment, Amount: 200, WalletDelta: 200, Reference: "ch_1", At: addedAt}
+	expect(t, repos.ledgerRepo.AppendEntry(topUp) == nil, "expected the top-up to be recorded")
+	charge := src.LedgerEntry{Id: "entry-2", UserId: user.GetId(), RideId: ride.GetId(), PaymentId: "payment-1", Kind: src.RideCharge, Method: src.WalletPayment, Amount: 120, WalletDelta: -120, Note: "fare", At: addedAt}
+	expect(t, repos.ledgerRepo.AppendEntry(charge) == nil, "expected the charge to be recorded")
+	balance := repos.ledgerRepo.GetBalance(user.GetId())
+	expect(t, balance.UserId == user.GetId() && balance.WalletBalance == 80 && balance.OutstandingDues == 87, "expected the balance to add up from the ledger, got %v", balance)
+	entries := repos.ledgerRepo.FindEntriesForUser(user.GetId())
+	expect(t, len(entries) == 3 && entries[0].Kind == src.DueRecorded && entries[2].Id == charge.Id && entries[2].WalletDelta == -120 && entries[2].Note == "fare" && entries[1].At.Equal(addedAt), "expected the entries in order, got %v", entries)
+	expect(t, repos.ledgerRepo.GetBalance("missing") == src.RiderBalance{UserId: "missing"}, "expected an empty balance for an unknown rider")
+
+	// Promotions
+	promotion := &src.Promotion{Code: "MONSOON", Kind: src.PercentageDiscount, Value: 10, MaxDiscount: 40, TotalLimit: 3, PerUserLimit: 2, ValidUntil: addedAt.Add(time.Hour), ZoneIds: []string{"indiranagar"}, CreatedAt: addedAt}
+	expect(t, repos.promotionRepo.SavePromotion(promotion) == nil, "expected the promotion to be saved")
+	err = repos.promotionRepo.SavePromotion(&src.Promotion{Code: "MONSOON", Kind: src.FlatDiscount, Value: 5})
+	expect(t, errors.Is(err, src.ErrPromoCodeTaken), "expected %v for a code in use, got %v", src.ErrPromoCodeTaken, err)
+	storedPromotion := repos.promotionRepo.GetPromotion("MONSOON")
+	expect(t, storedPromotion != nil && storedPromotion.Kind == src.PercentageDiscount && storedPromotion.MaxDiscount == 40 && storedPromotion.ValidFrom.IsZero() &&
+		storedPromotion.ValidUntil.Equal(promotion.ValidUntil) && len(storedPromotion.ZoneIds) == 1 && storedPromotion.ZoneIds[0] == "indiranagar", "expected the promotion to round trip, got %v", storedPromotion)
+	expect(t, repos.promotionRepo.GetPromotion("missing") == nil, "expected no promotion for an unknown code")
+	referral := &src.Promotion{Code: "REFKAVYA", Kind: src.FlatDiscount, Value: 50, FirstRideOnly: true, PerUserLimit: 1, ReferrerId: user.GetId(), CreatedAt: addedAt}
+	expect(t, repos.promotionRepo.SavePromotion(referral) == nil, "expected the referral code to be saved")
+	storedReferral := repos.promotionRepo.GetReferralPromotion(user.GetId())
+	expect(t, storedReferral != nil && storedReferral.Code == "REFKAVYA" && storedReferral.FirstRideOnly, "expected the rider's referral code, got %v", storedReferral)
+	expect(t, repos.promotionRepo.GetReferralPromotion("missing") == nil, "expected no referral code for a rider who never asked for one")
+
+	// Only as many of many concurrent reservations as the limits allow win
+	neverRode := func(string) bool { return false }
+	var reservations sync.WaitGroup
+	reservedCount := make(chan struct{}, 10)
+	for i := 0; i < 10; i++ {
+		reservations.Add(1)
+		go func(i int) {
+			defer reservations.Done()
+			reserve := &src.PromoRedemption{Id: fmt.Sprintf("redemption-%d", i), Code: "MONSOON", UserId: fmt.Sprintf("rider-%d", i%2), Status: src.RedemptionReserved, ReservedAt: addedAt, UpdatedAt: addedAt}
+			if err := repos.promotionRepo.ReserveRedemption(promotion, reserve, neverRode); err == nil {
+				reservedCount <- struct{}{}
+			} else if !errors.Is(err, src.ErrPromoLimitReached) {
+				t.Errorf("expected the reservation to succeed or hit a limit, got %v", err)
+			}
+		}(i)
+	}
+	reservations.Wait()
+	expect(t, len(reservedCount) == 3, "expected 3 reservations of the 10, got %d", len(reservedCount))
+	riderRedemptions := repos.promotionRepo.FindRedemptionsForUser("rider-0")
+	expect(t, len(riderRedemptions) <= 2, "expected a rider to hold at most 2 uses, got %v", riderRedemptions)
+	riderRedemptions = append(riderRedemptions, repos.promotionRepo.FindRedemptionsForUser("rider-1")...)
+	released := riderRedemptions[0]
+	_, err = repos.promotionRepo.UpdateRedemption(released.Id, func(redemption *src.PromoRedemption) error {
+		redemption.Status = src.RedemptionReleased
+		return nil
+	})
+	expect(t, err == nil, "expected the redemption to be released, got %v", err)
+	err = repos.promotionRepo.ReserveRedemption(promotion, &src.PromoRedemption{Id: "redemption-again", Code: "MONSOON", UserId: released.UserId, Status: src.RedemptionReserved, ReservedAt: addedAt, UpdatedAt: addedAt}, neverRode)
+	expect(t, err == nil, "expected a released use to be reserved again, got %v", err)
+	_, err = repos.promotionRepo.UpdateRedemption("missing", func(redemption *src.PromoRedemption) error { return nil })
+	expect(t, errors.Is(err, src.ErrRedemptionNotFound), "expected %v, got %v", src.ErrRedemptionNotFound, err)
+
+	// A rider holds one first ride offer at a time
+	firstRide := &src.Promotion{Code: "FIRSTRIDE", Kind: src.FlatDiscount, Value: 30, FirstRideOnly: true, CreatedAt: addedAt}
+	expect(t, repos.promotionRepo.SavePromotion(firstRide) == nil, "expected the first ride promotion to be saved")
+	newRider := &src.PromoRedemption{Id: "redemption-referral", Code: "REFKAVYA", UserId: "new-rider", Status: src.RedemptionReserved, ReservedAt: addedAt, UpdatedAt: addedAt}
+	expect(t, repos.promotionRepo.ReserveRedemption(referral, newRider, neverRode) == nil, "expected the referral code to be reserved")
+	err = repos.promotionRepo.ReserveRedemption(firstRide, &src.PromoRedemption{Id: "redemption-first", Code: "FIRSTRIDE", UserId: "new-rider", Status: src.RedemptionReserved, ReservedAt: addedAt, UpdatedAt: addedAt}, neverRode)
+	expect(t, errors.Is(err, src.ErrPromoNotApplicable), "expected %v for a second first ride offer, got %v", src.ErrPromoNotApplicable, err)
+	hasRidden := func(string) bool { return true }
+	err = repos.promotionRepo.ReserveRedemption(firstRide, &src.PromoRedemption{Id: "redemption-regular", Code: "FIRSTRIDE", UserId: "regular", Status: src.RedemptionReserved, ReservedAt: addedAt, UpdatedAt: addedAt}, hasRidden)
+	expect(t, errors.Is(err, src.ErrPromoNotApplicable), "expected %v for a rider who has ridden, got %v", src.ErrPromoNotApplicable, err)
+	referralForRaces := &src.Promotion{Code: "REFARJUN", Kind: src.FlatDiscount, Value: 50, FirstRideOnly: true, PerUserLimit: 1, ReferrerId: "arjun", CreatedAt: addedAt}
+	expect(t, repos.promotionRepo.SavePromotion(referralForRaces) == nil, "expected the referral code to be saved")
+	firstRideClaims := make(chan error, 2)
+	for i, offer := range []*src.Promotion{referralForRaces, firstRide} {
+		go func() {
+			firstRideClaims <- repos.promotionRepo.ReserveRedemption(offer, &src.PromoRedemption{Id: fmt.Sprintf("redemption-race-%d", i), Code: offer.Code, UserId: "racing-rider", Status: src.RedemptionReserved, ReservedAt: addedAt, UpdatedAt: addedAt}, neverRode)
+		}()
+	}
+	claimA, claimB := <-firstRideClaims, <-firstRideClaims
+	expect(t, (claimA == nil) != (claimB == nil), "expected one of two racing first ride offers to be reserved, got %v and %v", claimA, claimB)
+
+	// Redemptions are found by ride once one is attached
+	expect(t, repos.promotionRepo.GetRedemptionForRide(ride.GetId()) == nil, "expected no redemption before the ride is attached")
+	_, err = repos.promotionRepo.UpdateRedemption("redemption-referral", func(redemption *src.PromoRedemption) error {
+		redemption.RideId = ride.GetId()
+		redemption.Status = src.RedemptionRedeemed
+		redemption.Discount = 50
+		return nil
+	})
+	expect(t, err == nil, "expected the ride to be attached, got %v", err)
+	forRide := repos.promotionRepo.GetRedemptionForRide(ride.GetId())
+	expect(t, forRide != nil && forRide.Id == "redemption-referral" && forRide.Status == src.RedemptionRedeemed && forRide.Discount == 50 && forRide.ReservedAt.Equal(addedAt),
+		"expected the redemption for the ride, got %v", forRide)
+
+	// Driver earnings
+	earning := src.EarningEntry{Id: "earning-1", CabId: near.GetId(), RideId: ride.GetId(), Kind: src.RideEarning, Fare: 200, Commission: 40, Amount: 160, At: addedAt}
+	expect(t, repos.earningsRepo.AppendEarning(earning) == nil, "expected the ride earning to be recorded")
+	err = repos.earningsRepo.AppendEarning(src.EarningEntry{Id: "earning-2", CabId: near.GetId(), RideId: ride.GetId(), Kind: src.RideEarning, Fare: 200, Commission: 40, Amount: 160, At: addedAt})
+	expect(t, errors.Is(err, src.ErrEarningAlreadyRecorded), "expected %v for a second earning from the ride, got %v", src.ErrEarningAlreadyRecorded, err)
+	expect(t, repos.earningsRepo.AppendEarning(src.EarningEntry{Id: "incentive-1", CabId: near.GetId(), Kind: src.Incentive, Amount: 50, Note: "rain bonus", At: addedAt.Add(time.Hour)}) == nil, "expected the incentive to be recorded")
+	expect(t, repos.earningsRepo.AppendEarning(src.EarningEntry{Id: "incentive-2", CabId: far.GetId(), Kind: src.Incentive, Amount: 30, At: addedAt.Add(time.Hour)}) == nil, "expected the other cab's incentive to be recorded")
+	earnings := repos.earningsRepo.FindEarnings(near.GetId(), addedAt, addedAt.Add(time.Hour))
+	expect(t, len(earnings) == 1 && earnings[0].Id == "earning-1" && earnings[0].Fare == 200 && earnings[0].Commission == 40 && earnings[0].At.Equal(addedAt),
+		"expected only the earning inside the range, got %v", earnings)
+	earnings = repos.earningsRepo.FindEarnings(near.GetId(), addedAt, addedAt.Add(2*time.Hour))
+	expect(t, len(earnings) == 2 && earnings[1].Kind == src.Incentive && earnings[1].Note == "rain bonus", "expected the earnings in order, got %v", earnings)
+	expect(t, repos.earningsRepo.GetEarningsBalance(near.GetId()) == 210 && repos.earningsRepo.GetEarningsBalance("missing") == 0, "expected the balance to add up from the earnings")
+	expect(t, repos.earningsRepo.AppendEarning(src.EarningEntry{Id: "payout-1", CabId: near.GetId(), Kind: src.Payout, Amount: -210, BatchId: "batch-1", At: addedAt.Add(2 * time.Hour)}) == nil, "expected the payout to be recorded")
+	balances := repos.earningsRepo.GetEarningsBalances()
+	expect(t, balances[near.GetId()] == 0 && balances[far.GetId()] == 30, "expected the balances of every cab, got %v", balances)
+	batch := repos.earningsRepo.FindPayoutBatch("batch-1")
+	expect(t, len(batch) == 1 && batch[0].Id == "payout-1" && batch[0].Amount == -210, "expected the payout in its batch, got %v", batch)
+	expect(t, len(repos.earningsRepo.FindPayoutBatch("missing")) == 0, "expected no payouts for an unknown batch")
+
+	// Shift changes come back with the one the range started in
+	expect(t, repos.earningsRepo.GetLastShiftChange(near.GetId()) == nil, "expected no shift change for a cab that never changed shift")
+	shifts := []src.ShiftChange{
+		{CabId: near.GetId(), Status: src.ReadyToTakeRide, At: addedAt},
+		{CabId: near.GetId(), Status: src.OnBreak, At: addedAt.Add(time.Hour)},
+		{CabId: near.GetId(), Status: src.ReadyToTakeRide, At: addedAt.Add(90 * time.Minute)},
+		{CabId: near.GetId(), Status: src.InActive, At: addedAt.Add(3 * time.Hour)},
+	}
+	for _, shift := range shifts {
+		expect(t, repos.earningsRepo.RecordShiftChange(shift) == nil, "expected the shift change to be recorded")
+	}
+	last := repos.earningsRepo.GetLastShiftChange(near.GetId())
+	expect(t, last != nil && last.Status == src.InActive && last.At.Equal(shifts[3].At), "expected the last shift change, got %v", last)
+	found := repos.earningsRepo.FindShiftChanges(near.GetId(), addedAt.Add(70*time.Minute), addedAt.Add(2*time.Hour))
+	expect(t, len(found) == 2 && found[0].Status == src.OnBreak && found[1].Status == src.ReadyToTakeRide && found[1].At.Equal(shifts[2].At),
+		"expected the change the range started in and the one inside it, got %v", found)
+	expect(t, len(repos.earningsRepo.FindShiftChanges(far.GetId(), addedAt, addedAt.Add(time.Hour))) == 0, "expected no shift changes for another cab")
+}
+
+func TestInMemoryRepositories(t *testing.T) {
+	testRepositoryConformance(t, newInMemoryRepositories(src.NewManualClock(time.Date(2026, time.March, 2, 8, 0, 0, 0, time.Local))))
+}
+
+func TestSQLiteMemoryRepositories(t *testing.T) {
+	repos, closeDatabase := openSQLiteRepositories(t, ":memory:", src.NewManualClock(time.Date(2026, time.March, 2, 8, 0, 0, 0, time.Local)))
+	defer closeDatabase()
+	testRepositoryConformance(t, repos)
+
+	// Cancelling reads the cab while the ride update holds its transaction
+	cab, err := repos.cabRepo.CreateCab("Dzire", src.Sedan)
+	expect(t, err == nil, "expected the cab to be created, got %v", err)
+	ride, err := repos.rideRepo.CreateRide("rider", 12.970, 77.640, 12.935, 77.624)
+	expect(t, err == nil, "expected the ride to be created, got %v", err)
+	_, err = repos.rideRepo.UpdateRide(ride.GetId(), func(ride *src.Ride) error {
+		expect(t, repos.cabRepo.GetCabById(cab.GetId()) != nil, "expected the cab to be readable during a ride update")
+		return nil
+	})
+	expect(t, err == nil, "expected the ride update to succeed, got %v", err)
+}
+
+// TestSQLiteRepositories runs the conformance checks, then reopens the database
+// and checks that the entities and the geo indexes built from them come back.
+func TestSQLiteRepositories(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cab_booking.db")
+	clock := src.NewManualClock(time.Date(2026, time.March, 2, 8, 0, 0, 0, time.Local))
+
+	repos, closeDatabase := openSQLiteRepositories(t, path, clock)
+	testRepositoryConformance(t, repos)
+	user, err := repos.userRepo.CreateUser("Rohan")
+	expect(t, err == nil, "expected the user to be created, got %v", err)
+	cab, err := repos.cabRepo.CreateCab("Ertiga", src.SUV)
+	expect(t, err == nil, "expected the cab to be created, got %v", err)
+	repos.cabRepo.UpdateCabLocation(cab.GetId(), 12.9352, 77.6245)
+	ride, err := repos.rideRepo.CreateRide(user.GetId(), 12.9350, 77.6240, 12.9716, 77.5946)
+	expect(t, err == nil, "expected the ride to be created, got %v", err)
+	koramangala := src.NewPolygonZone("koramangala", []src.GeoPoint{{Lat: 12.92, Lon: 77.61}, {Lat: 12.92, Lon: 77.64}, {Lat: 12.95, Lon: 77.64}, {Lat: 12.95, Lon: 77.61}})
+	openRides := repos.rideRepo.CountOpenRidesInZone(koramangala)
+	repos.ledgerRepo.AppendEntry(src.LedgerEntry{Id: "top-up", UserId: user.GetId(), Kind: src.WalletTopUp, Method: src.CardPayment, Amount: 150, WalletDelta: 150, At: time.Now()})
+	repos.rideRepo.UpdateRide(ride.GetId(), func(ride *src.Ride) error {
+		ride.SetPromoCode("REFROHAN")
+		return nil
+	})
+	closeDatabase()
+
+	// Writes to a closed database fail instead of handing back nothing
+	_, err = repos.userRepo.CreateUser("Ghost")
+	expect(t, err != nil, "expected creating a user on a closed database to fail")
+	_, err = repos.cabRepo.CreateCab("Ghost", src.Sedan)
+	expect(t, err != nil, "expected creating a cab on a closed database to fail")
+	_, err = repos.rideRepo.CreateRide(user.GetId(), 12.9350, 77.6240, 12.9716, 77.5946)
+	expect(t, err != nil, "expected creating a ride on a closed database to fail")
+
+	repos, closeDatabase = openSQLiteRepositories(t, path, clock)
+	defer closeDatabase()
+	expect(t, repos.userRepo.GetUserById(user.GetId()) != nil, "expected the user to survive a restart")
+	nearest := repos.cabRepo.FindNearestAvailableCabs(12.9350, 77.6240, 1, src.SUV)
+	expect(t, len(nearest) == 1 && nearest[0].GetId() == cab.GetId(), "expected the cab to be found near its last location after a restart, got %v", nearest)
+	expect(t, openRides > 0 && repos.rideRepo.CountOpenRidesInZone(koramangala) == openRides, "expected the open rides to be indexed again after a restart")
+	reopened := repos.rideRepo.FindOpenRides()
+	expect(t, slices.ContainsFunc(reopened, func(open src.Ride) bool { return open.GetId() == ride.GetId() }), "expected the ride to still be searching for a cab after a restart, got %v", reopened)
+	expect(t, len(repos.rideRepo.TotalRideForUser(ride.GetUserId())) == 1, "expected the ride history to survive a restart")
+	expect(t, repos.ledgerRepo.GetBalance(user.GetId()).WalletBalance == 150, "expected the wallet balance to survive a restart")
+	expect(t, repos.rideRepo.GetRideById(ride.GetId()).GetPromoCode() == "REFROHAN", "expected the ride's promo code to survive a restart")
+	expect(t, repos.promotionRepo.GetPromotion("MONSOON") != nil, "expected the promotions to survive a restart")
+	expect(t, len(repos.promotionRepo.FindRedemptionsForUser("new-rider")) == 1, "expected the redemptions to survive a restart")
+	expect(t, len(repos.earningsRepo.FindPayoutBatch("batch-1")) == 1, "expected the driver earnings to survive a restart")
+	expect(t, len(repos.earningsRepo.GetEarningsBalances()) == 2, "expected the driver balances to survive a restart")
+}
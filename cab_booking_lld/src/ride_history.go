@@ -0,0 +1,204 @@
+package src
+
+import (
+	"encoding/base64"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	DefaultRidePageSize = 20
+	MaxRidePageSize     = 100
+)
+
+type RideSortOrder int
+
+const (
+	OldestFirst RideSortOrder = iota
+	NewestFirst
+)
+
+func (rso RideSortOrder) String() string {
+	switch rso {
+	case OldestFirst:
+		return "oldest"
+	case NewestFirst:
+		return "newest"
+	}
+	return "Unknown"
+}
+
+func ParseRideSortOrder(name string) (RideSortOrder, error) {
+	for order := OldestFirst; order <= NewestFirst; order++ {
+		if order.String() == name {
+			return order, nil
+		}
+	}
+	return 0, fmt.Errorf("%w: unknown sort order %q", ErrInvalidRideQuery, name)
+}
+
+// RideQuery selects the rides of a user, a cab, or both. Statuses and the
+// created range narrow it down, with CreatedFrom inclusive and CreatedTo
+// exclusive. Cursor is the NextCursor of the previous page.
+type RideQuery struct {
+	UserId      string
+	CabId       string
+	Statuses    []RideStatus
+	CreatedFrom time.Time
+	CreatedTo   time.Time
+	Order       RideSortOrder
+	Limit       int
+	Cursor      string
+}
+
+// RideTotals sum up every ride the query matches, not just the page. Spend
+// counts what was charged: completed fares and cancellation fees.
+type RideTotals struct {
+	Rides      int
+	Completed  int
+	Canceled   int
+	Spend      int
+	DistanceKm float64
+}
+
+func (rt *RideTotals) add(ride *Ride) {
+	rt.Rides++
+	switch ride.GetStatus() {
+	case Completed:
+		rt.Completed++
+		rt.Spend += ride.GetTotalAmount()
+		if finalFare := ride.GetFinalFare(); finalFare != nil {
+			rt.DistanceKm += finalFare.DistanceKm
+		}
+	case Canceled:
+		rt.Canceled++
+		rt.Spend += ride.GetTotalAmount()
+	}
+}
+
+// RidePage is one page of a ride query. NextCursor is empty on the last page.
+type RidePage struct {
+	Rides      []Ride
+	NextCursor string
+	Totals     RideTotals
+}
+
+// rideCursor is the position of the last ride on a page. Rides are ordered by
+// created time and then id, so a cursor stays valid as new rides are booked.
+type rideCursor struct {
+	createdAt int64
+	rideId    string
+}
+
+func newRideCursor(ride *Ride) string {
+	raw := strconv.FormatInt(ride.GetCreatedAt().UnixNano(), 10) + ":" + ride.GetId()
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+func parseRideCursor(cursor string) (*rideCursor, error) {
+	if cursor == "" {
+		return nil, nil
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+	createdAt, rideId, found := strings.Cut(string(raw), ":")
+	if !found || rideId == "" {
+		return nil, ErrInvalidCursor
+	}
+	nanos, err := strconv.ParseInt(createdAt, 10, 64)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+	return &rideCursor{createdAt: nanos, rideId: rideId}, nil
+}
+
+// normalize checks the query and fills in the default page size.
+func (rq RideQuery) normalize() (RideQuery, *rideCursor, error) {
+	if rq.UserId == "" && rq.CabId == "" {
+		return rq, nil, fmt.Errorf("%w: a user or a cab is required", ErrInvalidRideQuery)
+	}
+	if rq.Order != OldestFirst && rq.Order != NewestFirst {
+		return rq, nil, fmt.Errorf("%w: unknown sort order", ErrInvalidRideQuery)
+	}
+	if rq.Limit < 0 || rq.Limit > MaxRidePageSize {
+		return rq, nil, fmt.Errorf("%w: limit must be between 1 and %d", ErrInvalidRideQuery, MaxRidePageSize)
+	}
+	if rq.Limit == 0 {
+		rq.Limit = DefaultRidePageSize
+	}
+	if !rq.CreatedFrom.IsZero() && !rq.CreatedTo.IsZero() && !rq.CreatedFrom.Before(rq.CreatedTo) {
+		return rq, nil, fmt.Errorf("%w: the created range is empty", ErrInvalidRideQuery)
+	}
+	cursor, err := parseRideCursor(rq.Cursor)
+	return rq, cursor, err
+}
+
+func (rq RideQuery) matches(ride *Ride) bool {
+	if rq.UserId != "" && ride.GetUserId() != rq.UserId {
+		return false
+	}
+	if rq.CabId != "" && ride.GetCabId() != rq.CabId {
+		return false
+	}
+	if len(rq.Statuses) > 0 {
+		found := false
+		for _, status := range rq.Statuses {
+			found = found || ride.GetStatus() == status
+		}
+		if !found {
+			return false
+		}
+	}
+	createdAt := ride.GetCreatedAt()
+	if !rq.CreatedFrom.IsZero() && createdAt.Before(rq.CreatedFrom) {
+		return false
+	}
+	return rq.CreatedTo.IsZero() || createdAt.Before(rq.CreatedTo)
+}
+
+// pageRides sorts the matched rides, totals them and cuts out the page that
+// follows the cursor.
+func pageRides(rides []Ride, query RideQuery, cursor *rideCursor) *RidePage {
+	page := &RidePage{Rides: make([]Ride, 0)}
+	for i := range rides {
+		page.Totals.add(&rides[i])
+	}
+	sort.Slice(rides, func(i, j int) bool {
+		return rideBefore(&rides[i], rides[j].GetCreatedAt().UnixNano(), rides[j].GetId(), query.Order)
+	})
+	start := 0
+	if cursor != nil {
+		start = sort.Search(len(rides), func(i int) bool {
+			return !rideBefore(&rides[i], cursor.createdAt, cursor.rideId, query.Order) && !rideAt(&rides[i], cursor)
+		})
+	}
+	end := min(len(rides), start+query.Limit)
+	page.Rides = append(page.Rides, rides[start:end]...)
+	if end < len(rides) {
+		page.NextCursor = newRideCursor(&rides[end-1])
+	}
+	return page
+}
+
+func rideBefore(ride *Ride, createdAt int64, rideId string, order RideSortOrder) bool {
+	rideCreatedAt := ride.GetCreatedAt().UnixNano()
+	if rideCreatedAt == createdAt {
+		if order == NewestFirst {
+			return ride.GetId() > rideId
+		}
+		return ride.GetId() < rideId
+	}
+	if order == NewestFirst {
+		return rideCreatedAt > createdAt
+	}
+	return rideCreatedAt < createdAt
+}
+
+func rideAt(ride *Ride, cursor *rideCursor) bool {
+	return ride.GetCreatedAt().UnixNano() == cursor.createdAt && ride.GetId() == cursor.rideId
+}
@@ -0,0 +1,46 @@
+package src
+
+import (
+	"fmt"
+	"time"
+)
+
+var allowedRideTransitions = map[RideStatus][]RideStatus{
+	Scheduled:       {SearchingForCab, Canceled},
+	SearchingForCab: {Confirmed, NoCabFound, Canceled},
+	Confirmed:       {PickedUp, Canceled},
+	PickedUp:        {Completed},
+}
+
+func CanTransitionRide(from, to RideStatus) bool {
+	for _, allowed := range allowedRideTransitions[from] {
+		if allowed == to {
+			return true
+		}
+	}
+	return false
+}
+
+type RideTransition struct {
+	From RideStatus
+	To   RideStatus
+	At   time.Time
+}
+
+func (rt RideTransition) String() string {
+	return fmt.Sprintf("%s: %v -> %v", rt.At.Format(time.RFC3339Nano), rt.From, rt.To)
+}
+
+type InvalidRideTransitionError struct {
+	RideId string
+	From   RideStatus
+	To     RideStatus
+}
+
+func (irte *InvalidRideTransitionError) Error() string {
+	return fmt.Sprintf("ride %s cannot move from %v to %v", irte.RideId, irte.From, irte.To)
+}
+
+func (irte *InvalidRideTransitionError) Is(target error) bool {
+	return target == ErrInvalidTransition
+}
@@ -0,0 +1,345 @@
+package src
+
+import (
+	"container/heap"
+	"container/list"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sync"
+	"time"
+)
+
+// roadGraphFile is the layout of a road graph file. Edges go both ways unless
+// marked one way, and an edge without a length is as long as the straight line
+// between its nodes.
+type roadGraphFile struct {
+	Nodes []struct {
+		Id  string  `json:"id"`
+		Lat float64 `json:"lat"`
+		Lon float64 `json:"lon"`
+	} `json:"nodes"`
+	Edges []struct {
+		From      string  `json:"from"`
+		To        string  `json:"to"`
+		LengthKm  float64 `json:"lengthKm"`
+		SpeedKmph float64 `json:"speedKmph"`
+		OneWay    bool    `json:"oneWay"`
+	} `json:"edges"`
+}
+
+type RoadNode struct {
+	Id  string
+	Lat float64
+	Lon float64
+}
+
+type roadEdge struct {
+	to       int
+	lengthKm float64
+	hours    float64
+}
+
+// RoadGraph is a read-only road network, safe to route on from many goroutines.
+type RoadGraph struct {
+	nodes        []RoadNode
+	nodeIndex    map[string]int
+	edges        [][]roadEdge
+	snapIndex    GeoIndex
+	maxSpeedKmph float64
+}
+
+func LoadRoadGraph(path string, distanceCalculator DistanceCalculator) (*RoadGraph, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return ReadRoadGraph(file, distanceCalculator)
+}
+
+func ReadRoadGraph(r io.Reader, distanceCalculator DistanceCalculator) (*RoadGraph, error) {
+	var graphFile roadGraphFile
+	decoder := json.NewDecoder(r)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&graphFile); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidRoadGraph, err)
+	}
+	if len(graphFile.Nodes) == 0 {
+		return nil, fmt.Errorf("%w: no nodes", ErrInvalidRoadGraph)
+	}
+	graph := &RoadGraph{
+		nodes:     make([]RoadNode, 0, len(graphFile.Nodes)),
+		nodeIndex: make(map[string]int, len(graphFile.Nodes)),
+		edges:     make([][]roadEdge, len(graphFile.Nodes)),
+		snapIndex: NewGridGeoIndex(0.01, distanceCalculator),
+	}
+	for _, node := range graphFile.Nodes {
+		if _, exists := graph.nodeIndex[node.Id]; exists || node.Id == "" {
+			return nil, fmt.Errorf("%w: node id %q is empty or repeated", ErrInvalidRoadGraph, node.Id)
+		}
+		if err := ValidateCoordinates(node.Lat, node.Lon); err != nil {
+			return nil, fmt.Errorf("%w: node %s: %v", ErrInvalidRoadGraph, node.Id, err)
+		}
+		graph.nodeIndex[node.Id] = len(graph.nodes)
+		graph.nodes = append(graph.nodes, RoadNode{Id: node.Id, Lat: node.Lat, Lon: node.Lon})
+		graph.snapIndex.Upsert(node.Id, node.Lat, node.Lon)
+	}
+	for _, edge := range graphFile.Edges {
+		from, fromExists := graph.nodeIndex[edge.From]
+		to, toExists := graph.nodeIndex[edge.To]
+		if !fromExists || !toExists {
+			return nil, fmt.Errorf("%w: edge %s-%s joins an unknown node", ErrInvalidRoadGraph, edge.From, edge.To)
+		}
+		if edge.SpeedKmph <= 0 {
+			return nil, fmt.Errorf("%w: edge %s-%s needs a speed", ErrInvalidRoadGraph, edge.From, edge.To)
+		}
+		// A* estimates the time left from the straight line, so no road may be
+		// shorter than it.
+		straightKm := distanceCalculator.Distance(graph.nodes[from].Lat, graph.nodes[from].Lon, graph.nodes[to].Lat, graph.nodes[to].Lon)
+		lengthKm := edge.LengthKm
+		if lengthKm == 0 {
+			lengthKm = straightKm
+		} else if lengthKm < straightKm*0.999 {
+			return nil, fmt.Errorf("%w: edge %s-%s is shorter than the straight line between its nodes", ErrInvalidRoadGraph, edge.From, edge.To)
+		}
+		hours := lengthKm / edge.SpeedKmph
+		graph.edges[from] = append(graph.edges[from], roadEdge{to: to, lengthKm: lengthKm, hours: hours})
+		if !edge.OneWay {
+			graph.edges[to] = append(graph.edges[to], roadEdge{to: from, lengthKm: lengthKm, hours: hours})
+		}
+		graph.maxSpeedKmph = math.Max(graph.maxSpeedKmph, edge.SpeedKmph)
+	}
+	return graph, nil
+}
+
+func (rg *RoadGraph) GetNodeCount() int {
+	return len(rg.nodes)
+}
+
+// Snap finds the node closest to the coordinates and how far away it is.
+func (rg *RoadGraph) Snap(lat, lon float64) (RoadNode, float64) {
+	nearest := rg.snapIndex.Nearest(lat, lon, 1, nil)
+	return rg.nodes[rg.nodeIndex[nearest[0].Id]], nearest[0].DistanceKm
+}
+
+// Route is the way by road between two points. Points runs from the node the
+// start snapped to to the node the end snapped to, while the distance and the
+// duration also cover getting on and off the road network.
+type Route struct {
+	Points     []GeoPoint
+	DistanceKm float64
+	Duration   time.Duration
+}
+
+func (r *Route) String() string {
+	return fmt.Sprintf("{%.2f km in %v over %d nodes}", r.DistanceKm, r.Duration.Round(time.Second), len(r.Points))
+}
+
+type RouteCacheStats struct {
+	Hits   int
+	Misses int
+	Size   int
+}
+
+type Router interface {
+	// Route fails with ErrOffRoadNetwork when either point is too far from a
+	// road and with ErrNoRoute when no road joins them.
+	Route(fromLat, fromLon, toLat, toLon float64) (*Route, error)
+	GetCacheStats() RouteCacheStats
+}
+
+type RoutingPolicy struct {
+	// MaxSnapDistanceKm is how far from the nearest node a point can be and
+	// still be routed. Zero allows any distance.
+	MaxSnapDistanceKm float64
+	// AccessSpeedKmph is the speed assumed between a point and its node.
+	AccessSpeedKmph float64
+	// CacheSize is how many node to node paths are kept, least recently used
+	// first out. Zero turns the cache off.
+	CacheSize int
+}
+
+type routeCacheKey struct {
+	from int
+	to   int
+}
+
+type cachedPath struct {
+	key        routeCacheKey
+	path       []int
+	distanceKm float64
+	hours      float64
+}
+
+// AStarRouter snaps both points to the road graph and finds the fastest path
+// between their nodes with A*, timing the part still to go as the straight line
+// at the graph's top speed. Paths between nodes are cached, since riders keep
+// asking for the same stretches of road.
+type AStarRouter struct {
+	graph              *RoadGraph
+	distanceCalculator DistanceCalculator
+	policy             RoutingPolicy
+	mu                 sync.Mutex
+	cache              map[routeCacheKey]*list.Element
+	recent             *list.List
+	stats              RouteCacheStats
+}
+
+func NewAStarRouter(graph *RoadGraph, distanceCalculator DistanceCalculator, policy RoutingPolicy) Router {
+	return &AStarRouter{
+		graph:              graph,
+		distanceCalculator: distanceCalculator,
+		policy:             policy,
+		cache:              make(map[routeCacheKey]*list.Element),
+		recent:             list.New(),
+	}
+}
+
+func (asr *AStarRouter) Route(fromLat, fromLon, toLat, toLon float64) (*Route, error) {
+	fromNode, fromSnapKm := asr.graph.Snap(fromLat, fromLon)
+	toNode, toSnapKm := asr.graph.Snap(toLat, toLon)
+	if limit := asr.policy.MaxSnapDistanceKm; limit > 0 && (fromSnapKm > limit || toSnapKm > limit) {
+		return nil, fmt.Errorf("%w: %.2f km and %.2f km from the nearest roads", ErrOffRoadNetwork, fromSnapKm, toSnapKm)
+	}
+	key := routeCacheKey{from: asr.graph.nodeIndex[fromNode.Id], to: asr.graph.nodeIndex[toNode.Id]}
+	path := asr.cachedPath(key)
+	if path == nil {
+		path = asr.findPath(key)
+		if path == nil {
+			return nil, fmt.Errorf("%w: from node %s to node %s", ErrNoRoute, fromNode.Id, toNode.Id)
+		}
+		asr.cachePath(path)
+	}
+	accessKm := fromSnapKm + toSnapKm
+	hours := path.hours
+	if asr.policy.AccessSpeedKmph > 0 {
+		hours += accessKm / asr.policy.AccessSpeedKmph
+	}
+	route := &Route{
+		Points:     make([]GeoPoint, 0, len(path.path)),
+		DistanceKm: path.distanceKm + accessKm,
+		Duration:   time.Duration(hours * float64(time.Hour)),
+	}
+	for _, node := range path.path {
+		route.Points = append(route.Points, GeoPoint{Lat: asr.graph.nodes[node].Lat, Lon: asr.graph.nodes[node].Lon})
+	}
+	return route, nil
+}
+
+func (asr *AStarRouter) GetCacheStats() RouteCacheStats {
+	asr.mu.Lock()
+	defer asr.mu.Unlock()
+	stats := asr.stats
+	stats.Size = asr.recent.Len()
+	return stats
+}
+
+func (asr *AStarRouter) cachedPath(key routeCacheKey) *cachedPath {
+	if asr.policy.CacheSize <= 0 {
+		return nil
+	}
+	asr.mu.Lock()
+	defer asr.mu.Unlock()
+	element, exists := asr.cache[key]
+	if !exists {
+		asr.stats.Misses++
+		return nil
+	}
+	asr.stats.Hits++
+	asr.recent.MoveToFront(element)
+	return element.Value.(*cachedPath)
+}
+
+func (asr *AStarRouter) cachePath(path *cachedPath) {
+	if asr.policy.CacheSize <= 0 {
+		return
+	}
+	asr.mu.Lock()
+	defer asr.mu.Unlock()
+	if element, exists := asr.cache[path.key]; exists {
+		asr.recent.MoveToFront(element)
+		return
+	}
+	asr.cache[path.key] = asr.recent.PushFront(path)
+	if asr.recent.Len() > asr.policy.CacheSize {
+		oldest := asr.recent.Back()
+		asr.recent.Remove(oldest)
+		delete(asr.cache, oldest.Value.(*cachedPath).key)
+	}
+}
+
+type searchEntry struct {
+	node     int
+	estimate float64
+}
+
+type searchQueue []searchEntry
+
+func (sq searchQueue) Len() int           { return len(sq) }
+func (sq searchQueue) Less(i, j int) bool { return sq[i].estimate < sq[j].estimate }
+func (sq searchQueue) Swap(i, j int)      { sq[i], sq[j] = sq[j], sq[i] }
+func (sq *searchQueue) Push(x any)        { *sq = append(*sq, x.(searchEntry)) }
+func (sq *searchQueue) Pop() any {
+	old := *sq
+	entry := old[len(old)-1]
+	*sq = old[:len(old)-1]
+	return entry
+}
+
+// findPath returns nil when the goal cannot be reached from the start.
+func (asr *AStarRouter) findPath(key routeCacheKey) *cachedPath {
+	graph := asr.graph
+	goal := graph.nodes[key.to]
+	hoursLeft := func(node int) float64 {
+		if graph.maxSpeedKmph == 0 {
+			return 0
+		}
+		return asr.distanceCalculator.Distance(graph.nodes[node].Lat, graph.nodes[node].Lon, goal.Lat, goal.Lon) / graph.maxSpeedKmph
+	}
+	hours := map[int]float64{key.from: 0}
+	cameFrom := make(map[int]roadEdge)
+	previous := make(map[int]int)
+	done := make(map[int]bool)
+	queue := &searchQueue{{node: key.from, estimate: hoursLeft(key.from)}}
+	for queue.Len() > 0 {
+		node := heap.Pop(queue).(searchEntry).node
+		if done[node] {
+			continue
+		}
+		if node == key.to {
+			return asr.tracePath(key, previous, cameFrom, hours[node])
+		}
+		done[node] = true
+		for _, edge := range graph.edges[node] {
+			if done[edge.to] {
+				continue
+			}
+			if known, seen := hours[edge.to]; seen && known <= hours[node]+edge.hours {
+				continue
+			}
+			hours[edge.to] = hours[node] + edge.hours
+			previous[edge.to] = node
+			cameFrom[edge.to] = edge
+			heap.Push(queue, searchEntry{node: edge.to, estimate: hours[edge.to] + hoursLeft(edge.to)})
+		}
+	}
+	return nil
+}
+
+func (asr *AStarRouter) tracePath(key routeCacheKey, previous map[int]int, cameFrom map[int]roadEdge, hours float64) *cachedPath {
+	path := &cachedPath{key: key, hours: hours}
+	for node := key.to; ; node = previous[node] {
+		path.path = append(path.path, node)
+		if node == key.from {
+			break
+		}
+		path.distanceKm += cameFrom[node].lengthKm
+	}
+	for i, j := 0, len(path.path)-1; i < j; i, j = i+1, j-1 {
+		path.path[i], path.path[j] = path.path[j], path.path[i]
+	}
+	return path
+}
@@ -0,0 +1,86 @@
+package src
+
+import (
+	"sync"
+	"time"
+)
+
+type RideScheduler interface {
+	DispatchDue() []*Ride
+	GetLeadTime() time.Duration
+	Close()
+}
+
+// LeadTimeRideScheduler starts dispatch for a scheduled ride once its pickup is
+// no more than leadTime away. The rides themselves are the schedule, so a
+// cancelled or rescheduled ride needs no bookkeeping here.
+type LeadTimeRideScheduler struct {
+	clock          Clock
+	rideRepo       IRideRegistory
+	rideDispatcher RideDispatcher
+	eventBus       EventBus
+	leadTime       time.Duration
+	done           chan struct{}
+	closeOnce      sync.Once
+}
+
+func NewLeadTimeRideScheduler(clock Clock, rideRepo IRideRegistory, rideDispatcher RideDispatcher, eventBus EventBus, leadTime, checkInterval time.Duration) RideScheduler {
+	lrs := &LeadTimeRideScheduler{
+		clock:          clock,
+		rideRepo:       rideRepo,
+		rideDispatcher: rideDispatcher,
+		eventBus:       eventBus,
+		leadTime:       leadTime,
+		done:           make(chan struct{}),
+	}
+	go lrs.dispatchDuePeriodically(clock.NewTicker(checkInterval))
+	return lrs
+}
+
+func (lrs *LeadTimeRideScheduler) dispatchDuePeriodically(ticker Ticker) {
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C():
+			lrs.DispatchDue()
+		case <-lrs.done:
+			return
+		}
+	}
+}
+
+// DispatchDue moves every ride that is due out of Scheduled and hands it to the
+// dispatcher. It returns the rides it started.
+func (lrs *LeadTimeRideScheduler) DispatchDue() []*Ride {
+	now := lrs.clock.Now()
+	pickupBy := now.Add(lrs.leadTime)
+	started := make([]*Ride, 0)
+	for _, due := range lrs.rideRepo.FindScheduledRidesDueBy(pickupBy) {
+		ride, err := lrs.rideRepo.UpdateRide(due.GetId(), func(ride *Ride) error {
+			// The rider may have cancelled or moved the pickup since it was read.
+			if ride.GetStatus() != Scheduled || ride.GetScheduledPickupAt().After(pickupBy) {
+				return ErrRideNotScheduled
+			}
+			return ride.TransitionTo(SearchingForCab, now)
+		})
+		if err != nil {
+			continue
+		}
+		lrs.eventBus.Publish(newRideEvent(RideRequested, ride, lrs.clock.Now()))
+		go lrs.rideDispatcher.Dispatch(ride)
+		started = append(started, ride)
+	}
+	return started
+}
+
+func (lrs *LeadTimeRideScheduler) GetLeadTime() time.Duration {
+	return lrs.leadTime
+}
+
+// Close stops checking for due rides. Rides already handed to the dispatcher
+// are not affected.
+func (lrs *LeadTimeRideScheduler) Close() {
+	lrs.closeOnce.Do(func() {
+		close(lrs.done)
+	})
+}
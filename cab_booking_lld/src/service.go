@@ -1,17 +1,117 @@
 package src
 
 import (
+	"fmt"
+	"slices"
 	"time"
 )
 
 type CabService interface {
-	RegisterUser(name string) *User
-	RegisterCab(name string) *Cab
-	BookRide(userId string, startPointLat float64, startPointLon float64, endPointLat float64, endPointLon float64) *Ride
-	GetRideStatus(rideId string) RideStatus
-	UpdateRideStatus(rideId string, newStatus RideStatus) *Ride
+	RegisterUser(name string) (*User, error)
+	GetUser(userId string) (*User, error)
+	RegisterCab(name string, category VehicleCategory) (*Cab, error)
+	BookRide(userId string, startPointLat float64, startPointLon float64, endPointLat float64, endPointLon float64, options ...BookingOption) (*Ride, error)
+	GetRide(rideId string) (*Ride, error)
+	GetRideStatus(rideId string) (RideStatus, error)
+	UpdateRideStatus(rideId string, newStatus RideStatus) (*Ride, error)
+	CancelRide(rideId string, cancelledBy CancellationActor, reason CancellationReason) (*Ride, error)
 	UpdateCabLocation(cabId string, lat, lon float64) error
 	TotalRideForUser(userId string) []Ride
+	QueryRides(query RideQuery) (*RidePage, error)
+	AcceptRide(rideId, cabId string) error
+	RejectRide(rideId, cabId string) error
+	GetRideOffer(rideId string) (*RideOffer, error)
+	GetRideTimeline(rideId string) ([]RideTransition, error)
+	SetUserPriorityTier(userId string, priorityTier int) error
+	GetPendingRide(rideId string) (*PendingRide, error)
+	GetPendingQueueStats() PendingQueueStats
+	TrackRide(rideId string) (*RideTracker, error)
+	ScheduleRide(userId string, startPointLat float64, startPointLon float64, endPointLat float64, endPointLon float64, pickupAt time.Time, options ...BookingOption) (*Ride, error)
+	RescheduleRide(rideId string, pickupAt time.Time) (*Ride, error)
+	GetPoolTrip(rideId string) (*PoolTrip, error)
+	QuoteFares(startPointLat float64, startPointLon float64, endPointLat float64, endPointLon float64) ([]FareQuote, error)
+	GetCab(cabId string) (*Cab, error)
+	RateDriver(rideId, userId string, stars int, tags []string) (*Rating, error)
+	RateRider(rideId, cabId string, stars int, tags []string) (*Rating, error)
+	GetRideRatings(rideId string) ([]Rating, error)
+	AddPaymentMethod(userId string, methodType PaymentMethodType, cardNumber string, makeDefault bool) (*PaymentMethod, error)
+	GetPaymentMethods(userId string) ([]PaymentMethod, error)
+	SetDefaultPaymentMethod(userId, methodId string) error
+	TopUpWallet(userId, methodId string, amount int) (RiderBalance, error)
+	GetBalance(userId string) (RiderBalance, error)
+	PayDues(userId, methodId string) (RiderBalance, error)
+	GetLedger(userId string) ([]LedgerEntry, error)
+	GetRidePayment(rideId string) (*Payment, error)
+	RefundRide(rideId string, amount int, reason string) (*Payment, error)
+	CreatePromotion(promotion Promotion) (*Promotion, error)
+	GetPromotion(code string) (*Promotion, error)
+	GetReferralCode(userId string) (*Promotion, error)
+	GetPromoRedemptions(userId string) ([]PromoRedemption, error)
+	GoOnline(cabId string) (*Cab, error)
+	TakeBreak(cabId string) (*Cab, error)
+	GoOffline(cabId string) (*Cab, error)
+	AddDriverIncentive(cabId string, amount int, note string) (*EarningEntry, error)
+	GetEarningsBalance(cabId string) (int, error)
+	GetEarningsStatement(cabId string, period StatementPeriod, at time.Time) (*EarningsStatement, error)
+	CreatePayoutBatch() (*PayoutBatch, error)
+	GetPayoutBatch(batchId string) (*PayoutBatch, error)
+	GetZoneQueue(zoneId string) ([]QueuedCab, error)
+	AddStop(rideId string, index int, lat, lon float64) (*Ride, error)
+	RemoveStop(rideId string, index int) (*Ride, error)
+	ArriveAtStop(rideId string, index int) (*Ride, error)
+	DepartStop(rideId string, index int) (*Ride, error)
+	Close()
+}
+
+type bookingOptions struct {
+	rideType RideType
+	seats    int
+	category VehicleCategory
+	// paymentMethodId is left empty to pay with the rider's default method.
+	paymentMethodId string
+	promoCode       string
+	stops           []GeoPoint
+}
+
+type BookingOption func(options *bookingOptions)
+
+// WithPool books a shared ride for the given number of seats.
+func WithPool(seats int) BookingOption {
+	return func(options *bookingOptions) {
+		options.rideType = PoolRide
+		options.seats = seats
+	}
+}
+
+// WithVehicleCategory only matches the ride with cabs of the category.
+func WithVehicleCategory(category VehicleCategory) BookingOption {
+	return func(options *bookingOptions) {
+		options.category = category
+	}
+}
+
+// WithPaymentMethod charges the ride to one of the rider's stored methods
+// instead of their default.
+func WithPaymentMethod(methodId string) BookingOption {
+	return func(options *bookingOptions) {
+		options.paymentMethodId = methodId
+	}
+}
+
+// WithPromoCode applies the promotion of the code, or a rider's referral code,
+// to the fare.
+func WithPromoCode(code string) BookingOption {
+	return func(options *bookingOptions) {
+		options.promoCode = code
+	}
+}
+
+// WithStops makes the ride stop at the locations, in order, on the way to the
+// drop.
+func WithStops(stops ...GeoPoint) BookingOption {
+	return func(options *bookingOptions) {
+		options.stops = append(options.stops, stops...)
+	}
 }
 
 type InMemoryCabService struct {
@@ -20,66 +120,556 @@ type InMemoryCabService struct {
 	rideRepo             IRideRegistory
 	idGenerationStrategy IdGenerationStrategy
 	pricingStrategy      PricingStrategy
-	cabFindingStrategy   CabFindingStrategy
+	rideDispatcher       RideDispatcher
+	poolManager          PoolManager
+	ratingManager        RatingManager
+	cancellationManager  CancellationManager
+	paymentProcessor     PaymentProcessor
+	promotionManager     PromotionManager
+	driverManager        DriverManager
+	zoneManager          ZoneManager
+	eventBus             EventBus
+	clock                Clock
 }
 
-func NewInMemoryCabService(userRepo IUserRepository, cabRepo ICabRepository, rideRepo IRideRegistory, idGenerationStrategy IdGenerationStrategy, pricingStrategy PricingStrategy, cabFindingStrategy CabFindingStrategy) CabService {
+func NewInMemoryCabService(userRepo IUserRepository, cabRepo ICabRepository, rideRepo IRideRegistory, idGenerationStrategy IdGenerationStrategy, pricingStrategy PricingStrategy, rideDispatcher RideDispatcher, poolManager PoolManager, ratingManager RatingManager, cancellationManager CancellationManager, paymentProcessor PaymentProcessor, promotionManager PromotionManager, driverManager DriverManager, zoneManager ZoneManager, eventBus EventBus, clock Clock) CabService {
 	return &InMemoryCabService{
 		userRepo:             userRepo,
 		cabRepo:              cabRepo,
 		rideRepo:             rideRepo,
 		idGenerationStrategy: idGenerationStrategy,
 		pricingStrategy:      pricingStrategy,
-		cabFindingStrategy:   cabFindingStrategy,
+		rideDispatcher:       rideDispatcher,
+		poolManager:          poolManager,
+		ratingManager:        ratingManager,
+		cancellationManager:  cancellationManager,
+		paymentProcessor:     paymentProcessor,
+		promotionManager:     promotionManager,
+		driverManager:        driverManager,
+		zoneManager:          zoneManager,
+		eventBus:             eventBus,
+		clock:                clock,
 	}
 }
 
-func (imcs InMemoryCabService) RegisterUser(name string) *User {
+func (imcs InMemoryCabService) RegisterUser(name string) (*User, error) {
 	return imcs.userRepo.CreateUser(name)
 }
-func (imcs InMemoryCabService) RegisterCab(name string) *Cab {
-	return imcs.cabRepo.CreateCab(name)
+func (imcs InMemoryCabService) GetUser(userId string) (*User, error) {
+	user := imcs.userRepo.GetUserById(userId)
+	if user == nil {
+		return nil, ErrUserNotFound
+	}
+	return user, nil
 }
-func (imcs InMemoryCabService) BookRide(userId string, startPointLat float64, startPointLon float64, endPointLat float64, endPointLon float64) *Ride {
-	ride := imcs.rideRepo.CreateRide(userId, startPointLat, startPointLat, endPointLat, endPointLon)
-	ridePrice := imcs.pricingStrategy.CalculateFare(ride)
-	ride.SetTotalAmount(ridePrice)
 
-	go imcs.findAvailableCabsForRide(ride)
+// RegisterCab brings the cab in online, which starts the driver's first shift.
+func (imcs InMemoryCabService) RegisterCab(name string, category VehicleCategory) (*Cab, error) {
+	cab, err := imcs.cabRepo.CreateCab(name, category)
+	if err != nil {
+		return nil, err
+	}
+	return imcs.driverManager.StartFirstShift(cab.GetId())
+}
+func (imcs InMemoryCabService) GetCab(cabId string) (*Cab, error) {
+	cab := imcs.cabRepo.GetCabById(cabId)
+	if cab == nil {
+		return nil, ErrCabNotFound
+	}
+	return cab, nil
+}
+func (imcs InMemoryCabService) BookRide(userId string, startPointLat float64, startPointLon float64, endPointLat float64, endPointLon float64, options ...BookingOption) (*Ride, error) {
+	user, booking, err := imcs.validateBooking(userId, startPointLat, startPointLon, endPointLat, endPointLon, options)
+	if err != nil {
+		return nil, err
+	}
+	redemption, err := imcs.reservePromoCode(userId, startPointLat, startPointLon, booking)
+	if err != nil {
+		return nil, err
+	}
+	ride, err := imcs.rideRepo.CreateRide(userId, startPointLat, startPointLon, endPointLat, endPointLon)
+	if err != nil {
+		imcs.releasePromoCode(redemption)
+		return nil, err
+	}
+	ride = imcs.quote(ride, user, booking, redemption)
+
+	imcs.eventBus.Publish(newRideEvent(RideRequested, ride, imcs.clock.Now()))
+	go imcs.rideDispatcher.Dispatch(ride)
+	return ride, nil
+}
+
+// ScheduleRide books a ride for a later pickup. It is quoted now and waits in
+// Scheduled until the ride scheduler starts dispatch for it.
+func (imcs InMemoryCabService) ScheduleRide(userId string, startPointLat float64, startPointLon float64, endPointLat float64, endPointLon float64, pickupAt time.Time, options ...BookingOption) (*Ride, error) {
+	user, booking, err := imcs.validateBooking(userId, startPointLat, startPointLon, endPointLat, endPointLon, options)
+	if err != nil {
+		return nil, err
+	}
+	if !pickupAt.After(imcs.clock.Now()) {
+		return nil, ErrInvalidPickupTime
+	}
+	redemption, err := imcs.reservePromoCode(userId, startPointLat, startPointLon, booking)
+	if err != nil {
+		return nil, err
+	}
+	ride, err := imcs.rideRepo.CreateScheduledRide(userId, startPointLat, startPointLon, endPointLat, endPointLon, pickupAt)
+	if err != nil {
+		imcs.releasePromoCode(redemption)
+		return nil, err
+	}
+	ride = imcs.quote(ride, user, booking, redemption)
+
+	imcs.eventBus.Publish(newRideEvent(RideScheduled, ride, imcs.clock.Now()))
+	return ride, nil
+}
+func (imcs InMemoryCabService) RescheduleRide(rideId string, pickupAt time.Time) (*Ride, error) {
+	if !pickupAt.After(imcs.clock.Now()) {
+		return nil, ErrInvalidPickupTime
+	}
+	ride, err := imcs.rideRepo.UpdateRide(rideId, func(ride *Ride) error {
+		return ride.Reschedule(pickupAt)
+	})
+	if err != nil {
+		return nil, err
+	}
+	imcs.eventBus.Publish(newRideEvent(RideRescheduled, ride, imcs.clock.Now()))
+	return ride, nil
+}
+func (imcs InMemoryCabService) validateBooking(userId string, startPointLat float64, startPointLon float64, endPointLat float64, endPointLon float64, options []BookingOption) (*User, bookingOptions, error) {
+	booking := bookingOptions{rideType: SoloRide, seats: 1, category: AnyCategory}
+	for _, option := range options {
+		option(&booking)
+	}
+	user := imcs.userRepo.GetUserById(userId)
+	if user == nil {
+		return nil, booking, ErrUserNotFound
+	}
+	if err := ValidateCoordinates(startPointLat, startPointLon); err != nil {
+		return nil, booking, err
+	}
+	if err := ValidateCoordinates(endPointLat, endPointLon); err != nil {
+		return nil, booking, err
+	}
+	if !imcs.zoneManager.IsServiced(startPointLat, startPointLon) {
+		return nil, booking, fmt.Errorf("%w: (%v, %v)", ErrOutsideServiceArea, startPointLat, startPointLon)
+	}
+	if booking.category < AnyCategory || booking.category > Bike {
+		return nil, booking, fmt.Errorf("%w: %d", ErrUnknownVehicleCategory, booking.category)
+	}
+	maxSeats := imcs.poolManager.GetPolicy().Capacity
+	if booking.category != AnyCategory {
+		maxSeats = min(maxSeats, booking.category.GetSeats())
+	}
+	if booking.rideType == PoolRide && (booking.seats < 1 || booking.seats > maxSeats) {
+		return nil, booking, fmt.Errorf("%w: %d seats", ErrInvalidSeats, booking.seats)
+	}
+	if len(booking.stops) > 0 && booking.rideType == PoolRide {
+		return nil, booking, fmt.Errorf("%w: pooled rides cannot make stops", ErrInvalidStop)
+	}
+	if len(booking.stops) > MaxRideStops {
+		return nil, booking, fmt.Errorf("%w: a ride makes at most %d stops", ErrInvalidStop, MaxRideStops)
+	}
+	for _, stop := range booking.stops {
+		if err := ValidateCoordinates(stop.Lat, stop.Lon); err != nil {
+			return nil, booking, err
+		}
+	}
+	if booking.paymentMethodId != "" {
+		if _, err := imcs.paymentProcessor.GetPaymentMethod(userId, booking.paymentMethodId); err != nil {
+			return nil, booking, err
+		}
+	}
+	if balance, _ := imcs.paymentProcessor.GetBalance(userId); balance.OutstandingDues > 0 {
+		return nil, booking, fmt.Errorf("%w: %d owed", ErrOutstandingDues, balance.OutstandingDues)
+	}
+	return user, booking, nil
+}
+
+// reservePromoCode holds a use of the booking's promo code, if it has one. It
+// comes after every other check so that a booking turned down never uses it up.
+func (imcs InMemoryCabService) reservePromoCode(userId string, startPointLat float64, startPointLon float64, booking bookingOptions) (*PromoRedemption, error) {
+	if booking.promoCode == "" {
+		return nil, nil
+	}
+	return imcs.promotionManager.Reserve(booking.promoCode, userId, startPointLat, startPointLon)
+}
+func (imcs InMemoryCabService) releasePromoCode(redemption *PromoRedemption) {
+	if redemption != nil {
+		imcs.promotionManager.Release(redemption.Id)
+	}
+}
+func (imcs InMemoryCabService) quote(ride *Ride, user *User, booking bookingOptions, redemption *PromoRedemption) *Ride {
+	promoCode := ""
+	if redemption != nil {
+		promoCode = redemption.Code
+		imcs.promotionManager.AttachRide(redemption.Id, ride.GetId())
+	}
+	ride.SetRideType(booking.rideType, booking.seats)
+	ride.SetVehicleCategory(booking.category)
+	ride.SetPromoCode(promoCode)
+	ride.SetStops(booking.stops)
+	fareEstimate := imcs.pricingStrategy.EstimateFare(ride)
+	ride, _ = imcs.rideRepo.UpdateRide(ride.GetId(), func(ride *Ride) error {
+		ride.SetRideType(booking.rideType, booking.seats)
+		ride.SetVehicleCategory(booking.category)
+		ride.SetStops(booking.stops)
+		ride.SetFareEstimate(fareEstimate)
+		ride.SetPriorityTier(user.GetPriorityTier())
+		ride.SetPaymentMethodId(booking.paymentMethodId)
+		ride.SetPromoCode(promoCode)
+		return nil
+	})
 	return ride
 }
-func (imcs InMemoryCabService) GetRideStatus(rideId string) RideStatus {
+func (imcs InMemoryCabService) GetRide(rideId string) (*Ride, error) {
 	ride := imcs.rideRepo.GetRideById(rideId)
-	return ride.GetStatus()
+	if ride == nil {
+		return nil, ErrRideNotFound
+	}
+	return ride, nil
 }
-func (imcs InMemoryCabService) UpdateRideStatus(rideId string, newStatus RideStatus) *Ride {
-	imcs.rideRepo.UpdateRideStatus(rideId, newStatus)
+func (imcs InMemoryCabService) GetRideStatus(rideId string) (RideStatus, error) {
 	ride := imcs.rideRepo.GetRideById(rideId)
-	cabId := ride.GetCabId()
-	cab := imcs.cabRepo.GetCabById(cabId)
+	if ride == nil {
+		return 0, ErrRideNotFound
+	}
+	return ride.GetStatus(), nil
+}
+
+// UpdateRideStatus moves the ride along its lifecycle. Setting it to Canceled
+// is taken as the rider cancelling without a reason.
+func (imcs InMemoryCabService) UpdateRideStatus(rideId string, newStatus RideStatus) (*Ride, error) {
 	if newStatus == Canceled {
-		cab.SetCabStatus(ReadyToTakeRide)
+		return imcs.CancelRide(rideId, CancelledByRider, OtherReason)
+	}
+	ride, err := imcs.rideRepo.UpdateRide(rideId, func(ride *Ride) error {
+		return ride.TransitionTo(newStatus, imcs.clock.Now())
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer imcs.finishStatusChange(newStatus, rideId)
+	cabId := ride.GetCabId()
+	if cabId == "" {
+		return ride, nil
+	}
+	// A pooled cab is only free again once its last rider is dropped or gone.
+	isPool := ride.GetRideType() == PoolRide
+	if newStatus == PickedUp && isPool {
+		imcs.poolManager.MarkPickedUp(rideId)
 	} else if newStatus == Completed {
+		finalFare := imcs.pricingStrategy.CalculateFinalFare(ride)
+		ride, _ = imcs.rideRepo.UpdateRide(rideId, func(ride *Ride) error {
+			ride.SetFinalFare(finalFare)
+			return nil
+		})
+		cabFreed := true
+		if isPool {
+			cabFreed, _ = imcs.poolManager.MarkDropped(rideId)
+		}
 		rideEndPointLat, rideEndPointLon := ride.GetEndPoint()
-		cab.SetCabStatus(ReadyToTakeRide)
-		cab.IncreaseCabRides()
-		imcs.UpdateCabLocation(cabId, rideEndPointLat, rideEndPointLon)
+		imcs.cabRepo.UpdateCab(cabId, func(cab *Cab) error {
+			cab.IncreaseCabRides()
+			cab.SetCurrLocation(rideEndPointLat, rideEndPointLon)
+			if !cabFreed {
+				return nil
+			}
+			return cab.SetCabStatus(ReadyToTakeRide)
+		})
+		if cabFreed {
+			imcs.rideDispatcher.NotifyCabAvailable()
+		}
+	}
+	return ride, nil
+}
+func (imcs InMemoryCabService) CancelRide(rideId string, cancelledBy CancellationActor, reason CancellationReason) (*Ride, error) {
+	ride, err := imcs.rideRepo.UpdateRide(rideId, func(ride *Ride) error {
+		// The cab is read for the ride as stored, in case one was assigned since
+		// the caller last looked.
+		var cab *Cab
+		if ride.GetCabId() != "" {
+			cab = imcs.cabRepo.GetCabById(ride.GetCabId())
+		}
+		cancellation, err := imcs.cancellationManager.Assess(ride, cab, cancelledBy, reason)
+		if err != nil {
+			return err
+		}
+		return ride.Cancel(cancellation)
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer imcs.finishStatusChange(Canceled, rideId)
+	imcs.rideDispatcher.CancelDispatch(rideId)
+	cabId := ride.GetCabId()
+	if cabId == "" {
+		return ride, nil
+	}
+	// A pooled cab is only free again once its last rider is dropped or gone.
+	if ride.GetRideType() != PoolRide || imcs.poolManager.Leave(rideId) {
+		imcs.cabRepo.UpdateCabStatus(cabId, ReadyToTakeRide)
+		imcs.rideDispatcher.NotifyCabAvailable()
+	}
+	imcs.cancellationManager.RecordCancellation(ride)
+	return ride, nil
+}
+func (imcs InMemoryCabService) finishStatusChange(newStatus RideStatus, rideId string) {
+	eventTypes := map[RideStatus]RideEventType{PickedUp: RidePickedUp, Completed: RideCompleted, Canceled: RideCanceled}
+	ride := imcs.rideRepo.GetRideById(rideId)
+	if eventType, exists := eventTypes[newStatus]; exists {
+		imcs.eventBus.Publish(newRideEvent(eventType, ride, imcs.clock.Now()))
+	}
+	// The ride is charged once the rider has been told it ended.
+	if newStatus == Completed || newStatus == Canceled {
+		imcs.paymentProcessor.ChargeRide(ride)
 	}
-	return ride
 }
 func (imcs InMemoryCabService) UpdateCabLocation(cabId string, lat, lon float64) error {
-	imcs.cabRepo.UpdateCabLocation(cabId, lat, lon)
+	if err := ValidateCoordinates(lat, lon); err != nil {
+		return err
+	}
+	if err := imcs.cabRepo.UpdateCabLocation(cabId, lat, lon); err != nil {
+		return err
+	}
+	imcs.eventBus.Publish(RideEvent{Type: CabLocationUpdated, CabId: cabId, Lat: lat, Lon: lon, OccurredAt: imcs.clock.Now()})
 	return nil
 }
 func (imcs InMemoryCabService) TotalRideForUser(userId string) []Ride {
 	return imcs.rideRepo.TotalRideForUser(userId)
 }
 
-func (imcs InMemoryCabService) findAvailableCabsForRide(ride *Ride) {
-	time.Sleep(50 * time.Millisecond)
+// QueryRides pages through the ride history of a user or a cab, both of which
+// must exist.
+func (imcs InMemoryCabService) QueryRides(query RideQuery) (*RidePage, error) {
+	if query.UserId != "" && imcs.userRepo.GetUserById(query.UserId) == nil {
+		return nil, ErrUserNotFound
+	}
+	if query.CabId != "" && imcs.cabRepo.GetCabById(query.CabId) == nil {
+		return nil, ErrCabNotFound
+	}
+	return imcs.rideRepo.QueryRides(query)
+}
+func (imcs InMemoryCabService) AcceptRide(rideId, cabId string) error {
+	return imcs.rideDispatcher.RespondToOffer(rideId, cabId, true)
+}
+func (imcs InMemoryCabService) RejectRide(rideId, cabId string) error {
+	return imcs.rideDispatcher.RespondToOffer(rideId, cabId, false)
+}
+func (imcs InMemoryCabService) GetRideOffer(rideId string) (*RideOffer, error) {
+	return imcs.rideDispatcher.GetCurrentOffer(rideId)
+}
+func (imcs InMemoryCabService) GetRideTimeline(rideId string) ([]RideTransition, error) {
+	ride := imcs.rideRepo.GetRideById(rideId)
+	if ride == nil {
+		return nil, ErrRideNotFound
+	}
+	return ride.GetTimeline(), nil
+}
+func (imcs InMemoryCabService) SetUserPriorityTier(userId string, priorityTier int) error {
+	_, err := imcs.userRepo.UpdateUser(userId, func(user *User) error {
+		user.SetPriorityTier(priorityTier)
+		return nil
+	})
+	return err
+}
+func (imcs InMemoryCabService) GetPendingRide(rideId string) (*PendingRide, error) {
+	return imcs.rideDispatcher.GetPendingRide(rideId)
+}
+func (imcs InMemoryCabService) GetPendingQueueStats() PendingQueueStats {
+	return imcs.rideDispatcher.GetPendingQueueStats()
+}
+func (imcs InMemoryCabService) TrackRide(rideId string) (*RideTracker, error) {
+	ride := imcs.rideRepo.GetRideById(rideId)
+	if ride == nil {
+		return nil, ErrRideNotFound
+	}
+	tracker := newRideTracker(imcs.eventBus, ride, 64)
+	ride = imcs.rideRepo.GetRideById(rideId)
+	var cab *Cab
+	if cabId := ride.GetCabId(); cabId != "" {
+		cab = imcs.cabRepo.GetCabById(cabId)
+	}
+	tracker.start(ride, cab, imcs.clock.Now())
+	return tracker, nil
+}
+func (imcs InMemoryCabService) GetPoolTrip(rideId string) (*PoolTrip, error) {
+	if imcs.rideRepo.GetRideById(rideId) == nil {
+		return nil, ErrRideNotFound
+	}
+	return imcs.poolManager.GetTrip(rideId)
+}
+
+// QuoteFares estimates a solo ride in every vehicle category without booking
+// anything, so the rider can compare before choosing.
+func (imcs InMemoryCabService) QuoteFares(startPointLat float64, startPointLon float64, endPointLat float64, endPointLon float64) ([]FareQuote, error) {
+	if err := ValidateCoordinates(startPointLat, startPointLon); err != nil {
+		return nil, err
+	}
+	if err := ValidateCoordinates(endPointLat, endPointLon); err != nil {
+		return nil, err
+	}
+	if !imcs.zoneManager.IsServiced(startPointLat, startPointLon) {
+		return nil, fmt.Errorf("%w: (%v, %v)", ErrOutsideServiceArea, startPointLat, startPointLon)
+	}
+	quotes := make([]FareQuote, 0, len(VehicleCategories()))
+	for _, category := range VehicleCategories() {
+		ride := NewRide("", "", startPointLat, startPointLon, endPointLat, endPointLon, imcs.clock.Now())
+		ride.SetVehicleCategory(category)
+		quotes = append(quotes, FareQuote{Category: category, Seats: category.GetSeats(), Fare: imcs.pricingStrategy.EstimateFare(ride)})
+	}
+	return quotes, nil
+}
+func (imcs InMemoryCabService) RateDriver(rideId, userId string, stars int, tags []string) (*Rating, error) {
+	return imcs.ratingManager.RateDriver(rideId, userId, stars, tags)
+}
+func (imcs InMemoryCabService) RateRider(rideId, cabId string, stars int, tags []string) (*Rating, error) {
+	return imcs.ratingManager.RateRider(rideId, cabId, stars, tags)
+}
+func (imcs InMemoryCabService) GetRideRatings(rideId string) ([]Rating, error) {
+	return imcs.ratingManager.GetRideRatings(rideId)
+}
+func (imcs InMemoryCabService) AddPaymentMethod(userId string, methodType PaymentMethodType, cardNumber string, makeDefault bool) (*PaymentMethod, error) {
+	return imcs.paymentProcessor.AddPaymentMethod(userId, methodType, cardNumber, makeDefault)
+}
+func (imcs InMemoryCabService) GetPaymentMethods(userId string) ([]PaymentMethod, error) {
+	return imcs.paymentProcessor.GetPaymentMethods(userId)
+}
+func (imcs InMemoryCabService) SetDefaultPaymentMethod(userId, methodId string) error {
+	return imcs.paymentProcessor.SetDefaultPaymentMethod(userId, methodId)
+}
+func (imcs InMemoryCabService) TopUpWallet(userId, methodId string, amount int) (RiderBalance, error) {
+	return imcs.paymentProcessor.TopUpWallet(userId, methodId, amount)
+}
+func (imcs InMemoryCabService) GetBalance(userId string) (RiderBalance, error) {
+	return imcs.paymentProcessor.GetBalance(userId)
+}
+func (imcs InMemoryCabService) PayDues(userId, methodId string) (RiderBalance, error) {
+	return imcs.paymentProcessor.PayDues(userId, methodId)
+}
+func (imcs InMemoryCabService) GetLedger(userId string) ([]LedgerEntry, error) {
+	return imcs.paymentProcessor.GetLedger(userId)
+}
+func (imcs InMemoryCabService) GetRidePayment(rideId string) (*Payment, error) {
+	if imcs.rideRepo.GetRideById(rideId) == nil {
+		return nil, ErrRideNotFound
+	}
+	return imcs.paymentProcessor.GetRidePayment(rideId)
+}
+
+// RefundRide settles a dispute over a charged ride.
+func (imcs InMemoryCabService) RefundRide(rideId string, amount int, reason string) (*Payment, error) {
+	if imcs.rideRepo.GetRideById(rideId) == nil {
+		return nil, ErrRideNotFound
+	}
+	return imcs.paymentProcessor.RefundRide(rideId, amount, reason)
+}
+func (imcs InMemoryCabService) CreatePromotion(promotion Promotion) (*Promotion, error) {
+	return imcs.promotionManager.CreatePromotion(promotion)
+}
+func (imcs InMemoryCabService) GetPromotion(code string) (*Promotion, error) {
+	return imcs.promotionManager.GetPromotion(code)
+}
+func (imcs InMemoryCabService) GetReferralCode(userId string) (*Promotion, error) {
+	return imcs.promotionManager.GetReferralCode(userId)
+}
+func (imcs InMemoryCabService) GetPromoRedemptions(userId string) ([]PromoRedemption, error) {
+	return imcs.promotionManager.GetRedemptions(userId)
+}
+
+// GoOnline puts the driver back in line for rides, so riders waiting for a cab
+// get another look.
+func (imcs InMemoryCabService) GoOnline(cabId string) (*Cab, error) {
+	cab, err := imcs.driverManager.GoOnline(cabId)
+	if err != nil {
+		return nil, err
+	}
+	imcs.rideDispatcher.NotifyCabAvailable()
+	return cab, nil
+}
+func (imcs InMemoryCabService) TakeBreak(cabId string) (*Cab, error) {
+	return imcs.driverManager.TakeBreak(cabId)
+}
+func (imcs InMemoryCabService) GoOffline(cabId string) (*Cab, error) {
+	return imcs.driverManager.GoOffline(cabId)
+}
+func (imcs InMemoryCabService) AddDriverIncentive(cabId string, amount int, note string) (*EarningEntry, error) {
+	return imcs.driverManager.AddIncentive(cabId, amount, note)
+}
+func (imcs InMemoryCabService) GetEarningsBalance(cabId string) (int, error) {
+	return imcs.driverManager.GetEarningsBalance(cabId)
+}
+func (imcs InMemoryCabService) GetEarningsStatement(cabId string, period StatementPeriod, at time.Time) (*EarningsStatement, error) {
+	return imcs.driverManager.GetStatement(cabId, period, at)
+}
+func (imcs InMemoryCabService) CreatePayoutBatch() (*PayoutBatch, error) {
+	return imcs.driverManager.CreatePayoutBatch()
+}
+func (imcs InMemoryCabService) GetPayoutBatch(batchId string) (*PayoutBatch, error) {
+	return imcs.driverManager.GetPayoutBatch(batchId)
+}
+func (imcs InMemoryCabService) GetZoneQueue(zoneId string) ([]QueuedCab, error) {
+	return imcs.zoneManager.GetZoneQueue(zoneId)
+}
+
+// AddStop puts a stop before the stop at index, or at the end when index is
+// the number of stops, and quotes the ride again.
+func (imcs InMemoryCabService) AddStop(rideId string, index int, lat, lon float64) (*Ride, error) {
+	return imcs.changeStops(rideId, func(ride *Ride) error {
+		return ride.AddStop(index, lat, lon)
+	})
+}
+func (imcs InMemoryCabService) RemoveStop(rideId string, index int) (*Ride, error) {
+	return imcs.changeStops(rideId, func(ride *Ride) error {
+		return ride.RemoveStop(index)
+	})
+}
+
+// changeStops prices the ride outside the repository's lock, so the fare is
+// only saved while the ride still has the stops it was priced for. A stop
+// change that lands in between has the ride priced again.
+func (imcs InMemoryCabService) changeStops(rideId string, change func(ride *Ride) error) (*Ride, error) {
+	ride, err := imcs.rideRepo.UpdateRide(rideId, change)
+	for priced := false; err == nil && !priced; {
+		waypoints := ride.GetWaypoints()
+		fareEstimate := imcs.pricingStrategy.EstimateFare(ride)
+		ride, err = imcs.rideRepo.UpdateRide(rideId, func(ride *Ride) error {
+			if priced = slices.Equal(ride.GetWaypoints(), waypoints); priced {
+				ride.SetFareEstimate(fareEstimate)
+			}
+			return nil
+		})
+	}
+	if err != nil {
+		return nil, err
+	}
+	imcs.eventBus.Publish(newRideEvent(RideStopsChanged, ride, imcs.clock.Now()))
+	return ride, nil
+}
+func (imcs InMemoryCabService) ArriveAtStop(rideId string, index int) (*Ride, error) {
+	return imcs.progressStop(rideId, index, CabArrivedAtStop, func(ride *Ride) error {
+		return ride.ArriveAtStop(index, imcs.clock.Now())
+	})
+}
+func (imcs InMemoryCabService) DepartStop(rideId string, index int) (*Ride, error) {
+	return imcs.progressStop(rideId, index, CabDepartedStop, func(ride *Ride) error {
+		return ride.DepartStop(index, imcs.clock.Now())
+	})
+}
+func (imcs InMemoryCabService) progressStop(rideId string, index int, eventType RideEventType, progress func(ride *Ride) error) (*Ride, error) {
+	ride, err := imcs.rideRepo.UpdateRide(rideId, progress)
+	if err != nil {
+		return nil, err
+	}
+	stop := ride.GetStops()[index]
+	event := newRideEvent(eventType, ride, imcs.clock.Now())
+	event.StopIndex = &index
+	event.Lat, event.Lon = stop.Location.Lat, stop.Location.Lon
+	imcs.eventBus.Publish(event)
+	return ride, nil
+}
 
-	cab := imcs.cabFindingStrategy.FindCab(ride)
-	cab.SetCabStatus(Busy)
-	ride.SetRideStatus(Confirmed)
-	ride.AssignCab(cab.GetId())
+// Close stops the dispatcher's background work. The service is not used after.
+func (imcs InMemoryCabService) Close() {
+	imcs.rideDispatcher.Close()
 }
@@ -0,0 +1,486 @@
+package src
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+)
+
+// CabServiceV2 is CabService for callers that need to give up on a request.
+// Every method takes a context and returns an error instead of a bare value or
+// a panic, using the sentinel errors in constants.go. BookRide waits for a cab,
+// and cancelling its context cancels the ride and the dispatch behind it.
+type CabServiceV2 interface {
+	RegisterUser(ctx context.Context, name string) (*User, error)
+	GetUser(ctx context.Context, userId string) (*User, error)
+	SetUserPriorityTier(ctx context.Context, userId string, priorityTier int) error
+	RegisterCab(ctx context.Context, name string, category VehicleCategory) (*Cab, error)
+	GetCab(ctx context.Context, cabId string) (*Cab, error)
+	UpdateCabLocation(ctx context.Context, cabId string, lat, lon float64) error
+	QuoteFares(ctx context.Context, startPointLat float64, startPointLon float64, endPointLat float64, endPointLon float64) ([]FareQuote, error)
+	BookRide(ctx context.Context, userId string, startPointLat float64, startPointLon float64, endPointLat float64, endPointLon float64, options ...BookingOption) (*Ride, error)
+	RequestRide(ctx context.Context, userId string, startPointLat float64, startPointLon float64, endPointLat float64, endPointLon float64, options ...BookingOption) (*Ride, error)
+	ScheduleRide(ctx context.Context, userId string, startPointLat float64, startPointLon float64, endPointLat float64, endPointLon float64, pickupAt time.Time, options ...BookingOption) (*Ride, error)
+	RescheduleRide(ctx context.Context, rideId string, pickupAt time.Time) (*Ride, error)
+	GetRide(ctx context.Context, rideId string) (*Ride, error)
+	GetRideStatus(ctx context.Context, rideId string) (RideStatus, error)
+	GetRideTimeline(ctx context.Context, rideId string) ([]RideTransition, error)
+	UpdateRideStatus(ctx context.Context, rideId string, newStatus RideStatus) (*Ride, error)
+	CancelRide(ctx context.Context, rideId string, cancelledBy CancellationActor, reason CancellationReason) (*Ride, error)
+	QueryRides(ctx context.Context, query RideQuery) (*RidePage, error)
+	TrackRide(ctx context.Context, rideId string) (*RideTracker, error)
+	GetPoolTrip(ctx context.Context, rideId string) (*PoolTrip, error)
+	AcceptRide(ctx context.Context, rideId, cabId string) error
+	RejectRide(ctx context.Context, rideId, cabId string) error
+	GetRideOffer(ctx context.Context, rideId string) (*RideOffer, error)
+	GetPendingRide(ctx context.Context, rideId string) (*PendingRide, error)
+	GetPendingQueueStats(ctx context.Context) (PendingQueueStats, error)
+	RateDriver(ctx context.Context, rideId, userId string, stars int, tags []string) (*Rating, error)
+	RateRider(ctx context.Context, rideId, cabId string, stars int, tags []string) (*Rating, error)
+	GetRideRatings(ctx context.Context, rideId string) ([]Rating, error)
+	AddPaymentMethod(ctx context.Context, userId string, methodType PaymentMethodType, cardNumber string, makeDefault bool) (*PaymentMethod, error)
+	GetPaymentMethods(ctx context.Context, userId string) ([]PaymentMethod, error)
+	SetDefaultPaymentMethod(ctx context.Context, userId, methodId string) error
+	TopUpWallet(ctx context.Context, userId, methodId string, amount int) (RiderBalance, error)
+	GetBalance(ctx context.Context, userId string) (RiderBalance, error)
+	PayDues(ctx context.Context, userId, methodId string) (RiderBalance, error)
+	GetLedger(ctx context.Context, userId string) ([]LedgerEntry, error)
+	GetRidePayment(ctx context.Context, rideId string) (*Payment, error)
+	RefundRide(ctx context.Context, rideId string, amount int, reason string) (*Payment, error)
+	CreatePromotion(ctx context.Context, promotion Promotion) (*Promotion, error)
+	GetPromotion(ctx context.Context, code string) (*Promotion, error)
+	GetReferralCode(ctx context.Context, userId string) (*Promotion, error)
+	GetPromoRedemptions(ctx context.Context, userId string) ([]PromoRedemption, error)
+	GoOnline(ctx context.Context, cabId string) (*Cab, error)
+	TakeBreak(ctx context.Context, cabId string) (*Cab, error)
+	GoOffline(ctx context.Context, cabId string) (*Cab, error)
+	AddDriverIncentive(ctx context.Context, cabId string, amount int, note string) (*EarningEntry, error)
+	GetEarningsBalance(ctx context.Context, cabId string) (int, error)
+	GetEarningsStatement(ctx context.Context, cabId string, period StatementPeriod, at time.Time) (*EarningsStatement, error)
+	CreatePayoutBatch(ctx context.Context) (*PayoutBatch, error)
+	GetPayoutBatch(ctx context.Context, batchId string) (*PayoutBatch, error)
+	GetZoneQueue(ctx context.Context, zoneId string) ([]QueuedCab, error)
+	AddStop(ctx context.Context, rideId string, index int, lat, lon float64) (*Ride, error)
+	RemoveStop(ctx context.Context, rideId string, index int) (*Ride, error)
+	ArriveAtStop(ctx context.Context, rideId string, index int) (*Ride, error)
+	DepartStop(ctx context.Context, rideId string, index int) (*Ride, error)
+	Close()
+}
+
+// ContextCabService serves CabServiceV2 on top of a CabService. It checks the
+// context before each call, so a request that was given up on does not still
+// book, cancel or charge, and checks the ids the wrapped call does not.
+type ContextCabService struct {
+	cabService CabService
+}
+
+func NewCabServiceV2(cabService CabService) CabServiceV2 {
+	return &ContextCabService{cabService: cabService}
+}
+
+func (ccs *ContextCabService) RegisterUser(ctx context.Context, name string) (*User, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if strings.TrimSpace(name) == "" {
+		return nil, ErrInvalidName
+	}
+	return ccs.cabService.RegisterUser(name)
+}
+func (ccs *ContextCabService) GetUser(ctx context.Context, userId string) (*User, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return ccs.cabService.GetUser(userId)
+}
+func (ccs *ContextCabService) SetUserPriorityTier(ctx context.Context, userId string, priorityTier int) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return ccs.cabService.SetUserPriorityTier(userId, priorityTier)
+}
+func (ccs *ContextCabService) RegisterCab(ctx context.Context, name string, category VehicleCategory) (*Cab, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if strings.TrimSpace(name) == "" {
+		return nil, ErrInvalidName
+	}
+	if !slices.Contains(VehicleCategories(), category) {
+		return nil, fmt.Errorf("%w: %d", ErrUnknownVehicleCategory, category)
+	}
+	return ccs.cabService.RegisterCab(name, category)
+}
+func (ccs *ContextCabService) GetCab(ctx context.Context, cabId string) (*Cab, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return ccs.cabService.GetCab(cabId)
+}
+func (ccs *ContextCabService) UpdateCabLocation(ctx context.Context, cabId string, lat, lon float64) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return ccs.cabService.UpdateCabLocation(cabId, lat, lon)
+}
+func (ccs *ContextCabService) QuoteFares(ctx context.Context, startPointLat float64, startPointLon float64, endPointLat float64, endPointLon float64) ([]FareQuote, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return ccs.cabService.QuoteFares(startPointLat, startPointLon, endPointLat, endPointLon)
+}
+
+// BookRide returns once a cab has been assigned to the ride. It fails with
+// ErrNoCabAvailable when dispatch gives up, with ErrRideCanceled when the ride
+// is cancelled elsewhere, and with the context's error when the context ends
+// first, in which case the ride is cancelled by the rider.
+func (ccs *ContextCabService) BookRide(ctx context.Context, userId string, startPointLat float64, startPointLon float64, endPointLat float64, endPointLon float64, options ...BookingOption) (*Ride, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	ride, err := ccs.cabService.BookRide(userId, startPointLat, startPointLon, endPointLat, endPointLon, options...)
+	if err != nil {
+		return nil, err
+	}
+	return ccs.awaitCab(ctx, ride.GetId())
+}
+
+// awaitCab follows the ride until dispatch for it ends. The ride is read back
+// whenever its updates stop, so one still searching for a cab is followed
+// again rather than returned as booked.
+func (ccs *ContextCabService) awaitCab(ctx context.Context, rideId string) (*Ride, error) {
+	for {
+		if err := ccs.waitForDispatch(ctx, rideId); err != nil {
+			return nil, err
+		}
+		ride, err := ccs.cabService.GetRide(rideId)
+		if err != nil {
+			return nil, err
+		}
+		switch ride.GetStatus() {
+		case SearchingForCab:
+			continue
+		case NoCabFound:
+			return nil, fmt.Errorf("%w: ride %s", ErrNoCabAvailable, rideId)
+		case Canceled:
+			return nil, fmt.Errorf("%w: ride %s", ErrRideCanceled, rideId)
+		}
+		return ride, nil
+	}
+}
+
+// waitForDispatch returns once the ride is assigned a cab or its updates stop.
+// When the context ends first the ride is cancelled by the rider, which
+// withdraws any offer out to a driver and takes it out of the pending queue.
+func (ccs *ContextCabService) waitForDispatch(ctx context.Context, rideId string) error {
+	tracker, err := ccs.cabService.TrackRide(rideId)
+	if err != nil {
+		return err
+	}
+	defer tracker.Stop()
+	for searching := tracker.GetRide().GetStatus() == SearchingForCab; searching; {
+		select {
+		case event, open := <-tracker.Updates():
+			searching = open && event.Type != CabAssigned
+		case <-ctx.Done():
+			ccs.cabService.CancelRide(rideId, CancelledByRider, OtherReason)
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// RequestRide books the ride and returns it while dispatch is still looking for
+// a cab. The ride outlives the context, for callers that follow it on their own.
+func (ccs *ContextCabService) RequestRide(ctx context.Context, userId string, startPointLat float64, startPointLon float64, endPointLat float64, endPointLon float64, options ...BookingOption) (*Ride, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return ccs.cabService.BookRide(userId, startPointLat, startPointLon, endPointLat, endPointLon, options...)
+}
+func (ccs *ContextCabService) ScheduleRide(ctx context.Context, userId string, startPointLat float64, startPointLon float64, endPointLat float64, endPointLon float64, pickupAt time.Time, options ...BookingOption) (*Ride, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return ccs.cabService.ScheduleRide(userId, startPointLat, startPointLon, endPointLat, endPointLon, pickupAt, options...)
+}
+func (ccs *ContextCabService) RescheduleRide(ctx context.Context, rideId string, pickupAt time.Time) (*Ride, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return ccs.cabService.RescheduleRide(rideId, pickupAt)
+}
+func (ccs *ContextCabService) GetRide(ctx context.Context, rideId string) (*Ride, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return ccs.cabService.GetRide(rideId)
+}
+func (ccs *ContextCabService) GetRideStatus(ctx context.Context, rideId string) (RideStatus, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	return ccs.cabService.GetRideStatus(rideId)
+}
+func (ccs *ContextCabService) GetRideTimeline(ctx context.Context, rideId string) ([]RideTransition, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return ccs.cabService.GetRideTimeline(rideId)
+}
+func (ccs *ContextCabService) UpdateRideStatus(ctx context.Context, rideId string, newStatus RideStatus) (*Ride, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return ccs.cabService.UpdateRideStatus(rideId, newStatus)
+}
+func (ccs *ContextCabService) CancelRide(ctx context.Context, rideId string, cancelledBy CancellationActor, reason CancellationReason) (*Ride, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return ccs.cabService.CancelRide(rideId, cancelledBy, reason)
+}
+func (ccs *ContextCabService) QueryRides(ctx context.Context, query RideQuery) (*RidePage, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return ccs.cabService.QueryRides(query)
+}
+
+// TrackRide stops the tracker when the context ends.
+func (ccs *ContextCabService) TrackRide(ctx context.Context, rideId string) (*RideTracker, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	tracker, err := ccs.cabService.TrackRide(rideId)
+	if err != nil {
+		return nil, err
+	}
+	context.AfterFunc(ctx, tracker.Stop)
+	return tracker, nil
+}
+func (ccs *ContextCabService) GetPoolTrip(ctx context.Context, rideId string) (*PoolTrip, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return ccs.cabService.GetPoolTrip(rideId)
+}
+func (ccs *ContextCabService) AcceptRide(ctx context.Context, rideId, cabId string) error {
+	if err := ccs.checkOffer(ctx, rideId, cabId); err != nil {
+		return err
+	}
+	return ccs.cabService.AcceptRide(rideId, cabId)
+}
+func (ccs *ContextCabService) RejectRide(ctx context.Context, rideId, cabId string) error {
+	if err := ccs.checkOffer(ctx, rideId, cabId); err != nil {
+		return err
+	}
+	return ccs.cabService.RejectRide(rideId, cabId)
+}
+
+// checkOffer tells an unknown ride or cab apart from an offer that is no
+// longer open, which the dispatcher alone cannot.
+func (ccs *ContextCabService) checkOffer(ctx context.Context, rideId, cabId string) error {
+	if _, err := ccs.GetRide(ctx, rideId); err != nil {
+		return err
+	}
+	_, err := ccs.cabService.GetCab(cabId)
+	return err
+}
+func (ccs *ContextCabService) GetRideOffer(ctx context.Context, rideId string) (*RideOffer, error) {
+	if _, err := ccs.GetRide(ctx, rideId); err != nil {
+		return nil, err
+	}
+	return ccs.cabService.GetRideOffer(rideId)
+}
+func (ccs *ContextCabService) GetPendingRide(ctx context.Context, rideId string) (*PendingRide, error) {
+	if _, err := ccs.GetRide(ctx, rideId); err != nil {
+		return nil, err
+	}
+	return ccs.cabService.GetPendingRide(rideId)
+}
+func (ccs *ContextCabService) GetPendingQueueStats(ctx context.Context) (PendingQueueStats, error) {
+	if err := ctx.Err(); err != nil {
+		return PendingQueueStats{}, err
+	}
+	return ccs.cabService.GetPendingQueueStats(), nil
+}
+func (ccs *ContextCabService) RateDriver(ctx context.Context, rideId, userId string, stars int, tags []string) (*Rating, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return ccs.cabService.RateDriver(rideId, userId, stars, tags)
+}
+func (ccs *ContextCabService) RateRider(ctx context.Context, rideId, cabId string, stars int, tags []string) (*Rating, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return ccs.cabService.RateRider(rideId, cabId, stars, tags)
+}
+func (ccs *ContextCabService) GetRideRatings(ctx context.Context, rideId string) ([]Rating, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return ccs.cabService.GetRideRatings(rideId)
+}
+func (ccs *ContextCabService) AddPaymentMethod(ctx context.Context, userId string, methodType PaymentMethodType, cardNumber string, makeDefault bool) (*PaymentMethod, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return ccs.cabService.AddPaymentMethod(userId, methodType, cardNumber, makeDefault)
+}
+func (ccs *ContextCabService) GetPaymentMethods(ctx context.Context, userId string) ([]PaymentMethod, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return ccs.cabService.GetPaymentMethods(userId)
+}
+func (ccs *ContextCabService) SetDefaultPaymentMethod(ctx context.Context, userId, methodId string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return ccs.cabService.SetDefaultPaymentMethod(userId, methodId)
+}
+func (ccs *ContextCabService) TopUpWallet(ctx context.Context, userId, methodId string, amount int) (RiderBalance, error) {
+	if err := ctx.Err(); err != nil {
+		return RiderBalance{}, err
+	}
+	return ccs.cabService.TopUpWallet(userId, methodId, amount)
+}
+func (ccs *ContextCabService) GetBalance(ctx context.Context, userId string) (RiderBalance, error) {
+	if err := ctx.Err(); err != nil {
+		return RiderBalance{}, err
+	}
+	return ccs.cabService.GetBalance(userId)
+}
+func (ccs *ContextCabService) PayDues(ctx context.Context, userId, methodId string) (RiderBalance, error) {
+	if err := ctx.Err(); err != nil {
+		return RiderBalance{}, err
+	}
+	return ccs.cabService.PayDues(userId, methodId)
+}
+func (ccs *ContextCabService) GetLedger(ctx context.Context, userId string) ([]LedgerEntry, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return ccs.cabService.GetLedger(userId)
+}
+func (ccs *ContextCabService) GetRidePayment(ctx context.Context, rideId string) (*Payment, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return ccs.cabService.GetRidePayment(rideId)
+}
+func (ccs *ContextCabService) RefundRide(ctx context.Context, rideId string, amount int, reason string) (*Payment, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return ccs.cabService.RefundRide(rideId, amount, reason)
+}
+func (ccs *ContextCabService) CreatePromotion(ctx context.Context, promotion Promotion) (*Promotion, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return ccs.cabService.CreatePromotion(promotion)
+}
+func (ccs *ContextCabService) GetPromotion(ctx context.Context, code string) (*Promotion, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return ccs.cabService.GetPromotion(code)
+}
+func (ccs *ContextCabService) GetReferralCode(ctx context.Context, userId string) (*Promotion, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return ccs.cabService.GetReferralCode(userId)
+}
+func (ccs *ContextCabService) GetPromoRedemptions(ctx context.Context, userId string) ([]PromoRedemption, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return ccs.cabService.GetPromoRedemptions(userId)
+}
+func (ccs *ContextCabService) GoOnline(ctx context.Context, cabId string) (*Cab, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return ccs.cabService.GoOnline(cabId)
+}
+func (ccs *ContextCabService) TakeBreak(ctx context.Context, cabId string) (*Cab, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return ccs.cabService.TakeBreak(cabId)
+}
+func (ccs *ContextCabService) GoOffline(ctx context.Context, cabId string) (*Cab, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return ccs.cabService.GoOffline(cabId)
+}
+func (ccs *ContextCabService) AddDriverIncentive(ctx context.Context, cabId string, amount int, note string) (*EarningEntry, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return ccs.cabService.AddDriverIncentive(cabId, amount, note)
+}
+func (ccs *ContextCabService) GetEarningsBalance(ctx context.Context, cabId string) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	return ccs.cabService.GetEarningsBalance(cabId)
+}
+func (ccs *ContextCabService) GetEarningsStatement(ctx context.Context, cabId string, period StatementPeriod, at time.Time) (*EarningsStatement, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return ccs.cabService.GetEarningsStatement(cabId, period, at)
+}
+func (ccs *ContextCabService) CreatePayoutBatch(ctx context.Context) (*PayoutBatch, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return ccs.cabService.CreatePayoutBatch()
+}
+func (ccs *ContextCabService) GetPayoutBatch(ctx context.Context, batchId string) (*PayoutBatch, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return ccs.cabService.GetPayoutBatch(batchId)
+}
+func (ccs *ContextCabService) GetZoneQueue(ctx context.Context, zoneId string) ([]QueuedCab, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return ccs.cabService.GetZoneQueue(zoneId)
+}
+func (ccs *ContextCabService) AddStop(ctx context.Context, rideId string, index int, lat, lon float64) (*Ride, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return ccs.cabService.AddStop(rideId, index, lat, lon)
+}
+func (ccs *ContextCabService) RemoveStop(ctx context.Context, rideId string, index int) (*Ride, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return ccs.cabService.RemoveStop(rideId, index)
+}
+func (ccs *ContextCabService) ArriveAtStop(ctx context.Context, rideId string, index int) (*Ride, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return ccs.cabService.ArriveAtStop(rideId, index)
+}
+func (ccs *ContextCabService) DepartStop(ctx context.Context, rideId string, index int) (*Ride, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return ccs.cabService.DepartStop(rideId, index)
+}
+func (ccs *ContextCabService) Close() {
+	ccs.cabService.Close()
+}
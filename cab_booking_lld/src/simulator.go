@@ -0,0 +1,582 @@
+package src
+
+import (
+	"container/heap"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"runtime"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// DemandHotspot is a disc that riders are drawn to, in proportion to its
+// weight among the hotspots it is listed with.
+type DemandHotspot struct {
+	Center   GeoPoint
+	RadiusKm float64
+	Weight   float64
+}
+
+// DemandProfile says when and where riders appear. Riders arrive as a Poisson
+// process at RidersPerHour, scaled by the multiplier for the hour of the day
+// when one is given. Pickups and drops are drawn from their hotspots, or from
+// anywhere in the area when there are none.
+type DemandProfile struct {
+	RidersPerHour     float64
+	HourlyMultipliers map[int]float64
+	Pickups           []DemandHotspot
+	Drops             []DemandHotspot
+}
+
+type SimulationConfig struct {
+	Name     string
+	Duration time.Duration
+	Seed     int64
+	Area     BoundingBox
+	Demand   DemandProfile
+	Cabs     int
+	Category VehicleCategory
+	// Cabs drive at CabSpeedKmph unless the router gives the time by road.
+	CabSpeedKmph float64
+	// After a drop cabs cruise towards a likely pickup at CruiseSpeedKmph and
+	// wait there, or wait at the drop when it is zero.
+	CruiseSpeedKmph  float64
+	MovementInterval time.Duration
+	// RiderPatience is how long a rider waits for a cab before cancelling.
+	RiderPatience time.Duration
+}
+
+// SimulationReport sums up a run. Wait times run from the request to the
+// pickup, utilisation is the share of cab time spent between accepting a ride
+// and dropping the rider, and dead-head distance is driven without a rider.
+type SimulationReport struct {
+	Name          string
+	Requested     int
+	Matched       int
+	Completed     int
+	Abandoned     int
+	MatchRate     float64
+	WaitP50       time.Duration
+	WaitP90       time.Duration
+	WaitP99       time.Duration
+	Utilisation   float64
+	DeadHeadKm    float64
+	PassengerKm   float64
+	Revenue       int
+	RevenuePerCab float64
+}
+
+func (sr *SimulationReport) String() string {
+	return fmt.Sprintf("%s: %d requested, match rate %.0f%%, wait p50 %v p90 %v p99 %v, utilisation %.0f%%, dead-head %.1f km of %.1f km, revenue %d",
+		sr.Name, sr.Requested, sr.MatchRate*100, sr.WaitP50.Round(time.Second), sr.WaitP90.Round(time.Second), sr.WaitP99.Round(time.Second),
+		sr.Utilisation*100, sr.DeadHeadKm, sr.DeadHeadKm+sr.PassengerKm, sr.Revenue)
+}
+
+// WriteSimulationCSV exports the reports one row each, so runs of different
+// strategies can be compared side by side.
+func WriteSimulationCSV(w io.Writer, reports []*SimulationReport) error {
+	writer := csv.NewWriter(w)
+	writer.Write([]string{"name", "requested", "matched", "completed", "abandoned", "match_rate", "wait_p50_s", "wait_p90_s", "wait_p99_s",
+		"utilisation", "dead_head_km", "passenger_km", "revenue", "revenue_per_cab"})
+	for _, report := range reports {
+		writer.Write([]string{
+			report.Name,
+			strconv.Itoa(report.Requested),
+			strconv.Itoa(report.Matched),
+			strconv.Itoa(report.Completed),
+			strconv.Itoa(report.Abandoned),
+			strconv.FormatFloat(report.MatchRate, 'f', 4, 64),
+			strconv.FormatFloat(report.WaitP50.Seconds(), 'f', 0, 64),
+			strconv.FormatFloat(report.WaitP90.Seconds(), 'f', 0, 64),
+			strconv.FormatFloat(report.WaitP99.Seconds(), 'f', 0, 64),
+			strconv.FormatFloat(report.Utilisation, 'f', 4, 64),
+			strconv.FormatFloat(report.DeadHeadKm, 'f', 2, 64),
+			strconv.FormatFloat(report.PassengerKm, 'f', 2, 64),
+			strconv.Itoa(report.Revenue),
+			strconv.FormatFloat(report.RevenuePerCab, 'f', 2, 64),
+		})
+	}
+	writer.Flush()
+	return writer.Error()
+}
+
+type Simulator interface {
+	Run() (*SimulationReport, error)
+}
+
+type simEventKind int
+
+const (
+	riderArrives simEventKind = iota
+	riderGivesUp
+	cabReachesPickup
+	cabReachesDrop
+	fleetMoves
+)
+
+type simEvent struct {
+	at     time.Time
+	seq    int
+	kind   simEventKind
+	rideId string
+}
+
+type simEventQueue []simEvent
+
+func (seq simEventQueue) Len() int { return len(seq) }
+func (seq simEventQueue) Less(i, j int) bool {
+	if !seq[i].at.Equal(seq[j].at) {
+		return seq[i].at.Before(seq[j].at)
+	}
+	return seq[i].seq < seq[j].seq
+}
+func (seq simEventQueue) Swap(i, j int) { seq[i], seq[j] = seq[j], seq[i] }
+func (seq *simEventQueue) Push(x any)   { *seq = append(*seq, x.(simEvent)) }
+func (seq *simEventQueue) Pop() any {
+	old := *seq
+	event := old[len(old)-1]
+	*seq = old[:len(old)-1]
+	return event
+}
+
+type simCabPhase int
+
+const (
+	cabIdle simCabPhase = iota
+	cabToPickup
+	cabOnTrip
+)
+
+type simCab struct {
+	id           string
+	position     GeoPoint
+	phase        simCabPhase
+	cruiseTarget *GeoPoint
+	repositioned bool
+	legFrom      GeoPoint
+	legTo        GeoPoint
+	legStart     time.Time
+	legDuration  time.Duration
+	busySince    time.Time
+}
+
+type simRide struct {
+	rider       int
+	requestedAt time.Time
+	cabId       string
+}
+
+// FleetSimulator drives a CabService through a day of riders and drivers in
+// simulated time, one event at a time. Drivers accept every offer and drive
+// straight to the pickup and on to the drop.
+//
+// The dispatcher's offer timeouts and retries run on the simulated clock, so
+// after a booking or a drop the simulator answers the offers and lets dispatch
+// go quiet before moving the clock on, and runs with the same seed give the
+// same report. Build the service's pending queue with a deadline longer than
+// the run takes, riders give up after RiderPatience instead.
+type FleetSimulator struct {
+	cabService         CabService
+	clock              *ManualClock
+	distanceCalculator DistanceCalculator
+	router             Router
+	config             SimulationConfig
+	demandRandom       *rand.Rand
+	fleetRandom        *rand.Rand
+	end                time.Time
+	events             simEventQueue
+	seq                int
+	cabs               map[string]*simCab
+	fleet              []*simCab
+	searching          map[string]*simRide
+	onTrip             map[string]*simRide
+	waits              []time.Duration
+	report             SimulationReport
+	busyTime           time.Duration
+	riders             int
+}
+
+// NewFleetSimulator runs on a fresh service built with clock, so the cabs and
+// rides it counts are its own. The router is optional. Riders are drawn apart
+// from the fleet, so runs with the same seed see the same riders whatever the
+// strategies.
+func NewFleetSimulator(cabService CabService, clock *ManualClock, distanceCalculator DistanceCalculator, router Router, config SimulationConfig) Simulator {
+	return &FleetSimulator{
+		cabService:         cabService,
+		clock:              clock,
+		distanceCalculator: distanceCalculator,
+		router:             router,
+		config:             config,
+		demandRandom:       rand.New(rand.NewSource(config.Seed)),
+		fleetRandom:        rand.New(rand.NewSource(config.Seed + 1)),
+		cabs:               make(map[string]*simCab),
+		searching:          make(map[string]*simRide),
+		onTrip:             make(map[string]*simRide),
+	}
+}
+
+func (fs *FleetSimulator) validate() error {
+	config := fs.config
+	switch {
+	case config.Duration <= 0:
+		return fmt.Errorf("%w: duration must be positive", ErrInvalidSimulation)
+	case config.Cabs <= 0:
+		return fmt.Errorf("%w: the fleet needs cabs", ErrInvalidSimulation)
+	case config.Demand.RidersPerHour <= 0:
+		return fmt.Errorf("%w: riders per hour must be positive", ErrInvalidSimulation)
+	case config.CabSpeedKmph <= 0:
+		return fmt.Errorf("%w: cab speed must be positive", ErrInvalidSimulation)
+	case config.MovementInterval <= 0:
+		return fmt.Errorf("%w: movement interval must be positive", ErrInvalidSimulation)
+	case config.RiderPatience <= 0:
+		return fmt.Errorf("%w: rider patience must be positive", ErrInvalidSimulation)
+	case config.Category == AnyCategory:
+		return fmt.Errorf("%w: the fleet needs a vehicle category", ErrInvalidSimulation)
+	}
+	if len(config.Demand.Pickups) == 0 || len(config.Demand.Drops) == 0 {
+		if config.Area.MinLat >= config.Area.MaxLat || config.Area.MinLon >= config.Area.MaxLon {
+			return fmt.Errorf("%w: demand without hotspots needs an area", ErrInvalidSimulation)
+		}
+	}
+	return nil
+}
+
+func (fs *FleetSimulator) Run() (*SimulationReport, error) {
+	if err := fs.validate(); err != nil {
+		return nil, err
+	}
+	fs.report = SimulationReport{Name: fs.config.Name}
+	fs.end = fs.clock.Now().Add(fs.config.Duration)
+	for i := 0; i < fs.config.Cabs; i++ {
+		cab, err := fs.cabService.RegisterCab(fmt.Sprintf("%s-cab-%d", fs.config.Name, i+1), fs.config.Category)
+		if err != nil {
+			return nil, err
+		}
+		position := fs.samplePoint(fs.fleetRandom, fs.config.Demand.Pickups)
+		fs.cabService.UpdateCabLocation(cab.GetId(), position.Lat, position.Lon)
+		fs.cabs[cab.GetId()] = &simCab{id: cab.GetId(), position: position, repositioned: true}
+		fs.fleet = append(fs.fleet, fs.cabs[cab.GetId()])
+	}
+	fs.schedule(fs.clock.Now().Add(fs.nextArrivalGap()), riderArrives, "")
+	fs.schedule(fs.clock.Now().Add(fs.config.MovementInterval), fleetMoves, "")
+
+	for fs.events.Len() > 0 {
+		event := heap.Pop(&fs.events).(simEvent)
+		if event.at.After(fs.end) {
+			break
+		}
+		fs.clock.Advance(event.at.Sub(fs.clock.Now()))
+		switch event.kind {
+		case riderArrives:
+			fs.bookRide()
+			fs.schedule(event.at.Add(fs.nextArrivalGap()), riderArrives, "")
+		case riderGivesUp:
+			fs.giveUp(event.rideId)
+		case cabReachesPickup:
+			fs.pickUp(event.rideId)
+		case cabReachesDrop:
+			fs.dropOff(event.rideId)
+		case fleetMoves:
+			fs.moveFleet()
+			fs.schedule(event.at.Add(fs.config.MovementInterval), fleetMoves, "")
+		}
+	}
+	fs.clock.Advance(max(0, fs.end.Sub(fs.clock.Now())))
+	fs.settle()
+	return fs.finish(), nil
+}
+
+func (fs *FleetSimulator) schedule(at time.Time, kind simEventKind, rideId string) {
+	fs.seq++
+	heap.Push(&fs.events, simEvent{at: at, seq: fs.seq, kind: kind, rideId: rideId})
+}
+
+// nextArrivalGap draws the time to the next rider at the rate for the hour of
+// the day it is now.
+func (fs *FleetSimulator) nextArrivalGap() time.Duration {
+	rate := fs.config.Demand.RidersPerHour
+	if multiplier, exists := fs.config.Demand.HourlyMultipliers[fs.clock.Now().Hour()]; exists {
+		rate *= multiplier
+	}
+	if rate <= 0 {
+		// Nobody comes this hour, look again at the top of the next one.
+		now := fs.clock.Now()
+		return now.Truncate(time.Hour).Add(time.Hour).Sub(now)
+	}
+	return time.Duration(fs.demandRandom.ExpFloat64() / rate * float64(time.Hour))
+}
+
+func (fs *FleetSimulator) samplePoint(random *rand.Rand, hotspots []DemandHotspot) GeoPoint {
+	if len(hotspots) == 0 {
+		area := fs.config.Area
+		return GeoPoint{
+			Lat: area.MinLat + random.Float64()*(area.MaxLat-area.MinLat),
+			Lon: area.MinLon + random.Float64()*(area.MaxLon-area.MinLon),
+		}
+	}
+	totalWeight := 0.0
+	for _, hotspot := range hotspots {
+		totalWeight += hotspot.Weight
+	}
+	pick := random.Float64() * totalWeight
+	hotspot := hotspots[len(hotspots)-1]
+	for _, candidate := range hotspots {
+		if pick < candidate.Weight {
+			hotspot = candidate
+			break
+		}
+		pick -= candidate.Weight
+	}
+	// The square root spreads points evenly over the disc instead of bunching
+	// them in the middle.
+	distanceKm := hotspot.RadiusKm * math.Sqrt(random.Float64())
+	bearing := random.Float64() * 2 * math.Pi
+	return GeoPoint{
+		Lat: hotspot.Center.Lat + distanceKm*math.Cos(bearing)/kmPerDegreeLat,
+		Lon: hotspot.Center.Lon + distanceKm*math.Sin(bearing)/(kmPerDegreeLat*math.Cos(toRadians(hotspot.Center.Lat))),
+	}
+}
+
+// travel is how far and how long a cab drives between two points, by road
+// when the router can route it.
+func (fs *FleetSimulator) travel(from, to GeoPoint) (float64, time.Duration) {
+	if fs.router != nil {
+		if route, err := fs.router.Route(from.Lat, from.Lon, to.Lat, to.Lon); err == nil {
+			return route.DistanceKm, route.Duration
+		}
+	}
+	distanceKm := fs.distanceCalculator.Distance(from.Lat, from.Lon, to.Lat, to.Lon)
+	return distanceKm, time.Duration(distanceKm / fs.config.CabSpeedKmph * float64(time.Hour))
+}
+
+func (fs *FleetSimulator) bookRide() {
+	fs.riders++
+	rider, err := fs.cabService.RegisterUser(fmt.Sprintf("%s-rider-%d", fs.config.Name, fs.riders))
+	pickup := fs.samplePoint(fs.demandRandom, fs.config.Demand.Pickups)
+	drop := fs.samplePoint(fs.demandRandom, fs.config.Demand.Drops)
+	fs.report.Requested++
+	var ride *Ride
+	if err == nil {
+		ride, err = fs.cabService.BookRide(rider.GetId(), pickup.Lat, pickup.Lon, drop.Lat, drop.Lon, WithVehicleCategory(fs.config.Category))
+	}
+	if err != nil {
+		fs.report.Abandoned++
+		return
+	}
+	fs.searching[ride.GetId()] = &simRide{rider: fs.riders, requestedAt: fs.clock.Now()}
+	fs.schedule(fs.clock.Now().Add(fs.config.RiderPatience), riderGivesUp, ride.GetId())
+	fs.settle()
+}
+
+// settle answers every offer and waits until each searching ride is either
+// matched or parked in the pending queue with no dispatch under way. The clock
+// stands still meanwhile and retries for freed cabs run before the call that
+// freed them returns, so nothing else is left to start once all are quiet.
+func (fs *FleetSimulator) settle() {
+	for {
+		busy := false
+		for _, rideId := range fs.searchingRideIds() {
+			if !fs.checkSearch(rideId) {
+				busy = true
+			}
+		}
+		if !busy {
+			return
+		}
+		runtime.Gosched()
+	}
+}
+
+// searchingRideIds lists the rides still searching in the order they were
+// booked, so they are looked at in the same order on every run.
+func (fs *FleetSimulator) searchingRideIds() []string {
+	rideIds := make([]string, 0, len(fs.searching))
+	for rideId := range fs.searching {
+		rideIds = append(rideIds, rideId)
+	}
+	sort.Slice(rideIds, func(i, j int) bool {
+		return fs.searching[rideIds[i]].rider < fs.searching[rideIds[j]].rider
+	})
+	return rideIds
+}
+
+// checkSearch reports whether dispatch is done with the ride for now.
+func (fs *FleetSimulator) checkSearch(rideId string) bool {
+	ride, err := fs.cabService.GetRide(rideId)
+	if err != nil {
+		delete(fs.searching, rideId)
+		return true
+	}
+	switch ride.GetStatus() {
+	case Confirmed:
+		fs.startPickup(ride)
+		return true
+	case SearchingForCab:
+	default:
+		delete(fs.searching, rideId)
+		fs.report.Abandoned++
+		return true
+	}
+	if offer, err := fs.cabService.GetRideOffer(rideId); err == nil && offer.GetStatus() == OfferPending {
+		fs.cabService.AcceptRide(rideId, offer.GetCabId())
+		return false
+	}
+	pending, err := fs.cabService.GetPendingRide(rideId)
+	return err == nil && !pending.IsInFlight()
+}
+
+func (fs *FleetSimulator) startPickup(ride *Ride) {
+	simRide := fs.searching[ride.GetId()]
+	delete(fs.searching, ride.GetId())
+	simRide.cabId = ride.GetCabId()
+	fs.onTrip[ride.GetId()] = simRide
+	fs.report.Matched++
+	cab := fs.cabs[ride.GetCabId()]
+	if cab == nil {
+		return
+	}
+	startLat, startLon := ride.GetStartPoint()
+	distanceKm, duration := fs.travel(cab.position, GeoPoint{Lat: startLat, Lon: startLon})
+	fs.report.DeadHeadKm += distanceKm
+	cab.phase = cabToPickup
+	cab.cruiseTarget = nil
+	cab.busySince = fs.clock.Now()
+	fs.startLeg(cab, GeoPoint{Lat: startLat, Lon: startLon}, duration)
+	fs.schedule(fs.clock.Now().Add(duration), cabReachesPickup, ride.GetId())
+}
+
+func (fs *FleetSimulator) startLeg(cab *simCab, to GeoPoint, duration time.Duration) {
+	cab.legFrom = cab.position
+	cab.legTo = to
+	cab.legStart = fs.clock.Now()
+	cab.legDuration = duration
+}
+
+func (fs *FleetSimulator) giveUp(rideId string) {
+	if _, waiting := fs.searching[rideId]; !waiting {
+		return
+	}
+	// The ride may have been matched since dispatch last went quiet.
+	if fs.checkSearch(rideId); fs.searching[rideId] == nil {
+		return
+	}
+	delete(fs.searching, rideId)
+	fs.report.Abandoned++
+	fs.cabService.CancelRide(rideId, CancelledByRider, ChangeOfPlans)
+}
+
+func (fs *FleetSimulator) pickUp(rideId string) {
+	simRide := fs.onTrip[rideId]
+	cab := fs.cabs[simRide.cabId]
+	ride, err := fs.cabService.UpdateRideStatus(rideId, PickedUp)
+	if err != nil {
+		return
+	}
+	fs.waits = append(fs.waits, fs.clock.Now().Sub(simRide.requestedAt))
+	cab.position = cab.legTo
+	fs.cabService.UpdateCabLocation(cab.id, cab.position.Lat, cab.position.Lon)
+	endLat, endLon := ride.GetEndPoint()
+	distanceKm, duration := fs.travel(cab.position, GeoPoint{Lat: endLat, Lon: endLon})
+	fs.report.PassengerKm += distanceKm
+	cab.phase = cabOnTrip
+	fs.startLeg(cab, GeoPoint{Lat: endLat, Lon: endLon}, duration)
+	fs.schedule(fs.clock.Now().Add(duration), cabReachesDrop, rideId)
+}
+
+func (fs *FleetSimulator) dropOff(rideId string) {
+	simRide := fs.onTrip[rideId]
+	delete(fs.onTrip, rideId)
+	cab := fs.cabs[simRide.cabId]
+	ride, err := fs.cabService.UpdateRideStatus(rideId, Completed)
+	if err != nil {
+		return
+	}
+	fs.report.Completed++
+	if fare := ride.GetFinalFare(); fare != nil {
+		fs.report.Revenue += fare.Total
+	}
+	// Completing the ride leaves the cab at the drop.
+	cab.position = cab.legTo
+	cab.phase = cabIdle
+	cab.repositioned = false
+	fs.busyTime += fs.clock.Now().Sub(cab.busySince)
+	fs.settle()
+}
+
+// moveFleet moves cabs on a leg along it and cabs that just dropped a rider
+// towards a likely pickup, so dispatch sees where every cab really is.
+func (fs *FleetSimulator) moveFleet() {
+	now := fs.clock.Now()
+	step := fs.config.CruiseSpeedKmph * fs.config.MovementInterval.Hours()
+	for _, cab := range fs.fleet {
+		switch cab.phase {
+		case cabIdle:
+			if step <= 0 || cab.repositioned {
+				continue
+			}
+			if cab.cruiseTarget == nil {
+				target := fs.samplePoint(fs.fleetRandom, fs.config.Demand.Pickups)
+				cab.cruiseTarget = &target
+			}
+			remainingKm := fs.distanceCalculator.Distance(cab.position.Lat, cab.position.Lon, cab.cruiseTarget.Lat, cab.cruiseTarget.Lon)
+			if remainingKm <= step {
+				fs.report.DeadHeadKm += remainingKm
+				cab.position = *cab.cruiseTarget
+				cab.cruiseTarget = nil
+				cab.repositioned = true
+			} else {
+				fs.report.DeadHeadKm += step
+				cab.position = interpolate(cab.position, *cab.cruiseTarget, step/remainingKm)
+			}
+		default:
+			if cab.legDuration <= 0 {
+				continue
+			}
+			cab.position = interpolate(cab.legFrom, cab.legTo, math.Min(1, float64(now.Sub(cab.legStart))/float64(cab.legDuration)))
+		}
+		fs.cabService.UpdateCabLocation(cab.id, cab.position.Lat, cab.position.Lon)
+	}
+}
+
+func interpolate(from, to GeoPoint, fraction float64) GeoPoint {
+	return GeoPoint{Lat: from.Lat + (to.Lat-from.Lat)*fraction, Lon: from.Lon + (to.Lon-from.Lon)*fraction}
+}
+
+// finish cancels the riders still waiting, counts cabs still on a ride as busy
+// up to the end and works out the rates and percentiles.
+func (fs *FleetSimulator) finish() *SimulationReport {
+	for _, rideId := range fs.searchingRideIds() {
+		fs.report.Abandoned++
+		fs.cabService.CancelRide(rideId, CancelledByRider, ChangeOfPlans)
+	}
+	fs.searching = make(map[string]*simRide)
+	for _, cab := range fs.cabs {
+		if cab.phase != cabIdle {
+			fs.busyTime += fs.end.Sub(cab.busySince)
+		}
+	}
+	report := fs.report
+	if report.Requested > 0 {
+		report.MatchRate = float64(report.Matched) / float64(report.Requested)
+	}
+	report.Utilisation = float64(fs.busyTime) / float64(time.Duration(fs.config.Cabs)*fs.config.Duration)
+	report.RevenuePerCab = float64(report.Revenue) / float64(fs.config.Cabs)
+	sort.Slice(fs.waits, func(i, j int) bool { return fs.waits[i] < fs.waits[j] })
+	report.WaitP50 = percentile(fs.waits, 50)
+	report.WaitP90 = percentile(fs.waits, 90)
+	report.WaitP99 = percentile(fs.waits, 99)
+	return &report
+}
+
+// percentile takes the nearest rank from sorted durations.
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	rank := int(math.Ceil(p / 100 * float64(len(sorted))))
+	return sorted[max(0, rank-1)]
+}
@@ -0,0 +1,1180 @@
+package src
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The SQLite repositories keep the database as the source of truth. The geo
+// indexes, and the cab statuses the cab index filters on, are rebuilt from it
+// on start and then kept in step under the repository lock, which assumes one
+// process owns the database.
+
+type SQLiteUserRepository struct {
+	db                   *sql.DB
+	idGenerationStrategy IdGenerationStrategy
+	mu                   sync.Mutex
+}
+
+func NewSQLiteUserRepository(db *sql.DB, idGenerationStrategy IdGenerationStrategy) IUserRepository {
+	return &SQLiteUserRepository{
+		db:                   db,
+		idGenerationStrategy: idGenerationStrategy,
+	}
+}
+
+const userColumns = `id, name, priority_tier, rating, rating_count`
+
+func scanUser(row sqlScanner) (*User, error) {
+	user := &User{}
+	if err := row.Scan(&user.id, &user.name, &user.priorityTier, &user.rating, &user.ratingCount); err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+func (sur *SQLiteUserRepository) CreateUser(name string) (*User, error) {
+	newUser := NewUser(sur.idGenerationStrategy.GenerateId(), name)
+	if _, err := sur.db.Exec(`INSERT INTO users (`+userColumns+`) VALUES (?, ?, ?, ?, ?)`, newUser.id, newUser.name, newUser.priorityTier, newUser.rating, newUser.ratingCount); err != nil {
+		return nil, fmt.Errorf("creating user: %w", err)
+	}
+	return newUser, nil
+}
+func (sur *SQLiteUserRepository) GetUserById(id string) *User {
+	user, err := scanUser(sur.db.QueryRow(`SELECT `+userColumns+` FROM users WHERE id = ?`, id))
+	if err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			log.Printf("sqlite: reading user %s: %v", id, err)
+		}
+		return nil
+	}
+	return user
+}
+func (sur *SQLiteUserRepository) UpdateUser(id string, update func(user *User) error) (*User, error) {
+	sur.mu.Lock()
+	defer sur.mu.Unlock()
+	var updated *User
+	err := inSQLiteTx(sur.db, func(tx *sql.Tx) error {
+		user, err := scanUser(tx.QueryRow(`SELECT `+userColumns+` FROM users WHERE id = ?`, id))
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrUserNotFound
+		} else if err != nil {
+			return err
+		}
+		if err := update(user); err != nil {
+			return err
+		}
+		updated = user
+		_, err = tx.Exec(`UPDATE users SET name = ?, priority_tier = ?, rating = ?, rating_count = ? WHERE id = ?`,
+			user.name, user.priorityTier, user.rating, user.ratingCount, id)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return updated, nil
+}
+
+type SQLiteCabRepository struct {
+	db                   *sql.DB
+	idGenerationStrategy IdGenerationStrategy
+	cabLocationIndex     GeoIndex
+	cabStatuses          map[string]CabStatus
+	cabCategories        map[string]VehicleCategory
+	mu                   sync.RWMutex
+}
+
+func NewSQLiteCabRepository(db *sql.DB, idGenerationStrategy IdGenerationStrategy, cabLocationIndex GeoIndex) (ICabRepository, error) {
+	scr := &SQLiteCabRepository{
+		db:                   db,
+		idGenerationStrategy: idGenerationStrategy,
+		cabLocationIndex:     cabLocationIndex,
+		cabStatuses:          make(map[string]CabStatus),
+		cabCategories:        make(map[string]VehicleCategory),
+	}
+	cabs, err := scr.queryCabs(`SELECT ` + cabColumns + ` FROM cabs`)
+	if err != nil {
+		return nil, fmt.Errorf("loading cabs: %w", err)
+	}
+	for i := range cabs {
+		scr.track(&cabs[i])
+	}
+	return scr, nil
+}
+
+const cabColumns = `id, name, status, total_rides, lat, lon, category, rating, rating_count, flagged_for_review,
+	cancellations, deprioritised_until`
+
+func scanCab(row sqlScanner) (*Cab, error) {
+	cab := &Cab{}
+	var deprioritisedUntil sql.NullInt64
+	if err := row.Scan(&cab.id, &cab.name, &cab.cabStatus, &cab.totalRides, &cab.currLocLat, &cab.currLocLon, &cab.category,
+		&cab.rating, &cab.ratingCount, &cab.flaggedForReview, &cab.cancellations, &deprioritisedUntil); err != nil {
+		return nil, err
+	}
+	if deprioritisedUntil.Valid {
+		cab.deprioritisedUntil = time.Unix(0, deprioritisedUntil.Int64)
+	}
+	return cab, nil
+}
+
+// cabDeprioritisedUntil stores a cab that was never deprioritised as NULL.
+func cabDeprioritisedUntil(cab *Cab) any {
+	if cab.deprioritisedUntil.IsZero() {
+		return nil
+	}
+	return cab.deprioritisedUntil.UnixNano()
+}
+
+func (scr *SQLiteCabRepository) queryCabs(query string, args ...any) ([]Cab, error) {
+	rows, err := scr.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	cabs := make([]Cab, 0)
+	for rows.Next() {
+		cab, err := scanCab(rows)
+		if err != nil {
+			return nil, err
+		}
+		cabs = append(cabs, *cab)
+	}
+	return cabs, rows.Err()
+}
+
+func (scr *SQLiteCabRepository) track(cab *Cab) {
+	cabLat, cabLon := cab.GetCurrLocation()
+	scr.cabLocationIndex.Upsert(cab.GetId(), cabLat, cabLon)
+	scr.cabStatuses[cab.GetId()] = cab.GetCabStatus()
+	scr.cabCategories[cab.GetId()] = cab.GetCategory()
+}
+
+func (scr *SQLiteCabRepository) CreateCab(name string, category VehicleCategory) (*Cab, error) {
+	scr.mu.Lock()
+	defer scr.mu.Unlock()
+	newCab := NewCab(scr.idGenerationStrategy.GenerateId(), name, category)
+	_, err := scr.db.Exec(`INSERT INTO cabs (`+cabColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		newCab.id, newCab.name, newCab.cabStatus, newCab.totalRides, newCab.currLocLat, newCab.currLocLon, newCab.category,
+		newCab.rating, newCab.ratingCount, newCab.flaggedForReview, newCab.cancellations, cabDeprioritisedUntil(newCab))
+	if err != nil {
+		return nil, fmt.Errorf("creating cab: %w", err)
+	}
+	scr.track(newCab)
+	return newCab, nil
+}
+func (scr *SQLiteCabRepository) FindAvailableCabs() []Cab {
+	cabs, err := scr.queryCabs(`SELECT `+cabColumns+` FROM cabs WHERE status = ?`, ReadyToTakeRide)
+	if err != nil {
+		log.Printf("sqlite: reading available cabs: %v", err)
+		return make([]Cab, 0)
+	}
+	return cabs
+}
+func (scr *SQLiteCabRepository) FindNearestAvailableCabs(lat, lon float64, k int, category VehicleCategory) []Cab {
+	scr.mu.RLock()
+	defer scr.mu.RUnlock()
+	return scr.cabsFromIndexResults(scr.cabLocationIndex.Nearest(lat, lon, k, func(id string) bool {
+		return scr.isCabAvailable(id) && category.Matches(scr.cabCategories[id])
+	}))
+}
+func (scr *SQLiteCabRepository) FindAvailableCabsWithinRadius(lat, lon, radiusKm float64) []Cab {
+	scr.mu.RLock()
+	defer scr.mu.RUnlock()
+	return scr.cabsFromIndexResults(scr.cabLocationIndex.WithinRadius(lat, lon, radiusKm, scr.isCabAvailable))
+}
+func (scr *SQLiteCabRepository) CountAvailableCabsInZone(zone Zone) int {
+	scr.mu.RLock()
+	defer scr.mu.RUnlock()
+	count := 0
+	for _, result := range scr.cabLocationIndex.WithinBounds(zone.GetBounds(), scr.isCabAvailable) {
+		if zone.Contains(result.Lat, result.Lon) {
+			count++
+		}
+	}
+	return count
+}
+func (scr *SQLiteCabRepository) isCabAvailable(id string) bool {
+	status, exists := scr.cabStatuses[id]
+	return exists && status == ReadyToTakeRide
+}
+func (scr *SQLiteCabRepository) cabsFromIndexResults(results []GeoIndexResult) []Cab {
+	cabs := make([]Cab, 0, len(results))
+	for _, result := range results {
+		if cab := scr.GetCabById(result.Id); cab != nil {
+			cabs = append(cabs, *cab)
+		}
+	}
+	return cabs
+}
+func (scr *SQLiteCabRepository) UpdateCabStatus(id string, newStatus CabStatus) error {
+	_, err := scr.UpdateCab(id, func(cab *Cab) error {
+		return cab.SetCabStatus(newStatus)
+	})
+	return err
+}
+func (scr *SQLiteCabRepository) UpdateCabLocation(id string, lat, lon float64) error {
+	_, err := scr.UpdateCab(id, func(cab *Cab) error {
+		return cab.SetCurrLocation(lat, lon)
+	})
+	return err
+}
+func (scr *SQLiteCabRepository) ClaimCab(id string) error {
+	_, err := scr.UpdateCab(id, func(cab *Cab) error {
+		if cab.GetCabStatus() != ReadyToTakeRide {
+			return ErrCabNotAvailable
+		}
+		return cab.SetCabStatus(Busy)
+	})
+	return err
+}
+func (scr *SQLiteCabRepository) UpdateCab(id string, update func(cab *Cab) error) (*Cab, error) {
+	scr.mu.Lock()
+	defer scr.mu.Unlock()
+	var updated *Cab
+	err := inSQLiteTx(scr.db, func(tx *sql.Tx) error {
+		cab, err := scanCab(tx.QueryRow(`SELECT `+cabColumns+` FROM cabs WHERE id = ?`, id))
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrCabNotFound
+		} else if err != nil {
+			return err
+		}
+		if err := update(cab); err != nil {
+			return err
+		}
+		updated = cab
+		_, err = tx.Exec(`UPDATE cabs SET name = ?, status = ?, total_rides = ?, lat = ?, lon = ?, rating = ?, rating_count = ?, flagged_for_review = ?,
+			cancellations = ?, deprioritised_until = ? WHERE id = ?`,
+			cab.name, cab.cabStatus, cab.totalRides, cab.currLocLat, cab.currLocLon, cab.rating, cab.ratingCount, cab.flaggedForReview,
+			cab.cancellations, cabDeprioritisedUntil(cab), id)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	scr.track(updated)
+	return updated.clone(), nil
+}
+func (scr *SQLiteCabRepository) GetCabById(id string) *Cab {
+	cab, err := scanCab(scr.db.QueryRow(`SELECT `+cabColumns+` FROM cabs WHERE id = ?`, id))
+	if err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			log.Printf("sqlite: reading cab %s: %v", id, err)
+		}
+		return nil
+	}
+	return cab
+}
+
+type SQLiteRideRegistory struct {
+	db                   *sql.DB
+	idGenerationStrategy IdGenerationStrategy
+	openRideIndex        GeoIndex
+	clock                Clock
+	mu                   sync.RWMutex
+}
+
+func NewSQLiteRideRepository(db *sql.DB, idGenerationStrategy IdGenerationStrategy, openRideIndex GeoIndex, clock Clock) (IRideRegistory, error) {
+	srr := &SQLiteRideRegistory{
+		db:                   db,
+		idGenerationStrategy: idGenerationStrategy,
+		openRideIndex:        openRideIndex,
+		clock:                clock,
+	}
+	openRides, err := srr.queryRides(`SELECT `+rideColumns+` FROM rides WHERE status = ?`, SearchingForCab)
+	if err != nil {
+		return nil, fmt.Errorf("loading open rides: %w", err)
+	}
+	for _, ride := range openRides {
+		srr.openRideIndex.Upsert(ride.GetId(), ride.startPointLat, ride.startPointLon)
+	}
+	return srr, nil
+}
+
+const rideColumns = `id, user_id, start_lat, start_lon, end_lat, end_lon, total_amount, fare_estimate, final_fare,
+	surge_zone_id, surge, status, priority_tier, cab_id, created_at, timeline, scheduled_pickup_at, ride_type, seats, vehicle_category,
+	cab_accepted_from, cancellation, payment_method_id, promo_code, stops`
+
+const rideValuePlaceholders = `?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?`
+
+func scanRide(row sqlScanner) (*Ride, error) {
+	ride := &Ride{}
+	var fareEstimate, finalFare, cabId, cabAcceptedFrom, cancellation sql.NullString
+	var createdAt int64
+	var pickupAt sql.NullInt64
+	var timeline, stops string
+	err := row.Scan(&ride.id, &ride.userId, &ride.startPointLat, &ride.startPointLon, &ride.endPointLat, &ride.endPointLon,
+		&ride.totalAmount, &fareEstimate, &finalFare, &ride.surgeZoneId, &ride.surge, &ride.status, &ride.priorityTier,
+		&cabId, &createdAt, &timeline, &pickupAt, &ride.rideType, &ride.seats, &ride.category,
+		&cabAcceptedFrom, &cancellation, &ride.paymentMethodId, &ride.promoCode, &stops)
+	if err != nil {
+		return nil, err
+	}
+	if ride.fareEstimate, err = fromJSONColumn[FareBreakdown](fareEstimate); err != nil {
+		return nil, err
+	}
+	if ride.finalFare, err = fromJSONColumn[FareBreakdown](finalFare); err != nil {
+		return nil, err
+	}
+	if ride.cabAcceptedFrom, err = fromJSONColumn[GeoPoint](cabAcceptedFrom); err != nil {
+		return nil, err
+	}
+	if ride.cancellation, err = fromJSONColumn[Cancellation](cancellation); err != nil {
+		return nil, err
+	}
+	if cabId.Valid {
+		ride.cabId = &cabId.String
+	}
+	ride.createdAt = time.Unix(0, createdAt)
+	if pickupAt.Valid {
+		ride.pickupAt = time.Unix(0, pickupAt.Int64)
+	}
+	transitions, err := fromJSONColumn[[]RideTransition](sql.NullString{String: timeline, Valid: true})
+	if err != nil {
+		return nil, err
+	}
+	ride.timeline = *transitions
+	rideStops, err := fromJSONColumn[[]RideStop](sql.NullString{String: stops, Valid: true})
+	if err != nil {
+		return nil, err
+	}
+	ride.stops = *rideStops
+	return ride, nil
+}
+
+// rideValues lists the ride in rideColumns order.
+func rideValues(ride *Ride) ([]any, error) {
+	fareEstimate, err := toJSONColumn(ride.fareEstimate)
+	if err != nil {
+		return nil, err
+	}
+	finalFare, err := toJSONColumn(ride.finalFare)
+	if err != nil {
+		return nil, err
+	}
+	timeline, err := toJSONColumn(&ride.timeline)
+	if err != nil {
+		return nil, err
+	}
+	cabAcceptedFrom, err := toJSONColumn(ride.cabAcceptedFrom)
+	if err != nil {
+		return nil, err
+	}
+	cancellation, err := toJSONColumn(ride.cancellation)
+	if err != nil {
+		return nil, err
+	}
+	stops, err := toJSONColumn(&ride.stops)
+	if err != nil {
+		return nil, err
+	}
+	var cabId, pickupAt any
+	if ride.cabId != nil {
+		cabId = *ride.cabId
+	}
+	if ride.IsScheduled() {
+		pickupAt = ride.pickupAt.UnixNano()
+	}
+	return []any{ride.id, ride.userId, ride.startPointLat, ride.startPointLon, ride.endPointLat, ride.endPointLon,
+		ride.totalAmount, fareEstimate, finalFare, ride.surgeZoneId, ride.surge, ride.status, ride.priorityTier,
+		cabId, ride.createdAt.UnixNano(), timeline, pickupAt, ride.rideType, ride.seats, ride.category,
+		cabAcceptedFrom, cancellation, ride.paymentMethodId, ride.promoCode, stops}, nil
+}
+
+func (srr *SQLiteRideRegistory) queryRides(query string, args ...any) ([]Ride, error) {
+	rows, err := srr.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	rides := make([]Ride, 0)
+	for rows.Next() {
+		ride, err := scanRide(rows)
+		if err != nil {
+			return nil, err
+		}
+		rides = append(rides, *ride)
+	}
+	return rides, rows.Err()
+}
+
+func (srr *SQLiteRideRegistory) CreateRide(userId string, startPointLat, startPointLon, endPointLat, endPointLon float64) (*Ride, error) {
+	srr.mu.Lock()
+	defer srr.mu.Unlock()
+	newRide := NewRide(srr.idGenerationStrategy.GenerateId(), userId, startPointLat, startPointLon, endPointLat, endPointLon, srr.clock.Now())
+	if err := srr.insertRide(newRide); err != nil {
+		return nil, fmt.Errorf("creating ride: %w", err)
+	}
+	srr.openRideIndex.Upsert(newRide.GetId(), startPointLat, startPointLon)
+	return newRide.clone(), nil
+}
+func (srr *SQLiteRideRegistory) CreateScheduledRide(userId string, startPointLat, startPointLon, endPointLat, endPointLon float64, pickupAt time.Time) (*Ride, error) {
+	srr.mu.Lock()
+	defer srr.mu.Unlock()
+	newRide := NewScheduledRide(srr.idGenerationStrategy.GenerateId(), userId, startPointLat, startPointLon, endPointLat, endPointLon, srr.clock.Now(), pickupAt)
+	if err := srr.insertRide(newRide); err != nil {
+		return nil, fmt.Errorf("creating scheduled ride: %w", err)
+	}
+	return newRide.clone(), nil
+}
+func (srr *SQLiteRideRegistory) insertRide(ride *Ride) error {
+	values, err := rideValues(ride)
+	if err != nil {
+		return err
+	}
+	_, err = srr.db.Exec(`INSERT INTO rides (`+rideColumns+`) VALUES (`+rideValuePlaceholders+`)`, values...)
+	return err
+}
+func (srr *SQLiteRideRegistory) UpdateRideStatus(id string, newStatus RideStatus) error {
+	_, err := srr.UpdateRide(id, func(ride *Ride) error {
+		return ride.TransitionTo(newStatus, srr.clock.Now())
+	})
+	return err
+}
+func (srr *SQLiteRideRegistory) AssignCab(id string, cabId string) error {
+	_, err := srr.UpdateRide(id, func(ride *Ride) error {
+		return ride.AssignCab(cabId, srr.clock.Now())
+	})
+	return err
+}
+
+// UpdateRide reads, updates and writes the ride in one transaction, so a
+// rejected transition or a failed write leaves the stored ride untouched.
+func (srr *SQLiteRideRegistory) UpdateRide(id string, update func(ride *Ride) error) (*Ride, error) {
+	srr.mu.Lock()
+	defer srr.mu.Unlock()
+	var updated *Ride
+	err := inSQLiteTx(srr.db, func(tx *sql.Tx) error {
+		ride, err := scanRide(tx.QueryRow(`SELECT `+rideColumns+` FROM rides WHERE id = ?`, id))
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrRideNotFound
+		} else if err != nil {
+			return err
+		}
+		if err := update(ride); err != nil {
+			return err
+		}
+		updated = ride
+		values, err := rideValues(ride)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(`UPDATE rides SET (`+rideColumns+`) = (`+rideValuePlaceholders+`) WHERE id = ?`, append(values, id)...)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if updated.GetStatus() == SearchingForCab {
+		srr.openRideIndex.Upsert(id, updated.startPointLat, updated.startPointLon)
+	} else {
+		srr.openRideIndex.Remove(id)
+	}
+	return updated.clone(), nil
+}
+func (srr *SQLiteRideRegistory) GetRideById(id string) *Ride {
+	ride, err := scanRide(srr.db.QueryRow(`SELECT `+rideColumns+` FROM rides WHERE id = ?`, id))
+	if err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			log.Printf("sqlite: reading ride %s: %v", id, err)
+		}
+		return nil
+	}
+	return ride
+}
+func (srr *SQLiteRideRegistory) TotalRideForUser(userId string) []Ride {
+	rides, err := srr.queryRides(`SELECT `+rideColumns+` FROM rides WHERE user_id = ? ORDER BY created_at`, userId)
+	if err != nil {
+		log.Printf("sqlite: reading rides of user %s: %v", userId, err)
+		return make([]Ride, 0)
+	}
+	return rides
+}
+
+// QueryRides filters, totals and pages in SQL, relying on the rides_by_user
+// and rides_by_cab indexes.
+func (srr *SQLiteRideRegistory) QueryRides(query RideQuery) (*RidePage, error) {
+	query, cursor, err := query.normalize()
+	if err != nil {
+		return nil, err
+	}
+	var conditions []string
+	var args []any
+	if query.UserId != "" {
+		conditions, args = append(conditions, `user_id = ?`), append(args, query.UserId)
+	}
+	if query.CabId != "" {
+		conditions, args = append(conditions, `cab_id = ?`), append(args, query.CabId)
+	}
+	if len(query.Statuses) > 0 {
+		placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(query.Statuses)), ", ")
+		conditions = append(conditions, `status IN (`+placeholders+`)`)
+		for _, status := range query.Statuses {
+			args = append(args, status)
+		}
+	}
+	if !query.CreatedFrom.IsZero() {
+		conditions, args = append(conditions, `created_at >= ?`), append(args, query.CreatedFrom.UnixNano())
+	}
+	if !query.CreatedTo.IsZero() {
+		conditions, args = append(conditions, `created_at < ?`), append(args, query.CreatedTo.UnixNano())
+	}
+	where := strings.Join(conditions, ` AND `)
+
+	page := &RidePage{}
+	var spend sql.NullInt64
+	var distanceKm sql.NullFloat64
+	err = srr.db.QueryRow(`SELECT COUNT(*),
+			COALESCE(SUM(status = ?), 0),
+			COALESCE(SUM(status = ?), 0),
+			SUM(CASE WHEN status IN (?, ?) THEN total_amount END),
+			SUM(CASE WHEN status = ? THEN json_extract(final_fare, '$.DistanceKm') END)
+		FROM rides WHERE `+where, append([]any{Completed, Canceled, Completed, Canceled, Completed}, args...)...).
+		Scan(&page.Totals.Rides, &page.Totals.Completed, &page.Totals.Canceled, &spend, &distanceKm)
+	if err != nil {
+		return nil, err
+	}
+	page.Totals.Spend, page.Totals.DistanceKm = int(spend.Int64), distanceKm.Float64
+
+	direction, comparison := `ASC`, `>`
+	if query.Order == NewestFirst {
+		direction, comparison = `DESC`, `<`
+	}
+	if cursor != nil {
+		where += ` AND (created_at ` + comparison + ` ? OR (created_at = ? AND id ` + comparison + ` ?))`
+		args = append(args, cursor.createdAt, cursor.createdAt, cursor.rideId)
+	}
+	rides, err := srr.queryRides(`SELECT `+rideColumns+` FROM rides WHERE `+where+
+		` ORDER BY created_at `+direction+`, id `+direction+` LIMIT ?`, append(args, query.Limit+1)...)
+	if err != nil {
+		return nil, err
+	}
+	if len(rides) > query.Limit {
+		rides = rides[:query.Limit]
+		page.NextCursor = newRideCursor(&rides[query.Limit-1])
+	}
+	page.Rides = rides
+	return page, nil
+}
+func (srr *SQLiteRideRegistory) FindScheduledRidesDueBy(pickupBy time.Time) []Ride {
+	rides, err := srr.queryRides(`SELECT `+rideColumns+` FROM rides WHERE status = ? AND scheduled_pickup_at <= ? ORDER BY scheduled_pickup_at`, Scheduled, pickupBy.UnixNano())
+	if err != nil {
+		log.Printf("sqlite: reading scheduled rides: %v", err)
+		return make([]Ride, 0)
+	}
+	return rides
+}
+func (srr *SQLiteRideRegistory) FindOpenRides() []Ride {
+	rides, err := srr.queryRides(`SELECT `+rideColumns+` FROM rides WHERE status = ? ORDER BY created_at, id`, SearchingForCab)
+	if err != nil {
+		log.Printf("sqlite: reading open rides: %v", err)
+		return make([]Ride, 0)
+	}
+	return rides
+}
+func (srr *SQLiteRideRegistory) CountOpenRidesInZone(zone Zone) int {
+	srr.mu.RLock()
+	defer srr.mu.RUnlock()
+	count := 0
+	for _, result := range srr.openRideIndex.WithinBounds(zone.GetBounds(), nil) {
+		if zone.Contains(result.Lat, result.Lon) {
+			count++
+		}
+	}
+	return count
+}
+
+type SQLiteRatingRepository struct {
+	db *sql.DB
+}
+
+func NewSQLiteRatingRepository(db *sql.DB) IRatingRepository {
+	return &SQLiteRatingRepository{db: db}
+}
+
+const ratingColumns = `ride_id, author, rater_id, subject_id, stars, tags, submitted_at`
+
+func scanRating(row sqlScanner) (*Rating, error) {
+	rating := &Rating{}
+	var tags string
+	var submittedAt int64
+	if err := row.Scan(&rating.rideId, &rating.author, &rating.raterId, &rating.subjectId, &rating.stars, &tags, &submittedAt); err != nil {
+		return nil, err
+	}
+	decoded, err := fromJSONColumn[[]string](sql.NullString{String: tags, Valid: true})
+	if err != nil {
+		return nil, err
+	}
+	rating.tags = *decoded
+	rating.submittedAt = time.Unix(0, submittedAt)
+	return rating, nil
+}
+
+func (srr *SQLiteRatingRepository) SaveRating(rating *Rating) error {
+	tags, err := toJSONColumn(&rating.tags)
+	if err != nil {
+		return err
+	}
+	// The primary key on (ride_id, author) leaves a second rating uninserted.
+	result, err := srr.db.Exec(`INSERT INTO ratings (`+ratingColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?) ON CONFLICT DO NOTHING`,
+		rating.rideId, rating.author, rating.raterId, rating.subjectId, rating.stars, tags, rating.submittedAt.UnixNano())
+	if err != nil {
+		return err
+	}
+	if inserted, err := result.RowsAffected(); err != nil {
+		return err
+	} else if inserted == 0 {
+		return ErrAlreadyRated
+	}
+	return nil
+}
+func (srr *SQLiteRatingRepository) FindRatingsForRide(rideId string) []Rating {
+	ratings, err := srr.queryRatings(`SELECT `+ratingColumns+` FROM ratings WHERE ride_id = ? ORDER BY author`, rideId)
+	if err != nil {
+		log.Printf("sqlite: reading ratings for ride %s: %v", rideId, err)
+		return make([]Rating, 0)
+	}
+	return ratings
+}
+func (srr *SQLiteRatingRepository) FindRecentRatings(author RatingAuthor, subjectId string, limit int) []Rating {
+	ratings, err := srr.queryRatings(`SELECT `+ratingColumns+` FROM ratings WHERE author = ? AND subject_id = ? ORDER BY submitted_at DESC LIMIT ?`,
+		author, subjectId, limit)
+	if err != nil {
+		log.Printf("sqlite: reading ratings for %s: %v", subjectId, err)
+		return make([]Rating, 0)
+	}
+	return ratings
+}
+
+func (srr *SQLiteRatingRepository) queryRatings(query string, args ...any) ([]Rating, error) {
+	rows, err := srr.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	ratings := make([]Rating, 0)
+	for rows.Next() {
+		rating, err := scanRating(rows)
+		if err != nil {
+			return nil, err
+		}
+		ratings = append(ratings, *rating)
+	}
+	return ratings, rows.Err()
+}
+
+type SQLitePaymentRepository struct {
+	db *sql.DB
+	mu sync.Mutex
+}
+
+func NewSQLitePaymentRepository(db *sql.DB) IPaymentRepository {
+	return &SQLitePaymentRepository{db: db}
+}
+
+const paymentMethodColumns = `id, user_id, method_type, gateway_token, label, is_default, created_at`
+
+func scanPaymentMethod(row sqlScanner) (*PaymentMethod, error) {
+	method := &PaymentMethod{}
+	var createdAt int64
+	if err := row.Scan(&method.id, &method.userId, &method.methodType, &method.gatewayToken, &method.label, &method.isDefault, &createdAt); err != nil {
+		return nil, err
+	}
+	method.createdAt = time.Unix(0, createdAt)
+	return method, nil
+}
+
+const paymentColumns = `id, ride_id, user_id, method_id, method_type, amount, refunded, status, reference, failure_reason, created_at, updated_at`
+
+const paymentValuePlaceholders = `?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?`
+
+func scanPayment(row sqlScanner) (*Payment, error) {
+	payment := &Payment{}
+	var createdAt, updatedAt int64
+	err := row.Scan(&payment.id, &payment.rideId, &payment.userId, &payment.methodId, &payment.methodType, &payment.amount,
+		&payment.refunded, &payment.status, &payment.reference, &payment.failureReason, &createdAt, &updatedAt)
+	if err != nil {
+		return nil, err
+	}
+	payment.createdAt = time.Unix(0, createdAt)
+	payment.updatedAt = time.Unix(0, updatedAt)
+	return payment, nil
+}
+
+// paymentValues lists the payment in paymentColumns order.
+func paymentValues(payment *Payment) []any {
+	return []any{payment.id, payment.rideId, payment.userId, payment.methodId, payment.methodType, payment.amount,
+		payment.refunded, payment.status, payment.reference, payment.failureReason, payment.createdAt.UnixNano(), payment.updatedAt.UnixNano()}
+}
+
+func (spr *SQLitePaymentRepository) SavePaymentMethod(method *PaymentMethod) error {
+	_, err := spr.db.Exec(`INSERT INTO payment_methods (`+paymentMethodColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		method.id, method.userId, method.methodType, method.gatewayToken, method.label, method.isDefault, method.createdAt.UnixNano())
+	return err
+}
+func (spr *SQLitePaymentRepository) GetPaymentMethodById(id string) *PaymentMethod {
+	method, err := scanPaymentMethod(spr.db.QueryRow(`SELECT `+paymentMethodColumns+` FROM payment_methods WHERE id = ?`, id))
+	if err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			log.Printf("sqlite: reading payment method %s: %v", id, err)
+		}
+		return nil
+	}
+	return method
+}
+func (spr *SQLitePaymentRepository) FindPaymentMethods(userId string) []PaymentMethod {
+	methods := make([]PaymentMethod, 0)
+	rows, err := spr.db.Query(`SELECT `+paymentMethodColumns+` FROM payment_methods WHERE user_id = ? ORDER BY created_at, rowid`, userId)
+	if err != nil {
+		log.Printf("sqlite: reading payment methods for %s: %v", userId, err)
+		return methods
+	}
+	defer rows.Close()
+	for rows.Next() {
+		method, err := scanPaymentMethod(rows)
+		if err != nil {
+			log.Printf("sqlite: reading payment methods for %s: %v", userId, err)
+			return make([]PaymentMethod, 0)
+		}
+		methods = append(methods, *method)
+	}
+	return methods
+}
+func (spr *SQLitePaymentRepository) SetDefaultPaymentMethod(userId, methodId string) error {
+	return inSQLiteTx(spr.db, func(tx *sql.Tx) error {
+		result, err := tx.Exec(`UPDATE payment_methods SET is_default = (id = ?) WHERE user_id = ?`, methodId, userId)
+		if err != nil {
+			return err
+		}
+		var owned int
+		if err := tx.QueryRow(`SELECT COUNT(*) FROM payment_methods WHERE id = ? AND user_id = ?`, methodId, userId).Scan(&owned); err != nil {
+			return err
+		}
+		if updated, err := result.RowsAffected(); err != nil {
+			return err
+		} else if updated == 0 || owned == 0 {
+			return ErrPaymentMethodNotFound
+		}
+		return nil
+	})
+}
+func (spr *SQLitePaymentRepository) SavePayment(payment *Payment) error {
+	// The unique ride_id leaves a second payment for the ride uninserted.
+	result, err := spr.db.Exec(`INSERT INTO payments (`+paymentColumns+`) VALUES (`+paymentValuePlaceholders+`) ON CONFLICT DO NOTHING`, paymentValues(payment)...)
+	if err != nil {
+		return err
+	}
+	if inserted, err := result.RowsAffected(); err != nil {
+		return err
+	} else if inserted == 0 {
+		return ErrAlreadyCharged
+	}
+	return nil
+}
+func (spr *SQLitePaymentRepository) UpdatePayment(id string, update func(payment *Payment) error) (*Payment, error) {
+	spr.mu.Lock()
+	defer spr.mu.Unlock()
+	var updated *Payment
+	err := inSQLiteTx(spr.db, func(tx *sql.Tx) error {
+		payment, err := scanPayment(tx.QueryRow(`SELECT `+paymentColumns+` FROM payments WHERE id = ?`, id))
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrPaymentNotFound
+		}
+		if err != nil {
+			return err
+		}
+		if err := update(payment); err != nil {
+			return err
+		}
+		_, err = tx.Exec(`UPDATE payments SET (`+paymentColumns+`) = (`+paymentValuePlaceholders+`) WHERE id = ?`, append(paymentValues(payment), id)...)
+		updated = payment
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return updated, nil
+}
+func (spr *SQLitePaymentRepository) GetPaymentForRide(rideId string) *Payment {
+	payment, err := scanPayment(spr.db.QueryRow(`SELECT `+paymentColumns+` FROM payments WHERE ride_id = ?`, rideId))
+	if err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			log.Printf("sqlite: reading payment for ride %s: %v", rideId, err)
+		}
+		return nil
+	}
+	return payment
+}
+func (spr *SQLitePaymentRepository) FindPaymentsForUser(userId string, status PaymentStatus) []Payment {
+	payments := make([]Payment, 0)
+	rows, err := spr.db.Query(`SELECT `+paymentColumns+` FROM payments WHERE user_id = ? AND status = ? ORDER BY created_at, rowid`, userId, status)
+	if err != nil {
+		log.Printf("sqlite: reading payments for %s: %v", userId, err)
+		return payments
+	}
+	defer rows.Close()
+	for rows.Next() {
+		payment, err := scanPayment(rows)
+		if err != nil {
+			log.Printf("sqlite: reading payments for %s: %v", userId, err)
+			return make([]Payment, 0)
+		}
+		payments = append(payments, *payment)
+	}
+	return payments
+}
+
+type SQLiteLedgerRepository struct {
+	db *sql.DB
+}
+
+func NewSQLiteLedgerRepository(db *sql.DB) ILedgerRepository {
+	return &SQLiteLedgerRepository{db: db}
+}
+
+const ledgerEntryColumns = `id, user_id, ride_id, payment_id, kind, method_type, amount, wallet_delta, dues_delta, reference, note, created_at`
+
+func (slr *SQLiteLedgerRepository) AppendEntry(entry LedgerEntry) error {
+	_, err := slr.db.Exec(`INSERT INTO ledger_entries (`+ledgerEntryColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		entry.Id, entry.UserId, entry.RideId, entry.PaymentId, entry.Kind, entry.Method, entry.Amount,
+		entry.WalletDelta, entry.DuesDelta, entry.Reference, entry.Note, entry.At.UnixNano())
+	return err
+}
+func (slr *SQLiteLedgerRepository) FindEntriesForUser(userId string) []LedgerEntry {
+	entries := make([]LedgerEntry, 0)
+	rows, err := slr.db.Query(`SELECT `+ledgerEntryColumns+` FROM ledger_entries WHERE user_id = ? ORDER BY rowid`, userId)
+	if err != nil {
+		log.Printf("sqlite: reading ledger for %s: %v", userId, err)
+		return entries
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var entry LedgerEntry
+		var at int64
+		err := rows.Scan(&entry.Id, &entry.UserId, &entry.RideId, &entry.PaymentId, &entry.Kind, &entry.Method, &entry.Amount,
+			&entry.WalletDelta, &entry.DuesDelta, &entry.Reference, &entry.Note, &at)
+		if err != nil {
+			log.Printf("sqlite: reading ledger for %s: %v", userId, err)
+			return make([]LedgerEntry, 0)
+		}
+		entry.At = time.Unix(0, at)
+		entries = append(entries, entry)
+	}
+	return entries
+}
+func (slr *SQLiteLedgerRepository) GetBalance(userId string) RiderBalance {
+	balance := RiderBalance{UserId: userId}
+	err := slr.db.QueryRow(`SELECT COALESCE(SUM(wallet_delta), 0), COALESCE(SUM(dues_delta), 0) FROM ledger_entries WHERE user_id = ?`, userId).
+		Scan(&balance.WalletBalance, &balance.OutstandingDues)
+	if err != nil {
+		log.Printf("sqlite: reading balance for %s: %v", userId, err)
+	}
+	return balance
+}
+
+type SQLitePromotionRepository struct {
+	db *sql.DB
+	mu sync.Mutex
+}
+
+func NewSQLitePromotionRepository(db *sql.DB) IPromotionRepository {
+	return &SQLitePromotionRepository{db: db}
+}
+
+const promotionColumns = `code, kind, value, max_discount, first_ride_only, per_user_limit, total_limit, valid_from, valid_until, zone_ids, referrer_id, created_at`
+
+func scanPromotion(row sqlScanner) (*Promotion, error) {
+	promotion := &Promotion{}
+	var validFrom, validUntil sql.NullInt64
+	var zoneIds string
+	var createdAt int64
+	err := row.Scan(&promotion.Code, &promotion.Kind, &promotion.Value, &promotion.MaxDiscount, &promotion.FirstRideOnly, &promotion.PerUserLimit,
+		&promotion.TotalLimit, &validFrom, &validUntil, &zoneIds, &promotion.ReferrerId, &createdAt)
+	if err != nil {
+		return nil, err
+	}
+	if validFrom.Valid {
+		promotion.ValidFrom = time.Unix(0, validFrom.Int64)
+	}
+	if validUntil.Valid {
+		promotion.ValidUntil = time.Unix(0, validUntil.Int64)
+	}
+	zones, err := fromJSONColumn[[]string](sql.NullString{String: zoneIds, Valid: true})
+	if err != nil {
+		return nil, err
+	}
+	promotion.ZoneIds = *zones
+	promotion.CreatedAt = time.Unix(0, createdAt)
+	return promotion, nil
+}
+
+// nullableTime stores the zero time as NULL.
+func nullableTime(at time.Time) any {
+	if at.IsZero() {
+		return nil
+	}
+	return at.UnixNano()
+}
+
+const redemptionColumns = `id, code, user_id, ride_id, status, discount, reserved_at, updated_at`
+
+const redemptionValuePlaceholders = `?, ?, ?, ?, ?, ?, ?, ?`
+
+func scanRedemption(row sqlScanner) (*PromoRedemption, error) {
+	redemption := &PromoRedemption{}
+	var reservedAt, updatedAt int64
+	err := row.Scan(&redemption.Id, &redemption.Code, &redemption.UserId, &redemption.RideId, &redemption.Status, &redemption.Discount, &reservedAt, &updatedAt)
+	if err != nil {
+		return nil, err
+	}
+	redemption.ReservedAt = time.Unix(0, reservedAt)
+	redemption.UpdatedAt = time.Unix(0, updatedAt)
+	return redemption, nil
+}
+
+// redemptionValues lists the redemption in redemptionColumns order.
+func redemptionValues(redemption *PromoRedemption) []any {
+	return []any{redemption.Id, redemption.Code, redemption.UserId, redemption.RideId, redemption.Status, redemption.Discount,
+		redemption.ReservedAt.UnixNano(), redemption.UpdatedAt.UnixNano()}
+}
+
+func (spr *SQLitePromotionRepository) SavePromotion(promotion *Promotion) error {
+	zoneIds, err := toJSONColumn(&promotion.ZoneIds)
+	if err != nil {
+		return err
+	}
+	result, err := spr.db.Exec(`INSERT INTO promotions (`+promotionColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?) ON CONFLICT DO NOTHING`,
+		promotion.Code, promotion.Kind, promotion.Value, promotion.MaxDiscount, promotion.FirstRideOnly, promotion.PerUserLimit, promotion.TotalLimit,
+		nullableTime(promotion.ValidFrom), nullableTime(promotion.ValidUntil), zoneIds, promotion.ReferrerId, promotion.CreatedAt.UnixNano())
+	if err != nil {
+		return err
+	}
+	if inserted, err := result.RowsAffected(); err != nil {
+		return err
+	} else if inserted == 0 {
+		return fmt.Errorf("%w: %s", ErrPromoCodeTaken, promotion.Code)
+	}
+	return nil
+}
+func (spr *SQLitePromotionRepository) GetPromotion(code string) *Promotion {
+	return spr.getPromotion(`SELECT `+promotionColumns+` FROM promotions WHERE code = ?`, code)
+}
+func (spr *SQLitePromotionRepository) GetReferralPromotion(referrerId string) *Promotion {
+	return spr.getPromotion(`SELECT `+promotionColumns+` FROM promotions WHERE referrer_id = ? AND referrer_id != '' ORDER BY created_at LIMIT 1`, referrerId)
+}
+func (spr *SQLitePromotionRepository) getPromotion(query string, arg string) *Promotion {
+	promotion, err := scanPromotion(spr.db.QueryRow(query, arg))
+	if err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			log.Printf("sqlite: reading promotion %s: %v", arg, err)
+		}
+		return nil
+	}
+	return promotion
+}
+
+// ReserveRedemption counts the uses and inserts the new one in the same
+// transaction. The ride history is read before the transaction starts, which
+// keeps the connection free for it, but still under the lock.
+func (spr *SQLitePromotionRepository) ReserveRedemption(promotion *Promotion, redemption *PromoRedemption, hasTakenRide func(userId string) bool) error {
+	spr.mu.Lock()
+	defer spr.mu.Unlock()
+	if promotion.FirstRideOnly && hasTakenRide(redemption.UserId) {
+		return errNotFirstRide(promotion)
+	}
+	return inSQLiteTx(spr.db, func(tx *sql.Tx) error {
+		var used, usedByUser int
+		err := tx.QueryRow(`SELECT COUNT(*), COALESCE(SUM(user_id = ?), 0) FROM promo_redemptions WHERE code = ? AND status != ?`,
+			redemption.UserId, promotion.Code, RedemptionReleased).Scan(&used, &usedByUser)
+		if err != nil {
+			return err
+		}
+		if err := checkPromotionLimits(promotion, used, usedByUser); err != nil {
+			return err
+		}
+		if promotion.FirstRideOnly {
+			var heldCode string
+			err := tx.QueryRow(`SELECT r.code FROM promo_redemptions r JOIN promotions p ON p.code = r.code
+				WHERE r.user_id = ? AND r.status != ? AND p.first_ride_only LIMIT 1`, redemption.UserId, RedemptionReleased).Scan(&heldCode)
+			if err == nil {
+				return fmt.Errorf("%w: the rider already has a first ride offer on %s", ErrPromoNotApplicable, heldCode)
+			}
+			if !errors.Is(err, sql.ErrNoRows) {
+				return err
+			}
+		}
+		_, err = tx.Exec(`INSERT INTO promo_redemptions (`+redemptionColumns+`) VALUES (`+redemptionValuePlaceholders+`)`, redemptionValues(redemption)...)
+		return err
+	})
+}
+func (spr *SQLitePromotionRepository) UpdateRedemption(id string, update func(redemption *PromoRedemption) error) (*PromoRedemption, error) {
+	spr.mu.Lock()
+	defer spr.mu.Unlock()
+	var updated *PromoRedemption
+	err := inSQLiteTx(spr.db, func(tx *sql.Tx) error {
+		redemption, err := scanRedemption(tx.QueryRow(`SELECT `+redemptionColumns+` FROM promo_redemptions WHERE id = ?`, id))
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrRedemptionNotFound
+		}
+		if err != nil {
+			return err
+		}
+		if err := update(redemption); err != nil {
+			return err
+		}
+		_, err = tx.Exec(`UPDATE promo_redemptions SET (`+redemptionColumns+`) = (`+redemptionValuePlaceholders+`) WHERE id = ?`, append(redemptionValues(redemption), id)...)
+		updated = redemption
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return updated, nil
+}
+func (spr *SQLitePromotionRepository) GetRedemptionForRide(rideId string) *PromoRedemption {
+	redemption, err := scanRedemption(spr.db.QueryRow(`SELECT `+redemptionColumns+` FROM promo_redemptions WHERE ride_id = ? AND ride_id != ''`, rideId))
+	if err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			log.Printf("sqlite: reading promo redemption for ride %s: %v", rideId, err)
+		}
+		return nil
+	}
+	return redemption
+}
+func (spr *SQLitePromotionRepository) FindRedemptionsForUser(userId string) []PromoRedemption {
+	redemptions := make([]PromoRedemption, 0)
+	rows, err := spr.db.Query(`SELECT `+redemptionColumns+` FROM promo_redemptions WHERE user_id = ? ORDER BY reserved_at, rowid`, userId)
+	if err != nil {
+		log.Printf("sqlite: reading promo redemptions for %s: %v", userId, err)
+		return redemptions
+	}
+	defer rows.Close()
+	for rows.Next() {
+		redemption, err := scanRedemption(rows)
+		if err != nil {
+			log.Printf("sqlite: reading promo redemptions for %s: %v", userId, err)
+			return make([]PromoRedemption, 0)
+		}
+		redemptions = append(redemptions, *redemption)
+	}
+	return redemptions
+}
+
+type SQLiteEarningsRepository struct {
+	db *sql.DB
+}
+
+func NewSQLiteEarningsRepository(db *sql.DB) IEarningsRepository {
+	return &SQLiteEarningsRepository{db: db}
+}
+
+const earningColumns = `id, cab_id, ride_id, kind, fare, commission, amount, batch_id, note, created_at`
+
+func (ser *SQLiteEarningsRepository) AppendEarning(entry EarningEntry) error {
+	result, err := ser.db.Exec(`INSERT INTO driver_earnings (`+earningColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?) ON CONFLICT DO NOTHING`,
+		entry.Id, entry.CabId, entry.RideId, entry.Kind, entry.Fare, entry.Commission, entry.Amount, entry.BatchId, entry.Note, entry.At.UnixNano())
+	if err != nil {
+		return err
+	}
+	if inserted, err := result.RowsAffected(); err != nil {
+		return err
+	} else if inserted == 0 {
+		return fmt.Errorf("%w: %s", ErrEarningAlreadyRecorded, entry.RideId)
+	}
+	return nil
+}
+func (ser *SQLiteEarningsRepository) FindEarnings(cabId string, from, to time.Time) []EarningEntry {
+	return ser.queryEarnings(`SELECT `+earningColumns+` FROM driver_earnings WHERE cab_id = ? AND created_at >= ? AND created_at < ? ORDER BY created_at, rowid`,
+		cabId, from.UnixNano(), to.UnixNano())
+}
+func (ser *SQLiteEarningsRepository) FindPayoutBatch(batchId string) []EarningEntry {
+	return ser.queryEarnings(`SELECT `+earningColumns+` FROM driver_earnings WHERE batch_id = ? AND batch_id != '' ORDER BY rowid`, batchId)
+}
+func (ser *SQLiteEarningsRepository) queryEarnings(query string, args ...any) []EarningEntry {
+	entries := make([]EarningEntry, 0)
+	rows, err := ser.db.Query(query, args...)
+	if err != nil {
+		log.Printf("sqlite: reading driver earnings: %v", err)
+		return entries
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var entry EarningEntry
+		var at int64
+		err := rows.Scan(&entry.Id, &entry.CabId, &entry.RideId, &entry.Kind, &entry.Fare, &entry.Commission, &entry.Amount, &entry.BatchId, &entry.Note, &at)
+		if err != nil {
+			log.Printf("sqlite: reading driver earnings: %v", err)
+			return make([]EarningEntry, 0)
+		}
+		entry.At = time.Unix(0, at)
+		entries = append(entries, entry)
+	}
+	return entries
+}
+func (ser *SQLiteEarningsRepository) GetEarningsBalance(cabId string) int {
+	var balance int
+	if err := ser.db.QueryRow(`SELECT COALESCE(SUM(amount), 0) FROM driver_earnings WHERE cab_id = ?`, cabId).Scan(&balance); err != nil {
+		log.Printf("sqlite: reading earnings balance for %s: %v", cabId, err)
+	}
+	return balance
+}
+func (ser *SQLiteEarningsRepository) GetEarningsBalances() map[string]int {
+	balances := make(map[string]int)
+	rows, err := ser.db.Query(`SELECT cab_id, SUM(amount) FROM driver_earnings GROUP BY cab_id`)
+	if err != nil {
+		log.Printf("sqlite: reading earnings balances: %v", err)
+		return balances
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var cabId string
+		var balance int
+		if err := rows.Scan(&cabId, &balance); err != nil {
+			log.Printf("sqlite: reading earnings balances: %v", err)
+			return make(map[string]int)
+		}
+		balances[cabId] = balance
+	}
+	return balances
+}
+func (ser *SQLiteEarningsRepository) RecordShiftChange(change ShiftChange) error {
+	_, err := ser.db.Exec(`INSERT INTO shift_changes (cab_id, status, changed_at) VALUES (?, ?, ?)`, change.CabId, change.Status, change.At.UnixNano())
+	return err
+}
+func (ser *SQLiteEarningsRepository) GetLastShiftChange(cabId string) *ShiftChange {
+	changes := ser.queryShiftChanges(`SELECT cab_id, status, changed_at FROM shift_changes WHERE cab_id = ? ORDER BY changed_at DESC, rowid DESC LIMIT 1`, cabId)
+	if len(changes) == 0 {
+		return nil
+	}
+	return &changes[0]
+}
+func (ser *SQLiteEarningsRepository) FindShiftChanges(cabId string, from, to time.Time) []ShiftChange {
+	return ser.queryShiftChanges(`SELECT cab_id, status, changed_at FROM shift_changes WHERE cab_id = ? AND changed_at < ? AND changed_at >= COALESCE(
+			(SELECT MAX(changed_at) FROM shift_changes WHERE cab_id = ? AND changed_at < ?), ?)
+		ORDER BY changed_at, rowid`, cabId, to.UnixNano(), cabId, from.UnixNano(), from.UnixNano())
+}
+func (ser *SQLiteEarningsRepository) queryShiftChanges(query string, args ...any) []ShiftChange {
+	changes := make([]ShiftChange, 0)
+	rows, err := ser.db.Query(query, args...)
+	if err != nil {
+		log.Printf("sqlite: reading shift changes: %v", err)
+		return changes
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var change ShiftChange
+		var at int64
+		if err := rows.Scan(&change.CabId, &change.Status, &at); err != nil {
+			log.Printf("sqlite: reading shift changes: %v", err)
+			return make([]ShiftChange, 0)
+		}
+		change.At = time.Unix(0, at)
+		changes = append(changes, change)
+	}
+	return changes
+}
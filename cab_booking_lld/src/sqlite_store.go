@@ -0,0 +1,281 @@
+package src
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+// sqliteMigrations are applied in order and recorded in schema_migrations, so
+// a database is upgraded by appending a migration and never by editing one.
+var sqliteMigrations = [][]string{
+	{
+		`CREATE TABLE users (
+			id            TEXT PRIMARY KEY,
+			name          TEXT NOT NULL,
+			priority_tier INTEGER NOT NULL DEFAULT 0
+		)`,
+		`CREATE TABLE cabs (
+			id          TEXT PRIMARY KEY,
+			name        TEXT NOT NULL,
+			status      INTEGER NOT NULL,
+			total_rides INTEGER NOT NULL DEFAULT 0,
+			lat         REAL NOT NULL DEFAULT 0,
+			lon         REAL NOT NULL DEFAULT 0
+		)`,
+		`CREATE TABLE rides (
+			id            TEXT PRIMARY KEY,
+			user_id       TEXT NOT NULL,
+			start_lat     REAL NOT NULL,
+			start_lon     REAL NOT NULL,
+			end_lat       REAL NOT NULL,
+			end_lon       REAL NOT NULL,
+			total_amount  INTEGER NOT NULL DEFAULT 0,
+			fare_estimate TEXT,
+			final_fare    TEXT,
+			surge_zone_id TEXT NOT NULL DEFAULT '',
+			surge         REAL NOT NULL DEFAULT 1,
+			status        INTEGER NOT NULL,
+			priority_tier INTEGER NOT NULL DEFAULT 0,
+			cab_id        TEXT,
+			created_at    INTEGER NOT NULL,
+			timeline      TEXT NOT NULL DEFAULT '[]'
+		)`,
+		`CREATE INDEX rides_by_user ON rides (user_id, created_at)`,
+		`CREATE INDEX rides_by_status ON rides (status)`,
+		`CREATE INDEX cabs_by_status ON cabs (status)`,
+	},
+	{
+		`ALTER TABLE rides ADD COLUMN scheduled_pickup_at INTEGER`,
+		`CREATE INDEX rides_by_scheduled_pickup ON rides (status, scheduled_pickup_at)`,
+	},
+	{
+		`ALTER TABLE rides ADD COLUMN ride_type INTEGER NOT NULL DEFAULT 0`,
+		`ALTER TABLE rides ADD COLUMN seats INTEGER NOT NULL DEFAULT 1`,
+	},
+	{
+		// Cabs registered before categories existed are taken to be sedans.
+		`ALTER TABLE cabs ADD COLUMN category INTEGER NOT NULL DEFAULT 2`,
+		`ALTER TABLE rides ADD COLUMN vehicle_category INTEGER NOT NULL DEFAULT 0`,
+	},
+	{
+		`ALTER TABLE users ADD COLUMN rating REAL NOT NULL DEFAULT 0`,
+		`ALTER TABLE users ADD COLUMN rating_count INTEGER NOT NULL DEFAULT 0`,
+		`ALTER TABLE cabs ADD COLUMN rating REAL NOT NULL DEFAULT 0`,
+		`ALTER TABLE cabs ADD COLUMN rating_count INTEGER NOT NULL DEFAULT 0`,
+		`ALTER TABLE cabs ADD COLUMN flagged_for_review INTEGER NOT NULL DEFAULT 0`,
+		`CREATE TABLE ratings (
+			ride_id      TEXT NOT NULL,
+			author       INTEGER NOT NULL,
+			rater_id     TEXT NOT NULL,
+			subject_id   TEXT NOT NULL,
+			stars        INTEGER NOT NULL,
+			tags         TEXT NOT NULL DEFAULT '[]',
+			submitted_at INTEGER NOT NULL,
+			PRIMARY KEY (ride_id, author)
+		)`,
+		`CREATE INDEX ratings_by_subject ON ratings (author, subject_id, submitted_at)`,
+	},
+	{
+		`ALTER TABLE rides ADD COLUMN cab_accepted_from TEXT`,
+		`ALTER TABLE rides ADD COLUMN cancellation TEXT`,
+		`ALTER TABLE cabs ADD COLUMN cancellations INTEGER NOT NULL DEFAULT 0`,
+		`ALTER TABLE cabs ADD COLUMN deprioritised_until INTEGER`,
+	},
+	{
+		`ALTER TABLE rides ADD COLUMN payment_method_id TEXT NOT NULL DEFAULT ''`,
+		`CREATE TABLE payment_methods (
+			id            TEXT PRIMARY KEY,
+			user_id       TEXT NOT NULL,
+			method_type   INTEGER NOT NULL,
+			gateway_token TEXT NOT NULL DEFAULT '',
+			label         TEXT NOT NULL,
+			is_default    INTEGER NOT NULL DEFAULT 0,
+			created_at    INTEGER NOT NULL
+		)`,
+		`CREATE INDEX payment_methods_by_user ON payment_methods (user_id, created_at)`,
+		`CREATE TABLE payments (
+			id             TEXT PRIMARY KEY,
+			ride_id        TEXT NOT NULL UNIQUE,
+			user_id        TEXT NOT NULL,
+			method_id      TEXT NOT NULL DEFAULT '',
+			method_type    INTEGER NOT NULL,
+			amount         INTEGER NOT NULL,
+			refunded       INTEGER NOT NULL DEFAULT 0,
+			status         INTEGER NOT NULL,
+			reference      TEXT NOT NULL DEFAULT '',
+			failure_reason TEXT NOT NULL DEFAULT '',
+			created_at     INTEGER NOT NULL,
+			updated_at     INTEGER NOT NULL
+		)`,
+		`CREATE INDEX payments_by_user ON payments (user_id, status, created_at)`,
+		// Entries are read back in rowid order, which is the order they were made.
+		`CREATE TABLE ledger_entries (
+			id           TEXT PRIMARY KEY,
+			user_id      TEXT NOT NULL,
+			ride_id      TEXT NOT NULL DEFAULT '',
+			payment_id   TEXT NOT NULL DEFAULT '',
+			kind         INTEGER NOT NULL,
+			method_type  INTEGER NOT NULL,
+			amount       INTEGER NOT NULL,
+			wallet_delta INTEGER NOT NULL,
+			dues_delta   INTEGER NOT NULL,
+			reference    TEXT NOT NULL DEFAULT '',
+			note         TEXT NOT NULL DEFAULT '',
+			created_at   INTEGER NOT NULL
+		)`,
+		`CREATE INDEX ledger_entries_by_user ON ledger_entries (user_id)`,
+	},
+	{
+		`ALTER TABLE rides ADD COLUMN promo_code TEXT NOT NULL DEFAULT ''`,
+		`CREATE TABLE promotions (
+			code            TEXT PRIMARY KEY,
+			kind            INTEGER NOT NULL,
+			value           INTEGER NOT NULL,
+			max_discount    INTEGER NOT NULL DEFAULT 0,
+			first_ride_only INTEGER NOT NULL DEFAULT 0,
+			per_user_limit  INTEGER NOT NULL DEFAULT 0,
+			total_limit     INTEGER NOT NULL DEFAULT 0,
+			valid_from      INTEGER,
+			valid_until     INTEGER,
+			zone_ids        TEXT NOT NULL DEFAULT '[]',
+			referrer_id     TEXT NOT NULL DEFAULT '',
+			created_at      INTEGER NOT NULL
+		)`,
+		`CREATE INDEX promotions_by_referrer ON promotions (referrer_id) WHERE referrer_id != ''`,
+		`CREATE TABLE promo_redemptions (
+			id          TEXT PRIMARY KEY,
+			code        TEXT NOT NULL,
+			user_id     TEXT NOT NULL,
+			ride_id     TEXT NOT NULL DEFAULT '',
+			status      INTEGER NOT NULL,
+			discount    INTEGER NOT NULL DEFAULT 0,
+			reserved_at INTEGER NOT NULL,
+			updated_at  INTEGER NOT NULL
+		)`,
+		`CREATE INDEX promo_redemptions_by_code ON promo_redemptions (code, status)`,
+		`CREATE INDEX promo_redemptions_by_user ON promo_redemptions (user_id, reserved_at)`,
+		`CREATE INDEX promo_redemptions_by_ride ON promo_redemptions (ride_id) WHERE ride_id != ''`,
+	},
+	{
+		`CREATE TABLE driver_earnings (
+			id         TEXT PRIMARY KEY,
+			cab_id     TEXT NOT NULL,
+			ride_id    TEXT NOT NULL DEFAULT '',
+			kind       INTEGER NOT NULL,
+			fare       INTEGER NOT NULL DEFAULT 0,
+			commission INTEGER NOT NULL DEFAULT 0,
+			amount     INTEGER NOT NULL,
+			batch_id   TEXT NOT NULL DEFAULT '',
+			note       TEXT NOT NULL DEFAULT '',
+			created_at INTEGER NOT NULL
+		)`,
+		`CREATE INDEX driver_earnings_by_cab ON driver_earnings (cab_id, created_at)`,
+		// Kind 0 is RideEarning, which a ride only ever earns once.
+		`CREATE UNIQUE INDEX driver_earnings_by_ride ON driver_earnings (ride_id) WHERE kind = 0`,
+		`CREATE INDEX driver_earnings_by_batch ON driver_earnings (batch_id) WHERE batch_id != ''`,
+		`CREATE TABLE shift_changes (
+			cab_id     TEXT NOT NULL,
+			status     INTEGER NOT NULL,
+			changed_at INTEGER NOT NULL
+		)`,
+		`CREATE INDEX shift_changes_by_cab ON shift_changes (cab_id, changed_at)`,
+	},
+	{
+		`CREATE INDEX rides_by_cab ON rides (cab_id, created_at) WHERE cab_id IS NOT NULL`,
+	},
+	{
+		`ALTER TABLE rides ADD COLUMN stops TEXT NOT NULL DEFAULT '[]'`,
+	},
+}
+
+// memoryDatabases numbers the throwaway databases so each open gets its own.
+var memoryDatabases atomic.Int64
+
+// OpenSQLiteDatabase opens (or creates) the database at path and brings its
+// schema up to date. Use ":memory:" for a throwaway database.
+func OpenSQLiteDatabase(path string) (*sql.DB, error) {
+	dsn := "file:" + path + "?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)&_txlock=immediate"
+	if path == ":memory:" {
+		// Connections share one named in-memory database, so a read made while
+		// a transaction holds a connection does not wait for it to be released.
+		dsn = fmt.Sprintf("file:memdb%d?mode=memory&cache=shared&_pragma=busy_timeout(5000)&_txlock=immediate", memoryDatabases.Add(1))
+	}
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, err
+	}
+	if err := migrateSQLiteDatabase(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+func migrateSQLiteDatabase(db *sql.DB) error {
+	if _, err := db.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (version INTEGER PRIMARY KEY, applied_at INTEGER NOT NULL)`); err != nil {
+		return fmt.Errorf("creating schema_migrations: %w", err)
+	}
+	var current int
+	if err := db.QueryRow(`SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&current); err != nil {
+		return fmt.Errorf("reading schema version: %w", err)
+	}
+	for version := current + 1; version <= len(sqliteMigrations); version++ {
+		err := inSQLiteTx(db, func(tx *sql.Tx) error {
+			for _, statement := range sqliteMigrations[version-1] {
+				if _, err := tx.Exec(statement); err != nil {
+					return err
+				}
+			}
+			_, err := tx.Exec(`INSERT INTO schema_migrations (version, applied_at) VALUES (?, ?)`, version, time.Now().Unix())
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("applying migration %d: %w", version, err)
+		}
+	}
+	return nil
+}
+
+func inSQLiteTx(db *sql.DB, fn func(tx *sql.Tx) error) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	if err := fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+type sqlScanner interface {
+	Scan(dest ...any) error
+}
+
+// toJSONColumn stores nil as NULL so optional values round trip as nil.
+func toJSONColumn[T any](value *T) (any, error) {
+	if value == nil {
+		return nil, nil
+	}
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+	return string(encoded), nil
+}
+
+func fromJSONColumn[T any](column sql.NullString) (*T, error) {
+	if !column.Valid {
+		return nil, nil
+	}
+	value := new(T)
+	if err := json.Unmarshal([]byte(column.String), value); err != nil {
+		return nil, err
+	}
+	return value, nil
+}
@@ -0,0 +1,142 @@
+package src
+
+import (
+	"fmt"
+	"time"
+)
+
+// MaxRideStops is how many stops a rider can make between pickup and drop.
+const MaxRideStops = 3
+
+// RideStop is a stop the rider makes on the way to the drop, for example to
+// pick up a friend. The cab visits stops in order once the rider is on board.
+type RideStop struct {
+	Location   GeoPoint
+	Status     StopStatus
+	ArrivedAt  time.Time
+	DepartedAt time.Time
+}
+
+// GetWaitingTime is how long the cab stood at the stop.
+func (rs RideStop) GetWaitingTime() time.Duration {
+	if rs.Status != StopDeparted {
+		return 0
+	}
+	return max(0, rs.DepartedAt.Sub(rs.ArrivedAt))
+}
+
+func (r Ride) GetStops() []RideStop {
+	return append([]RideStop(nil), r.stops...)
+}
+
+// GetWaypoints is the path the ride takes: the pickup, every stop that was not
+// skipped and the drop.
+func (r Ride) GetWaypoints() []GeoPoint {
+	waypoints := []GeoPoint{{Lat: r.startPointLat, Lon: r.startPointLon}}
+	for _, stop := range r.stops {
+		if stop.Status != StopSkipped {
+			waypoints = append(waypoints, stop.Location)
+		}
+	}
+	return append(waypoints, GeoPoint{Lat: r.endPointLat, Lon: r.endPointLon})
+}
+
+// SetStops replaces the stops with pending stops at the locations. The
+// locations are expected to be checked already.
+func (r *Ride) SetStops(locations []GeoPoint) {
+	r.stops = make([]RideStop, 0, len(locations))
+	for _, location := range locations {
+		r.stops = append(r.stops, RideStop{Location: location})
+	}
+}
+
+// canChangeStops is true until the rider is picked up.
+func (r Ride) canChangeStops() bool {
+	return r.status == SearchingForCab || r.status == Confirmed || r.status == Scheduled
+}
+
+// AddStop inserts a stop before the stop at index, or after the last stop when
+// index is the number of stops.
+func (r *Ride) AddStop(index int, lat, lon float64) error {
+	if !r.canChangeStops() {
+		return ErrStopsLocked
+	}
+	if r.rideType == PoolRide {
+		return fmt.Errorf("%w: pooled rides cannot make stops", ErrInvalidStop)
+	}
+	if len(r.stops) >= MaxRideStops {
+		return fmt.Errorf("%w: a ride makes at most %d stops", ErrInvalidStop, MaxRideStops)
+	}
+	if index < 0 || index > len(r.stops) {
+		return fmt.Errorf("%w: no place %d among %d stops", ErrInvalidStop, index, len(r.stops))
+	}
+	if err := ValidateCoordinates(lat, lon); err != nil {
+		return err
+	}
+	stops := append(r.stops[:index:index], RideStop{Location: GeoPoint{Lat: lat, Lon: lon}})
+	r.stops = append(stops, r.stops[index:]...)
+	return nil
+}
+
+func (r *Ride) RemoveStop(index int) error {
+	if !r.canChangeStops() {
+		return ErrStopsLocked
+	}
+	if index < 0 || index >= len(r.stops) {
+		return fmt.Errorf("%w: no stop %d among %d stops", ErrInvalidStop, index, len(r.stops))
+	}
+	r.stops = append(r.stops[:index:index], r.stops[index+1:]...)
+	return nil
+}
+
+// ArriveAtStop records the cab reaching the stop. Every stop before it must
+// have been left first.
+func (r *Ride) ArriveAtStop(index int, at time.Time) error {
+	if err := r.checkStopProgress(index, StopPending); err != nil {
+		return err
+	}
+	for _, stop := range r.stops[:index] {
+		if stop.Status != StopDeparted {
+			return fmt.Errorf("%w: stop %d comes first", ErrStopOutOfOrder, index-1)
+		}
+	}
+	r.stops[index].Status = StopArrived
+	r.stops[index].ArrivedAt = at
+	return nil
+}
+
+func (r *Ride) DepartStop(index int, at time.Time) error {
+	if err := r.checkStopProgress(index, StopArrived); err != nil {
+		return err
+	}
+	r.stops[index].Status = StopDeparted
+	r.stops[index].DepartedAt = at
+	return nil
+}
+
+func (r Ride) checkStopProgress(index int, want StopStatus) error {
+	if r.status != PickedUp {
+		return fmt.Errorf("%w: the rider is not on board", ErrStopOutOfOrder)
+	}
+	if index < 0 || index >= len(r.stops) {
+		return fmt.Errorf("%w: no stop %d among %d stops", ErrInvalidStop, index, len(r.stops))
+	}
+	if status := r.stops[index].Status; status != want {
+		return fmt.Errorf("%w: stop %d is %v", ErrStopOutOfOrder, index, status)
+	}
+	return nil
+}
+
+// settleStops closes the stops when the ride ends. The cab leaves a stop it
+// is still standing at, and stops it never reached are skipped.
+func (r *Ride) settleStops(at time.Time) {
+	for i := range r.stops {
+		switch r.stops[i].Status {
+		case StopPending:
+			r.stops[i].Status = StopSkipped
+		case StopArrived:
+			r.stops[i].Status = StopDeparted
+			r.stops[i].DepartedAt = at
+		}
+	}
+}
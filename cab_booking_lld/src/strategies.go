@@ -1,7 +1,9 @@
 package src
 
 import (
-	"sort"
+	"math"
+	"sync"
+	"time"
 
 	"github.com/google/uuid"
 )
@@ -20,49 +22,641 @@ func (iguu IdGenerationUsingUUID) GenerateId() string {
 	return uuid.New().String()
 }
 
+type DistanceCalculator interface {
+	Distance(lat1, lon1, lat2, lon2 float64) float64
+}
+
+type HaversineDistanceCalculator struct{}
+
+func NewHaversineDistanceCalculator() DistanceCalculator {
+	return &HaversineDistanceCalculator{}
+}
+
+// Distance returns the great-circle distance between two points in kilometres.
+func (hdc HaversineDistanceCalculator) Distance(lat1, lon1, lat2, lon2 float64) float64 {
+	dLat := toRadians(lat2 - lat1)
+	dLon := toRadians(lon2 - lon1)
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) + math.Cos(toRadians(lat1))*math.Cos(toRadians(lat2))*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return 2 * earthRadiusKm * math.Asin(math.Min(1, math.Sqrt(a)))
+}
+
+func toRadians(deg float64) float64 {
+	return deg * math.Pi / 180
+}
+
 type CabFindingStrategy interface {
-	FindCab(ride *Ride) *Cab
+	FindCab(ride *Ride, excludedCabIds map[string]bool) *Cab
 }
 
 type NearestAvailableCarFindingStrategy struct {
-	cabRepository ICabRepository
+	cabRepository      ICabRepository
+	distanceCalculator DistanceCalculator
+	maxPickupRadiusKm  float64
 }
 
-func NewNearestAvailableCarFindingStrategy(cabRepository ICabRepository) CabFindingStrategy {
+func NewNearestAvailableCarFindingStrategy(cabRepository ICabRepository, distanceCalculator DistanceCalculator, maxPickupRadiusKm float64) CabFindingStrategy {
 	return &NearestAvailableCarFindingStrategy{
-		cabRepository: cabRepository,
+		cabRepository:      cabRepository,
+		distanceCalculator: distanceCalculator,
+		maxPickupRadiusKm:  maxPickupRadiusKm,
 	}
 }
 
-func (nacfs NearestAvailableCarFindingStrategy) FindCab(ride *Ride) *Cab {
-	availableCars := nacfs.cabRepository.FindAvailableCabs()
-	sort.Slice(availableCars, func(i, j int) bool {
-		car1LocationLat, car1LocationLon := availableCars[i].GetCurrLocation()
-		car2LocationLat, car2LocationLon := availableCars[i].GetCurrLocation()
-		rideStartPointLat, rideStartPointLon := ride.GetStartPoint()
+func (nacfs NearestAvailableCarFindingStrategy) FindCab(ride *Ride, excludedCabIds map[string]bool) *Cab {
+	rideStartPointLat, rideStartPointLon := ride.GetStartPoint()
+	nearestCabs := nacfs.cabRepository.FindNearestAvailableCabs(rideStartPointLat, rideStartPointLon, len(excludedCabIds)+1, ride.GetVehicleCategory())
+	for i := range nearestCabs {
+		if excludedCabIds[nearestCabs[i].GetId()] {
+			continue
+		}
+		cabLat, cabLon := nearestCabs[i].GetCurrLocation()
+		if nacfs.maxPickupRadiusKm > 0 && nacfs.distanceCalculator.Distance(cabLat, cabLon, rideStartPointLat, rideStartPointLon) > nacfs.maxPickupRadiusKm {
+			return nil
+		}
+		return nacfs.cabRepository.GetCabById(nearestCabs[i].GetId())
+	}
+	return nil
+}
+
+// unratedDriverRating stands in for the rating of drivers nobody has rated yet,
+// so new drivers are neither favoured nor buried.
+const unratedDriverRating = 4.0
+
+// RatingAwareCabFindingStrategy looks at the nearest few cabs and picks the one
+// with the best blend of pickup distance and driver rating: every star above or
+// below unratedDriverRating counts as kmPerStar kilometres closer or further.
+type RatingAwareCabFindingStrategy struct {
+	cabRepository      ICabRepository
+	distanceCalculator DistanceCalculator
+	maxPickupRadiusKm  float64
+	candidates         int
+	kmPerStar          float64
+}
+
+func NewRatingAwareCabFindingStrategy(cabRepository ICabRepository, distanceCalculator DistanceCalculator, maxPickupRadiusKm float64, candidates int, kmPerStar float64) CabFindingStrategy {
+	return &RatingAwareCabFindingStrategy{
+		cabRepository:      cabRepository,
+		distanceCalculator: distanceCalculator,
+		maxPickupRadiusKm:  maxPickupRadiusKm,
+		candidates:         candidates,
+		kmPerStar:          kmPerStar,
+	}
+}
+
+func (racfs RatingAwareCabFindingStrategy) FindCab(ride *Ride, excludedCabIds map[string]bool) *Cab {
+	rideStartPointLat, rideStartPointLon := ride.GetStartPoint()
+	nearestCabs := racfs.cabRepository.FindNearestAvailableCabs(rideStartPointLat, rideStartPointLon, len(excludedCabIds)+racfs.candidates, ride.GetVehicleCategory())
+	bestCabId := ""
+	bestScore := math.Inf(1)
+	for i := range nearestCabs {
+		if excludedCabIds[nearestCabs[i].GetId()] {
+			continue
+		}
+		cabLat, cabLon := nearestCabs[i].GetCurrLocation()
+		distanceKm := racfs.distanceCalculator.Distance(cabLat, cabLon, rideStartPointLat, rideStartPointLon)
+		if racfs.maxPickupRadiusKm > 0 && distanceKm > racfs.maxPickupRadiusKm {
+			break
+		}
+		rating := unratedDriverRating
+		if nearestCabs[i].GetRatingCount() > 0 {
+			rating = nearestCabs[i].GetRating()
+		}
+		if score := distanceKm - (rating-unratedDriverRating)*racfs.kmPerStar; score < bestScore {
+			bestCabId, bestScore = nearestCabs[i].GetId(), score
+		}
+	}
+	if bestCabId == "" {
+		return nil
+	}
+	return racfs.cabRepository.GetCabById(bestCabId)
+}
 
-		return (rideStartPointLat-car1LocationLat)*(rideStartPointLat-car1LocationLat)+(rideStartPointLon-car1LocationLon)*(rideStartPointLon-car1LocationLon) < (rideStartPointLat-car2LocationLat)*(rideStartPointLat-car2LocationLat)+(rideStartPointLon-car2LocationLon)*(rideStartPointLon-car2LocationLon)
-	})
-	return &availableCars[0]
+// RouteAwareCabFindingStrategy looks at the nearest few cabs as the crow flies
+// and picks the one that gets to the pickup first by road. Like the rating
+// aware strategy, every star above or below unratedDriverRating counts as
+// minutesPerStar minutes sooner or later. Cabs with no road to the pickup are
+// passed over, and none is found when even the best is further than
+// maxPickupEta away.
+type RouteAwareCabFindingStrategy struct {
+	cabRepository  ICabRepository
+	router         Router
+	candidates     int
+	maxPickupEta   time.Duration
+	minutesPerStar float64
+}
+
+func NewRouteAwareCabFindingStrategy(cabRepository ICabRepository, router Router, candidates int, maxPickupEta time.Duration, minutesPerStar float64) CabFindingStrategy {
+	return &RouteAwareCabFindingStrategy{
+		cabRepository:  cabRepository,
+		router:         router,
+		candidates:     candidates,
+		maxPickupEta:   maxPickupEta,
+		minutesPerStar: minutesPerStar,
+	}
+}
+
+func (racfs RouteAwareCabFindingStrategy) FindCab(ride *Ride, excludedCabIds map[string]bool) *Cab {
+	rideStartPointLat, rideStartPointLon := ride.GetStartPoint()
+	nearestCabs := racfs.cabRepository.FindNearestAvailableCabs(rideStartPointLat, rideStartPointLon, len(excludedCabIds)+racfs.candidates, ride.GetVehicleCategory())
+	bestCabId := ""
+	bestScore := math.Inf(1)
+	for i := range nearestCabs {
+		if excludedCabIds[nearestCabs[i].GetId()] {
+			continue
+		}
+		pickupEta, err := racfs.GetPickupEta(&nearestCabs[i], ride)
+		if err != nil || (racfs.maxPickupEta > 0 && pickupEta > racfs.maxPickupEta) {
+			continue
+		}
+		rating := unratedDriverRating
+		if nearestCabs[i].GetRatingCount() > 0 {
+			rating = nearestCabs[i].GetRating()
+		}
+		if score := pickupEta.Minutes() - (rating-unratedDriverRating)*racfs.minutesPerStar; score < bestScore {
+			bestCabId, bestScore = nearestCabs[i].GetId(), score
+		}
+	}
+	if bestCabId == "" {
+		return nil
+	}
+	return racfs.cabRepository.GetCabById(bestCabId)
+}
+
+// GetPickupEta is how long the cab takes to drive to the ride's pickup.
+func (racfs RouteAwareCabFindingStrategy) GetPickupEta(cab *Cab, ride *Ride) (time.Duration, error) {
+	cabLat, cabLon := cab.GetCurrLocation()
+	rideStartPointLat, rideStartPointLon := ride.GetStartPoint()
+	route, err := racfs.router.Route(cabLat, cabLon, rideStartPointLat, rideStartPointLon)
+	if err != nil {
+		return 0, err
+	}
+	return route.Duration, nil
+}
+
+// CancellationAwareCabFindingStrategy passes over deprioritised drivers and
+// only falls back to the first of them when no other cab is found.
+type CancellationAwareCabFindingStrategy struct {
+	baseCabFindingStrategy CabFindingStrategy
+	clock                  Clock
+}
+
+func NewCancellationAwareCabFindingStrategy(baseCabFindingStrategy CabFindingStrategy, clock Clock) CabFindingStrategy {
+	return &CancellationAwareCabFindingStrategy{
+		baseCabFindingStrategy: baseCabFindingStrategy,
+		clock:                  clock,
+	}
+}
+
+func (cacfs CancellationAwareCabFindingStrategy) FindCab(ride *Ride, excludedCabIds map[string]bool) *Cab {
+	now := cacfs.clock.Now()
+	skipped := make(map[string]bool, len(excludedCabIds))
+	for cabId := range excludedCabIds {
+		skipped[cabId] = true
+	}
+	var fallback *Cab
+	for {
+		cab := cacfs.baseCabFindingStrategy.FindCab(ride, skipped)
+		if cab == nil {
+			return fallback
+		}
+		if !cab.IsDeprioritised(now) {
+			return cab
+		}
+		if fallback == nil {
+			fallback = cab
+		}
+		skipped[cab.GetId()] = true
+	}
+}
+
+// PoolAwareCabFindingStrategy first looks for a busy cab whose pool the ride
+// can join, and otherwise falls back to a free cab that starts a new pool.
+// Solo rides only ever get free cabs.
+type PoolAwareCabFindingStrategy struct {
+	baseCabFindingStrategy CabFindingStrategy
+	poolManager            PoolManager
+}
+
+func NewPoolAwareCabFindingStrategy(baseCabFindingStrategy CabFindingStrategy, poolManager PoolManager) CabFindingStrategy {
+	return &PoolAwareCabFindingStrategy{
+		baseCabFindingStrategy: baseCabFindingStrategy,
+		poolManager:            poolManager,
+	}
+}
+
+func (pacfs PoolAwareCabFindingStrategy) FindCab(ride *Ride, excludedCabIds map[string]bool) *Cab {
+	if ride.GetRideType() == PoolRide {
+		if cab := pacfs.poolManager.FindPoolCab(ride, excludedCabIds); cab != nil {
+			return cab
+		}
+	}
+	return pacfs.baseCabFindingStrategy.FindCab(ride, excludedCabIds)
+}
+
+// ZoneQueueCabFindingStrategy gives rides picked up in a queued zone, such as
+// an airport, to the cabs waiting there in the order they arrived, and only
+// looks further afield when none of them can take the ride.
+type ZoneQueueCabFindingStrategy struct {
+	baseCabFindingStrategy CabFindingStrategy
+	zoneManager            ZoneManager
+}
+
+func NewZoneQueueCabFindingStrategy(baseCabFindingStrategy CabFindingStrategy, zoneManager ZoneManager) CabFindingStrategy {
+	return &ZoneQueueCabFindingStrategy{
+		baseCabFindingStrategy: baseCabFindingStrategy,
+		zoneManager:            zoneManager,
+	}
+}
+
+func (zqcfs ZoneQueueCabFindingStrategy) FindCab(ride *Ride, excludedCabIds map[string]bool) *Cab {
+	if specialZone := zqcfs.zoneManager.GetSpecialZone(ride.GetStartPoint()); specialZone != nil && specialZone.Queued {
+		if cab := zqcfs.zoneManager.FindQueuedCab(specialZone.Zone.GetId(), ride, excludedCabIds); cab != nil {
+			return cab
+		}
+	}
+	return zqcfs.baseCabFindingStrategy.FindCab(ride, excludedCabIds)
 }
 
 type PricingStrategy interface {
-	CalculateFare(ride *Ride) int
+	EstimateFare(ride *Ride) *FareBreakdown
+	CalculateFinalFare(ride *Ride) *FareBreakdown
 }
 
 type FixPricingStrategy struct {
-	perMileFare int
+	perKmFare          int
+	distanceCalculator DistanceCalculator
 }
 
-func NewFixPricingStrategy(perMileFare int) PricingStrategy {
+func NewFixPricingStrategy(perKmFare int, distanceCalculator DistanceCalculator) PricingStrategy {
 	return &FixPricingStrategy{
-		perMileFare: perMileFare,
+		perKmFare:          perKmFare,
+		distanceCalculator: distanceCalculator,
+	}
+}
+
+func (fps FixPricingStrategy) EstimateFare(ride *Ride) *FareBreakdown {
+	totalDistance := pathDistanceKm(fps.distanceCalculator, ride.GetWaypoints())
+	fare := &FareBreakdown{
+		DistanceKm:   totalDistance,
+		DistanceFare: int(math.Round(totalDistance * float64(fps.perKmFare))),
+	}
+	fare.Settle()
+	return fare
+}
+
+func (fps FixPricingStrategy) CalculateFinalFare(ride *Ride) *FareBreakdown {
+	fare := fps.EstimateFare(ride)
+	fare.IsFinal = true
+	return fare
+}
+
+// pathDistanceKm is the straight line distance from each waypoint to the next.
+func pathDistanceKm(distanceCalculator DistanceCalculator, waypoints []GeoPoint) float64 {
+	distanceKm := 0.0
+	for i := 1; i < len(waypoints); i++ {
+		distanceKm += distanceCalculator.Distance(waypoints[i-1].Lat, waypoints[i-1].Lon, waypoints[i].Lat, waypoints[i].Lon)
+	}
+	return distanceKm
+}
+
+// CategoryPricingStrategy prices each ride with the strategy of the vehicle
+// category it was booked for. Rides open to any category are priced at the
+// anyCategoryRates category, whichever cab ends up taking them.
+type CategoryPricingStrategy struct {
+	pricingStrategies map[VehicleCategory]PricingStrategy
+	anyCategoryRates  VehicleCategory
+}
+
+func NewCategoryPricingStrategy(pricingStrategies map[VehicleCategory]PricingStrategy, anyCategoryRates VehicleCategory) PricingStrategy {
+	return &CategoryPricingStrategy{
+		pricingStrategies: pricingStrategies,
+		anyCategoryRates:  anyCategoryRates,
+	}
+}
+
+func (cps CategoryPricingStrategy) EstimateFare(ride *Ride) *FareBreakdown {
+	return cps.pricingStrategyFor(ride).EstimateFare(ride)
+}
+
+func (cps CategoryPricingStrategy) CalculateFinalFare(ride *Ride) *FareBreakdown {
+	return cps.pricingStrategyFor(ride).CalculateFinalFare(ride)
+}
+
+func (cps CategoryPricingStrategy) pricingStrategyFor(ride *Ride) PricingStrategy {
+	if pricingStrategy, exists := cps.pricingStrategies[ride.GetVehicleCategory()]; exists {
+		return pricingStrategy
+	}
+	return cps.pricingStrategies[cps.anyCategoryRates]
+}
+
+// MeteredPricingStrategy charges base, distance and time like a taxi meter.
+// Estimates assume the rate card's average speed, final fares use the actual
+// pickup and drop timestamps from the ride timeline. With a router the trip is
+// measured along the roads and estimates take the route's duration, falling
+// back to the straight line for trips the router cannot route.
+type MeteredPricingStrategy struct {
+	rateCard           FareRateCard
+	distanceCalculator DistanceCalculator
+	router             Router
+}
+
+func NewMeteredPricingStrategy(rateCard FareRateCard, distanceCalculator DistanceCalculator) PricingStrategy {
+	return NewRoutedMeteredPricingStrategy(rateCard, nil, distanceCalculator)
+}
+
+func NewRoutedMeteredPricingStrategy(rateCard FareRateCard, router Router, distanceCalculator DistanceCalculator) PricingStrategy {
+	return &MeteredPricingStrategy{
+		rateCard:           rateCard,
+		distanceCalculator: distanceCalculator,
+		router:             router,
+	}
+}
+
+func (mps MeteredPricingStrategy) EstimateFare(ride *Ride) *FareBreakdown {
+	stops := len(ride.GetWaypoints()) - 2
+	if route := mps.route(ride); route != nil {
+		return mps.fareFor(route.DistanceKm, route.Duration, 0, stops, 0)
+	}
+	distanceKm := mps.tripDistanceKm(ride)
+	duration := time.Duration(0)
+	if mps.rateCard.AverageSpeedKmph > 0 {
+		duration = time.Duration(distanceKm / mps.rateCard.AverageSpeedKmph * float64(time.Hour))
 	}
+	return mps.fareFor(distanceKm, duration, 0, stops, 0)
 }
 
-func (fps FixPricingStrategy) CalculateFare(ride *Ride) int {
+// CalculateFinalFare charges the time standing at stops as stop waiting, so
+// it is left out of the time fare. Skipped stops are not charged.
+func (mps MeteredPricingStrategy) CalculateFinalFare(ride *Ride) *FareBreakdown {
+	confirmedAt, _ := ride.GetTransitionTime(Confirmed)
+	pickedUpAt, _ := ride.GetTransitionTime(PickedUp)
+	completedAt, _ := ride.GetTransitionTime(Completed)
+
+	stops, stoppedFor, stopWaitingTime := 0, time.Duration(0), time.Duration(0)
+	for _, stop := range ride.GetStops() {
+		if stop.Status == StopSkipped {
+			continue
+		}
+		stops++
+		stoppedFor += stop.GetWaitingTime()
+		stopWaitingTime += max(0, stop.GetWaitingTime()-mps.rateCard.FreeStopWaitingTime)
+	}
+	waitingTime := max(0, pickedUpAt.Sub(confirmedAt)-mps.rateCard.FreeWaitingTime)
+	fare := mps.fareFor(mps.tripDistanceKm(ride), max(0, completedAt.Sub(pickedUpAt)-stoppedFor), waitingTime, stops, stopWaitingTime)
+	fare.IsFinal = true
+	return fare
+}
+
+func (mps MeteredPricingStrategy) tripDistanceKm(ride *Ride) float64 {
+	if route := mps.route(ride); route != nil {
+		return route.DistanceKm
+	}
+	return pathDistanceKm(mps.distanceCalculator, ride.GetWaypoints())
+}
+
+// route joins the routes between consecutive waypoints, nil when any of them
+// cannot be routed.
+func (mps MeteredPricingStrategy) route(ride *Ride) *Route {
+	if mps.router == nil {
+		return nil
+	}
+	waypoints := ride.GetWaypoints()
+	trip := &Route{}
+	for i := 1; i < len(waypoints); i++ {
+		leg, err := mps.router.Route(waypoints[i-1].Lat, waypoints[i-1].Lon, waypoints[i].Lat, waypoints[i].Lon)
+		if err != nil {
+			return nil
+		}
+		trip.Points = append(trip.Points, leg.Points...)
+		trip.DistanceKm += leg.DistanceKm
+		trip.Duration += leg.Duration
+	}
+	return trip
+}
+
+func (mps MeteredPricingStrategy) fareFor(distanceKm float64, duration, waitingTime time.Duration, stops int, stopWaitingTime time.Duration) *FareBreakdown {
+	fare := &FareBreakdown{
+		BaseFare:          mps.rateCard.BaseFare,
+		DistanceFare:      int(math.Round(distanceKm * float64(mps.rateCard.PerKm))),
+		TimeFare:          int(math.Round(duration.Minutes() * float64(mps.rateCard.PerMinute))),
+		WaitingCharge:     int(math.Round(waitingTime.Minutes() * float64(mps.rateCard.WaitingPerMinute))),
+		StopCharge:        stops * mps.rateCard.PerStop,
+		StopWaitingCharge: int(math.Round(stopWaitingTime.Minutes() * float64(mps.rateCard.WaitingPerMinute))),
+		MinimumFare:       mps.rateCard.MinimumFare,
+		TaxPercent:        mps.rateCard.TaxPercent,
+		DistanceKm:        distanceKm,
+		Duration:          duration,
+		WaitingTime:       waitingTime,
+		Stops:             stops,
+		StopWaitingTime:   stopWaitingTime,
+	}
+	fare.Settle()
+	return fare
+}
+
+type surgeSample struct {
+	at    time.Time
+	ratio float64
+}
+
+// SurgePricingStrategy scales the base fare when open ride requests in the
+// pickup zone outnumber the cabs ready to take them. The demand/supply ratio is
+// sampled at each booking and averaged over a sliding window so one burst of
+// requests does not spike fares.
+type SurgePricingStrategy struct {
+	basePricingStrategy PricingStrategy
+	zoneResolver        ZoneResolver
+	rideRepo            IRideRegistory
+	cabRepo             ICabRepository
+	maxMultiplier       float64
+	window              time.Duration
+	clock               Clock
+	mu                  sync.Mutex
+	samples             map[string][]surgeSample
+}
+
+func NewSurgePricingStrategy(basePricingStrategy PricingStrategy, zoneResolver ZoneResolver, rideRepo IRideRegistory, cabRepo ICabRepository, maxMultiplier float64, window time.Duration, clock Clock) PricingStrategy {
+	return &SurgePricingStrategy{
+		basePricingStrategy: basePricingStrategy,
+		zoneResolver:        zoneResolver,
+		rideRepo:            rideRepo,
+		cabRepo:             cabRepo,
+		maxMultiplier:       maxMultiplier,
+		window:              window,
+		clock:               clock,
+		samples:             make(map[string][]surgeSample),
+	}
+}
+
+// EstimateFare samples demand in the pickup zone only for a ride being booked.
+// Fare quotes and the new quote after a stop change read the smoothed
+// multiplier, so polling for fares cannot move surge.
+func (sps *SurgePricingStrategy) EstimateFare(ride *Ride) *FareBreakdown {
 	startPointLat, startPointLon := ride.GetStartPoint()
-	endPointLat, endPointLon := ride.GetEndPoint()
-	totalDistance := (endPointLat-startPointLat)*(endPointLat-startPointLat) + (endPointLon-startPointLon)*(endPointLon-startPointLon)
-	return int(totalDistance) * fps.perMileFare
+	zone := sps.zoneResolver.ResolveZone(startPointLat, startPointLon)
+	var multiplier float64
+	if ride.GetId() != "" && ride.GetFareEstimate() == nil {
+		demand := sps.rideRepo.CountOpenRidesInZone(zone)
+		supply := sps.cabRepo.CountAvailableCabsInZone(zone)
+		multiplier = sps.observe(zone.GetId(), demand, supply, sps.clock.Now())
+	} else {
+		multiplier = sps.GetSurgeMultiplier(zone.GetId())
+	}
+	fare := applySurge(sps.basePricingStrategy.EstimateFare(ride), multiplier)
+	fare.SurgeZoneId = zone.GetId()
+	return fare
+}
+
+// CalculateFinalFare keeps the multiplier the rider was quoted at booking time.
+func (sps *SurgePricingStrategy) CalculateFinalFare(ride *Ride) *FareBreakdown {
+	fare := applySurge(sps.basePricingStrategy.CalculateFinalFare(ride), ride.GetSurgeMultiplier())
+	fare.SurgeZoneId = ride.GetSurgeZoneId()
+	return fare
+}
+
+func applySurge(fare *FareBreakdown, multiplier float64) *FareBreakdown {
+	fare.SurgeMultiplier = multiplier
+	fare.SurgeCharge = int(math.Round(float64(fare.Subtotal()) * (multiplier - 1)))
+	fare.Settle()
+	return fare
+}
+
+func (sps *SurgePricingStrategy) GetSurgeMultiplier(zoneId string) float64 {
+	sps.mu.Lock()
+	defer sps.mu.Unlock()
+	return sps.smoothedMultiplier(zoneId, sps.clock.Now())
+}
+
+func (sps *SurgePricingStrategy) observe(zoneId string, demand, supply int, now time.Time) float64 {
+	ratio := 1.0
+	if demand > supply {
+		ratio = math.Min(float64(demand)/float64(max(supply, 1)), sps.maxMultiplier)
+	}
+
+	sps.mu.Lock()
+	defer sps.mu.Unlock()
+	sps.samples[zoneId] = append(sps.samples[zoneId], surgeSample{at: now, ratio: ratio})
+	return sps.smoothedMultiplier(zoneId, now)
+}
+
+func (sps *SurgePricingStrategy) smoothedMultiplier(zoneId string, now time.Time) float64 {
+	samples := sps.samples[zoneId]
+	for len(samples) > 0 && now.Sub(samples[0].at) > sps.window {
+		samples = samples[1:]
+	}
+	sps.samples[zoneId] = samples
+	if len(samples) == 0 {
+		return 1
+	}
+	total := 0.0
+	for _, sample := range samples {
+		total += sample.ratio
+	}
+	multiplier := math.Min(total/float64(len(samples)), sps.maxMultiplier)
+	return math.Round(multiplier*10) / 10
+}
+
+// PoolPricingStrategy discounts the fare of pool rides to the rider's share of
+// the route, see PoolManager.GetFareShare. Solo rides are priced unchanged.
+type PoolPricingStrategy struct {
+	basePricingStrategy PricingStrategy
+	poolManager         PoolManager
+}
+
+func NewPoolPricingStrategy(basePricingStrategy PricingStrategy, poolManager PoolManager) PricingStrategy {
+	return &PoolPricingStrategy{
+		basePricingStrategy: basePricingStrategy,
+		poolManager:         poolManager,
+	}
+}
+
+func (pps PoolPricingStrategy) EstimateFare(ride *Ride) *FareBreakdown {
+	return pps.applyPoolShare(ride, pps.basePricingStrategy.EstimateFare(ride))
+}
+
+func (pps PoolPricingStrategy) CalculateFinalFare(ride *Ride) *FareBreakdown {
+	return pps.applyPoolShare(ride, pps.basePricingStrategy.CalculateFinalFare(ride))
+}
+
+func (pps PoolPricingStrategy) applyPoolShare(ride *Ride, fare *FareBreakdown) *FareBreakdown {
+	if ride.GetRideType() != PoolRide {
+		return fare
+	}
+	fare.PoolShare = pps.poolManager.GetFareShare(ride.GetId())
+	fare.PoolDiscount = int(math.Round(float64(fare.Subtotal()) * (1 - fare.PoolShare)))
+	fare.Settle()
+	return fare
+}
+
+// ZoneSurchargePricingStrategy adds the fixed surcharges of the special zones
+// a ride starts and ends in. Surcharges are not surged or pooled, every rider
+// pays them in full.
+type ZoneSurchargePricingStrategy struct {
+	basePricingStrategy PricingStrategy
+	zoneManager         ZoneManager
+}
+
+func NewZoneSurchargePricingStrategy(basePricingStrategy PricingStrategy, zoneManager ZoneManager) PricingStrategy {
+	return &ZoneSurchargePricingStrategy{
+		basePricingStrategy: basePricingStrategy,
+		zoneManager:         zoneManager,
+	}
+}
+
+func (zsps ZoneSurchargePricingStrategy) EstimateFare(ride *Ride) *FareBreakdown {
+	return zsps.applySurcharges(ride, zsps.basePricingStrategy.EstimateFare(ride))
+}
+
+func (zsps ZoneSurchargePricingStrategy) CalculateFinalFare(ride *Ride) *FareBreakdown {
+	return zsps.applySurcharges(ride, zsps.basePricingStrategy.CalculateFinalFare(ride))
+}
+
+func (zsps ZoneSurchargePricingStrategy) applySurcharges(ride *Ride, fare *FareBreakdown) *FareBreakdown {
+	if pickupZone := zsps.zoneManager.GetSpecialZone(ride.GetStartPoint()); pickupZone != nil && pickupZone.PickupSurcharge > 0 {
+		fare.ZoneSurcharge += pickupZone.PickupSurcharge
+		fare.PickupZoneId = pickupZone.Zone.GetId()
+	}
+	if dropZone := zsps.zoneManager.GetSpecialZone(ride.GetEndPoint()); dropZone != nil && dropZone.DropSurcharge > 0 {
+		fare.ZoneSurcharge += dropZone.DropSurcharge
+		fare.DropZoneId = dropZone.Zone.GetId()
+	}
+	fare.Settle()
+	return fare
+}
+
+// PromotionPricingStrategy takes the promotion of the code a ride was booked
+// with off its fare. The final fare is discounted again from scratch, so the
+// rider saves what the promotion allows on what they actually pay.
+type PromotionPricingStrategy struct {
+	basePricingStrategy PricingStrategy
+	promotionRepo       IPromotionRepository
+}
+
+func NewPromotionPricingStrategy(basePricingStrategy PricingStrategy, promotionRepo IPromotionRepository) PricingStrategy {
+	return &PromotionPricingStrategy{
+		basePricingStrategy: basePricingStrategy,
+		promotionRepo:       promotionRepo,
+	}
+}
+
+func (pps PromotionPricingStrategy) EstimateFare(ride *Ride) *FareBreakdown {
+	return pps.applyPromotion(ride, pps.basePricingStrategy.EstimateFare(ride))
+}
+
+func (pps PromotionPricingStrategy) CalculateFinalFare(ride *Ride) *FareBreakdown {
+	return pps.applyPromotion(ride, pps.basePricingStrategy.CalculateFinalFare(ride))
+}
+
+func (pps PromotionPricingStrategy) applyPromotion(ride *Ride, fare *FareBreakdown) *FareBreakdown {
+	if ride.GetPromoCode() == "" {
+		return fare
+	}
+	promotion := pps.promotionRepo.GetPromotion(ride.GetPromoCode())
+	if promotion == nil {
+		return fare
+	}
+	fare.PromoCode = promotion.Code
+	fare.PromoDiscount = promotion.Discount(fare.Total)
+	fare.Settle()
+	return fare
 }
@@ -0,0 +1,141 @@
+package src
+
+import (
+	"sync"
+	"time"
+)
+
+// trackedStatusEvents are the events a rider watching a ride cares about, keyed
+// to the status the ride moves to.
+var trackedStatusEvents = map[RideEventType]RideStatus{
+	RideRequested:  SearchingForCab,
+	CabAssigned:    Confirmed,
+	RidePickedUp:   PickedUp,
+	RideCompleted:  Completed,
+	RideCanceled:   Canceled,
+	RideNoCabFound: NoCabFound,
+}
+
+func isRideOver(status RideStatus) bool {
+	return status == Completed || status == Canceled || status == NoCabFound
+}
+
+// RideTracker follows one ride on the event bus. It forwards the ride's status
+// changes and the location updates of the cab assigned to it, and closes its
+// updates channel once the ride is over.
+type RideTracker struct {
+	rideId      string
+	ride        *Ride
+	cabId       string
+	seen        map[RideStatus]bool
+	finished    bool
+	updates     chan RideEvent
+	ready       chan struct{}
+	done        chan struct{}
+	stopOnce    sync.Once
+	unsubscribe func()
+}
+
+func newRideTracker(eventBus EventBus, ride *Ride, bufferSize int) *RideTracker {
+	rt := &RideTracker{
+		rideId:  ride.GetId(),
+		ride:    ride,
+		updates: make(chan RideEvent, bufferSize),
+		ready:   make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	rt.unsubscribe = eventBus.Subscribe(rt)
+	return rt
+}
+
+// start is called with the ride read after subscribing, so nothing that happens
+// in between is lost. Events already reflected in the snapshot are skipped.
+func (rt *RideTracker) start(ride *Ride, cab *Cab, at time.Time) {
+	rt.ride = ride
+	rt.cabId = ride.GetCabId()
+	rt.seen = map[RideStatus]bool{ride.GetStatus(): true}
+	for _, transition := range ride.GetTimeline() {
+		rt.seen[transition.To] = true
+	}
+	if isRideOver(ride.GetStatus()) {
+		rt.finish()
+	} else if cab != nil {
+		lat, lon := cab.GetCurrLocation()
+		rt.updates <- RideEvent{Type: CabLocationUpdated, RideId: ride.GetId(), CabId: cab.GetId(), Lat: lat, Lon: lon, OccurredAt: at}
+	}
+	close(rt.ready)
+}
+
+func (rt *RideTracker) GetName() string {
+	return "ride-tracker:" + rt.rideId
+}
+
+func (rt *RideTracker) HandleEvent(event RideEvent) error {
+	select {
+	case <-rt.ready:
+	case <-rt.done:
+		return nil
+	}
+	if rt.finished {
+		return nil
+	}
+	if event.Type == CabLocationUpdated {
+		if rt.cabId == "" || event.CabId != rt.cabId {
+			return nil
+		}
+		event.RideId = rt.rideId
+		rt.send(event)
+		return nil
+	}
+	if event.Type == CabArrivedAtStop || event.Type == CabDepartedStop {
+		if event.RideId == rt.rideId {
+			rt.send(event)
+		}
+		return nil
+	}
+	// A ride reaches each status at most once, so a status already seen is
+	// already known to the client.
+	status, tracked := trackedStatusEvents[event.Type]
+	if !tracked || event.RideId != rt.rideId || rt.seen[status] {
+		return nil
+	}
+	rt.seen[status] = true
+	if event.Type == CabAssigned {
+		rt.cabId = event.CabId
+	}
+	rt.send(event)
+	if isRideOver(status) {
+		rt.finish()
+	}
+	return nil
+}
+
+func (rt *RideTracker) send(event RideEvent) {
+	select {
+	case rt.updates <- event:
+	case <-rt.done:
+	}
+}
+
+func (rt *RideTracker) finish() {
+	rt.finished = true
+	close(rt.updates)
+	rt.unsubscribe()
+}
+
+// GetRide is the ride as it was when tracking started.
+func (rt *RideTracker) GetRide() *Ride {
+	return rt.ride.clone()
+}
+
+func (rt *RideTracker) Updates() <-chan RideEvent {
+	return rt.updates
+}
+
+// Stop ends tracking early, for example when the client disconnects.
+func (rt *RideTracker) Stop() {
+	rt.stopOnce.Do(func() {
+		close(rt.done)
+		rt.unsubscribe()
+	})
+}
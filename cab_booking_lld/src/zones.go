@@ -0,0 +1,150 @@
+package src
+
+import (
+	"fmt"
+	"math"
+)
+
+type GeoPoint struct {
+	Lat float64
+	Lon float64
+}
+
+func ValidateCoordinates(lat, lon float64) error {
+	if math.IsNaN(lat) || math.IsNaN(lon) || lat < -90 || lat > 90 || lon < -180 || lon > 180 {
+		return fmt.Errorf("%w: (%v, %v)", ErrInvalidCoordinates, lat, lon)
+	}
+	return nil
+}
+
+type BoundingBox struct {
+	MinLat float64
+	MinLon float64
+	MaxLat float64
+	MaxLon float64
+}
+
+func (bb BoundingBox) Contains(lat, lon float64) bool {
+	return lat >= bb.MinLat && lat <= bb.MaxLat && lon >= bb.MinLon && lon <= bb.MaxLon
+}
+
+type Zone interface {
+	GetId() string
+	GetBounds() BoundingBox
+	Contains(lat, lon float64) bool
+}
+
+type GridZone struct {
+	id     string
+	bounds BoundingBox
+}
+
+func (gz GridZone) GetId() string {
+	return gz.id
+}
+
+func (gz GridZone) GetBounds() BoundingBox {
+	return gz.bounds
+}
+
+// Contains treats the upper edges as exclusive so that a point on a shared edge
+// belongs to exactly one cell.
+func (gz GridZone) Contains(lat, lon float64) bool {
+	return lat >= gz.bounds.MinLat && lat < gz.bounds.MaxLat && lon >= gz.bounds.MinLon && lon < gz.bounds.MaxLon
+}
+
+type PolygonZone struct {
+	id       string
+	vertices []GeoPoint
+	bounds   BoundingBox
+}
+
+func NewPolygonZone(id string, vertices []GeoPoint) *PolygonZone {
+	bounds := BoundingBox{MinLat: math.Inf(1), MinLon: math.Inf(1), MaxLat: math.Inf(-1), MaxLon: math.Inf(-1)}
+	for _, vertex := range vertices {
+		bounds.MinLat = math.Min(bounds.MinLat, vertex.Lat)
+		bounds.MinLon = math.Min(bounds.MinLon, vertex.Lon)
+		bounds.MaxLat = math.Max(bounds.MaxLat, vertex.Lat)
+		bounds.MaxLon = math.Max(bounds.MaxLon, vertex.Lon)
+	}
+	return &PolygonZone{
+		id:       id,
+		vertices: vertices,
+		bounds:   bounds,
+	}
+}
+
+func (pz PolygonZone) GetId() string {
+	return pz.id
+}
+
+func (pz PolygonZone) GetBounds() BoundingBox {
+	return pz.bounds
+}
+
+// Contains uses ray casting, which is accurate enough for city sized polygons
+// that do not cross the antimeridian.
+func (pz PolygonZone) Contains(lat, lon float64) bool {
+	if !pz.bounds.Contains(lat, lon) {
+		return false
+	}
+	inside := false
+	for i, j := 0, len(pz.vertices)-1; i < len(pz.vertices); j, i = i, i+1 {
+		vi, vj := pz.vertices[i], pz.vertices[j]
+		if (vi.Lat > lat) != (vj.Lat > lat) && lon < (vj.Lon-vi.Lon)*(lat-vi.Lat)/(vj.Lat-vi.Lat)+vi.Lon {
+			inside = !inside
+		}
+	}
+	return inside
+}
+
+type ZoneResolver interface {
+	ResolveZone(lat, lon float64) Zone
+}
+
+type GridZoneResolver struct {
+	cellSizeDeg float64
+}
+
+func NewGridZoneResolver(cellSizeDeg float64) ZoneResolver {
+	return &GridZoneResolver{
+		cellSizeDeg: cellSizeDeg,
+	}
+}
+
+func (gzr GridZoneResolver) ResolveZone(lat, lon float64) Zone {
+	row := math.Floor(lat / gzr.cellSizeDeg)
+	col := math.Floor(lon / gzr.cellSizeDeg)
+	return &GridZone{
+		id: fmt.Sprintf("grid:%d:%d", int(row), int(col)),
+		bounds: BoundingBox{
+			MinLat: row * gzr.cellSizeDeg,
+			MinLon: col * gzr.cellSizeDeg,
+			MaxLat: (row + 1) * gzr.cellSizeDeg,
+			MaxLon: (col + 1) * gzr.cellSizeDeg,
+		},
+	}
+}
+
+// PolygonZoneResolver returns the first configured zone containing the point and
+// falls back to another resolver (usually a grid) everywhere else.
+type PolygonZoneResolver struct {
+	zones    []Zone
+	fallback ZoneResolver
+}
+
+func NewPolygonZoneResolver(zones []Zone, fallback ZoneResolver) ZoneResolver {
+	return &PolygonZoneResolver{
+		zones:    zones,
+		fallback: fallback,
+	}
+}
+
+func (pzr PolygonZoneResolver) ResolveZone(lat, lon float64) Zone {
+	for _, zone := range pzr.zones {
+		if zone.Contains(lat, lon) {
+			return zone
+		}
+	}
+	return pzr.fallback.ResolveZone(lat, lon)
+}